@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/autarch/metagodoc/elc"
 	"github.com/autarch/metagodoc/esmodels"
 	"github.com/autarch/metagodoc/logger"
 
@@ -14,17 +15,17 @@ import (
 
 type handlers struct {
 	l  *logger.Logger
-	el *elastic.Client
+	el *elc.Client
 }
 
-func New(l *logger.Logger, el *elastic.Client) *handlers {
+func New(l *logger.Logger, el *elc.Client) *handlers {
 	return &handlers{l, el}
 }
 
 func (h *handlers) getRepo(repo string) (*esmodels.Repository, int) {
 	result, err := h.el.Get().
-		Index("metagodoc-repository").
-		Type("repository").
+		Index(esmodels.Index("repository")).
+		Type(h.el.Type("repository")).
 		Id(repo).
 		Do(context.Background())
 	if err != nil {
@@ -64,9 +65,43 @@ func (h *handlers) getRef(repo, ref string) (*esmodels.Repository, *esmodels.Ref
 		return nil, nil, 404
 	}
 
+	esref.Packages, status = h.getRefPackages(repo, ref)
+	if status != 0 {
+		return nil, nil, status
+	}
+
 	return esr, esref, 0
 }
 
+func (h *handlers) getRefPackages(repo, ref string) ([]*esmodels.Package, int) {
+	q := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("repository_id", repo),
+		elastic.NewTermQuery("ref", ref),
+	)
+	result, err := h.el.Search().
+		Index(esmodels.Index("package")).
+		Query(q).
+		Size(10000).
+		Do(context.Background())
+	if err != nil {
+		h.l.Errorf("Elastic search failed: %s", err)
+		return nil, 500
+	}
+
+	var pkgs []*esmodels.Package
+	for _, hit := range result.Hits.Hits {
+		p := &esmodels.Package{}
+		err = json.Unmarshal(*hit.Source, p)
+		if err != nil {
+			h.l.Errorf("Unmarshal: %s", err)
+			return nil, 500
+		}
+		pkgs = append(pkgs, p)
+	}
+
+	return pkgs, 0
+}
+
 func (h *handlers) getPackage(repo, ref, pkg string) (*esmodels.Repository, *esmodels.Ref, *esmodels.Package, int) {
 	esr, esref, status := h.getRef(repo, ref)
 	if status != 0 {
@@ -34,10 +34,16 @@ func (h *handlers) maybeRepositoryOkResponse(esr *esmodels.Repository) middlewar
 		return operations.NewGetRepositoryRepositoryDefault(500)
 	}
 
+	// The full README is only in the document if it was compressed.
+	about, err := esr.About.FullContent()
+	if err != nil {
+		return operations.NewGetRepositoryRepositoryDefault(500)
+	}
+
 	return operations.NewGetRepositoryRepositoryOK().WithPayload(
 		&models.Repository{
 			About: &models.RepositoryAbout{
-				Content:     esr.About.Content,
+				Content:     about,
 				ContentType: esr.About.ContentType,
 			},
 			Created:     *c,
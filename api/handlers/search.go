@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/autarch/metagodoc/api/models"
 	"github.com/autarch/metagodoc/api/restapi/operations"
@@ -18,7 +19,7 @@ func (h *handlers) GetRepositoryRefPackage(
 	params operations.GetRepositoryRepositoryRefRefPackagePackageParams,
 ) middleware.Responder {
 
-	result, err := h.el.Search("metagodoc-repository", "metagodoc-author").
+	result, err := h.el.Search(esmodels.Index("repository"), esmodels.Index("author")).
 		Query(elastic.NewTermQuery(params.Query)).
 		//		Sort() how to sort by score?
 		Do(context.Background())
@@ -53,7 +54,8 @@ func items(hits []*elastic.SearchHit) []*models.SearchResultResultsItem {
 }
 
 func item(hit *elastic.SearchHit) *models.SearchResultResultsItem {
-	if hit.Index == "metagodoc-repository" {
+	// The hit's index is the versioned index behind the alias.
+	if strings.HasPrefix(hit.Index, esmodels.Index("repository")) {
 		if true {
 			return repositoryItem(hit)
 		} else {
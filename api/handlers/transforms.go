@@ -11,7 +11,9 @@ import (
 func refNames(refs []*esmodels.Ref) []string {
 	var items []string
 	for _, r := range refs {
-		items = append(items, r.Name)
+		if r.Removed == "" {
+			items = append(items, r.Name)
+		}
 	}
 	return items
 }
@@ -26,21 +28,28 @@ func packages(pkgs []*esmodels.Package) []*models.Package {
 
 func onePackage(p *esmodels.Package) *models.Package {
 	return &models.Package{
-		Consts:       values(p.Consts),
-		Doc:          p.Doc,
-		Errors:       p.Errors,
-		Examples:     examples(p.Examples),
-		Files:        files(p.Files),
-		Funcs:        funcs(p.Funcs),
-		ImportPath:   p.ImportPath,
-		Imports:      p.Imports,
-		IsCommand:    p.IsCommand,
-		Name:         p.Name,
-		Synopsis:     p.Synopsis,
-		TestImports:  p.TestImports,
-		Types:        types(p.Types),
-		Vars:         values(p.Vars),
-		XTestImports: p.XTestImports,
+		Consts:              values(p.Consts),
+		Doc:                 p.Doc,
+		Errors:              packageErrors(p.Errors),
+		Examples:            examples(p.Examples),
+		Files:               files(p.Files),
+		Funcs:               funcs(p.Funcs),
+		GeneratedFiles:      int64(p.GeneratedFiles),
+		HandWrittenFiles:    int64(p.HandWrittenFiles),
+		ImportPath:          p.ImportPath,
+		CanonicalImportPath: p.CanonicalImportPath,
+		ImportPathMismatch:  p.ImportPathMismatch,
+		Imports:             p.Imports,
+		IsCommand:           p.IsCommand,
+		IsInternal:          p.IsInternal,
+		IsVendored:          p.IsVendored,
+		IsStdlib:            p.IsStdlib,
+		Name:                p.Name,
+		Synopsis:            p.Synopsis,
+		TestImports:         p.TestImports,
+		Types:               types(p.Types),
+		Vars:                values(p.Vars),
+		XTestImports:        p.XTestImports,
 	}
 }
 
@@ -103,8 +112,23 @@ func files(files []*doc.File) []*models.File {
 	var items []*models.File
 	for _, f := range files {
 		items = append(items, &models.File{
-			Name: f.Name,
-			URL:  strfmt.URI(f.URL),
+			Name:      f.Name,
+			URL:       strfmt.URI(f.URL),
+			Generated: f.Generated,
+		})
+	}
+	return items
+}
+
+func packageErrors(errs []*doc.Error) []*models.PackageError {
+	var items []*models.PackageError
+	for _, e := range errs {
+		items = append(items, &models.PackageError{
+			Category: e.Category,
+			File:     e.File,
+			Line:     int32(e.Line),
+			Column:   int32(e.Column),
+			Message:  e.Message,
 		})
 	}
 	return items
@@ -12,6 +12,7 @@ import (
 	"github.com/autarch/metagodoc/api/restapi/operations"
 	"github.com/autarch/metagodoc/elc"
 	"github.com/autarch/metagodoc/env"
+	"github.com/autarch/metagodoc/esmodels"
 	"github.com/autarch/metagodoc/logger"
 
 	"github.com/go-openapi/errors"
@@ -19,7 +20,6 @@ import (
 	"github.com/go-openapi/runtime"
 	"github.com/go-openapi/runtime/middleware"
 	flags "github.com/jessevdk/go-flags"
-	"github.com/olivere/elastic"
 	"github.com/tylerb/graceful"
 )
 
@@ -60,7 +60,21 @@ func main() {
 		os.Exit(code)
 	}
 
-	el, err := elc.NewClient(env.TraceElastic(), l)
+	err = esmodels.SetIndexPrefix(env.IndexPrefix())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = esmodels.SetTenant(env.Tenant())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	el, err := elc.NewClient(elc.NewParams{
+		Logger:          l,
+		Trace:           env.TraceElastic(),
+		URLs:            env.ElasticURLs(),
+		DisableSniffing: env.DisableElasticSniffing(),
+	})
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -72,7 +86,7 @@ func main() {
 	}
 }
 
-func configureAPI(api *operations.MetaGodocAPI, l *logger.Logger, el *elastic.Client) http.Handler {
+func configureAPI(api *operations.MetaGodocAPI, l *logger.Logger, el *elc.Client) http.Handler {
 	// configure the api here
 	api.ServeError = errors.ServeError
 
@@ -2,83 +2,82 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"os"
 
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/env"
 	"github.com/autarch/metagodoc/esmodels"
-	"github.com/autarch/metagodoc/indexer/repository"
-	"github.com/olivere/elastic"
+	"github.com/autarch/metagodoc/logger"
 )
 
-type database struct {
-	client *elastic.Client
-}
-
 func main() {
-	d := New(true)
-	d.makeIndices()
-}
-
-func New(trace bool) database {
-	funcs := []elastic.ClientOptionFunc{}
-	if trace {
-		funcs = append(funcs, elastic.SetTraceLog(log.New(os.Stdout, "ES: ", 0)))
+	run := command(os.Args[1:])
+	if run == nil {
+		usage()
 	}
 
-	client, err := elastic.NewClient(funcs...)
+	l, err := logger.New(logger.NewParams{})
 	if err != nil {
-		log.Panicf("NewClient: %s", err)
+		log.Fatal(err)
 	}
 
-	return database{
-		client: client,
-	}
-}
-
-func (d database) makeIndices() {
-	mappings := []*esmodels.Mapping{
-		esmodels.MappingForType(repository.ESRepository{}),
-		esmodels.MappingForType(esmodels.Author{}),
+	err = esmodels.SetIndexPrefix(env.IndexPrefix())
+	if err != nil {
+		log.Panic(err)
 	}
-	for _, m := range mappings {
-		idx := d.makeIndex(m.Name)
-		d.putMapping(idx, m)
+	err = esmodels.SetTenant(env.Tenant())
+	if err != nil {
+		log.Panic(err)
 	}
-}
-
-func (d database) makeIndex(m string) string {
-	name := fmt.Sprintf("metagodoc-%s", m)
 
-	exists, err := d.client.IndexExists(name).Do(context.Background())
+	client, err := elc.NewClient(elc.NewParams{
+		Logger:          l,
+		Trace:           true,
+		URLs:            env.ElasticURLs(),
+		DisableSniffing: env.DisableElasticSniffing(),
+	})
 	if err != nil {
-		log.Panicf("IndexExists: %s", err)
+		log.Panicf("NewClient: %s", err)
 	}
 
-	if exists {
-		_, err := d.client.DeleteIndex(name).Do(context.Background())
-		if err != nil {
-			log.Panicf("DeleteIndex: %s", err)
-		}
-	}
+	m := esmodels.NewIndexManager(esmodels.NewIndexManagerParams{
+		Logger:  l,
+		Elastic: client,
+		Context: context.Background(),
+	})
 
-	_, err = d.client.CreateIndex(name).Do(context.Background())
+	err = run(m)
 	if err != nil {
-		log.Panicf("CreateIndex: %s", err)
+		log.Panic(err)
 	}
-
-	return name
 }
 
-func (d database) putMapping(idx string, m *esmodels.Mapping) {
-	log.Printf("Putting mapping for %s", m.Name)
-	_, err := d.client.
-		PutMapping().
-		Index(idx).
-		Type(m.Name).
-		BodyString(m.ToJSON()).
-		Do(context.Background())
-	if err != nil {
-		log.Panicf("PutMapping: %s", err)
+// command returns the function for the command named in args, or nil if
+// there isn't one. "migrate" keeps the existing data and just brings the
+// indices up to date, "reindex <name>" rebuilds one index with the current
+// mapping, and "rebuild-symbols" refills the symbol index from the package
+// index. See snapshot.go for the snapshot commands. "recreate --yes" throws
+// away every index and creates them again, so it has to be asked for.
+func command(args []string) func(*esmodels.IndexManager) error {
+	if len(args) == 0 {
+		return nil
+	}
+	switch cmd := args[0]; {
+	case cmd == "migrate" && len(args) == 1:
+		return (*esmodels.IndexManager).Migrate
+	case cmd == "reindex" && len(args) == 2:
+		return func(m *esmodels.IndexManager) error { return m.Reindex(args[1]) }
+	case cmd == "rebuild-symbols" && len(args) == 1:
+		return (*esmodels.IndexManager).RebuildSymbols
+	case cmd == "recreate" && len(args) == 2 && args[1] == "--yes":
+		return (*esmodels.IndexManager).Recreate
+	case isSnapshotCommand(cmd):
+		return func(m *esmodels.IndexManager) error { return snapshotCommand(m, cmd, args[1:]) }
 	}
+	return nil
+}
+
+func usage() {
+	log.Fatalf("Usage: %s [migrate | reindex <index> | rebuild-symbols | recreate --yes | snapshot-repository ... | snapshot ... | restore ...]", os.Args[0])
 }
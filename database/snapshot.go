@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+)
+
+// The snapshot commands are:
+//
+//	snapshot-repository <name> fs <location>
+//	snapshot-repository <name> s3 <bucket> [<base path>]
+//	snapshot <repository> [<snapshot>]
+//	restore <repository> <snapshot>
+//
+// A snapshot's name defaults to the current time. Restoring needs a cluster
+// without any metagodoc indices, and it should be followed by "migrate".
+func isSnapshotCommand(cmd string) bool {
+	switch cmd {
+	case "snapshot-repository", "snapshot", "restore":
+		return true
+	}
+	return false
+}
+
+func snapshotCommand(m *esmodels.IndexManager, cmd string, args []string) error {
+	switch cmd {
+	case "snapshot-repository":
+		if len(args) < 3 {
+			return fmt.Errorf("Usage: snapshot-repository <name> fs <location> | <name> s3 <bucket> [<base path>]")
+		}
+		settings, err := repositorySettings(args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		return m.CreateSnapshotRepository(args[0], args[1], settings)
+	case "snapshot":
+		if len(args) < 1 {
+			return fmt.Errorf("Usage: snapshot <repository> [<snapshot>]")
+		}
+		// Snapshot names must be lowercase.
+		name := "metagodoc-" + time.Now().UTC().Format("2006.01.02-15.04.05")
+		if len(args) > 1 {
+			name = args[1]
+		}
+		return m.Snapshot(args[0], name)
+	default:
+		if len(args) < 2 {
+			return fmt.Errorf("Usage: restore <repository> <snapshot>")
+		}
+		return m.Restore(args[0], args[1])
+	}
+}
+
+func repositorySettings(typ string, args []string) (map[string]interface{}, error) {
+	switch typ {
+	case "fs":
+		return map[string]interface{}{"location": args[0], "compress": true}, nil
+	case "s3":
+		settings := map[string]interface{}{"bucket": args[0]}
+		if len(args) > 1 {
+			settings["base_path"] = args[1]
+		}
+		return settings, nil
+	default:
+		return nil, fmt.Errorf("Unknown snapshot repository type %s, it must be fs or s3", typ)
+	}
+}
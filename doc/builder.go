@@ -9,12 +9,15 @@ package doc
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"go/ast"
 	"go/build"
 	"go/doc"
 	"go/format"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -152,18 +155,20 @@ type builder struct {
 }
 
 type Value struct {
-	Decl Code   `json:"code"`
-	Pos  Pos    `json:"pos"`
-	Doc  string `json:"doc" esType:"text" esAnalyzer:"english"`
+	Names []string `json:"names" esType:"keyword"`
+	Decl  Code     `json:"code"`
+	Pos   Pos      `json:"pos"`
+	Doc   string   `json:"doc" esType:"text" esAnalyzer:"english"`
 }
 
 func (b *builder) values(vdocs []*doc.Value) []*Value {
 	var result []*Value
 	for _, d := range vdocs {
 		result = append(result, &Value{
-			Decl: b.printDecl(d.Decl),
-			Pos:  b.position(d.Decl),
-			Doc:  d.Doc,
+			Names: d.Names,
+			Decl:  b.printDecl(d.Decl),
+			Pos:   b.position(d.Decl),
+			Doc:   d.Doc,
 		})
 	}
 	return result
@@ -172,7 +177,7 @@ func (b *builder) values(vdocs []*doc.Value) []*Value {
 type Note struct {
 	Pos  Pos    `json:"pos"`
 	UID  string `json:"uid" esType:"keyword"`
-	Body string `json:"uid" esType:"text" esAnalyzer:"english"`
+	Body string `json:"body" esType:"text" esAnalyzer:"english"`
 }
 
 type posNode token.Pos
@@ -357,6 +362,8 @@ func simpleImporter(imports map[string]*ast.Object, path string) (*ast.Object, e
 type File struct {
 	Name string `json:"name" esType:"keyword"`
 	URL  string `json:"url" esType:"keyword"`
+	// True if the file has a "Code generated ... DO NOT EDIT." comment.
+	Generated bool `json:"generated" esType:"boolean"`
 }
 
 type Pos struct {
@@ -365,6 +372,52 @@ type Pos struct {
 	File int16  `json:"file" esType:"short"`   // index in Package.Files
 }
 
+// An Error is a problem we found with one of the package's files, or with
+// the package as a whole if File is empty.
+type Error struct {
+	Category string `json:"category" esType:"keyword"`
+	File     string `json:"file" esType:"keyword"`
+	Line     int    `json:"line" esType:"integer"` // 0 if not known.
+	Column   int    `json:"column" esType:"integer"`
+	Message  string `json:"message" esType:"text"`
+}
+
+// The categories of Error.
+const (
+	// The file isn't valid Go.
+	ParseError = "parse"
+	// The package can't be built, for example because of conflicting
+	// package names or a bad import path.
+	BuildError = "build"
+	// The package imports another package through a vendor directory.
+	VendorError = "vendor"
+	// The file was too big to read.
+	SizeError = "size"
+	// The file is named *.go but isn't text.
+	BinaryError = "binary"
+	// The file's package name doesn't match the one most of the directory
+	// uses.
+	ConflictError = "conflict"
+)
+
+func parseErrors(err error) []*Error {
+	el, ok := err.(scanner.ErrorList)
+	if !ok {
+		return []*Error{{Category: ParseError, Message: err.Error()}}
+	}
+	var errs []*Error
+	for _, e := range el {
+		errs = append(errs, &Error{
+			Category: ParseError,
+			File:     e.Pos.Filename,
+			Line:     e.Pos.Line,
+			Column:   e.Pos.Column,
+			Message:  e.Msg,
+		})
+	}
+	return errs
+}
+
 type source struct {
 	name      string
 	browseURL string
@@ -376,8 +429,13 @@ type Package struct {
 	// The import path for this package.
 	ImportPath string
 
+	// The path from the package's import comment, if it has one which
+	// differs from ImportPath. This is the path the package has to be
+	// imported with.
+	CanonicalImportPath string
+
 	// Errors found when fetching or parsing this package.
-	Errors []string
+	Errors []*Error
 
 	// Packages referenced in README files.
 	References []string
@@ -412,15 +470,185 @@ type Package struct {
 	BrowseURL string
 	Files     []*File
 	TestFiles []*File
+	// Go files excluded by build constraints for the GOOS and GOARCH we
+	// documented.
+	IgnoredFiles []*File
+
+	// How many of Files were generated and how many were written by hand.
+	GeneratedFiles   int
+	HandWrittenFiles int
 
-	// Source size in bytes.
+	// Source size in bytes. This leaves out generated files if they're
+	// excluded, see directory.Directory.ExcludeGenerated.
 	SourceSize     int
 	TestSourceSize int
 
+	// Line counts for the same files as the sizes. A comment line is any
+	// line with a comment on it. See countLines.
+	Lines            int
+	CommentLines     int
+	TestLines        int
+	TestCommentLines int
+
+	// How complicated the package's functions are.
+	Complexity *Complexity
+	// How well the package's code does with gofmt and go vet.
+	Quality *Quality
+
+	// Whether the tests loop over tables of cases, and whether they have
+	// helper functions which take a testing.TB or the like.
+	TableTests  bool
+	TestHelpers bool
+
+	// The platforms from Platforms which the package builds on, like
+	// "linux/amd64". See platforms.
+	Platforms []string
+
 	// Imports
 	Imports      []string
 	TestImports  []string
 	XTestImports []string
+
+	// Patterns from //go:embed directives.
+	EmbedPatterns []string
+}
+
+// countLines returns how many lines a file has, and how many of them have a
+// comment on them. The file is nil if it couldn't be parsed at all, in which
+// case we don't know where the comments are.
+func countLines(fset *token.FileSet, file *ast.File, data []byte) (int, int) {
+	lines := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines++
+	}
+	if file == nil {
+		return lines, 0
+	}
+
+	commented := make(map[int]bool)
+	for _, g := range file.Comments {
+		for _, c := range g.List {
+			for l := fset.Position(c.Pos()).Line; l <= fset.Position(c.End()).Line; l++ {
+				commented[l] = true
+			}
+		}
+	}
+	return lines, len(commented)
+}
+
+// importValid imports the package in the directory, leaving out any files
+// go/build can't use, like files with a different package name. One bad file
+// in a directory shouldn't stop us from documenting the rest of it, so we
+// return an error for each file we left out instead.
+func importValid(dir *directory.Directory, ctxt *build.Context) (*build.Package, []*Error, error) {
+	d := *dir
+	var errs []*Error
+	for {
+		bpkg, err := d.Import(ctxt, build.ImportComment)
+		if err == nil || bpkg == nil || len(bpkg.InvalidGoFiles) == 0 {
+			return bpkg, errs, err
+		}
+
+		var drop map[string]bool
+		if _, ok := err.(*build.MultiplePackageError); ok {
+			var conflicting []*Error
+			drop, conflicting = conflicts(&d, bpkg)
+			errs = append(errs, conflicting...)
+		} else {
+			// go/build only tells us about the first bad file, so we leave
+			// that out and try again to find the next.
+			name := bpkg.InvalidGoFiles[0]
+			drop = map[string]bool{name: true}
+			if _, ok := err.(scanner.ErrorList); ok {
+				errs = append(errs, parseErrors(err)...)
+			} else {
+				errs = append(errs, &Error{Category: BuildError, File: name, Message: err.Error()})
+			}
+		}
+		if len(drop) == 0 {
+			return bpkg, errs, err
+		}
+
+		var files []*directory.File
+		for _, f := range d.Files {
+			if !drop[f.Name] {
+				files = append(files, f)
+			}
+		}
+		d.Files = files
+	}
+}
+
+// conflicts returns the files whose package name isn't the one most of the
+// directory's files use, and an error for each of them. A test file in
+// package foo_test counts as package foo. If there's a tie we prefer the
+// name that matches the directory.
+func conflicts(dir *directory.Directory, bpkg *build.Package) (map[string]bool, []*Error) {
+	var names []string
+	for _, files := range [][]string{bpkg.GoFiles, bpkg.CgoFiles, bpkg.TestGoFiles, bpkg.XTestGoFiles, bpkg.InvalidGoFiles} {
+		names = append(names, files...)
+	}
+
+	fset := token.NewFileSet()
+	pkgNames := make(map[string]string)
+	counts := make(map[string]int)
+	for _, f := range dir.Files {
+		if !containsString(names, f.Name) {
+			continue
+		}
+		file, err := parser.ParseFile(fset, f.Name, f.Data, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		name := file.Name.Name
+		if strings.HasSuffix(f.Name, "_test.go") {
+			name = strings.TrimSuffix(name, "_test")
+		}
+		pkgNames[f.Name] = name
+		counts[name]++
+	}
+
+	base := path.Base(dir.ImportPath)
+	better := func(name, than string) bool {
+		if counts[name] != counts[than] {
+			return counts[name] > counts[than]
+		}
+		if (name == base) != (than == base) {
+			return name == base
+		}
+		return name < than
+	}
+	dominant := ""
+	for name := range counts {
+		if dominant == "" || better(name, dominant) {
+			dominant = name
+		}
+	}
+
+	drop := make(map[string]bool)
+	var errs []*Error
+	for _, f := range dir.Files {
+		name, ok := pkgNames[f.Name]
+		if !ok || name == dominant {
+			continue
+		}
+		drop[f.Name] = true
+		errs = append(errs, &Error{
+			Category: ConflictError,
+			File:     f.Name,
+			Message:  fmt.Sprintf("package %s conflicts with package %s in the rest of the directory", name, dominant),
+		})
+	}
+	return drop, errs
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 var goEnvs = []struct{ GOOS, GOARCH string }{
@@ -466,6 +694,14 @@ var windowsOnlyPackages = map[string]bool{
 func NewPackage(dir *directory.Directory) (*Package, error) {
 	pkg := &Package{ImportPath: dir.ImportPath}
 
+	for _, s := range dir.Skipped {
+		category := SizeError
+		if s.Binary {
+			category = BinaryError
+		}
+		pkg.Errors = append(pkg.Errors, &Error{Category: category, File: s.Name, Message: s.Reason})
+	}
+
 	var b builder
 	b.srcs = make(map[string]*source)
 	references := make(map[string]bool)
@@ -511,22 +747,32 @@ func NewPackage(dir *directory.Directory) (*Package, error) {
 
 		ctxt.GOOS = env.GOOS
 		ctxt.GOARCH = env.GOARCH
-		bpkg, err = dir.Import(&ctxt, build.ImportComment)
+		var errs []*Error
+		bpkg, errs, err = importValid(dir, &ctxt)
 		if _, ok := err.(*build.NoGoError); !ok {
+			pkg.Errors = append(pkg.Errors, errs...)
 			break
 		}
 	}
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
-			pkg.Errors = append(pkg.Errors, err.Error())
+			pkg.Errors = append(pkg.Errors, &Error{Category: BuildError, Message: err.Error()})
 		}
 		return pkg, nil
 	}
 
-	if bpkg.ImportComment != "" && bpkg.ImportComment != dir.ImportPath {
-		return nil, gosrc.NotFoundError{
-			Message:  "not at canonical import path",
-			Redirect: bpkg.ImportComment,
+	pkg.Platforms = platforms(dir)
+
+	// The go command ignores import comments in module mode, so only a
+	// GOPATH-style package can be redirected by one.
+	if dir.Module == "" && bpkg.ImportComment != "" && bpkg.ImportComment != dir.ImportPath {
+		if gosrc.IsValidRemotePath(bpkg.ImportComment) {
+			pkg.CanonicalImportPath = bpkg.ImportComment
+		} else {
+			pkg.Errors = append(pkg.Errors, &Error{
+				Category: BuildError,
+				Message:  fmt.Sprintf("the import comment %q is not a valid import path", bpkg.ImportComment),
+			})
 		}
 	}
 
@@ -536,21 +782,49 @@ func NewPackage(dir *directory.Directory) (*Package, error) {
 	names := append(bpkg.GoFiles, bpkg.CgoFiles...)
 	sort.Strings(names)
 	pkg.Files = make([]*File, len(names))
+	pkg.Complexity = &Complexity{}
+	pkg.Quality = &Quality{}
 	for i, name := range names {
 		file, err := parser.ParseFile(b.fset, name, b.srcs[name].data, parser.ParseComments)
 		if err != nil {
-			pkg.Errors = append(pkg.Errors, err.Error())
+			pkg.Errors = append(pkg.Errors, parseErrors(err)...)
 		} else {
 			files[name] = file
 		}
 		src := b.srcs[name]
 		src.index = i
-		pkg.Files[i] = &File{Name: name, URL: src.browseURL}
-		pkg.SourceSize += len(src.data)
+		generated := file != nil && ast.IsGenerated(file)
+		pkg.Files[i] = &File{Name: name, URL: src.browseURL, Generated: generated}
+		lines, comments := countLines(b.fset, file, src.data)
+
+		if !generated {
+			pkg.HandWrittenFiles++
+			pkg.SourceSize += len(src.data)
+			pkg.Lines += lines
+			pkg.CommentLines += comments
+			if file != nil {
+				pkg.Complexity.addFile(b.fset, file)
+				pkg.Quality.addFile(file, src.data)
+			}
+			continue
+		}
+		pkg.GeneratedFiles++
+		if dir.ExcludeGenerated {
+			file.Doc = nil
+		} else {
+			pkg.SourceSize += len(src.data)
+			pkg.Lines += lines
+			pkg.CommentLines += comments
+		}
 	}
 
 	apkg, _ := ast.NewPackage(b.fset, files, simpleImporter, nil)
 
+	for _, name := range bpkg.IgnoredGoFiles {
+		pkg.IgnoredFiles = append(pkg.IgnoredFiles, &File{Name: name, URL: b.srcs[name].browseURL})
+	}
+	pkg.EmbedPatterns = embedPatterns(files)
+
 	// Find examples in the test files.
 
 	names = append(bpkg.TestGoFiles, bpkg.XTestGoFiles...)
@@ -558,13 +832,22 @@ func NewPackage(dir *directory.Directory) (*Package, error) {
 	pkg.TestFiles = make([]*File, len(names))
 	for i, name := range names {
 		file, err := parser.ParseFile(b.fset, name, b.srcs[name].data, parser.ParseComments)
+		generated := false
 		if err != nil {
-			pkg.Errors = append(pkg.Errors, err.Error())
+			pkg.Errors = append(pkg.Errors, parseErrors(err)...)
 		} else {
 			b.examples = append(b.examples, doc.Examples(file)...)
+			generated = ast.IsGenerated(file)
+			pkg.TableTests = pkg.TableTests || hasTableTests(file)
+			pkg.TestHelpers = pkg.TestHelpers || hasTestHelpers(file)
+		}
+		pkg.TestFiles[i] = &File{Name: name, URL: b.srcs[name].browseURL, Generated: generated}
+		if !generated || !dir.ExcludeGenerated {
+			lines, comments := countLines(b.fset, file, b.srcs[name].data)
+			pkg.TestSourceSize += len(b.srcs[name].data)
+			pkg.TestLines += lines
+			pkg.TestCommentLines += comments
 		}
-		pkg.TestFiles[i] = &File{Name: name, URL: b.srcs[name].browseURL}
-		pkg.TestSourceSize += len(b.srcs[name].data)
 	}
 
 	b.vetPackage(pkg, apkg)
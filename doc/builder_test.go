@@ -8,7 +8,12 @@ package doc
 
 import (
 	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
 	"testing"
+
+	"github.com/autarch/metagodoc/indexer/directory"
 )
 
 var badSynopsis = []string{
@@ -112,3 +117,175 @@ func TestSimpleImporter(t *testing.T) {
 		}
 	}
 }
+
+func TestComplexity(t *testing.T) {
+	const src = `package p
+
+func Simple() {}
+
+type T struct{}
+
+func (t *T) Branchy(x int, ok bool) int {
+	if x > 0 && ok {
+		return 1
+	}
+	for i := 0; i < x; i++ {
+		switch {
+		case i == 1:
+		case i == 2 || !ok:
+		default:
+		}
+	}
+	return 0
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Complexity{}
+	c.addFile(fset, file)
+	if c.Functions != 2 || c.MaxComplexity != 7 || c.MostComplex != "T.Branchy" || c.AverageComplexity != 4 {
+		t.Errorf("Got %+v, expected 2 functions with a max complexity of 7 from T.Branchy and an average of 4", c)
+	}
+	if c.LongestFunction != 13 || c.Longest != "T.Branchy" {
+		t.Errorf("Got the longest function %s with %d lines, expected T.Branchy with 13", c.Longest, c.LongestFunction)
+	}
+}
+
+func TestQuality(t *testing.T) {
+	const messy = `package p
+
+import (
+	"fmt"
+	a "sync/atomic"
+)
+
+type T struct {
+	N int64 ` + "`json:name`" + `
+	S string ` + "`json:\"s\" xml:\"s\"`" + `
+}
+
+func (t *T) Messy(x int) error {
+	x = x
+	t.N = a.AddInt64(&t.N, 1)
+	if x != 1 || x != 2 {
+		fmt.Printf("%d of %*d%%\n", x)
+	}
+	if t.S == "" && (t.N > 0 && t.S == "") {
+		panic("no")
+		x++
+	}
+	switch x {
+	case 1:
+		return nil
+	end:
+		goto end
+	}
+	return fmt.Errorf("%[1]d %[1]d", x)
+}
+`
+	const tidy = `package p
+
+func Tidy(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+`
+	q := &Quality{}
+	for _, src := range []string{messy, tidy, "package p\nvar  X = 1\n"} {
+		file, err := parser.ParseFile(token.NewFileSet(), "p.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.addFile(file, []byte(src))
+	}
+
+	if q.Files != 3 || q.Unformatted != 2 || q.Compliance < 33.3 || q.Compliance > 33.4 {
+		t.Errorf("Got %d files with %d unformatted and %.1f%% compliance, expected 3 with 2 unformatted and 33.3%%", q.Files, q.Unformatted, q.Compliance)
+	}
+	expect := VetFindings{Total: 7, Assign: 1, Atomic: 1, Bools: 2, Printf: 1, StructTag: 1, Unreachable: 1}
+	if q.Vet != expect {
+		t.Errorf("Got vet findings %+v, expected %+v", q.Vet, expect)
+	}
+}
+
+func TestTestSignals(t *testing.T) {
+	for src, expect := range map[string][2]bool{
+		`package p
+var cases = []struct{ in, out string }{{"a", "b"}}
+func TestCases(t *testing.T) {
+	for _, c := range cases {
+		_ = c
+	}
+}`: {true, false},
+		`package p
+func TestRun(t *testing.T) {
+	for name, f := range funcs() {
+		t.Run(name, f)
+	}
+}
+func mustOpen(tb testing.TB, path string) {}`: {true, true},
+		`package p
+func TestPlain(t *testing.T) {
+	for i := 0; i < 3; i++ {
+	}
+	check(t)
+}
+func check(t *testing.T) {}`: {false, true},
+	} {
+		file, err := parser.ParseFile(token.NewFileSet(), "p_test.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := [2]bool{hasTableTests(file), hasTestHelpers(file)}; got != expect {
+			t.Errorf("Got table tests and helpers %v, expected %v, for\n%s", got, expect, src)
+		}
+	}
+}
+
+func TestPlatforms(t *testing.T) {
+	dir := &directory.Directory{
+		Files: []*directory.File{
+			{Name: "sum.go", Data: []byte("package sum\n\nfunc Sum(xs []int) int\n")},
+			{Name: "sum_test.go", Data: []byte("package sum\n")},
+		},
+		AsmFiles: []*directory.File{{Name: "sum_amd64.s", Data: []byte("TEXT ·Sum(SB),4,$0\n")}},
+	}
+	expect := []string{"linux/amd64", "darwin/amd64", "windows/amd64", "freebsd/amd64"}
+	if got := platforms(dir); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v, only amd64 has the assembly", got, expect)
+	}
+
+	dir = &directory.Directory{
+		Files: []*directory.File{
+			{Name: "service_windows.go", Data: []byte("package service\n")},
+			{Name: "wasm.go", Data: []byte("//go:build wasm && !wasip1\n\npackage service\n")},
+		},
+	}
+	expect = []string{"windows/amd64", "windows/arm64", "windows/386", "js/wasm"}
+	if got := platforms(dir); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+}
+
+func TestEmbedPatterns(t *testing.T) {
+	src := "package thing\n\nimport \"embed\"\n\n" +
+		"//go:embed static/*.css \"with space.txt\" `raw.txt`\n" +
+		"//go:embed static/*.css templates\n" +
+		"var files embed.FS\n\n" +
+		"// go:embed not-a-directive.txt\n" +
+		"//go:embedded nor-this.txt\n"
+	file, err := parser.ParseFile(token.NewFileSet(), "thing.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"raw.txt", "static/*.css", "templates", "with space.txt"}
+	if got := embedPatterns(map[string]*ast.File{"thing.go": file}); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+}
@@ -0,0 +1,101 @@
+package doc
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// Complexity is a rough measure of how hard a package's code is to follow.
+// Complexity here is cyclomatic complexity, counted the way gocyclo counts
+// it: one for the function, plus one for each if, for, case, &&, and ||.
+// Function literals count towards the function they're in. Only the
+// hand-written functions in the package's own files are measured, since
+// generated code and tests don't say much about the package's quality.
+type Complexity struct {
+	Functions         int     `json:"functions" esType:"integer"`
+	AverageComplexity float64 `json:"average_complexity" esType:"float"`
+	MaxComplexity     int     `json:"max_complexity" esType:"integer"`
+	// The name of the most complex function, like "Parse" or
+	// "Decoder.Decode".
+	MostComplex string `json:"most_complex" esType:"keyword"`
+	// The length of the longest function in lines, including its
+	// signature, and its name.
+	LongestFunction int    `json:"longest_function" esType:"integer"`
+	Longest         string `json:"longest" esType:"keyword"`
+
+	// The sum of every function's complexity, for the average.
+	total int `json:"-"`
+}
+
+// addFile measures every function declared in the file.
+func (c *Complexity) addFile(fset *token.FileSet, file *ast.File) {
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Body == nil {
+			continue
+		}
+
+		name := fd.Name.Name
+		if fd.Recv != nil && len(fd.Recv.List) > 0 {
+			name = receiverName(fd.Recv.List[0].Type) + "." + name
+		}
+
+		cc := cyclomatic(fd)
+		c.Functions++
+		c.total += cc
+		c.AverageComplexity = float64(c.total) / float64(c.Functions)
+		if cc > c.MaxComplexity {
+			c.MaxComplexity = cc
+			c.MostComplex = name
+		}
+
+		lines := fset.Position(fd.End()).Line - fset.Position(fd.Pos()).Line + 1
+		if lines > c.LongestFunction {
+			c.LongestFunction = lines
+			c.Longest = name
+		}
+	}
+}
+
+func cyclomatic(fd *ast.FuncDecl) int {
+	cc := 1
+	ast.Inspect(fd, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			cc++
+		case *ast.CaseClause:
+			if n.List != nil {
+				cc++
+			}
+		case *ast.CommClause:
+			if n.Comm != nil {
+				cc++
+			}
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				cc++
+			}
+		}
+		return true
+	})
+	return cc
+}
+
+// receiverName returns the name of a method's receiver type, without any
+// pointer or type parameters.
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.ParenExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	default:
+		return "?"
+	}
+}
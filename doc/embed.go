@@ -0,0 +1,86 @@
+package doc
+
+import (
+	"go/ast"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// embedPatterns returns the patterns from every //go:embed directive in the
+// files, sorted and without duplicates, like build.Package.EmbedPatterns in
+// newer versions of Go.
+func embedPatterns(files map[string]*ast.File) []string {
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, file := range files {
+		for _, group := range file.Comments {
+			for _, c := range group.List {
+				if !strings.HasPrefix(c.Text, "//go:embed") {
+					continue
+				}
+				args := strings.TrimPrefix(c.Text, "//go:embed")
+				if args != "" && !unicode.IsSpace(rune(args[0])) {
+					continue
+				}
+				for _, p := range parseEmbedArgs(args) {
+					if !seen[p] {
+						seen[p] = true
+						patterns = append(patterns, p)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// parseEmbedArgs splits a //go:embed directive's arguments on spaces. An
+// argument may be quoted as a Go string, which is how a pattern with spaces
+// in it is written. The go command rejects a directive it can't parse, so we
+// just stop at the first bad argument.
+func parseEmbedArgs(args string) []string {
+	var patterns []string
+	for {
+		args = strings.TrimLeftFunc(args, unicode.IsSpace)
+		if args == "" {
+			return patterns
+		}
+
+		end := -1
+		switch args[0] {
+		case '"':
+			for i := 1; i < len(args); i++ {
+				if args[i] == '\\' {
+					i++
+				} else if args[i] == '"' {
+					end = i + 1
+					break
+				}
+			}
+		case '`':
+			if i := strings.IndexByte(args[1:], '`'); i >= 0 {
+				end = i + 2
+			}
+		default:
+			end = strings.IndexFunc(args, unicode.IsSpace)
+			if end < 0 {
+				end = len(args)
+			}
+			patterns = append(patterns, args[:end])
+			args = args[end:]
+			continue
+		}
+		if end < 0 {
+			return patterns
+		}
+		p, err := strconv.Unquote(args[:end])
+		if err != nil {
+			return patterns
+		}
+		patterns = append(patterns, p)
+		args = args[end:]
+	}
+}
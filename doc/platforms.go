@@ -0,0 +1,101 @@
+package doc
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/autarch/metagodoc/indexer/directory"
+)
+
+// Platforms are the GOOS/GOARCH pairs packages are checked against. These
+// are Go's first class ports plus the others people ask about most.
+var Platforms = []struct{ GOOS, GOARCH string }{
+	{"linux", "amd64"},
+	{"linux", "arm64"},
+	{"linux", "386"},
+	{"linux", "arm"},
+	{"darwin", "amd64"},
+	{"darwin", "arm64"},
+	{"windows", "amd64"},
+	{"windows", "arm64"},
+	{"windows", "386"},
+	{"freebsd", "amd64"},
+	{"android", "arm64"},
+	{"ios", "arm64"},
+	{"js", "wasm"},
+	{"wasip1", "wasm"},
+}
+
+// platforms returns the platforms the package in dir builds on, like
+// "windows/arm64", going by its build constraints and file name suffixes. A
+// package builds on a platform if any of its Go files do. If those declare
+// functions without bodies, which are written in assembly, then some of its
+// assembly files have to build there too. Whether the package's imports build
+// there is another matter, which we don't try to answer.
+func platforms(dir *directory.Directory) []string {
+	fset := token.NewFileSet()
+	bodiless := make(map[string]bool)
+	for _, f := range dir.Files {
+		if !strings.HasSuffix(f.Name, "_test.go") {
+			bodiless[f.Name] = hasBodilessFuncs(fset, f)
+		}
+	}
+
+	var supported []string
+	for _, p := range Platforms {
+		ctxt := &build.Context{
+			GOOS:   p.GOOS,
+			GOARCH: p.GOARCH,
+			// There's no cgo for WebAssembly. Everywhere else it only
+			// needs a C toolchain for the target.
+			CgoEnabled:  p.GOARCH != "wasm",
+			ReleaseTags: build.Default.ReleaseTags,
+			Compiler:    "gc",
+		}
+
+		goFiles, needsAsm := 0, false
+		for _, f := range dir.Files {
+			needs, ok := bodiless[f.Name]
+			if !ok {
+				continue
+			}
+			if match, err := dir.MatchFile(ctxt, f.Name); err != nil || !match {
+				continue
+			}
+			goFiles++
+			needsAsm = needsAsm || needs
+		}
+		if goFiles == 0 {
+			continue
+		}
+
+		hasAsm := false
+		for _, f := range dir.AsmFiles {
+			if match, err := dir.MatchFile(ctxt, f.Name); err == nil && match {
+				hasAsm = true
+				break
+			}
+		}
+		if needsAsm && !hasAsm {
+			continue
+		}
+		supported = append(supported, p.GOOS+"/"+p.GOARCH)
+	}
+	return supported
+}
+
+func hasBodilessFuncs(fset *token.FileSet, f *directory.File) bool {
+	file, err := parser.ParseFile(fset, f.Name, f.Data, 0)
+	if err != nil {
+		return false
+	}
+	for _, decl := range file.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,381 @@
+package doc
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// Quality is how a package's code does with gofmt and with a few of go vet's
+// checks. We don't type check packages, so the vet checks are only the ones
+// which can be done from the syntax alone. Like Complexity, this only covers
+// the hand-written files in the package itself.
+type Quality struct {
+	Files int `json:"files" esType:"integer"`
+	// How many of the files gofmt would change.
+	Unformatted int `json:"unformatted" esType:"integer"`
+	// The percentage of files which are gofmt'd and have no vet findings.
+	Compliance float64     `json:"compliance" esType:"float"`
+	Vet        VetFindings `json:"vet"`
+
+	compliant int `json:"-"`
+}
+
+// VetFindings counts what each check found. The checks are named after the
+// vet analyzers they're taken from, but they only do the parts of those which
+// don't need to know any types.
+type VetFindings struct {
+	Total int `json:"total" esType:"integer"`
+	// Assignments of something to itself, like "x = x".
+	Assign int `json:"assign" esType:"integer"`
+	// Assignments like "x = atomic.AddInt64(&x, 1)", which aren't atomic.
+	Atomic int `json:"atomic" esType:"integer"`
+	// Conditions like "a || a" or "x != 1 || x != 2".
+	Bools int `json:"bools" esType:"integer"`
+	// Calls to fmt.Printf and the like with a literal format which needs a
+	// different number of arguments than they're given.
+	Printf int `json:"printf" esType:"integer"`
+	// Struct tags which aren't in the usual `key:"value"` form.
+	StructTag int `json:"struct_tag" esType:"integer"`
+	// Statements right after a return, panic, or branch.
+	Unreachable int `json:"unreachable" esType:"integer"`
+}
+
+// addFile checks a file which was parsed from src.
+func (q *Quality) addFile(file *ast.File, src []byte) {
+	q.Files++
+	formatted, err := format.Source(src)
+	gofmtd := err == nil && bytes.Equal(formatted, src)
+	if !gofmtd {
+		q.Unformatted++
+	}
+
+	var v VetFindings
+	v.check(file)
+	q.Vet.add(v)
+	if gofmtd && v.Total == 0 {
+		q.compliant++
+	}
+	q.Compliance = 100 * float64(q.compliant) / float64(q.Files)
+}
+
+func (v *VetFindings) add(o VetFindings) {
+	v.Total += o.Total
+	v.Assign += o.Assign
+	v.Atomic += o.Atomic
+	v.Bools += o.Bools
+	v.Printf += o.Printf
+	v.StructTag += o.StructTag
+	v.Unreachable += o.Unreachable
+}
+
+func (v *VetFindings) check(file *ast.File) {
+	fmtName, atomicName := importName(file, "fmt"), importName(file, "sync/atomic")
+	found := func(n *int) {
+		*n++
+		v.Total++
+	}
+
+	// Nested && and || expressions are checked as a whole from the
+	// outermost one.
+	checked := make(map[ast.Expr]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok != token.ASSIGN || len(n.Lhs) != len(n.Rhs) {
+				break
+			}
+			for i, lhs := range n.Lhs {
+				if pure(lhs) && sameExpr(lhs, n.Rhs[i]) {
+					found(&v.Assign)
+				}
+				if atomicName != "" && isAtomicAdd(lhs, n.Rhs[i], atomicName) {
+					found(&v.Atomic)
+				}
+			}
+		case *ast.BinaryExpr:
+			if (n.Op == token.LAND || n.Op == token.LOR) && !checked[n] && badBools(n, checked) {
+				found(&v.Bools)
+			}
+		case *ast.CallExpr:
+			if fmtName != "" && badPrintf(n, fmtName) {
+				found(&v.Printf)
+			}
+		case *ast.Field:
+			if n.Tag != nil {
+				tag, err := strconv.Unquote(n.Tag.Value)
+				if err == nil && !validTag(tag) {
+					found(&v.StructTag)
+				}
+			}
+		case *ast.BlockStmt:
+			if unreachable(n.List) {
+				found(&v.Unreachable)
+			}
+		case *ast.CaseClause:
+			if unreachable(n.Body) {
+				found(&v.Unreachable)
+			}
+		case *ast.CommClause:
+			if unreachable(n.Body) {
+				found(&v.Unreachable)
+			}
+		}
+		return true
+	})
+}
+
+// importName returns the name a file uses for an imported package, or an
+// empty string if the file doesn't import it by name.
+func importName(file *ast.File, path string) string {
+	for _, is := range file.Imports {
+		if p, _ := strconv.Unquote(is.Path.Value); p != path {
+			continue
+		}
+		if is.Name == nil {
+			return path[strings.LastIndex(path, "/")+1:]
+		}
+		if is.Name.Name == "_" || is.Name.Name == "." {
+			return ""
+		}
+		return is.Name.Name
+	}
+	return ""
+}
+
+func sameExpr(a, b ast.Expr) bool {
+	return types.ExprString(a) == types.ExprString(b)
+}
+
+// pure returns true if evaluating the expression twice is the same as
+// evaluating it once, as far as we can tell without types.
+func pure(e ast.Expr) bool {
+	p := true
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr, *ast.FuncLit:
+			p = false
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW {
+				p = false
+			}
+		}
+		return p
+	})
+	return p
+}
+
+func isAtomicAdd(lhs, rhs ast.Expr, atomicName string) bool {
+	call, ok := rhs.(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || !strings.HasPrefix(sel.Sel.Name, "Add") {
+		return false
+	}
+	if x, ok := sel.X.(*ast.Ident); !ok || x.Name != atomicName {
+		return false
+	}
+	addr, ok := call.Args[0].(*ast.UnaryExpr)
+	return ok && addr.Op == token.AND && sameExpr(addr.X, lhs)
+}
+
+// badBools returns true if an && or || expression repeats an operand, or is
+// always true or false because it compares the same thing with two different
+// literals, like "x != 1 || x != 2".
+func badBools(e *ast.BinaryExpr, checked map[ast.Expr]bool) bool {
+	var operands []ast.Expr
+	var flatten func(ast.Expr)
+	flatten = func(x ast.Expr) {
+		for {
+			p, ok := x.(*ast.ParenExpr)
+			if !ok {
+				break
+			}
+			x = p.X
+		}
+		if b, ok := x.(*ast.BinaryExpr); ok && b.Op == e.Op {
+			checked[b] = true
+			flatten(b.X)
+			flatten(b.Y)
+			return
+		}
+		operands = append(operands, x)
+	}
+	flatten(e)
+
+	// For || we look for x != a || x != b, and for && x == a && x == b.
+	cmp := token.NEQ
+	if e.Op == token.LAND {
+		cmp = token.EQL
+	}
+	seen := make(map[string]bool)
+	compared := make(map[string]string)
+	for _, o := range operands {
+		if !pure(o) {
+			continue
+		}
+		s := types.ExprString(o)
+		if seen[s] {
+			return true
+		}
+		seen[s] = true
+
+		b, ok := o.(*ast.BinaryExpr)
+		if !ok || b.Op != cmp {
+			continue
+		}
+		lit, ok := b.Y.(*ast.BasicLit)
+		if !ok {
+			continue
+		}
+		x := types.ExprString(b.X)
+		if prev, ok := compared[x]; ok && prev != lit.Value {
+			return true
+		}
+		compared[x] = lit.Value
+	}
+	return false
+}
+
+// The fmt functions which take a format, and which of their arguments it is.
+var printfFormats = map[string]int{
+	"Errorf":  0,
+	"Fprintf": 1,
+	"Printf":  0,
+	"Sprintf": 0,
+}
+
+func badPrintf(call *ast.CallExpr, fmtName string) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || call.Ellipsis.IsValid() {
+		return false
+	}
+	if x, ok := sel.X.(*ast.Ident); !ok || x.Name != fmtName {
+		return false
+	}
+	i, ok := printfFormats[sel.Sel.Name]
+	if !ok || len(call.Args) <= i {
+		return false
+	}
+	lit, ok := call.Args[i].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return false
+	}
+	f, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return false
+	}
+	n, ok := formatArgs(f)
+	return ok && n != len(call.Args)-i-1
+}
+
+// formatArgs returns how many arguments a format uses, or false if it uses
+// explicit argument indexes like "%[1]d", which we don't try to follow.
+func formatArgs(format string) (int, bool) {
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+			i++
+		}
+		// The width and precision can each be a number or a "*", which
+		// takes an argument.
+		for i < len(format) && (format[i] >= '0' && format[i] <= '9' || format[i] == '.' || format[i] == '*') {
+			if format[i] == '*' {
+				n++
+			}
+			i++
+		}
+		if i == len(format) {
+			break
+		}
+		switch format[i] {
+		case '%':
+		case '[':
+			return 0, false
+		default:
+			n++
+		}
+	}
+	return n, true
+}
+
+// validTag returns true if a struct tag is a list of key:"value" pairs
+// separated by spaces, which is the only form reflect.StructTag.Get
+// understands.
+func validTag(tag string) bool {
+	tag = strings.TrimLeft(tag, " ")
+	for tag != "" {
+		i := 0
+		for i < len(tag) && tag[i] > ' ' && tag[i] != ':' && tag[i] != '"' && tag[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(tag) || tag[i] != ':' || tag[i+1] != '"' {
+			return false
+		}
+		tag = tag[i+1:]
+
+		i = 1
+		for i < len(tag) && tag[i] != '"' {
+			if tag[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(tag) {
+			return false
+		}
+		if _, err := strconv.Unquote(tag[:i+1]); err != nil {
+			return false
+		}
+		tag = tag[i+1:]
+		if tag != "" && tag[0] != ' ' {
+			return false
+		}
+		tag = strings.TrimLeft(tag, " ")
+	}
+	return true
+}
+
+// unreachable returns true if there's a statement right after a return,
+// panic, goto, break, or continue. A labeled statement could be jumped to, so
+// that doesn't count.
+func unreachable(list []ast.Stmt) bool {
+	for i := 0; i+1 < len(list); i++ {
+		if !terminates(list[i]) {
+			continue
+		}
+		switch list[i+1].(type) {
+		case *ast.LabeledStmt, *ast.EmptyStmt:
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func terminates(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return s.Tok != token.FALLTHROUGH
+	case *ast.ExprStmt:
+		call, ok := s.X.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		id, ok := call.Fun.(*ast.Ident)
+		return ok && id.Name == "panic" && id.Obj == nil
+	}
+	return false
+}
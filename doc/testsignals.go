@@ -0,0 +1,139 @@
+package doc
+
+import (
+	"go/ast"
+	"strings"
+)
+
+// hasTableTests returns true if any test in the file loops over a table of
+// cases. That's a range over a slice or map literal, or over a variable set to
+// one, or a loop which calls t.Run.
+func hasTableTests(file *ast.File) bool {
+	tables := make(map[string]bool)
+	for _, decl := range file.Decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			addTables(tables, n)
+			return true
+		})
+	}
+
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Recv != nil || fd.Body == nil || !strings.HasPrefix(fd.Name.Name, "Test") {
+			continue
+		}
+
+		found := false
+		ast.Inspect(fd.Body, func(n ast.Node) bool {
+			r, ok := n.(*ast.RangeStmt)
+			if !ok {
+				return !found
+			}
+			if isTable(r.X) || callsRun(r.Body) {
+				found = true
+			}
+			if id, ok := r.X.(*ast.Ident); ok && tables[id.Name] {
+				found = true
+			}
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// addTables records the names of any variables a node sets to a table.
+func addTables(tables map[string]bool, n ast.Node) {
+	switch n := n.(type) {
+	case *ast.AssignStmt:
+		for i, rhs := range n.Rhs {
+			if i >= len(n.Lhs) || !isTable(rhs) {
+				continue
+			}
+			if id, ok := n.Lhs[i].(*ast.Ident); ok {
+				tables[id.Name] = true
+			}
+		}
+	case *ast.ValueSpec:
+		for i, v := range n.Values {
+			if i < len(n.Names) && isTable(v) {
+				tables[n.Names[i].Name] = true
+			}
+		}
+	}
+}
+
+func isTable(expr ast.Expr) bool {
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		return false
+	}
+	switch lit.Type.(type) {
+	case *ast.ArrayType, *ast.MapType:
+		return true
+	default:
+		return false
+	}
+}
+
+func callsRun(body *ast.BlockStmt) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Run" {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// hasTestHelpers returns true if the file has any functions other than the
+// tests themselves which take a testing.TB, *testing.T, *testing.B, or
+// *testing.F, like a mustOpen(t, path) helper.
+func hasTestHelpers(file *ast.File) bool {
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || isTestFunc(fd.Name.Name) {
+			continue
+		}
+		for _, p := range fd.Type.Params.List {
+			if isTestingType(p.Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTestFunc(name string) bool {
+	for _, prefix := range []string{"Test", "Benchmark", "Fuzz", "Example"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTestingType(expr ast.Expr) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok || pkg.Name != "testing" {
+		return false
+	}
+	switch sel.Sel.Name {
+	case "TB", "T", "B", "F":
+		return true
+	default:
+		return false
+	}
+}
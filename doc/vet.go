@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -62,10 +63,13 @@ func (v *vetVisitor) Visit(n ast.Node) ast.Visitor {
 
 func (b *builder) vetPackage(pkg *Package, apkg *ast.Package) {
 	errors := make(map[string]token.Pos)
+	vendored := make(map[string]token.Pos)
 	for _, file := range apkg.Files {
 		for _, is := range file.Imports {
 			importPath, _ := strconv.Unquote(is.Path.Value)
-			if !gosrc.IsValidPath(importPath) &&
+			if strings.HasPrefix(importPath, "vendor/") || strings.Contains(importPath, "/vendor/") {
+				vendored[fmt.Sprintf("Import path %q refers to a vendor directory", importPath)] = is.Pos()
+			} else if !gosrc.IsValidPath(importPath) &&
 				!strings.HasPrefix(importPath, "exp/") &&
 				!strings.HasPrefix(importPath, "appengine") {
 				errors[fmt.Sprintf("Unrecognized import path %q", importPath)] = is.Pos()
@@ -74,8 +78,29 @@ func (b *builder) vetPackage(pkg *Package, apkg *ast.Package) {
 		v := vetVisitor{errors: errors}
 		ast.Walk(&v, file)
 	}
+	b.addErrors(pkg, BuildError, errors)
+	b.addErrors(pkg, VendorError, vendored)
+}
+
+func (b *builder) addErrors(pkg *Package, category string, errors map[string]token.Pos) {
+	var errs []*Error
 	for message, pos := range errors {
-		pkg.Errors = append(pkg.Errors,
-			fmt.Sprintf("%s (%s)", message, b.fset.Position(pos)))
+		p := b.fset.Position(pos)
+		errs = append(errs, &Error{
+			Category: category,
+			File:     p.Filename,
+			Line:     p.Line,
+			Column:   p.Column,
+			Message:  message,
+		})
 	}
+	// Map order is random, but the same package should always produce the
+	// same document.
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].File != errs[j].File {
+			return errs[i].File < errs[j].File
+		}
+		return errs[i].Line < errs[j].Line
+	})
+	pkg.Errors = append(pkg.Errors, errs...)
 }
@@ -1,16 +1,120 @@
 package elc
 
 import (
+	"context"
+	"net/http"
+	"strings"
+
 	"github.com/autarch/metagodoc/logger"
 
 	"github.com/olivere/elastic"
 )
 
-func NewClient(trace bool, l *logger.Logger) (*elastic.Client, error) {
-	funcs := []elastic.ClientOptionFunc{}
-	if l != nil {
-		funcs = append(funcs, elastic.SetTraceLog(l))
+type NewParams struct {
+	Logger *logger.Logger
+	Trace  bool
+	// Defaults to http://127.0.0.1:9200.
+	URLs []string
+	// Sniffing needs every node to be reachable at the address it publishes,
+	// which isn't the case for most hosted Elasticsearch and OpenSearch
+	// services.
+	DisableSniffing bool
+}
+
+// A Client is an Elasticsearch client which knows what kind of server it's
+// talking to. Everything that reads or writes documents should get type names
+// from the client rather than using them directly, since newer servers don't
+// have types.
+type Client struct {
+	*elastic.Client
+	Server *Server
+}
+
+func NewClient(p NewParams) (*Client, error) {
+	t := &compatTransport{base: http.DefaultTransport}
+	funcs := []elastic.ClientOptionFunc{
+		elastic.SetHttpClient(&http.Client{Transport: t}),
+	}
+	if p.Logger != nil && p.Trace {
+		funcs = append(funcs, elastic.SetTraceLog(p.Logger))
+	}
+	if len(p.URLs) > 0 {
+		funcs = append(funcs, elastic.SetURL(p.URLs...))
+	}
+	if p.DisableSniffing {
+		funcs = append(funcs, elastic.SetSniff(false))
+	}
+
+	c, err := elastic.NewClient(funcs...)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := negotiate(context.Background(), c)
+	if err != nil {
+		return nil, err
+	}
+	t.typeless = s.IsTypeless()
+
+	if p.Logger != nil {
+		p.Logger.Infof("Connected to %s", s)
+	}
+
+	return &Client{Client: c, Server: s}, nil
+}
+
+// Type returns the document type to use in request paths for documents of
+// the given type.
+func (c *Client) Type(name string) string {
+	if c.Server.IsTypeless() {
+		return "_doc"
+	}
+	return name
+}
+
+// SearchTypes returns the document types to search, which is none for servers
+// without types.
+func (c *Client) SearchTypes(name string) []string {
+	if c.Server.IsTypeless() {
+		return nil
 	}
+	return []string{name}
+}
+
+// BulkType returns the document type to use in bulk requests, which is empty
+// for servers without types.
+func (c *Client) BulkType(name string) string {
+	if c.Server.IsTypeless() {
+		return ""
+	}
+	return name
+}
+
+// The client library was written for Elasticsearch 6, which returns the total
+// number of search hits as a number. Newer servers return an object instead
+// unless asked not to.
+type compatTransport struct {
+	base     http.RoundTripper
+	typeless bool
+}
+
+// RoundTrip must not modify the request it's given, so the query is added to
+// a copy of it.
+func (t *compatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.typeless && isSearch(req.URL.Path) {
+		// A shallow copy is enough, since only the URL is changed.
+		r2 := new(http.Request)
+		*r2 = *req
+		u := *req.URL
+		r2.URL = &u
+		q := u.Query()
+		q.Set("rest_total_hits_as_int", "true")
+		r2.URL.RawQuery = q.Encode()
+		req = r2
+	}
+	return t.base.RoundTrip(req)
+}
 
-	return elastic.NewClient(funcs...)
+func isSearch(path string) bool {
+	return strings.HasSuffix(path, "/_search") || strings.HasPrefix(path, "/_search/scroll")
 }
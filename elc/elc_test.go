@@ -0,0 +1,42 @@
+package elc
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingTransport struct {
+	req *http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.req = req
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestCompatTransport(t *testing.T) {
+	base := &recordingTransport{}
+	ct := &compatTransport{base: base, typeless: true}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:9200/repository/_search?size=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ct.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "true", base.req.URL.Query().Get("rest_total_hits_as_int"))
+		assert.Equal(t, "10", base.req.URL.Query().Get("size"))
+	}
+	assert.Equal(t, "size=10", req.URL.RawQuery, "the caller's request is left alone")
+
+	req, err = http.NewRequest(http.MethodGet, "http://localhost:9200/repository/_doc/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ct.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.True(t, req == base.req, "only searches are changed")
+	}
+}
@@ -0,0 +1,89 @@
+package elc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	version "github.com/hashicorp/go-version"
+	"github.com/olivere/elastic"
+)
+
+const (
+	Elasticsearch = "elasticsearch"
+	OpenSearch    = "opensearch"
+)
+
+// Server describes the search server we're connected to.
+type Server struct {
+	Distribution string
+	Version      *version.Version
+}
+
+func (s *Server) String() string {
+	return fmt.Sprintf("%s %s", s.Distribution, s.Version)
+}
+
+// IsTypeless returns true for servers which only allow one document type per
+// index. That's Elasticsearch 7 and every version of OpenSearch.
+func (s *Server) IsTypeless() bool {
+	return s.Distribution == OpenSearch || s.major() >= 7
+}
+
+func (s *Server) major() int {
+	return s.Version.Segments()[0]
+}
+
+// We support the Elasticsearch versions the client library can talk to, plus
+// OpenSearch, which forked from Elasticsearch 7.10.
+func (s *Server) check() error {
+	switch s.Distribution {
+	case Elasticsearch:
+		if s.major() < 6 || s.major() > 7 {
+			return fmt.Errorf("Elasticsearch %s is not supported, only versions 6 and 7 are", s.Version)
+		}
+	case OpenSearch:
+		if s.major() > 2 {
+			return fmt.Errorf("OpenSearch %s is not supported, only versions 1 and 2 are", s.Version)
+		}
+	default:
+		return fmt.Errorf("Unknown search server distribution: %s", s.Distribution)
+	}
+	return nil
+}
+
+func negotiate(ctx context.Context, c *elastic.Client) (*Server, error) {
+	resp, err := c.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not get the search server version: {{err}}", err)
+	}
+
+	return parseServer(resp.Body)
+}
+
+func parseServer(body []byte) (*Server, error) {
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	err := json.Unmarshal(body, &info)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not parse the search server version: {{err}}", err)
+	}
+
+	v, err := version.NewVersion(info.Version.Number)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not parse the search server version: {{err}}", err)
+	}
+
+	// Elasticsearch doesn't say what it is.
+	s := &Server{Distribution: Elasticsearch, Version: v}
+	if info.Version.Distribution != "" {
+		s.Distribution = info.Version.Distribution
+	}
+
+	return s, s.check()
+}
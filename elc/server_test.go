@@ -0,0 +1,32 @@
+package elc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServer(t *testing.T) {
+	s, err := parseServer([]byte(`{"version": {"number": "6.8.23"}}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Elasticsearch, s.Distribution)
+		assert.False(t, s.IsTypeless())
+	}
+
+	s, err = parseServer([]byte(`{"version": {"number": "7.17.0", "build_flavor": "default"}}`))
+	if assert.NoError(t, err) {
+		assert.True(t, s.IsTypeless())
+	}
+
+	s, err = parseServer([]byte(`{"version": {"distribution": "opensearch", "number": "1.3.2"}}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, OpenSearch, s.Distribution)
+		assert.True(t, s.IsTypeless(), "OpenSearch never has types")
+	}
+
+	_, err = parseServer([]byte(`{"version": {"number": "5.6.0"}}`))
+	assert.Error(t, err, "too old")
+
+	_, err = parseServer([]byte(`{"version": {"distribution": "opensearch", "number": "3.0.0"}}`))
+	assert.Error(t, err, "too new")
+}
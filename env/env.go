@@ -1,11 +1,24 @@
 package env
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func GitHubToken() string {
 	return os.Getenv("METAGODOC_GITHUB_TOKEN")
 }
 
+// ConfigFile returns the path to the indexer's YAML config file. Any of the
+// other variables here which are set take precedence over the file. If this
+// is empty then only the environment is used.
+func ConfigFile() string {
+	return os.Getenv("METAGODOC_CONFIG")
+}
+
 func Root() string {
 	root := os.Getenv("METAGODOC_ROOT")
 	if root != "" {
@@ -19,6 +32,511 @@ func TraceElastic() bool {
 	return os.Getenv("METAGODOC_TRACE_ELASTIC") != ""
 }
 
+// ElasticURLs returns the URLs of the Elasticsearch or OpenSearch nodes to
+// connect to, from a comma-separated list. If this is empty then the client's
+// default of http://127.0.0.1:9200 is used.
+func ElasticURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("METAGODOC_ELASTIC_URLS"), ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// DisableElasticSniffing returns true if the client should only talk to the
+// nodes in ElasticURLs rather than discovering the rest of the cluster.
+func DisableElasticSniffing() bool {
+	return os.Getenv("METAGODOC_ELASTIC_NO_SNIFF") != ""
+}
+
+// IndexPrefix returns the prefix for every index name. This lets staging and
+// production share a cluster, with a prefix like "metagodoc-staging-".
+func IndexPrefix() string {
+	p := os.Getenv("METAGODOC_INDEX_PREFIX")
+	if p != "" {
+		return p
+	}
+
+	return "metagodoc-"
+}
+
+// Tenant returns the tenant to keep everything under, if any. See
+// esmodels.SetTenant.
+func Tenant() string {
+	return os.Getenv("METAGODOC_TENANT")
+}
+
 func IsProd() bool {
 	return os.Getenv("METAGODOC_PRODUCTION") != ""
 }
+
+// LogLevel returns the lowest level of log message to write, one of "debug",
+// "info", "warn", or "error". If this is empty then it depends on IsProd.
+func LogLevel() string {
+	return os.Getenv("METAGODOC_LOG_LEVEL")
+}
+
+// LogFormat returns how log messages are written, either "json" or
+// "console". If this is empty then it depends on IsProd.
+func LogFormat() string {
+	return os.Getenv("METAGODOC_LOG_FORMAT")
+}
+
+// DryRun returns true if the indexer should report what it would index rather
+// than writing anything.
+func DryRun() bool {
+	return os.Getenv("METAGODOC_DRY_RUN") != ""
+}
+
+// CrawlReports returns the directory to write a report to at the end of each
+// crawl. See indexer.NewParams.
+func CrawlReports() string {
+	return os.Getenv("METAGODOC_CRAWL_REPORTS")
+}
+
+// CrawlReportsToElastic returns true if crawl reports should be stored in
+// Elasticsearch as well.
+func CrawlReportsToElastic() bool {
+	return os.Getenv("METAGODOC_CRAWL_REPORTS_ELASTIC") != ""
+}
+
+// Output returns where the indexer should write documents instead of
+// Elasticsearch, either "ndjson:<dir>", "sqlite:<file>", or "sql:<file>",
+// which is a script for the sqlite3 shell. If this is empty then documents
+// are written to Elasticsearch.
+func Output() string {
+	return os.Getenv("METAGODOC_OUTPUT")
+}
+
+// QueueBackend returns the name of the store used for the crawl queue, either
+// "file" or "elastic".
+func QueueBackend() string {
+	b := os.Getenv("METAGODOC_QUEUE_BACKEND")
+	if b != "" {
+		return b
+	}
+
+	return "file"
+}
+
+// SkipList returns the path to the YAML file listing repositories to skip. If
+// this is empty then the built-in skip list is used.
+func SkipList() string {
+	return os.Getenv("METAGODOC_SKIP_LIST")
+}
+
+// AllowList returns the path to the YAML file listing the only repositories
+// the indexer may index. If this is empty then there are no restrictions.
+func AllowList() string {
+	return os.Getenv("METAGODOC_ALLOW_LIST")
+}
+
+// TagPolicy returns the default policy for which tags to index, like
+// "per_major=3,since=2018-01-01".
+func TagPolicy() string {
+	return os.Getenv("METAGODOC_TAG_POLICY")
+}
+
+// TagPolicies returns the path to the YAML file with tag policies for
+// particular repositories.
+func TagPolicies() string {
+	return os.Getenv("METAGODOC_TAG_POLICIES")
+}
+
+// RepoPolicies returns the path to the YAML file overriding which branches
+// and packages are indexed for particular repositories.
+func RepoPolicies() string {
+	return os.Getenv("METAGODOC_REPO_POLICIES")
+}
+
+// RateLimits returns the per host crawl rate limits as a comma-separated list
+// of host=duration pairs, like "github.com=100ms,git.example.com=10s".
+func RateLimits() string {
+	return os.Getenv("METAGODOC_RATE_LIMITS")
+}
+
+// StageWorkers returns the number of workers for particular stages of the
+// indexing pipeline, like "fetch=4,analyze=2". Other stages get Workers
+// workers.
+func StageWorkers() string {
+	return os.Getenv("METAGODOC_STAGE_WORKERS")
+}
+
+// DebugAddr returns the address to serve metrics, expvar, and pprof on, like
+// "localhost:6060". If this is empty then they're not served.
+func DebugAddr() string {
+	return os.Getenv("METAGODOC_DEBUG_ADDR")
+}
+
+// AdminAddr returns the address to serve the admin API on, like
+// "localhost:6061". If this is empty then it's not served.
+func AdminAddr() string {
+	return os.Getenv("METAGODOC_ADMIN_ADDR")
+}
+
+// AdminToken returns the bearer token the admin API requires.
+func AdminToken() string {
+	return os.Getenv("METAGODOC_ADMIN_TOKEN")
+}
+
+// OTLPEndpoint returns the base URL of the OpenTelemetry collector to send
+// traces to, like "http://localhost:4318". If this is empty then nothing is
+// traced.
+func OTLPEndpoint() string {
+	return os.Getenv("METAGODOC_OTLP_ENDPOINT")
+}
+
+// SeedLists returns the URLs or paths of the curated lists used to seed the
+// crawl queue. If this isn't set then awesome-go is used. Setting it to an
+// empty string disables seeding.
+func SeedLists() []string {
+	lists, ok := os.LookupEnv("METAGODOC_SEED_LISTS")
+	if !ok {
+		return []string{"https://raw.githubusercontent.com/avelino/awesome-go/master/README.md"}
+	}
+
+	var sources []string
+	for _, l := range strings.Split(lists, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			sources = append(sources, l)
+		}
+	}
+	return sources
+}
+
+// RetentionHorizon returns how long it can be since a repository was last
+// crawled before it's considered stale, or 0 to leave stale repositories
+// alone.
+func RetentionHorizon() (time.Duration, error) {
+	v := os.Getenv("METAGODOC_RETENTION_HORIZON")
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_RETENTION_HORIZON value: %s", v)
+	}
+	return d, nil
+}
+
+// RetentionAction returns what to do with stale repositories which can't be
+// recrawled, either "flag" or "delete".
+func RetentionAction() string {
+	a := os.Getenv("METAGODOC_RETENTION_ACTION")
+	if a != "" {
+		return a
+	}
+
+	return "flag"
+}
+
+// AboutPolicy returns what to do with READMEs too big to keep inline, one of
+// "truncate", "compress", or "externalize".
+func AboutPolicy() string {
+	p := os.Getenv("METAGODOC_ABOUT_POLICY")
+	if p != "" {
+		return p
+	}
+
+	return "truncate"
+}
+
+// AboutInlineBytes returns how much of a README to keep inline, or 0 for the
+// default.
+func AboutInlineBytes() (int, error) {
+	v := os.Getenv("METAGODOC_ABOUT_INLINE_BYTES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_ABOUT_INLINE_BYTES value: %s", v)
+	}
+	return n, nil
+}
+
+// AboutStoreDir returns the directory externalized READMEs are saved in.
+func AboutStoreDir() string {
+	return os.Getenv("METAGODOC_ABOUT_STORE_DIR")
+}
+
+// AboutStoreURL returns the URL the externalized README directory is served
+// from.
+func AboutStoreURL() string {
+	return os.Getenv("METAGODOC_ABOUT_STORE_URL")
+}
+
+// Workers returns how many workers each stage of the indexing pipeline has, or
+// 0 for the default.
+func Workers() (int, error) {
+	v := os.Getenv("METAGODOC_WORKERS")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_WORKERS value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxClones returns how many clones and fetches may run at once, or 0 for no
+// limit.
+func MaxClones() (int, error) {
+	v := os.Getenv("METAGODOC_MAX_CLONES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_CLONES value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxAPICalls returns how many API calls may be in progress at once, or 0 for
+// no limit.
+func MaxAPICalls() (int, error) {
+	v := os.Getenv("METAGODOC_MAX_API_CALLS")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_API_CALLS value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxRepositories returns the maximum number of repositories to index in one
+// run, or 0 for no limit.
+func MaxRepositories() (int, error) {
+	v := os.Getenv("METAGODOC_MAX_REPOSITORIES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_REPOSITORIES value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxCloneBytes returns the maximum number of bytes to download when cloning
+// and fetching repositories in one run, or 0 for no limit.
+func MaxCloneBytes() (int64, error) {
+	v := os.Getenv("METAGODOC_MAX_CLONE_BYTES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_CLONE_BYTES value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxCloneCacheBytes returns the most disk space cached clones may use, or 0
+// for no limit.
+func MaxCloneCacheBytes() (int64, error) {
+	v := os.Getenv("METAGODOC_MAX_CLONE_CACHE_BYTES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_CLONE_CACHE_BYTES value: %s", v)
+	}
+	return n, nil
+}
+
+// ExcludeGenerated returns true if generated files should be left out of
+// package docs and source sizes.
+func ExcludeGenerated() bool {
+	return os.Getenv("METAGODOC_EXCLUDE_GENERATED") != ""
+}
+
+// IndexTestdata returns true if packages in testdata directories should be
+// indexed.
+func IndexTestdata() bool {
+	return os.Getenv("METAGODOC_INDEX_TESTDATA") != ""
+}
+
+// VulnDBURL returns the URL of the Go vulnerability database which refs are
+// checked against, if any.
+func VulnDBURL() string {
+	return os.Getenv("METAGODOC_VULNDB_URL")
+}
+
+// ModuleProxyURL returns the URL of the Go module proxy which refs'
+// dependencies are followed with, if any.
+func ModuleProxyURL() string {
+	return os.Getenv("METAGODOC_MODULE_PROXY_URL")
+}
+
+// IndexInternal returns true if internal packages should be indexed.
+func IndexInternal() bool {
+	return os.Getenv("METAGODOC_INDEX_INTERNAL") != ""
+}
+
+// SummarizeVendor returns true if packages in vendor directories should be
+// indexed with a summary of their docs.
+func SummarizeVendor() bool {
+	return os.Getenv("METAGODOC_SUMMARIZE_VENDOR") != ""
+}
+
+// FetchDepth returns how many commits of history to fetch for each ref, or 0
+// for all of it.
+func FetchDepth() (int, error) {
+	v := os.Getenv("METAGODOC_FETCH_DEPTH")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid METAGODOC_FETCH_DEPTH value: %s", v)
+	}
+	return n, nil
+}
+
+// MaxDuration returns how long one run may go on for, or 0 for no limit.
+func MaxDuration() (time.Duration, error) {
+	v := os.Getenv("METAGODOC_MAX_DURATION")
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_DURATION value: %s", v)
+	}
+	return d, nil
+}
+
+// RepoTimeout returns how long indexing a single repository may take before
+// it's abandoned and retried later, or 0 for no limit.
+func RepoTimeout() (time.Duration, error) {
+	v := os.Getenv("METAGODOC_REPO_TIMEOUT")
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid METAGODOC_REPO_TIMEOUT value: %s", v)
+	}
+	return d, nil
+}
+
+// AlertWebhooks returns the URLs to post alerts to, which are taken from a
+// comma-separated list.
+func AlertWebhooks() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("METAGODOC_ALERT_WEBHOOKS"), ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// AlertFailureRate returns the fraction of recent repositories which have to
+// fail before an alert is sent, or 0 for the default.
+func AlertFailureRate() (float64, error) {
+	v := os.Getenv("METAGODOC_ALERT_FAILURE_RATE")
+	if v == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("Invalid METAGODOC_ALERT_FAILURE_RATE value: %s", v)
+	}
+	return f, nil
+}
+
+// AlertCooldown returns how long to wait before sending the same kind of
+// alert again, or 0 for the default.
+func AlertCooldown() (time.Duration, error) {
+	v := os.Getenv("METAGODOC_ALERT_COOLDOWN")
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid METAGODOC_ALERT_COOLDOWN value: %s", v)
+	}
+	return d, nil
+}
+
+// MaxFailures returns how many crawls in a row a repository may fail before
+// it's moved to the dead-letter list, or 0 to keep retrying it forever.
+func MaxFailures() (int, error) {
+	v := os.Getenv("METAGODOC_MAX_FAILURES")
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid METAGODOC_MAX_FAILURES value: %s", v)
+	}
+	return n, nil
+}
+
+// ShutdownTimeout returns how long the repositories in progress get to
+// finish once the indexer is asked to stop, or 0 for the default.
+func ShutdownTimeout() (time.Duration, error) {
+	return interval("METAGODOC_SHUTDOWN_TIMEOUT")
+}
+
+// Daemon returns true if the indexer should keep running in rounds instead of
+// stopping once its budget runs out. See indexer.Daemon.
+func Daemon() bool {
+	return os.Getenv("METAGODOC_DAEMON") != ""
+}
+
+// RoundInterval returns how often the daemon starts a new round, or 0 for the
+// default.
+func RoundInterval() (time.Duration, error) {
+	return interval("METAGODOC_ROUND_INTERVAL")
+}
+
+// SeedInterval returns how often the daemon reads the seed lists again, or 0
+// for the default.
+func SeedInterval() (time.Duration, error) {
+	return interval("METAGODOC_SEED_INTERVAL")
+}
+
+// ScheduleInterval returns how often every indexed repository is
+// rescheduled, or 0 for the default.
+func ScheduleInterval() (time.Duration, error) {
+	return interval("METAGODOC_SCHEDULE_INTERVAL")
+}
+
+func interval(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid %s value: %s", name, v)
+	}
+	return d, nil
+}
@@ -0,0 +1,199 @@
+package esmodels
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// What an AboutPolicy does with the rest of a README which is too big to keep
+// inline.
+const (
+	// The rest is dropped.
+	AboutTruncate = "truncate"
+	// The whole README is gzipped and stored in About.Compressed, which is
+	// not indexed.
+	AboutCompress = "compress"
+	// The whole README is saved to an AboutStore and About.URL points to it.
+	AboutExternalize = "externalize"
+)
+
+// DefaultAboutInlineBytes is how much of a README is kept inline, and
+// searchable, by default. That's plenty for the parts of a README people
+// actually search for, and it keeps repository documents small.
+const DefaultAboutInlineBytes = 64 * 1024
+
+// An AboutStore saves README content outside of Elasticsearch and returns a
+// URL for it.
+type AboutStore interface {
+	Put(ctx context.Context, content []byte) (string, error)
+}
+
+// An AboutPolicy decides how README content is stored, based on its size.
+type AboutPolicy struct {
+	// One of AboutTruncate, AboutCompress, or AboutExternalize. Defaults to
+	// AboutTruncate.
+	Mode string
+	// Content up to this many bytes is stored as is. Defaults to
+	// DefaultAboutInlineBytes.
+	InlineBytes int
+	// Where content goes with AboutExternalize.
+	Store AboutStore
+}
+
+// Validate returns an error if the policy can't be applied.
+func (p AboutPolicy) Validate() error {
+	switch p.Mode {
+	case "", AboutTruncate, AboutCompress:
+	case AboutExternalize:
+		if p.Store == nil {
+			return fmt.Errorf("The %s About policy needs a store", AboutExternalize)
+		}
+	default:
+		return fmt.Errorf("Unknown About policy: %s", p.Mode)
+	}
+
+	if p.InlineBytes < 0 || p.InlineBytes > MaxAboutContentBytes {
+		return fmt.Errorf("The About inline size must be between 0 and %d bytes", MaxAboutContentBytes)
+	}
+	return nil
+}
+
+// Apply makes sure no more than the inline limit of the About's content is
+// kept in the document. Small content is left alone. Otherwise Content is
+// truncated to the limit, so the start of the README is still searchable,
+// and the full content is kept according to the policy's mode.
+func (p AboutPolicy) Apply(ctx context.Context, a *About) error {
+	limit := p.InlineBytes
+	if limit == 0 {
+		limit = DefaultAboutInlineBytes
+	}
+	if a == nil || len(a.Content) <= limit {
+		return nil
+	}
+
+	full := a.Content
+	switch p.Mode {
+	case AboutCompress:
+		c, err := compress(full)
+		if err != nil {
+			return errwrap.Wrapf("Could not compress About content: {{err}}", err)
+		}
+		a.Compressed = c
+	case AboutExternalize:
+		url, err := p.Store.Put(ctx, []byte(full))
+		if err != nil {
+			return errwrap.Wrapf("Could not store About content: {{err}}", err)
+		}
+		a.URL = url
+	}
+
+	a.Content = truncateUTF8(full, limit)
+	a.Truncated = true
+	a.OriginalBytes = len(full)
+	return nil
+}
+
+// FullContent returns the whole README for a document stored with the
+// AboutCompress policy, or just Content otherwise.
+func (a *About) FullContent() (string, error) {
+	if a.Compressed == "" {
+		return a.Content, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(a.Compressed)
+	if err != nil {
+		return "", err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func compress(s string) (string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// We don't want to cut a multi-byte character in half.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// DirAboutStore saves content in a directory, which can be served as is or
+// synced to object storage. Files are named by the SHA-256 of their content,
+// so identical READMEs are only stored once.
+type DirAboutStore struct {
+	Dir string
+	// The URL the directory is served from. If this is empty then a file://
+	// URL is returned instead.
+	BaseURL string
+}
+
+func (s *DirAboutStore) Put(ctx context.Context, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	name := hex.EncodeToString(sum[:])
+
+	err := os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(s.Dir, name)
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		// Writing to a temp file and renaming it means a reader never sees
+		// half a file.
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, content, 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if s.BaseURL == "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		return "file://" + abs, nil
+	}
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + name, nil
+}
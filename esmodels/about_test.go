@@ -0,0 +1,69 @@
+package esmodels
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAboutPolicyTruncate(t *testing.T) {
+	p := AboutPolicy{InlineBytes: 10}
+
+	small := &About{Content: "small"}
+	must(t, p.Apply(context.Background(), small))
+	assert.Equal(t, &About{Content: "small"}, small, "small content is left alone")
+
+	// "é" is two bytes, so the limit falls in the middle of one.
+	a := &About{Content: "abcdefghié and more"}
+	must(t, p.Apply(context.Background(), a))
+	assert.Equal(t, "abcdefghi", a.Content, "content is truncated on a character boundary")
+	assert.True(t, a.Truncated)
+	assert.Equal(t, 20, a.OriginalBytes)
+	assert.Empty(t, a.Compressed)
+	assert.Empty(t, a.URL)
+}
+
+func TestAboutPolicyCompress(t *testing.T) {
+	p := AboutPolicy{Mode: AboutCompress, InlineBytes: 10}
+
+	full := strings.Repeat("readme ", 100)
+	a := &About{Content: full}
+	must(t, p.Apply(context.Background(), a))
+	assert.Equal(t, full[:10], a.Content)
+	assert.NotEmpty(t, a.Compressed)
+
+	c, err := a.FullContent()
+	must(t, err)
+	assert.Equal(t, full, c, "compressed content round trips")
+}
+
+func TestAboutPolicyExternalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "about")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	p := AboutPolicy{
+		Mode:        AboutExternalize,
+		InlineBytes: 10,
+		Store:       &DirAboutStore{Dir: dir, BaseURL: "https://example.com/about/"},
+	}
+	must(t, p.Validate())
+
+	full := strings.Repeat("readme ", 100)
+	a := &About{Content: full}
+	must(t, p.Apply(context.Background(), a))
+	assert.Equal(t, full[:10], a.Content)
+	assert.True(t, strings.HasPrefix(a.URL, "https://example.com/about/"), "URL is under the base URL")
+
+	name := strings.TrimPrefix(a.URL, "https://example.com/about/")
+	stored, err := ioutil.ReadFile(dir + "/" + name)
+	must(t, err)
+	assert.Equal(t, full, string(stored))
+
+	assert.Error(t, AboutPolicy{Mode: AboutExternalize}.Validate(), "externalize needs a store")
+	assert.Error(t, AboutPolicy{Mode: "shred"}.Validate(), "unknown modes are rejected")
+}
@@ -5,5 +5,5 @@ type Author struct {
 	PrimaryURL   string   `json:"primary_url" esType:"keyword"`
 	Created      string   `json:"created" esType:"date"`
 	LastUpdated  string   `json:"last_updated" esType:"date"`
-	Repositories []string `json:"name" esType:"keyword"`
+	Repositories []string `json:"repositories" esType:"keyword" esImportPath:"true"`
 }
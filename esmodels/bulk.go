@@ -0,0 +1,474 @@
+package esmodels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
+	"github.com/autarch/metagodoc/tracing"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	DefaultBulkSize          = 500
+	DefaultBulkFlushInterval = 5 * time.Second
+)
+
+// When Elasticsearch rejects documents because it's overloaded we retry them,
+// waiting twice as long after each rejection, up to maxRetryDelay. A document
+// which is rejected more than maxRetries times is given up on. Documents
+// refused because their index is blocked for writes during a reindex are
+// retried the same way, but they're never given up on, since the block only
+// lasts as long as the reindex.
+const (
+	initialRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 30 * time.Second
+	maxRetries        = 8
+)
+
+type NewBulkWriterParams struct {
+	Logger  *logger.Logger
+	Elastic *elc.Client
+	Context context.Context
+	// The number of documents to send in each _bulk request. Defaults to
+	// DefaultBulkSize.
+	BatchSize int
+	// Any pending documents are sent at least this often, even if there
+	// aren't enough of them to fill a batch. Defaults to
+	// DefaultBulkFlushInterval.
+	FlushInterval time.Duration
+}
+
+// A BulkWriter batches index and delete operations into _bulk requests.
+// Writes are asynchronous, so a failure is logged and reported by the next
+// call to Err rather than being returned by Index or Delete. Writes made
+// through a Batch report their failures to the batch instead, so one
+// repository's failures don't show up as another's.
+//
+// Documents rejected because the cluster is overloaded are retried with
+// backoff. While that's happening, Index, Update, and Delete block, so the
+// indexer slows down rather than piling up more documents.
+type BulkWriter struct {
+	l         *logger.Logger
+	elastic   *elc.Client
+	processor *elastic.BulkProcessor
+	mu        sync.Mutex
+
+	// Writes made directly through the writer rather than a Batch. Its error
+	// is the writer's.
+	shared *bulkBatch
+	// The batch each request in flight was made through.
+	batches map[elastic.BulkableRequest]*bulkBatch
+	// How many times each rejected request has been tried.
+	attempts map[elastic.BulkableRequest]int
+	// Writes are paused until this time.
+	pausedUntil time.Time
+	// How many retry goroutines haven't yet added their requests back to the
+	// processor. This is guarded by mu, and retried is signalled each time
+	// one finishes. A WaitGroup won't do, since retries are started while
+	// Flush is waiting.
+	retrying int
+	retried  *sync.Cond
+	// Bulk requests in flight, by execution ID.
+	inFlight map[int64]*bulkRequest
+}
+
+type bulkRequest struct {
+	start time.Time
+	span  *tracing.Span
+}
+
+func NewBulkWriter(p NewBulkWriterParams) (*BulkWriter, error) {
+	if p.BatchSize <= 0 {
+		p.BatchSize = DefaultBulkSize
+	}
+	if p.FlushInterval <= 0 {
+		p.FlushInterval = DefaultBulkFlushInterval
+	}
+	if p.Context == nil {
+		p.Context = context.Background()
+	}
+
+	w := &BulkWriter{
+		l:        p.Logger,
+		elastic:  p.Elastic,
+		batches:  make(map[elastic.BulkableRequest]*bulkBatch),
+		attempts: make(map[elastic.BulkableRequest]int),
+		inFlight: make(map[int64]*bulkRequest),
+	}
+	w.shared = &bulkBatch{w: w}
+	w.retried = sync.NewCond(&w.mu)
+	processor, err := p.Elastic.
+		BulkProcessor().
+		Name("metagodoc-bulk-writer").
+		Workers(1).
+		BulkActions(p.BatchSize).
+		// We only want to flush based on the number of documents and time.
+		BulkSize(-1).
+		FlushInterval(p.FlushInterval).
+		// This is for requests which fail entirely. Rejections of
+		// individual documents are handled in after.
+		Backoff(elastic.NewExponentialBackoff(initialRetryDelay, maxRetryDelay)).
+		Before(w.before).
+		After(w.after).
+		Do(p.Context)
+	if err != nil {
+		return nil, err
+	}
+	w.processor = processor
+
+	return w, nil
+}
+
+// Index queues a document to be indexed.
+func (w *BulkWriter) Index(index, typ, id string, doc interface{}) {
+	w.shared.Index(index, typ, id, doc)
+}
+
+// IndexWithRouting queues a document to be indexed on the shard for the
+// routing key.
+func (w *BulkWriter) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	w.shared.IndexWithRouting(index, typ, id, routing, doc)
+}
+
+// Update queues a partial update of an existing document. The fields in doc
+// replace the document's fields and everything else is left alone.
+func (w *BulkWriter) Update(index, typ, id string, doc interface{}) {
+	w.shared.Update(index, typ, id, doc)
+}
+
+// UpdateWithScript queues a partial update of an existing document made by a
+// script.
+func (w *BulkWriter) UpdateWithScript(index, typ, id string, script *elastic.Script) {
+	w.shared.UpdateWithScript(index, typ, id, script)
+}
+
+// Delete queues a document to be deleted. Deleting a document which doesn't
+// exist is not an error.
+func (w *BulkWriter) Delete(index, typ, id string) {
+	w.shared.Delete(index, typ, id)
+}
+
+// Batch returns a writer whose Flush and Err only report failures of the
+// writes made through it. The writes still go in the same _bulk requests as
+// everything else.
+func (w *BulkWriter) Batch() DocumentWriter {
+	return &bulkBatch{w: w}
+}
+
+func (w *BulkWriter) add(b *bulkBatch, r elastic.BulkableRequest) {
+	w.mu.Lock()
+	w.batches[r] = b
+	wait := w.pausedUntil.Sub(time.Now())
+	w.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	w.processor.Add(r)
+}
+
+// Flush sends everything which is queued, including retries, and waits for
+// it to be written.
+func (w *BulkWriter) Flush() error {
+	return w.shared.Flush()
+}
+
+// Retries are added back to the processor after a delay, and flushing may
+// cause more of them, so we keep going until there are none left.
+func (w *BulkWriter) flush() error {
+	for {
+		err := w.processor.Flush()
+		if err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		pending := len(w.attempts)
+		for w.retrying > 0 {
+			w.retried.Wait()
+		}
+		w.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+	}
+}
+
+// Close flushes anything which is queued and stops the writer.
+func (w *BulkWriter) Close() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+	err = w.processor.Close()
+	if err != nil {
+		return err
+	}
+	return w.Err()
+}
+
+// Err returns the first error since the last call to Err, if there was one.
+// This leaves out the errors from writes made through a Batch.
+func (w *BulkWriter) Err() error {
+	return w.shared.Err()
+}
+
+// Bulk requests mix documents from many repositories, so each one gets a
+// trace of its own rather than being part of a repository's trace.
+func (w *BulkWriter) before(id int64, requests []elastic.BulkableRequest) {
+	_, span := tracing.Start(context.Background(), "elasticsearch bulk", "requests", len(requests))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight[id] = &bulkRequest{start: time.Now(), span: span}
+}
+
+func (w *BulkWriter) after(id int64, requests []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+	w.mu.Lock()
+	if r, ok := w.inFlight[id]; ok {
+		metrics.BulkSeconds.Observe(time.Since(r.start).Seconds())
+		r.span.SetError(err)
+		r.span.End()
+		delete(w.inFlight, id)
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		w.l.Errorf("Bulk request failed: %s", err)
+		metrics.DocsFailed.Add(int64(len(requests)))
+		for _, r := range requests {
+			w.forget(r).setErr(err)
+		}
+		return
+	}
+	if resp == nil {
+		return
+	}
+
+	var rejected, blocked []elastic.BulkableRequest
+	for i, items := range resp.Items {
+		if i >= len(requests) {
+			break
+		}
+		for _, item := range items {
+			if isRejection(item) {
+				rejected = append(rejected, requests[i])
+				continue
+			}
+			if isWriteBlock(item) {
+				blocked = append(blocked, requests[i])
+				continue
+			}
+			b := w.forget(requests[i])
+			if item.Status < 200 || item.Status > 299 {
+				b.failed(item)
+			} else {
+				metrics.DocsWritten.Add(1)
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		w.retry(rejected, false)
+	}
+	if len(blocked) > 0 {
+		w.retry(blocked, true)
+	}
+}
+
+func isRejection(item *elastic.BulkResponseItem) bool {
+	return item.Status == http.StatusTooManyRequests ||
+		(item.Error != nil && item.Error.Type == "es_rejected_execution_exception")
+}
+
+func isWriteBlock(item *elastic.BulkResponseItem) bool {
+	return item.Error != nil && item.Error.Type == "cluster_block_exception"
+}
+
+// forget stops tracking a request once it's been written or has failed for
+// some reason other than being rejected. It returns the batch the request was
+// made through, which is where any failure goes.
+func (w *BulkWriter) forget(r elastic.BulkableRequest) *bulkBatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b := w.batches[r]
+	if b == nil {
+		b = w.shared
+	}
+	delete(w.attempts, r)
+	delete(w.batches, r)
+	return b
+}
+
+// retry pauses writes and then sends the rejected requests again. This
+// happens in its own goroutine since it's called from the processor's worker,
+// which is the only thing that takes requests from the processor. Blocked
+// requests are retried for as long as it takes.
+func (w *BulkWriter) retry(requests []elastic.BulkableRequest, blocked bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var again []elastic.BulkableRequest
+	attempts := 0
+	for _, r := range requests {
+		w.attempts[r]++
+		if blocked && w.attempts[r] > maxRetries {
+			w.attempts[r] = maxRetries
+		}
+		if w.attempts[r] > maxRetries {
+			b := w.batches[r]
+			if b == nil {
+				b = w.shared
+			}
+			delete(w.attempts, r)
+			delete(w.batches, r)
+			metrics.DocsFailed.Add(1)
+			err := fmt.Errorf("Gave up on a document after it was rejected %d times", maxRetries)
+			w.l.Error(err)
+			if b.err == nil {
+				b.err = err
+			}
+			continue
+		}
+		again = append(again, r)
+		if w.attempts[r] > attempts {
+			attempts = w.attempts[r]
+		}
+	}
+	if len(again) == 0 {
+		return
+	}
+
+	delay := initialRetryDelay << uint(attempts-1)
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	w.pausedUntil = time.Now().Add(delay)
+	if blocked {
+		w.l.Infof("%d documents were blocked by a reindex, retrying in %s", len(again), delay)
+	} else {
+		w.l.Infof("Elasticsearch rejected %d documents, retrying in %s", len(again), delay)
+	}
+
+	w.retrying++
+	go func() {
+		time.Sleep(delay)
+		for _, r := range again {
+			w.processor.Add(r)
+		}
+
+		w.mu.Lock()
+		w.retrying--
+		w.retried.Broadcast()
+		w.mu.Unlock()
+	}()
+}
+
+// A bulkBatch is a set of writes made through a BulkWriter whose failures
+// are kept apart from everything else's. Its error is guarded by the
+// writer's mu.
+type bulkBatch struct {
+	w   *BulkWriter
+	err error
+}
+
+func (b *bulkBatch) Index(index, typ, id string, doc interface{}) {
+	if !b.valid(index, id, doc) {
+		return
+	}
+	b.w.add(b, elastic.NewBulkIndexRequest().Index(index).Type(b.w.elastic.BulkType(typ)).Id(id).Doc(doc))
+}
+
+func (b *bulkBatch) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	if !b.valid(index, id, doc) {
+		return
+	}
+	b.w.add(b, elastic.NewBulkIndexRequest().Index(index).Type(b.w.elastic.BulkType(typ)).Id(id).Routing(routing).Doc(doc))
+}
+
+func (b *bulkBatch) Update(index, typ, id string, doc interface{}) {
+	b.w.add(b, elastic.NewBulkUpdateRequest().Index(index).Type(b.w.elastic.BulkType(typ)).Id(id).Doc(doc))
+}
+
+func (b *bulkBatch) UpdateWithScript(index, typ, id string, script *elastic.Script) {
+	b.w.add(b, elastic.NewBulkUpdateRequest().Index(index).Type(b.w.elastic.BulkType(typ)).Id(id).Script(script))
+}
+
+func (b *bulkBatch) Delete(index, typ, id string) {
+	b.w.add(b, elastic.NewBulkDeleteRequest().Index(index).Type(b.w.elastic.BulkType(typ)).Id(id))
+}
+
+// Batches of a batch would be no use, since its writes are already kept
+// apart.
+func (b *bulkBatch) Batch() DocumentWriter {
+	return b
+}
+
+// Flush waits for everything queued in the writer to be written, since the
+// batch's writes are mixed in with the rest, but only returns the batch's
+// errors.
+func (b *bulkBatch) Flush() error {
+	err := b.w.flush()
+	if err != nil {
+		return err
+	}
+	return b.Err()
+}
+
+// Close only flushes the batch. The writer is closed by its owner.
+func (b *bulkBatch) Close() error {
+	return b.Flush()
+}
+
+func (b *bulkBatch) Err() error {
+	b.w.mu.Lock()
+	defer b.w.mu.Unlock()
+
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// valid checks the document before it's queued. An invalid document is never
+// sent, since Elasticsearch would just reject it, and the problems are
+// recorded as the batch's error.
+func (b *bulkBatch) valid(index, id string, doc interface{}) bool {
+	err := Validate(index, id, doc)
+	if err == nil {
+		return true
+	}
+	b.w.l.Errorw("Document failed validation", "index", index, "id", id, "problems", err.(*ValidationError).Problems)
+	b.setErr(err)
+	return false
+}
+
+func (b *bulkBatch) failed(item *elastic.BulkResponseItem) {
+	// The document was already gone.
+	if item.Status == http.StatusNotFound && item.Error == nil {
+		return
+	}
+
+	reason := ""
+	if item.Error != nil {
+		reason = item.Error.Reason
+	}
+	b.w.l.Errorf("Could not write %s/%s/%s (%d): %s", item.Index, item.Type, item.Id, item.Status, reason)
+	metrics.DocsFailed.Add(1)
+	b.setErr(fmt.Errorf("Could not write %s/%s/%s: %s", item.Index, item.Type, item.Id, reason))
+}
+
+func (b *bulkBatch) setErr(err error) {
+	b.w.mu.Lock()
+	defer b.w.mu.Unlock()
+
+	if b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,116 @@
+package esmodels
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBulkServer rejects every document the first time it sees it, as if
+// it were overloaded or, if blocked is set, as if the index were blocked for
+// writes. Documents in invalid always fail.
+type fakeBulkServer struct {
+	seen    map[string]int
+	written []string
+	blocked bool
+	invalid map[string]bool
+	mu      sync.Mutex
+}
+
+func (s *fakeBulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" {
+		fmt.Fprint(w, `{"version": {"number": "6.8.0"}}`)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action map[string]struct {
+			ID string `json:"_id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &action) != nil || action["index"].ID == "" {
+			continue
+		}
+		// Skip the document.
+		scanner.Scan()
+
+		id := action["index"].ID
+		s.seen[id]++
+		switch {
+		case s.invalid[id]:
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "i", "_id": %q, "status": 400, "error": {"type": "mapper_parsing_exception", "reason": "bad"}}}`, id))
+		case s.seen[id] > 1:
+			s.written = append(s.written, id)
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "i", "_id": %q, "status": 201}}`, id))
+		case s.blocked:
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "i", "_id": %q, "status": 403, "error": {"type": "cluster_block_exception", "reason": "blocked"}}}`, id))
+		default:
+			items = append(items, fmt.Sprintf(`{"index": {"_index": "i", "_id": %q, "status": 429}}`, id))
+		}
+	}
+
+	fmt.Fprintf(w, `{"errors": true, "items": [%s]}`, strings.Join(items, ","))
+}
+
+func TestBulkWriterRetriesRejections(t *testing.T) {
+	for _, blocked := range []bool{false, true} {
+		fake := &fakeBulkServer{seen: make(map[string]int), blocked: blocked}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		l, err := logger.New(logger.NewParams{})
+		must(t, err)
+		client, err := elc.NewClient(elc.NewParams{URLs: []string{server.URL}, DisableSniffing: true})
+		must(t, err)
+
+		w, err := NewBulkWriter(NewBulkWriterParams{Logger: l, Elastic: client})
+		must(t, err)
+
+		w.Index("i", "t", "a", map[string]string{"foo": "bar"})
+		w.Index("i", "t", "b", map[string]string{"foo": "baz"})
+		must(t, w.Close())
+
+		assert.ElementsMatch(t, []string{"a", "b"}, fake.written, "rejected documents are retried (blocked = %v)", blocked)
+	}
+}
+
+func TestBulkWriterBatches(t *testing.T) {
+	fake := &fakeBulkServer{seen: make(map[string]int), invalid: map[string]bool{"bad": true}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	client, err := elc.NewClient(elc.NewParams{URLs: []string{server.URL}, DisableSniffing: true})
+	must(t, err)
+
+	w, err := NewBulkWriter(NewBulkWriterParams{Logger: l, Elastic: client})
+	must(t, err)
+	defer w.Close()
+
+	good := w.Batch()
+	bad := w.Batch()
+	good.Index("i", "t", "good", map[string]string{"foo": "bar"})
+	bad.Index("i", "t", "bad", map[string]string{"foo": "baz"})
+
+	assert.Nil(t, good.Flush(), "another batch's failure isn't reported")
+	if err := bad.Flush(); assert.Error(t, err, "a batch's own failure is") {
+		assert.Contains(t, err.Error(), "/bad: bad")
+	}
+	assert.Nil(t, w.Err(), "nor is it the writer's")
+	assert.Equal(t, []string{"good"}, fake.written)
+}
@@ -0,0 +1,40 @@
+package esmodels
+
+// A CrawlReport summarizes one run of the indexer, or one round in daemon
+// mode. Comparing these from run to run is how we notice when a change
+// quietly makes the crawl cover less than it used to.
+type CrawlReport struct {
+	Started  string `json:"started" esType:"date" esRequired:"true"`
+	Finished string `json:"finished" esType:"date" esRequired:"true"`
+	Tenant   string `json:"tenant,omitempty" esType:"keyword"`
+	// Why the run ended, like "budget exhausted: indexed 100 repositories"
+	// or "stopped".
+	StopReason string `json:"stop_reason" esType:"keyword"`
+
+	// Every repository taken off the queue ends up as one of succeeded,
+	// skipped, or failed. Skipped repositories include those on the skip
+	// list and those which hadn't changed since the last crawl.
+	Attempted int `json:"attempted" esType:"long"`
+	Succeeded int `json:"succeeded" esType:"long"`
+	Skipped   int `json:"skipped" esType:"long"`
+	Failed    int `json:"failed" esType:"long"`
+	// The number of failures in each category, like "fetch" or "timeout",
+	// and the first few failures themselves.
+	FailureCategories map[string]int  `json:"failure_categories"`
+	Failures          []*CrawlFailure `json:"failures"`
+
+	// Documents sent to the writer, including partial updates.
+	DocumentsWritten int64 `json:"documents_written" esType:"long"`
+	// Roughly how much was downloaded to clone and fetch repositories.
+	CloneBytes int64 `json:"clone_bytes" esType:"long"`
+	// How many GitHub API requests we made, and how many GitHub said we had
+	// left at the end. The remaining quota is -1 if we never asked.
+	GitHubRequests       int64 `json:"github_requests" esType:"long"`
+	GitHubQuotaRemaining int64 `json:"github_quota_remaining" esType:"long"`
+}
+
+type CrawlFailure struct {
+	ID       string `json:"id" esType:"keyword" esImportPath:"true"`
+	Category string `json:"category" esType:"keyword"`
+	Error    string `json:"error" esType:"text"`
+}
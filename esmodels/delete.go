@@ -0,0 +1,55 @@
+package esmodels
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/autarch/metagodoc/elc"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// DeleteRepository removes a repository from the index, along with its
+// packages. Authors refer to their repositories by ID, so the ID is removed
+// from every author as well. Everything is deleted before this returns, and
+// the repository's document goes last, so a failure leaves it in place to be
+// deleted again rather than leaving its packages behind. The client may be
+// nil when writing to an export rather than a cluster, in which case only the
+// repository's document is deleted, through the writer.
+func DeleteRepository(ctx context.Context, client *elc.Client, w DocumentWriter, id string) error {
+	if client == nil {
+		w.Delete(IndexName(mappingNamed("repository")), "repository", id)
+		return nil
+	}
+
+	err := deletePackages(ctx, client, id, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = client.
+		UpdateByQuery(IndexName(mappingNamed("author"))).
+		Type(client.SearchTypes("author")...).
+		Query(elastic.NewTermQuery("repositories", id)).
+		Script(
+			elastic.NewScript("ctx._source.repositories.removeIf(r -> r == params.id)").
+				Param("id", id),
+		).
+		Do(ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not remove %s from its authors: {{err}}", id), err)
+	}
+
+	_, err = client.
+		Delete().
+		Index(IndexName(mappingNamed("repository"))).
+		Type(client.Type("repository")).
+		Id(id).
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errwrap.Wrapf(fmt.Sprintf("Could not delete the document for %s: {{err}}", id), err)
+	}
+
+	return nil
+}
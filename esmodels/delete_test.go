@@ -0,0 +1,63 @@
+package esmodels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/autarch/metagodoc/elc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteRepository(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		failures = 1
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+			requests = append(requests, "packages")
+			fmt.Fprint(w, `{"deleted": 1}`)
+		case strings.HasSuffix(r.URL.Path, "/_update_by_query"):
+			requests = append(requests, "authors")
+			fmt.Fprint(w, `{"updated": 1}`)
+		case r.Method == http.MethodDelete:
+			requests = append(requests, "repository")
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{"error": "boom"}`)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"result": "not_found"}`)
+		default:
+			fmt.Fprint(w, `{"version": {"number": "6.8.0"}}`)
+		}
+	}))
+	defer server.Close()
+	client, err := elc.NewClient(elc.NewParams{URLs: []string{server.URL}, DisableSniffing: true})
+	must(t, err)
+
+	w := &recordingWriter{}
+	err = DeleteRepository(context.Background(), client, w, "github.com/foo/bar")
+	if assert.Error(t, err, "a failed delete is returned rather than left for a later flush") {
+		assert.Contains(t, err.Error(), "Could not delete the document for github.com/foo/bar")
+	}
+	assert.Equal(t, []string{"packages", "authors", "repository"}, requests, "the repository's document goes last")
+	assert.Empty(t, w.deleted, "nothing is left in the writer")
+
+	assert.Nil(t, DeleteRepository(context.Background(), client, w, "github.com/foo/bar"), "a document which is already gone is fine")
+
+	assert.Nil(t, DeleteRepository(context.Background(), nil, w, "github.com/foo/bar"))
+	assert.Len(t, w.deleted, 1, "an export only gets the repository's document deleted")
+}
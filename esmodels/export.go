@@ -0,0 +1,407 @@
+package esmodels
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// A DocumentWriter writes documents somewhere. The BulkWriter sends them to
+// Elasticsearch, and the export writers below write them to files for
+// offline use.
+type DocumentWriter interface {
+	Index(index, typ, id string, doc interface{})
+	// IndexWithRouting is like Index, but the document is stored on the
+	// shard for the routing key rather than the shard for its ID.
+	IndexWithRouting(index, typ, id, routing string, doc interface{})
+	Update(index, typ, id string, doc interface{})
+	// UpdateWithScript is a partial update made by a script, for changes
+	// which can't be made by merging fields.
+	UpdateWithScript(index, typ, id string, script *elastic.Script)
+	Delete(index, typ, id string)
+	// Batch returns a writer for a set of related writes, like everything
+	// for one repository. Its Flush and Err only report the failures of its
+	// own writes, so writers which are used concurrently don't see each
+	// other's failures. Closing a batch only flushes it.
+	Batch() DocumentWriter
+	Flush() error
+	Close() error
+	Err() error
+}
+
+// An exportBatch is the Batch of an export writer. Exports are written
+// synchronously, and any failure spoils the whole export, so a batch shares
+// its writer's errors.
+type exportBatch struct {
+	DocumentWriter
+}
+
+func (b exportBatch) Batch() DocumentWriter {
+	return b
+}
+
+func (b exportBatch) Close() error {
+	return b.Flush()
+}
+
+// NewExportWriter returns a writer for an output given as "ndjson:<dir>",
+// "sqlite:<file>", or "sql:<file>". The last is a SQL script for the sqlite3
+// shell rather than a database, see SQLWriter.
+func NewExportWriter(output string) (DocumentWriter, error) {
+	parts := strings.SplitN(output, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid output %q, expected ndjson:<dir>, sqlite:<file>, or sql:<file>", output)
+	}
+
+	switch parts[0] {
+	case "ndjson":
+		return NewNDJSONWriter(parts[1])
+	case "sqlite":
+		return NewSQLiteWriter(parts[1])
+	case "sql":
+		return NewSQLWriter(parts[1])
+	default:
+		return nil, fmt.Errorf("Unknown output format: %s", parts[0])
+	}
+}
+
+// exportWriter has the parts the export writers share. Unlike the BulkWriter
+// these write synchronously, so the first error is kept and returned by every
+// later call to Flush, Close, or Err.
+type exportWriter struct {
+	err error
+	mu  sync.Mutex
+}
+
+func (w *exportWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *exportWriter) setErr(err error) {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// An NDJSONWriter writes each index to its own file in a directory, named
+// after the index, with one JSON object per line. Each line has the
+// document's "id" and one of the document itself in "doc", a partial document
+// in "update", or "deleted": true. Later lines replace earlier lines with the
+// same ID, and an update's fields replace the fields of the same name.
+type NDJSONWriter struct {
+	exportWriter
+	dir   string
+	files map[string]*os.File
+	bufs  map[string]*bufio.Writer
+}
+
+type ndjsonLine struct {
+	ID      string      `json:"id"`
+	Doc     interface{} `json:"doc,omitempty"`
+	Update  interface{} `json:"update,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+func NewNDJSONWriter(dir string) (*NDJSONWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", dir), err)
+	}
+
+	return &NDJSONWriter{
+		dir:   dir,
+		files: make(map[string]*os.File),
+		bufs:  make(map[string]*bufio.Writer),
+	}, nil
+}
+
+func (w *NDJSONWriter) Index(index, typ, id string, doc interface{}) {
+	w.write(index, &ndjsonLine{ID: id, Doc: doc})
+}
+
+// Routing only matters to Elasticsearch.
+func (w *NDJSONWriter) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	w.Index(index, typ, id, doc)
+}
+
+func (w *NDJSONWriter) Update(index, typ, id string, doc interface{}) {
+	w.write(index, &ndjsonLine{ID: id, Update: doc})
+}
+
+// Scripts can only be run by Elasticsearch. An export is never updated with
+// one, since exporting always writes whole documents.
+func (w *NDJSONWriter) UpdateWithScript(index, typ, id string, script *elastic.Script) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setErr(fmt.Errorf("Could not update %s/%s: scripts can't be exported", index, id))
+}
+
+func (w *NDJSONWriter) Delete(index, typ, id string) {
+	w.write(index, &ndjsonLine{ID: id, Deleted: true})
+}
+
+func (w *NDJSONWriter) write(index string, line *ndjsonLine) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, err := w.buf(index)
+	if err != nil {
+		w.setErr(err)
+		return
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		w.setErr(errwrap.Wrapf(fmt.Sprintf("Could not marshal %s/%s: {{err}}", index, line.ID), err))
+		return
+	}
+	_, err = buf.Write(append(b, '\n'))
+	w.setErr(err)
+}
+
+func (w *NDJSONWriter) buf(index string) (*bufio.Writer, error) {
+	if buf, ok := w.bufs[index]; ok {
+		return buf, nil
+	}
+
+	path := filepath.Join(w.dir, index+".ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", path), err)
+	}
+	w.files[index] = f
+	w.bufs[index] = bufio.NewWriter(f)
+
+	return w.bufs[index], nil
+}
+
+func (w *NDJSONWriter) Batch() DocumentWriter {
+	return exportBatch{w}
+}
+
+func (w *NDJSONWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, buf := range w.bufs {
+		w.setErr(buf.Flush())
+	}
+	return w.err
+}
+
+func (w *NDJSONWriter) Close() error {
+	err := w.Flush()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.files {
+		w.setErr(f.Close())
+	}
+	if err != nil {
+		return err
+	}
+	return w.err
+}
+
+// A SQLWriter writes a SQL script which creates a SQLite database when fed
+// to the sqlite3 shell, as in "sqlite3 metagodoc.db < metagodoc.sql". Each
+// index becomes a table with "id" and "doc" columns, where "doc" is the
+// document as JSON, so it can be queried with SQLite's JSON functions.
+type SQLWriter struct {
+	exportWriter
+	f      *os.File
+	buf    *bufio.Writer
+	tables map[string]bool
+}
+
+func NewSQLWriter(path string) (*SQLWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", path), err)
+	}
+
+	w := &SQLWriter{
+		f:      f,
+		buf:    bufio.NewWriter(f),
+		tables: make(map[string]bool),
+	}
+	w.statement("BEGIN TRANSACTION")
+
+	return w, nil
+}
+
+func (w *SQLWriter) Index(index, typ, id string, doc interface{}) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		w.mu.Lock()
+		w.setErr(errwrap.Wrapf(fmt.Sprintf("Could not marshal %s/%s: {{err}}", index, id), err))
+		w.mu.Unlock()
+		return
+	}
+
+	w.table(index)
+	w.statement(fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s (id, doc) VALUES (%s, %s)",
+		sqlIdentifier(index), sqlString(id), sqlString(string(b)),
+	))
+}
+
+// Routing only matters to Elasticsearch.
+func (w *SQLWriter) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	w.Index(index, typ, id, doc)
+}
+
+// json_patch merges the partial document into the existing one, the same
+// way Elasticsearch applies a partial update.
+func (w *SQLWriter) Update(index, typ, id string, doc interface{}) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		w.mu.Lock()
+		w.setErr(errwrap.Wrapf(fmt.Sprintf("Could not marshal %s/%s: {{err}}", index, id), err))
+		w.mu.Unlock()
+		return
+	}
+
+	w.table(index)
+	w.statement(fmt.Sprintf(
+		"UPDATE %s SET doc = json_patch(doc, %s) WHERE id = %s",
+		sqlIdentifier(index), sqlString(string(b)), sqlString(id),
+	))
+}
+
+// See NDJSONWriter.UpdateWithScript.
+func (w *SQLWriter) UpdateWithScript(index, typ, id string, script *elastic.Script) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setErr(fmt.Errorf("Could not update %s/%s: scripts can't be exported", index, id))
+}
+
+func (w *SQLWriter) Delete(index, typ, id string) {
+	w.table(index)
+	w.statement(fmt.Sprintf("DELETE FROM %s WHERE id = %s", sqlIdentifier(index), sqlString(id)))
+}
+
+// The table is created while holding the lock, so that another goroutine
+// writing to the same index can't get its statement in first.
+func (w *SQLWriter) table(index string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.tables[index] {
+		return
+	}
+	w.tables[index] = true
+	w.write(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, doc TEXT NOT NULL)", sqlIdentifier(index)))
+}
+
+func (w *SQLWriter) statement(s string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(s)
+}
+
+func (w *SQLWriter) write(s string) {
+	_, err := w.buf.WriteString(s + ";\n")
+	w.setErr(err)
+}
+
+func (w *SQLWriter) Batch() DocumentWriter {
+	return exportBatch{w}
+}
+
+func (w *SQLWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.setErr(w.buf.Flush())
+	return w.err
+}
+
+func (w *SQLWriter) Close() error {
+	w.statement("COMMIT")
+	w.Flush()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setErr(w.f.Close())
+	return w.err
+}
+
+// A SQLiteWriter creates a SQLite database. There's no SQLite driver that
+// builds without cgo, which we don't want to require just for exports, so
+// this writes a script with a SQLWriter and runs it with the sqlite3 shell
+// when it's closed. The database is built next to the path and renamed into
+// place, so a failed export doesn't leave half a database behind.
+type SQLiteWriter struct {
+	*SQLWriter
+	path   string
+	script string
+}
+
+func NewSQLiteWriter(path string) (*SQLiteWriter, error) {
+	_, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return nil, errwrap.Wrapf("The sqlite output needs the sqlite3 shell: {{err}}", err)
+	}
+
+	script := path + ".sql"
+	w, err := NewSQLWriter(script)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteWriter{
+		SQLWriter: w,
+		path:      path,
+		script:    script,
+	}, nil
+}
+
+func (w *SQLiteWriter) Close() error {
+	defer os.Remove(w.script)
+
+	err := w.SQLWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(w.script)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not open %s: {{err}}", w.script), err)
+	}
+	defer f.Close()
+
+	tmp := w.path + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	cmd := exec.Command("sqlite3", "-bail", tmp)
+	cmd.Stdin = f
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}: %s", w.path, strings.TrimSpace(string(out))), err)
+	}
+
+	if err := os.Rename(tmp, w.path); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not rename %s: {{err}}", tmp), err)
+	}
+	return nil
+}
+
+func sqlIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
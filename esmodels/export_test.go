@@ -0,0 +1,101 @@
+package esmodels
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNDJSONWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-export")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewExportWriter("ndjson:" + dir)
+	must(t, err)
+	w.Index("metagodoc-repository", "repository", "github.com/foo/bar", &Repository{Name: "bar"})
+	w.Delete("metagodoc-repository", "repository", "github.com/foo/baz")
+	w.Index("metagodoc-tombstone", "tombstone", "github.com/foo/baz", &Tombstone{Reason: "gone"})
+	must(t, w.Close())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "metagodoc-repository.ndjson"))
+	must(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"id":"github.com/foo/bar","doc":{`)
+		assert.Contains(t, lines[0], `"name":"bar"`)
+		assert.Equal(t, `{"id":"github.com/foo/baz","deleted":true}`, lines[1])
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "metagodoc-tombstone.ndjson"))
+	assert.NoError(t, err, "each index gets its own file")
+}
+
+func TestSQLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-export")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metagodoc.sql")
+	w, err := NewExportWriter("sql:" + path)
+	must(t, err)
+	w.Index("metagodoc-repository", "repository", "github.com/foo/bar", &Repository{Name: "it's"})
+	w.Delete("metagodoc-repository", "repository", "github.com/foo/baz")
+	must(t, w.Close())
+
+	b, err := ioutil.ReadFile(path)
+	must(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 5) {
+		assert.Equal(t, "BEGIN TRANSACTION;", lines[0])
+		assert.Equal(t, `CREATE TABLE IF NOT EXISTS "metagodoc-repository" (id TEXT PRIMARY KEY, doc TEXT NOT NULL);`, lines[1])
+		assert.Contains(t, lines[2], `INSERT OR REPLACE INTO "metagodoc-repository" (id, doc) VALUES ('github.com/foo/bar', '{`)
+		assert.Contains(t, lines[2], `"name":"it''s"`, "quotes are escaped")
+		assert.Equal(t, `DELETE FROM "metagodoc-repository" WHERE id = 'github.com/foo/baz';`, lines[3])
+		assert.Equal(t, "COMMIT;", lines[4])
+	}
+}
+
+func TestSQLiteWriter(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("the sqlite3 shell is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "metagodoc-export")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metagodoc.db")
+	w, err := NewExportWriter("sqlite:" + path)
+	must(t, err)
+	w.Index("metagodoc-repository", "repository", "github.com/foo/bar", &Repository{Name: "it's"})
+	w.Index("metagodoc-repository", "repository", "github.com/foo/baz", &Repository{Name: "baz"})
+	w.Update("metagodoc-repository", "repository", "github.com/foo/bar", map[string]interface{}{"name": "bar"})
+	w.Delete("metagodoc-repository", "repository", "github.com/foo/baz")
+	must(t, w.Close())
+
+	out, err := exec.Command("sqlite3", path, `SELECT id, json_extract(doc, '$.name') FROM "metagodoc-repository"`).Output()
+	must(t, err)
+	assert.Equal(t, "github.com/foo/bar|bar\n", string(out))
+
+	_, err = os.Stat(path + ".sql")
+	assert.True(t, os.IsNotExist(err), "the script is removed")
+}
+
+func TestNewExportWriterErrors(t *testing.T) {
+	_, err := NewExportWriter("ndjson")
+	assert.Error(t, err)
+	_, err = NewExportWriter("csv:foo")
+	assert.Error(t, err)
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
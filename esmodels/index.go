@@ -0,0 +1,268 @@
+package esmodels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Every mapping gets its own index, named after the mapping with a prefix.
+// This is really an alias, see reindex.go for details.
+const DefaultIndexPrefix = "metagodoc-"
+
+var indexPrefix = DefaultIndexPrefix
+
+// Elasticsearch doesn't allow uppercase letters in index names, or most
+// punctuation, or a leading "-", "_", or "+".
+var indexPrefixRE = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// SetIndexPrefix changes the prefix of every index name, so that separate
+// installations, like staging and production, can share a cluster. For
+// example, with a prefix of "metagodoc-staging-" the repository index is
+// "metagodoc-staging-repository". This must be called before anything uses
+// an index.
+func SetIndexPrefix(prefix string) error {
+	if !indexPrefixRE.MatchString(prefix) {
+		return fmt.Errorf("Invalid index prefix %q, it must be lowercase letters, numbers, \".\", \"_\", and \"-\"", prefix)
+	}
+	indexPrefix = prefix
+	return nil
+}
+
+// The tenant everything belongs to. See SetTenant.
+var tenant string
+
+// A tenant goes in the middle of index names, so it's a bit stricter than the
+// prefix.
+var tenantRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SetTenant namespaces everything we store, so that one installation can
+// index several corpora, like public GitHub and an internal GitHub
+// Enterprise, without them ever mixing. The tenant goes in every index name
+// after the prefix, so with a tenant of "ghe" the repository index is
+// "metagodoc-ghe-repository", and in the tenant field of every document we
+// write. The default is no tenant, which leaves the index names alone. Like
+// SetIndexPrefix, this must be called before anything uses an index.
+func SetTenant(t string) error {
+	if t != "" && !tenantRE.MatchString(t) {
+		return fmt.Errorf("Invalid tenant %q, it must be lowercase letters, numbers, \"_\", and \"-\"", t)
+	}
+	tenant = t
+	return nil
+}
+
+// Tenant returns the tenant set by SetTenant.
+func Tenant() string {
+	return tenant
+}
+
+// The schema version is stored as a single document in its own index.
+const (
+	schemaType = "schema"
+	schemaID   = "version"
+)
+
+// Index returns the full name of one of our indices, which is the index
+// alias for mappings.
+func Index(name string) string {
+	if tenant != "" {
+		return indexPrefix + tenant + "-" + name
+	}
+	return indexPrefix + name
+}
+
+// IndexName returns the name of the index alias for a mapping.
+func IndexName(m *Mapping) string {
+	return Index(m.Name)
+}
+
+type NewIndexManagerParams struct {
+	Logger  *logger.Logger
+	Elastic *elc.Client
+	Context context.Context
+}
+
+// An IndexManager creates our indices with explicit mappings and keeps them
+// up to date by applying migrations.
+type IndexManager struct {
+	l          *logger.Logger
+	elastic    *elc.Client
+	ctx        context.Context
+	migrations []*Migration
+}
+
+func NewIndexManager(p NewIndexManagerParams) *IndexManager {
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return &IndexManager{
+		l:          p.Logger,
+		elastic:    p.Elastic,
+		ctx:        ctx,
+		migrations: migrations,
+	}
+}
+
+type schemaVersion struct {
+	Version int    `json:"version"`
+	Updated string `json:"updated"`
+}
+
+// Migrate creates any indices which don't exist and then applies every
+// migration newer than the stored schema version, in order. Indices created
+// here already have the latest mappings, so if there were no indices at all
+// the migrations are skipped.
+func (m *IndexManager) Migrate() error {
+	created, err := m.create()
+	if err != nil {
+		return err
+	}
+
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	latest := m.latest()
+	if created == len(Mappings()) {
+		m.l.Infof("Created all indices at schema version %d", latest)
+		return m.setVersion(latest)
+	}
+
+	for _, mig := range m.migrations {
+		if mig.Version <= current {
+			continue
+		}
+
+		m.l.Infof("Applying schema migration %d: %s", mig.Version, mig.Description)
+		err := mig.Apply(m)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Migration %d failed: {{err}}", mig.Version), err)
+		}
+
+		err = m.setVersion(mig.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Recreate deletes and recreates every index with the latest mappings. This
+// throws away all of the data, so it's only useful in development.
+func (m *IndexManager) Recreate() error {
+	for _, mapping := range Mappings() {
+		name, _, err := m.concreteIndex(IndexName(mapping))
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+
+		m.l.Infof("Deleting %s", name)
+		_, err = m.elastic.DeleteIndex(name).Do(m.ctx)
+		if err != nil {
+			return errwrap.Wrapf("DeleteIndex: {{err}}", err)
+		}
+	}
+
+	_, err := m.create()
+	if err != nil {
+		return err
+	}
+
+	return m.setVersion(m.latest())
+}
+
+// Version returns the current schema version. This is 0 if no migrations have
+// ever been applied.
+func (m *IndexManager) Version() (int, error) {
+	result, err := m.elastic.
+		Get().
+		Index(Index("schema")).
+		Type(m.elastic.Type(schemaType)).
+		Id(schemaID).
+		Do(m.ctx)
+	if elastic.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errwrap.Wrapf("Get: {{err}}", err)
+	}
+	if !result.Found {
+		return 0, nil
+	}
+
+	v := &schemaVersion{}
+	err = json.Unmarshal(*result.Source, v)
+	if err != nil {
+		return 0, errwrap.Wrapf("Unmarshal: {{err}}", err)
+	}
+
+	return v.Version, nil
+}
+
+func (m *IndexManager) setVersion(v int) error {
+	_, err := m.elastic.
+		Index().
+		Index(Index("schema")).
+		Type(m.elastic.Type(schemaType)).
+		Id(schemaID).
+		BodyJson(&schemaVersion{
+			Version: v,
+			Updated: FormatTime(time.Now()),
+		}).
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Could not store schema version: {{err}}", err)
+	}
+	return nil
+}
+
+func (m *IndexManager) latest() int {
+	latest := 0
+	for _, mig := range m.migrations {
+		if mig.Version > latest {
+			latest = mig.Version
+		}
+	}
+	return latest
+}
+
+// create creates every index which doesn't exist yet, returning the number
+// it created.
+func (m *IndexManager) create() (int, error) {
+	created := 0
+	for _, mapping := range Mappings() {
+		alias := IndexName(mapping)
+		exists, err := m.elastic.IndexExists(alias).Do(m.ctx)
+		if err != nil {
+			return created, errwrap.Wrapf("IndexExists: {{err}}", err)
+		}
+		if exists {
+			continue
+		}
+
+		name := versionedName(alias, 1)
+		m.l.Infof("Creating %s as %s", alias, name)
+		err = m.createIndex(name, mapping, alias)
+		if err != nil {
+			return created, err
+		}
+		created++
+	}
+
+	return created, nil
+}
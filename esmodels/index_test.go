@@ -0,0 +1,39 @@
+package esmodels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetIndexPrefix(t *testing.T) {
+	defer SetIndexPrefix(DefaultIndexPrefix)
+
+	assert.Equal(t, "metagodoc-repository", Index("repository"))
+
+	must(t, SetIndexPrefix("metagodoc-staging-"))
+	assert.Equal(t, "metagodoc-staging-repository", Index("repository"))
+	assert.Equal(t, "metagodoc-staging-tombstone", IndexName(mappingNamed("tombstone")))
+
+	assert.Error(t, SetIndexPrefix("Metagodoc-"), "uppercase")
+	assert.Error(t, SetIndexPrefix("_metagodoc"), "leading underscore")
+	assert.Error(t, SetIndexPrefix("meta godoc"), "space")
+	assert.Equal(t, "metagodoc-staging-repository", Index("repository"), "invalid prefixes are not set")
+}
+
+func TestSetTenant(t *testing.T) {
+	defer SetTenant("")
+
+	must(t, SetTenant("ghe"))
+	assert.Equal(t, "ghe", Tenant())
+	assert.Equal(t, "metagodoc-ghe-repository", Index("repository"))
+	assert.Equal(t, "metagodoc-ghe-package", IndexName(mappingNamed("package")))
+
+	assert.Error(t, SetTenant("GHE"), "uppercase")
+	assert.Error(t, SetTenant("-ghe"), "leading dash")
+	assert.Error(t, SetTenant("g.he"), "dot")
+	assert.Equal(t, "ghe", Tenant(), "invalid tenants are not set")
+
+	must(t, SetTenant(""))
+	assert.Equal(t, "metagodoc-repository", Index("repository"))
+}
@@ -5,25 +5,131 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/azer/snakecase"
 )
 
 const DateTimeFormat = "2006-01-02T15:04:05"
 
+// ESDateFormat is DateTimeFormat in Elasticsearch's date format syntax. Every
+// date field is mapped with this format so that Elasticsearch never has to
+// guess.
+const ESDateFormat = "yyyy-MM-dd'T'HH:mm:ss"
+
+// FormatTime formats a time for a date field. DateTimeFormat has no zone, so
+// a time that isn't in UTC ends up stored as the wrong instant. Every date we
+// store should go through this rather than being formatted directly.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(DateTimeFormat)
+}
+
 type Mapping struct {
 	Name       string
 	Properties Properties
 }
 
 type Field struct {
-	ESType     string     `json:"type"`
-	Analyzer   string     `json:"analyzer,omitempty"`
-	Properties Properties `json:"properties,omitempty"`
+	ESType         string     `json:"type"`
+	Analyzer       string     `json:"analyzer,omitempty"`
+	SearchAnalyzer string     `json:"search_analyzer,omitempty"`
+	Format         string     `json:"format,omitempty"`
+	Properties     Properties `json:"properties,omitempty"`
+	Fields         Properties `json:"fields,omitempty"`
 }
 
 type Properties map[string]Field
 
+// Fields tagged with esAutocomplete:"true" get an "autocomplete" subfield,
+// so "name.autocomplete" matches "met" to "metagodoc". The subfield is
+// indexed with every prefix of every word but searched with the standard
+// analyzer, otherwise the query would be split into prefixes too.
+var autocompleteField = Field{
+	ESType:         "text",
+	Analyzer:       "autocomplete",
+	SearchAnalyzer: "standard",
+}
+
+// Fields tagged with esImportPath:"true" get two more subfields. The "path"
+// subfield is indexed with every leading part of the path, so
+// "github.com/stretchr" matches "github.com/stretchr/testify/assert". The
+// "parts" subfield is split on "/" and ".", so "testify" matches it too. Both
+// are lowercased, since hosts and most Go import paths are case insensitive
+// in practice.
+var importPathFields = Properties{
+	"path": Field{
+		ESType:         "text",
+		Analyzer:       "import_path",
+		SearchAnalyzer: "import_path_search",
+	},
+	"parts": Field{
+		ESType:   "text",
+		Analyzer: "import_path_parts",
+	},
+}
+
+// IndexSettings returns the settings every index is created with, which
+// define the analyzers our mappings use.
+func IndexSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"autocomplete_filter": map[string]interface{}{
+					"type":     "edge_ngram",
+					"min_gram": 1,
+					"max_gram": 20,
+				},
+			},
+			"analyzer": map[string]interface{}{
+				"autocomplete": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "autocomplete_filter"},
+				},
+				"import_path": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "import_path_hierarchy",
+					"filter":    []string{"lowercase"},
+				},
+				// The query is matched as a whole, otherwise "github.com/foo"
+				// would be split up and match everything on github.com.
+				"import_path_search": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "keyword",
+					"filter":    []string{"lowercase"},
+				},
+				"import_path_parts": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "import_path_parts",
+					"filter":    []string{"lowercase"},
+				},
+			},
+			"tokenizer": map[string]interface{}{
+				"import_path_hierarchy": map[string]interface{}{
+					"type":      "path_hierarchy",
+					"delimiter": "/",
+				},
+				"import_path_parts": map[string]interface{}{
+					"type":    "pattern",
+					"pattern": "[/.]",
+				},
+			},
+		},
+	}
+}
+
+// Mappings returns the mapping for every type we store in its own index.
+func Mappings() []*Mapping {
+	return []*Mapping{
+		MappingForType(Repository{}),
+		MappingForType(Author{}),
+		MappingForType(Tombstone{}),
+		MappingForType(Package{}),
+		MappingForType(Symbol{}),
+		MappingForType(CrawlReport{}),
+	}
+}
+
 func MappingForType(v interface{}) *Mapping {
 	t := reflect.TypeOf(v)
 	return &Mapping{
@@ -41,11 +147,28 @@ func propertiesForType(t reflect.Type) Properties {
 	props := Properties{}
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
-		props[snakecase.SnakeCase(f.Name)] = esField(t, f)
+		name := propertyName(f)
+		if name == "" {
+			continue
+		}
+		props[name] = esField(t, f)
 	}
 	return props
 }
 
+// The property name has to match the name the field has when it's encoded as
+// JSON, so we use the json tag if there is one.
+func propertyName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if n := strings.Split(tag, ",")[0]; n != "" {
+		return n
+	}
+	return snakecase.SnakeCase(f.Name)
+}
+
 func esField(t reflect.Type, f reflect.StructField) Field {
 	field := maybeNested(t, f)
 	if field.ESType != "" {
@@ -57,16 +180,40 @@ func esField(t reflect.Type, f reflect.StructField) Field {
 		log.Panicf("Type %s has a field with no esType tag: %s (%s)", t.Name(), f.Name, f.Type.Kind())
 	}
 	field.ESType = esType
+	if esType == "date" {
+		field.Format = ESDateFormat
+	}
 
 	analyzer := f.Tag.Get("esAnalyzer")
 	if analyzer != "" {
 		field.Analyzer = analyzer
 	}
 
+	if f.Tag.Get("esAutocomplete") == "true" {
+		field.addFields(Properties{"autocomplete": autocompleteField})
+	}
+	if f.Tag.Get("esImportPath") == "true" {
+		field.addFields(importPathFields)
+	}
+
 	return field
 }
 
+func (f *Field) addFields(props Properties) {
+	if f.Fields == nil {
+		f.Fields = Properties{}
+	}
+	for name, field := range props {
+		f.Fields[name] = field
+	}
+}
+
 func maybeNested(t reflect.Type, f reflect.StructField) Field {
+	// Some structs, like Suggest, map to a single Elasticsearch type.
+	if f.Tag.Get("esType") != "" {
+		return Field{}
+	}
+
 	var esType string
 	var elem reflect.Type
 	if f.Type.Kind() == reflect.Slice {
@@ -2,99 +2,75 @@ package esmodels
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMappings(t *testing.T) {
 	mappings := Mappings()
+	if !assert.Len(t, mappings, 6) {
+		return
+	}
 
-	repository := &Mapping{
-		"repository",
-		Properties{
-			"name":      Field{ESType: "keyword"},
-			"full_name": Field{ESType: "keyword"},
-			"description": Field{
-				ESType:   "text",
-				Analyzer: "english",
-			},
-			"vcs":         Field{ESType: "keyword"},
-			"primary_url": Field{ESType: "keyword"},
-			"issues": Field{
-				ESType: "nested",
-				Properties: Properties{
-					"url":    Field{ESType: "keyword"},
-					"open":   Field{ESType: "long"},
-					"closed": Field{ESType: "long"},
-				},
-			},
-			"pull_requests": Field{
-				ESType: "nested",
-				Properties: Properties{
-					"url":    Field{ESType: "keyword"},
-					"open":   Field{ESType: "long"},
-					"closed": Field{ESType: "long"},
-				},
-			},
-			"owner":        Field{ESType: "keyword"},
-			"created":      Field{ESType: "date"},
-			"last_updated": Field{ESType: "date"},
-			"last_crawled": Field{ESType: "date"},
-			"stars":        Field{ESType: "long"},
-			"forks":        Field{ESType: "long"},
-			"is_fork":      Field{ESType: "boolean"},
-			"status":       Field{ESType: "keyword"},
-			"about": Field{
-				ESType: "nested",
-				Properties: Properties{
-					"content": Field{
-						ESType:   "text",
-						Analyzer: "english",
-					},
-					"content_type": Field{ESType: "keyword"}},
-			},
-			"refs": Field{
-				ESType: "nested",
-				Properties: Properties{
-					"name":              Field{ESType: "keyword"},
-					"is_default_branch": Field{ESType: "boolean"},
-					"ref_type":          Field{ESType: "keyword"},
-					"last_seen_commit":  Field{ESType: "keyword"},
-					"last_updated":      Field{ESType: "date"},
-					"packages": Field{
-						ESType: "nested",
-						Properties: Properties{
-							"name":        Field{ESType: "keyword"},
-							"import_path": Field{ESType: "keyword"},
-							"synopsis": Field{
-								ESType:   "text",
-								Analyzer: "english",
-							},
-							"errors":         Field{ESType: "keyword"},
-							"is_command":     Field{ESType: "boolean"},
-							"files":          Field{ESType: "keyword"},
-							"test_files":     Field{ESType: "keyword"},
-							"x_test_files":   Field{ESType: "keyword"},
-							"imports":        Field{ESType: "keyword"},
-							"test_imports":   Field{ESType: "keyword"},
-							"x_test_imports": Field{ESType: "keyword"},
-						},
-					},
-				},
+	repository := mappings[0]
+	assert.Equal(t, "repository", repository.Name)
+
+	props := repository.Properties
+	assert.Equal(
+		t,
+		Field{ESType: "keyword", Fields: Properties{"autocomplete": autocompleteField}},
+		props["name"],
+		"keyword field with autocomplete",
+	)
+	assert.Equal(t, Field{ESType: "completion"}, props["suggest"], "struct with an esType")
+	assert.Equal(t, Field{ESType: "text", Analyzer: "english"}, props["description"], "text field")
+	assert.Equal(t, Field{ESType: "date", Format: ESDateFormat}, props["last_crawled"], "date field")
+	assert.Equal(
+		t,
+		Field{
+			ESType: "object",
+			Properties: Properties{
+				"url":    Field{ESType: "keyword"},
+				"open":   Field{ESType: "long"},
+				"closed": Field{ESType: "long"},
 			},
 		},
-	}
-	assert.Equal(t, repository, mappings[0], "repository mapping is correct")
+		props["issues"],
+		"pointer to struct is an object",
+	)
 
-	author := &Mapping{
-		"author",
-		Properties{
-			"name":         Field{ESType: "keyword"},
-			"primary_url":  Field{ESType: "keyword"},
-			"created":      Field{ESType: "date"},
-			"last_updated": Field{ESType: "date"},
-			"repositories": Field{ESType: "keyword"},
-		},
-	}
-	assert.Equal(t, author, mappings[1], "author mapping is correct")
+	refs := props["refs"]
+	assert.Equal(t, "nested", refs.ESType, "slice of structs is nested")
+	assert.Equal(t, Field{ESType: "boolean"}, refs.Properties["is_head"], "property names come from json tags")
+	assert.Equal(t, Field{ESType: "date", Format: ESDateFormat}, refs.Properties["last_updated"])
+
+	assert.NotContains(t, refs.Properties, "packages", "fields with a json tag of - are skipped")
+
+	assert.Equal(t, "author", mappings[1].Name)
+	assert.Equal(t, Field{ESType: "date", Format: ESDateFormat}, mappings[1].Properties["created"])
+
+	assert.Equal(t, "tombstone", mappings[2].Name)
+	assert.Equal(t, Field{ESType: "keyword"}, mappings[2].Properties["kind"])
+	assert.Equal(t, Field{ESType: "keyword", Fields: importPathFields}, mappings[2].Properties["id"])
+
+	pkgs := mappings[3]
+	assert.Equal(t, "package", pkgs.Name)
+	assert.Equal(t, "autocomplete", pkgs.Properties["import_path"].Fields["autocomplete"].Analyzer)
+	assert.Equal(t, "import_path", pkgs.Properties["import_path"].Fields["path"].Analyzer)
+	assert.Equal(t, Field{ESType: "keyword", Fields: importPathFields}, pkgs.Properties["repository_id"])
+	assert.Equal(t, Field{ESType: "object"}, pkgs.Properties["notes"], "maps are objects")
+
+	assert.Equal(t, "symbol", mappings[4].Name)
+	assert.Equal(t, Field{ESType: "keyword", Fields: importPathFields}, mappings[4].Properties["import_path"])
+}
+
+func TestFormatTime(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	assert.Equal(
+		t,
+		"2018-06-01T17:30:00",
+		FormatTime(time.Date(2018, 6, 1, 12, 30, 0, 0, est)),
+		"times in other zones are converted to UTC",
+	)
 }
@@ -0,0 +1,590 @@
+package esmodels
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// A Migration changes the indices from one schema version to the next.
+// Elasticsearch lets us add fields to a mapping but not change the type of an
+// existing field, so most migrations just add the fields which were new in
+// their version. Anything more drastic needs its own Apply function, which
+// will probably involve a reindex.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(*IndexManager) error
+}
+
+// Migrations must be kept in version order. Never change or remove a
+// migration once it's been released, just add a new one.
+var migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "Add crawl metadata fields to repositories",
+		// Refs had their packages too, but the packages moved to their own
+		// index in migration 4, so they're left out.
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"is_head": {"type": "boolean"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     2,
+		Description: "Add the tombstone index",
+		Apply: addFields(map[string]string{
+			"tombstone": `{
+				"created": {"type": "date", "format": "yyyy-MM-dd'T'HH:mm:ss"},
+				"id": {"type": "keyword"},
+				"kind": {"type": "keyword"},
+				"reason": {"type": "text"}
+			}`,
+		}),
+	},
+	{
+		Version:     3,
+		Description: "Move every index behind an alias",
+		Apply:       moveBehindAliases,
+	},
+	{
+		Version:     4,
+		Description: "Move packages into their own index",
+		Apply:       removeRefs,
+	},
+	{
+		Version:     5,
+		Description: "Add the symbol index",
+		Apply:       (*IndexManager).RebuildSymbols,
+	},
+	{
+		Version:     6,
+		Description: "Add autocomplete and completion suggester fields",
+		// The autocomplete analyzer can only be added to a new index.
+		Apply: reindex("repository", "package"),
+	},
+	{
+		Version:     7,
+		Description: "Add the stale flag to repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{"stale": {"type": "boolean"}}`,
+		}),
+	},
+	{
+		Version:     8,
+		Description: "Add content hashes to repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{"content_hash": {"type": "keyword"}}`,
+		}),
+	},
+	{
+		Version:     9,
+		Description: "Add fields for truncated About content",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"about": {"type": "object", "properties": {
+					"compressed": {"type": "binary"},
+					"original_bytes": {"type": "long"},
+					"truncated": {"type": "boolean"},
+					"url": {"type": "keyword"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     10,
+		Description: "Add import path subfields",
+		// Like autocomplete, the import path analyzers can only be added to
+		// a new index.
+		Apply: reindex("repository", "author", "tombstone", "package", "symbol"),
+	},
+	{
+		Version:     11,
+		Description: "Add ignored files and embed patterns to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"embed_patterns": {"type": "keyword"},
+				"ignored_files": {"type": "nested", "properties": {
+					"name": {"type": "keyword"},
+					"url": {"type": "keyword"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     12,
+		Description: "Store package errors as objects with a category and position",
+		Apply:       structurePackageErrors,
+	},
+	{
+		Version:     13,
+		Description: "Add the removed date to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"removed": {"type": "date", "format": "yyyy-MM-dd'T'HH:mm:ss"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     14,
+		Description: "Add counts of generated and hand-written files to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"files": {"type": "nested", "properties": {
+					"generated": {"type": "boolean"}
+				}},
+				"generated_files": {"type": "integer"},
+				"hand_written_files": {"type": "integer"},
+				"ignored_files": {"type": "nested", "properties": {
+					"generated": {"type": "boolean"}
+				}},
+				"test_files": {"type": "nested", "properties": {
+					"generated": {"type": "boolean"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     15,
+		Description: "Add the internal and vendored flags to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"is_internal": {"type": "boolean"},
+				"is_vendored": {"type": "boolean"}
+			}`,
+		}),
+	},
+	{
+		Version:     16,
+		Description: "Add the canonical import path to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"canonical_import_path": {"type": "keyword", "fields": {
+					"parts": {"type": "text", "analyzer": "import_path_parts"},
+					"path": {"type": "text", "analyzer": "import_path", "search_analyzer": "import_path_search"}
+				}},
+				"import_path_mismatch": {"type": "boolean"}
+			}`,
+		}),
+	},
+	{
+		Version:     17,
+		Description: "Add the standard library flag to packages",
+		Apply: addFields(map[string]string{
+			"package": `{"is_stdlib": {"type": "boolean"}}`,
+		}),
+	},
+	{
+		Version:     18,
+		Description: "Add warnings to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"warnings": {"type": "nested", "properties": {
+						"kind": {"type": "keyword"},
+						"message": {"type": "text"},
+						"paths": {"type": "keyword"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     19,
+		Description: "Add the tenant to every document the indexer writes",
+		Apply: addFields(map[string]string{
+			"repository": `{"tenant": {"type": "keyword"}}`,
+			"tombstone":  `{"tenant": {"type": "keyword"}}`,
+			"package":    `{"tenant": {"type": "keyword"}}`,
+			"symbol":     `{"tenant": {"type": "keyword"}}`,
+		}),
+	},
+	{
+		Version:     20,
+		Description: "Add the crawl report index",
+		Apply: addFields(map[string]string{
+			"crawl_report": `{
+				"attempted": {"type": "long"},
+				"clone_bytes": {"type": "long"},
+				"documents_written": {"type": "long"},
+				"failed": {"type": "long"},
+				"failure_categories": {"type": "object"},
+				"failures": {"type": "nested", "properties": {
+					"category": {"type": "keyword"},
+					"error": {"type": "text"},
+					"id": {"type": "keyword", "fields": {
+						"parts": {"type": "text", "analyzer": "import_path_parts"},
+						"path": {"type": "text", "analyzer": "import_path", "search_analyzer": "import_path_search"}
+					}}
+				}},
+				"finished": {"type": "date", "format": "yyyy-MM-dd'T'HH:mm:ss"},
+				"github_quota_remaining": {"type": "long"},
+				"github_requests": {"type": "long"},
+				"skipped": {"type": "long"},
+				"started": {"type": "date", "format": "yyyy-MM-dd'T'HH:mm:ss"},
+				"stop_reason": {"type": "keyword"},
+				"succeeded": {"type": "long"},
+				"tenant": {"type": "keyword"}
+			}`,
+		}),
+	},
+	{
+		Version:     21,
+		Description: "Add importer counts to packages and repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"imported_by": {"type": "long"},
+				"importers_counted": {"type": "boolean"},
+				"top_importers": {"type": "keyword"}
+			}`,
+			"package": `{
+				"imported_by": {"type": "long"},
+				"top_importers": {"type": "keyword"}
+			}`,
+		}),
+	},
+	{
+		Version:     22,
+		Description: "Add known vulnerabilities to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"vulnerabilities": {"type": "nested", "properties": {
+						"aliases": {"type": "keyword"},
+						"fixed": {"type": "keyword"},
+						"id": {"type": "keyword"},
+						"module": {"type": "keyword"},
+						"severity": {"type": "keyword"},
+						"summary": {"type": "text"},
+						"version": {"type": "keyword"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     23,
+		Description: "Add code stats to packages and refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"stats": {"type": "object", "properties": {
+						"comment_lines": {"type": "integer"},
+						"go_files": {"type": "integer"},
+						"lines": {"type": "integer"},
+						"test_comment_lines": {"type": "integer"},
+						"test_files": {"type": "integer"},
+						"test_lines": {"type": "integer"}
+					}}
+				}}
+			}`,
+			"package": `{
+				"stats": {"type": "object", "properties": {
+					"comment_lines": {"type": "integer"},
+					"go_files": {"type": "integer"},
+					"lines": {"type": "integer"},
+					"test_comment_lines": {"type": "integer"},
+					"test_files": {"type": "integer"},
+					"test_lines": {"type": "integer"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     24,
+		Description: "Add complexity metrics to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"complexity": {"type": "object", "properties": {
+					"average_complexity": {"type": "float"},
+					"functions": {"type": "integer"},
+					"longest": {"type": "keyword"},
+					"longest_function": {"type": "integer"},
+					"max_complexity": {"type": "integer"},
+					"most_complex": {"type": "keyword"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     25,
+		Description: "Add test signals to packages, refs, and repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"testing": {"type": "object", "properties": {
+						"helpers": {"type": "boolean"},
+						"table_tests": {"type": "boolean"},
+						"test_ratio": {"type": "float"},
+						"tested_packages": {"type": "float"}
+					}}
+				}},
+				"testing": {"type": "object", "properties": {
+					"helpers": {"type": "boolean"},
+					"table_tests": {"type": "boolean"},
+					"test_ratio": {"type": "float"},
+					"tested_packages": {"type": "float"}
+				}}
+			}`,
+			"package": `{
+				"testing": {"type": "object", "properties": {
+					"helpers": {"type": "boolean"},
+					"table_tests": {"type": "boolean"},
+					"test_ratio": {"type": "float"},
+					"tested_packages": {"type": "float"}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     26,
+		Description: "Add supported platforms to packages",
+		Apply: addFields(map[string]string{
+			"package": `{"platforms": {"type": "keyword"}}`,
+		}),
+	},
+	{
+		Version:     27,
+		Description: "Add API diffs to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"api_diff": {"type": "object", "properties": {
+						"added": {"type": "keyword"},
+						"breaking": {"type": "boolean"},
+						"changed": {"type": "keyword"},
+						"incompatible": {"type": "boolean"},
+						"previous": {"type": "keyword"},
+						"removed": {"type": "keyword"},
+						"truncated": {"type": "boolean"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     28,
+		Description: "Add the latest versions to repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"latest_stable_version": {"type": "keyword"},
+				"latest_version": {"type": "keyword"}
+			}`,
+		}),
+	},
+	{
+		Version:     29,
+		Description: "Add gofmt and vet findings to packages",
+		Apply: addFields(map[string]string{
+			"package": `{
+				"quality": {"type": "object", "properties": {
+					"compliance": {"type": "float"},
+					"files": {"type": "integer"},
+					"unformatted": {"type": "integer"},
+					"vet": {"type": "object", "properties": {
+						"assign": {"type": "integer"},
+						"atomic": {"type": "integer"},
+						"bools": {"type": "integer"},
+						"printf": {"type": "integer"},
+						"struct_tag": {"type": "integer"},
+						"total": {"type": "integer"},
+						"unreachable": {"type": "integer"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     30,
+		Description: "Add dependency counts to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"dependencies": {"type": "object", "properties": {
+						"direct": {"type": "integer"},
+						"max_depth": {"type": "integer"},
+						"total": {"type": "integer"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     31,
+		Description: "Add binary artifacts to repositories",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"binary_artifacts": {"type": "keyword"},
+				"has_binary_artifacts": {"type": "boolean"}
+			}`,
+		}),
+	},
+	{
+		Version:     32,
+		Description: "Include the repository in package and symbol IDs",
+		Apply:       prefixPackageIDs,
+	},
+	{
+		Version:     33,
+		Description: "Add the import path root to refs",
+		Apply: addFields(map[string]string{
+			"repository": `{
+				"refs": {"type": "nested", "properties": {
+					"import_path_root": {"type": "keyword", "fields": {
+						"parts": {"type": "text", "analyzer": "import_path_parts"},
+						"path": {"type": "text", "analyzer": "import_path", "search_analyzer": "import_path_search"}
+					}}
+				}}
+			}`,
+		}),
+	},
+	{
+		Version:     34,
+		Description: "Rebuild every index with the current mappings and analyzers",
+		// Indices which went through the earlier migrations have whatever
+		// settings they were created with and the fields each migration
+		// added, which isn't quite what a new index gets.
+		Apply: reindex("repository", "author", "tombstone", "package", "symbol", "crawl_report"),
+	},
+}
+
+// addFields returns a migration which adds fields to the mapping for each
+// named type. The fields are JSON properties, written out as they were in
+// the migration's version. Putting the current mapping instead would break
+// on an index from an older version, which may not have the analyzers or
+// date formats the current mapping uses.
+func addFields(fields map[string]string) func(*IndexManager) error {
+	mappings := []*Mapping{}
+	for name, j := range fields {
+		if mappingNamed(name) == nil {
+			log.Panicf("There is no mapping named %s", name)
+		}
+
+		props := Properties{}
+		err := json.Unmarshal([]byte(j), &props)
+		if err != nil {
+			log.Panicf("json.Unmarshal for %s fields: %s", name, err)
+		}
+		mappings = append(mappings, &Mapping{Name: name, Properties: props})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Name < mappings[j].Name })
+
+	return func(m *IndexManager) error {
+		for _, mapping := range mappings {
+			err := m.putMapping(mapping)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("Could not put mapping for %s: {{err}}", mapping.Name), err)
+			}
+		}
+		return nil
+	}
+}
+
+// reindex returns a migration which reindexes each named index.
+func reindex(names ...string) func(*IndexManager) error {
+	return func(m *IndexManager) error {
+		for _, n := range names {
+			err := m.Reindex(n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Package errors used to be plain strings, which can't go in a nested field.
+// We don't know what kind of errors they were, so they only get a message.
+func structurePackageErrors(m *IndexManager) error {
+	script := elastic.NewScript(`
+if (ctx._source.errors != null) {
+	def errs = [];
+	for (e in ctx._source.errors) {
+		errs.add(e instanceof String ? ['message': e] : e);
+	}
+	ctx._source.errors = errs;
+}`)
+	return m.reindexWithScript("package", script)
+}
+
+// Package IDs didn't always include the repository, so forks overwrote each
+// other's packages. Symbol IDs start with their package's ID, so they get the
+// same prefix. See PackageID.
+func prefixPackageIDs(m *IndexManager) error {
+	script := elastic.NewScript(`ctx._id = ctx._source.repository_id + ':' + ctx._id`)
+	for _, name := range []string{"package", "symbol"} {
+		err := m.reindexWithScript(name, script)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Indices created before we used aliases are reindexed into versioned
+// indices.
+func moveBehindAliases(m *IndexManager) error {
+	for _, mapping := range Mappings() {
+		_, isAlias, err := m.concreteIndex(IndexName(mapping))
+		if err != nil {
+			return err
+		}
+		if isAlias {
+			continue
+		}
+
+		err = m.Reindex(mapping.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The client library always puts a mapping for a type, which servers without
+// types don't support, so we make the request ourselves for those.
+func (m *IndexManager) putMapping(mapping *Mapping) error {
+	if !m.elastic.Server.IsTypeless() {
+		_, err := m.elastic.
+			PutMapping().
+			Index(IndexName(mapping)).
+			Type(mapping.Name).
+			BodyString(mapping.ToJSON()).
+			Do(m.ctx)
+		return err
+	}
+
+	_, err := m.elastic.PerformRequest(m.ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + url.PathEscape(IndexName(mapping)) + "/_mapping",
+		Body:   map[string]Properties{"properties": mapping.Properties},
+	})
+	return err
+}
+
+// The package index is created empty, so the refs are removed from every
+// repository. Otherwise the indexer would see that the refs are unchanged the
+// next time it crawls a repository and never write its packages. Each
+// repository gets its refs back, and its packages, on its next crawl.
+func removeRefs(m *IndexManager) error {
+	_, err := m.elastic.
+		UpdateByQuery(IndexName(mappingNamed("repository"))).
+		Type(m.elastic.SearchTypes("repository")...).
+		Query(elastic.NewExistsQuery("refs")).
+		Script(elastic.NewScript("ctx._source.remove('refs')")).
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Could not remove refs from repositories: {{err}}", err)
+	}
+	return nil
+}
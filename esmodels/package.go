@@ -0,0 +1,205 @@
+package esmodels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/autarch/metagodoc/elc"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// PackageID returns the ID of a package's document. The same import path can
+// appear in many refs of a repository, and in every fork of it which hasn't
+// changed its module path, so the ID includes the repository and the ref.
+// Otherwise crawling a fork would replace the original's packages, and
+// deleting the fork would delete them. Import paths can't contain a colon, so
+// the ID can't be mistaken for another repository's.
+func PackageID(repositoryID, importPath, ref string) string {
+	return repositoryID + ":" + importPath + "@" + ref
+}
+
+// WritePackages writes the packages in r's refs to the package index, and
+// their symbols to the symbol index. Refs which are at the same commit as in
+// prev are skipped, since their packages are already there. For every other
+// ref, and for refs which are no longer in the repository at all, the old
+// packages are deleted first so that packages which were removed upstream
+// don't linger. The client may be nil when writing to an export, in which
+// case nothing is deleted.
+//
+// Every package and symbol is validated before anything is deleted or
+// written, so a repository with an invalid document is left as it was, and
+// the ValidationError is returned.
+//
+// Importer counts aren't known when a repository is crawled, so each package
+// which is written gets them from the package with the same import path
+// which is already in the index, if there is one. See CarryImporters.
+func WritePackages(ctx context.Context, client *elc.Client, w DocumentWriter, id string, prev, r *Repository) error {
+	prevCommits := make(map[string]string)
+	if prev != nil {
+		for _, ref := range prev.Refs {
+			if ref.Removed == "" {
+				prevCommits[ref.Name] = ref.LastSeenCommit
+			}
+		}
+	}
+
+	index := IndexName(mappingNamed("package"))
+	var changed []*Ref
+	replaced := make(map[string]bool)
+	for _, ref := range r.Refs {
+		// A removed ref's packages are deleted below along with those of
+		// refs which have disappeared entirely.
+		if ref.Removed != "" {
+			continue
+		}
+
+		c, ok := prevCommits[ref.Name]
+		delete(prevCommits, ref.Name)
+		if ok && c != "" && c == ref.LastSeenCommit {
+			continue
+		}
+		changed = append(changed, ref)
+		replaced[ref.Name] = ok
+
+		for _, p := range ref.Packages {
+			p.RepositoryID = id
+			p.Ref = ref.Name
+			p.Suggest = newSuggest(r.Stars, p.Name, p.ImportPath)
+			p.Tenant = tenant
+			err := validatePackage(index, PackageID(id, p.ImportPath, ref.Name), p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		err := carryPackageImporters(ctx, client, id, changed)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ref := range changed {
+		if replaced[ref.Name] {
+			err := deletePackages(ctx, client, id, ref.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, p := range ref.Packages {
+			w.Index(index, "package", PackageID(id, p.ImportPath, ref.Name), p)
+			writeSymbols(w, p)
+		}
+	}
+
+	// Anything left is a ref which has been deleted.
+	for name := range prevCommits {
+		err := deletePackages(ctx, client, id, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// carryPackageImporters copies the importer counts of the repository's
+// packages which are in the index to the packages with the same import path
+// in refs. The counts only depend on the import path, so it doesn't matter
+// which ref they come from.
+func carryPackageImporters(ctx context.Context, client *elc.Client, id string, refs []*Ref) error {
+	if client == nil {
+		return nil
+	}
+
+	scroll := client.
+		Scroll(IndexName(mappingNamed("package"))).
+		Type(client.SearchTypes("package")...).
+		Query(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("repository_id", id))).
+		FetchSourceContext(
+			elastic.NewFetchSourceContext(true).Include("import_path", "imported_by", "top_importers"),
+		).
+		Size(500)
+
+	prev := make(map[string]*Package)
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Could not read the packages for %s: {{err}}", id), err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			p := &Package{}
+			err := json.Unmarshal(*hit.Source, p)
+			if err != nil {
+				return errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+			if _, ok := prev[p.ImportPath]; !ok {
+				prev[p.ImportPath] = p
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		for _, p := range ref.Packages {
+			if old, ok := prev[p.ImportPath]; ok {
+				p.ImportedBy = old.ImportedBy
+				p.TopImporters = old.TopImporters
+			}
+		}
+	}
+
+	return nil
+}
+
+// deletePackages deletes the packages and symbols in one ref of a repository,
+// or all of them if ref is empty.
+func deletePackages(ctx context.Context, client *elc.Client, id, ref string) error {
+	if client == nil {
+		return nil
+	}
+
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("repository_id", id))
+	if ref != "" {
+		q = q.Filter(elastic.NewTermQuery("ref", ref))
+	}
+
+	_, err := client.
+		DeleteByQuery(IndexName(mappingNamed("package")), IndexName(mappingNamed("symbol"))).
+		Type(append(client.SearchTypes("package"), client.SearchTypes("symbol")...)...).
+		Query(q).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not delete packages for %s: {{err}}", id), err)
+	}
+
+	return nil
+}
+
+// validatePackage validates a package document along with the symbol
+// documents which come from it.
+func validatePackage(index, id string, p *Package) error {
+	err := Validate(index, id, p)
+	if err != nil {
+		return err
+	}
+
+	symbols := IndexName(mappingNamed("symbol"))
+	for _, s := range p.Symbols() {
+		err = Validate(symbols, s.ID(), s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package esmodels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/autarch/metagodoc/elc"
+
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingWriter struct {
+	indexed []string
+	deleted []string
+}
+
+func (w *recordingWriter) Index(index, typ, id string, doc interface{}) {
+	w.indexed = append(w.indexed, index+"/"+id)
+}
+func (w *recordingWriter) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	w.Index(index, typ, id, doc)
+}
+func (w *recordingWriter) Update(index, typ, id string, doc interface{})                  {}
+func (w *recordingWriter) UpdateWithScript(index, typ, id string, script *elastic.Script) {}
+func (w *recordingWriter) Delete(index, typ, id string) {
+	w.deleted = append(w.deleted, index+"/"+id)
+}
+func (w *recordingWriter) Batch() DocumentWriter { return w }
+func (w *recordingWriter) Flush() error          { return nil }
+func (w *recordingWriter) Close() error          { return nil }
+func (w *recordingWriter) Err() error            { return nil }
+
+func TestWritePackages(t *testing.T) {
+	prev := &Repository{Refs: []*Ref{
+		{Name: "master", LastSeenCommit: "abc"},
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+	}}
+	r := &Repository{Refs: []*Ref{
+		{
+			Name:           "master",
+			LastSeenCommit: "123",
+			Packages:       []*Package{{ImportPath: "github.com/foo/bar"}, {ImportPath: "github.com/foo/bar/baz"}},
+		},
+		{
+			Name:           "v1.0.0",
+			LastSeenCommit: "def",
+			Packages:       []*Package{{ImportPath: "github.com/foo/bar"}},
+		},
+	}}
+
+	w := &recordingWriter{}
+	must(t, WritePackages(context.Background(), nil, w, "github.com/foo/bar", prev, r))
+	assert.Equal(
+		t,
+		[]string{
+			"metagodoc-package/github.com/foo/bar:github.com/foo/bar@master",
+			"metagodoc-package/github.com/foo/bar:github.com/foo/bar/baz@master",
+		},
+		w.indexed,
+		"only packages in changed refs are written",
+	)
+	assert.Equal(t, "github.com/foo/bar", r.Refs[0].Packages[1].RepositoryID)
+	assert.Equal(t, "master", r.Refs[0].Packages[1].Ref)
+
+	w = &recordingWriter{}
+	must(t, WritePackages(context.Background(), nil, w, "github.com/foo/bar", nil, r))
+	assert.Len(t, w.indexed, 3, "everything is written for a new repository")
+
+	w = &recordingWriter{}
+	must(t, WritePackages(context.Background(), nil, w, "github.com/fork/bar", nil, r))
+	assert.Contains(t, w.indexed, "metagodoc-package/github.com/fork/bar:github.com/foo/bar@master", "a fork's packages don't replace the original's")
+
+	r.Refs[1].Removed = "2020-01-02T03:04:05"
+	w = &recordingWriter{}
+	must(t, WritePackages(context.Background(), nil, w, "github.com/foo/bar", nil, r))
+	assert.Len(t, w.indexed, 2, "nothing is written for a removed ref")
+}
+
+// fakePackageServer has one package from an earlier crawl, and accepts any
+// delete by query.
+func fakePackageServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_search/scroll"):
+			fmt.Fprint(w, `{"_scroll_id": "1", "hits": {"total": 1, "hits": []}}`)
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			fmt.Fprint(w, `{"_scroll_id": "1", "hits": {"total": 1, "hits": [
+				{"_id": "x", "_source": {"import_path": "github.com/foo/bar", "imported_by": 42, "top_importers": ["github.com/baz/quux"]}}
+			]}}`)
+		case strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+			fmt.Fprint(w, `{"deleted": 1}`)
+		default:
+			fmt.Fprint(w, `{"version": {"number": "6.8.0"}}`)
+		}
+	}))
+}
+
+func TestWritePackagesCarriesImporters(t *testing.T) {
+	server := fakePackageServer()
+	defer server.Close()
+	client, err := elc.NewClient(elc.NewParams{URLs: []string{server.URL}, DisableSniffing: true})
+	must(t, err)
+
+	prev := &Repository{Refs: []*Ref{{Name: "master", LastSeenCommit: "abc"}}}
+	r := &Repository{Refs: []*Ref{{
+		Name:           "master",
+		LastSeenCommit: "123",
+		Packages:       []*Package{{ImportPath: "github.com/foo/bar"}, {ImportPath: "github.com/foo/bar/new"}},
+	}}}
+
+	must(t, WritePackages(context.Background(), client, &recordingWriter{}, "github.com/foo/bar", prev, r))
+	assert.Equal(t, 42, r.Refs[0].Packages[0].ImportedBy, "the count is carried over")
+	assert.Equal(t, []string{"github.com/baz/quux"}, r.Refs[0].Packages[0].TopImporters)
+	assert.Equal(t, 0, r.Refs[0].Packages[1].ImportedBy, "a new package has no count yet")
+}
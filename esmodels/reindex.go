@@ -0,0 +1,234 @@
+package esmodels
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Each index is really an alias, like "metagodoc-repository", pointing at a
+// versioned index, like "metagodoc-repository-v3". Everything reads and writes
+// through the alias, so we can build a new index with a different mapping
+// and then swap the alias over without anyone noticing.
+func versionedName(alias string, v int) string {
+	return fmt.Sprintf("%s-v%d", alias, v)
+}
+
+var versionedNameRE = regexp.MustCompile(`-v([0-9]+)$`)
+
+func indexVersion(name string) int {
+	m := versionedNameRE.FindStringSubmatch(name)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(m[1])
+	return v
+}
+
+// concreteIndex returns the name of the index behind an alias. Indices created
+// before we used aliases are real indices with the alias name, in which case
+// this returns the alias name and false.
+func (m *IndexManager) concreteIndex(alias string) (string, bool, error) {
+	exists, err := m.elastic.IndexExists(alias).Do(m.ctx)
+	if err != nil {
+		return "", false, errwrap.Wrapf("IndexExists: {{err}}", err)
+	}
+	if !exists {
+		return "", false, nil
+	}
+
+	result, err := m.elastic.Aliases().Index(alias).Do(m.ctx)
+	if err != nil {
+		return "", false, errwrap.Wrapf("Aliases: {{err}}", err)
+	}
+
+	indices := result.IndicesByAlias(alias)
+	switch len(indices) {
+	case 0:
+		return alias, false, nil
+	case 1:
+		return indices[0], true, nil
+	default:
+		return "", false, fmt.Errorf("The %s alias points at more than one index: %v", alias, indices)
+	}
+}
+
+// Reindex copies the index for the named mapping into a new index with the
+// current mapping, checks that every document made it, and then points the
+// alias at the new index and deletes the old one.
+//
+// The old index is blocked for writes while it's copied, so that nothing
+// written during the copy is lost. A BulkWriter retries documents which are
+// blocked, so a running indexer just waits for the copy to finish and then
+// writes to the new index.
+func (m *IndexManager) Reindex(name string) error {
+	return m.reindexWithScript(name, nil)
+}
+
+// reindexWithScript is Reindex, except that each document is passed through
+// the script on its way to the new index, for when the old documents don't
+// fit the new mapping.
+func (m *IndexManager) reindexWithScript(name string, script *elastic.Script) error {
+	mapping := mappingNamed(name)
+	if mapping == nil {
+		return fmt.Errorf("There is no mapping named %s", name)
+	}
+
+	alias := IndexName(mapping)
+	old, isAlias, err := m.concreteIndex(alias)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		return fmt.Errorf("There is no %s index to reindex", alias)
+	}
+
+	next := versionedName(alias, indexVersion(old)+1)
+	m.l.Infof("Reindexing %s into %s", old, next)
+
+	err = m.createIndex(next, mapping, "")
+	if err != nil {
+		return err
+	}
+
+	err = m.setWriteBlock(old, true)
+	if err != nil {
+		m.deleteIndex(next)
+		return err
+	}
+
+	r := m.elastic.
+		Reindex().
+		SourceIndex(old).
+		DestinationIndex(next).
+		WaitForCompletion(true).
+		Refresh("true")
+	if script != nil {
+		r = r.Script(script)
+	}
+	_, err = r.Do(m.ctx)
+	if err != nil {
+		m.abandonReindex(old, next)
+		return errwrap.Wrapf(fmt.Sprintf("Could not reindex %s into %s: {{err}}", old, next), err)
+	}
+
+	err = m.verifyCounts(old, next)
+	if err != nil {
+		m.abandonReindex(old, next)
+		return err
+	}
+
+	// Both of these are a single atomic change, so readers always find the
+	// alias. An alias can't have the same name as an index, so an index from
+	// before we used aliases is deleted in the same change which creates the
+	// alias.
+	svc := m.elastic.Alias().Add(next, alias)
+	if isAlias {
+		svc = svc.Remove(old, alias)
+	} else {
+		svc = svc.Action(removeIndexAction(old))
+	}
+	_, err = svc.Do(m.ctx)
+	if err != nil {
+		m.abandonReindex(old, next)
+		return errwrap.Wrapf(fmt.Sprintf("Could not point %s at %s: {{err}}", alias, next), err)
+	}
+	if isAlias {
+		m.deleteIndex(old)
+	}
+
+	m.l.Infof("%s now points at %s", alias, next)
+
+	return nil
+}
+
+// setWriteBlock blocks or unblocks writes to an index.
+func (m *IndexManager) setWriteBlock(index string, block bool) error {
+	_, err := m.elastic.
+		IndexPutSettings(index).
+		BodyJson(map[string]interface{}{"index.blocks.write": block}).
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not set the write block on %s: {{err}}", index), err)
+	}
+	return nil
+}
+
+// abandonReindex cleans up after a reindex which failed, so that the old
+// index can be written to again.
+func (m *IndexManager) abandonReindex(old, next string) {
+	err := m.setWriteBlock(old, false)
+	if err != nil {
+		m.l.Error(err)
+	}
+	m.deleteIndex(next)
+}
+
+// removeIndexAction is the _aliases API's remove_index action, which deletes
+// an index as part of the same atomic change as the other actions. The
+// elastic package doesn't have it.
+type removeIndexAction string
+
+func (a removeIndexAction) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"remove_index": map[string]interface{}{"index": string(a)},
+	}, nil
+}
+
+func (m *IndexManager) verifyCounts(old, next string) error {
+	oldCount, err := m.elastic.Count(old).Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not count documents in %s: {{err}}", old), err)
+	}
+	nextCount, err := m.elastic.Count(next).Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not count documents in %s: {{err}}", next), err)
+	}
+
+	if oldCount != nextCount {
+		return fmt.Errorf("Reindexing %s into %s copied %d of %d documents", old, next, nextCount, oldCount)
+	}
+	return nil
+}
+
+// createIndex creates an index with the mapping, and with the alias pointing
+// at it if the alias isn't empty.
+func (m *IndexManager) createIndex(name string, mapping *Mapping, alias string) error {
+	var mappings interface{} = map[string]Properties{"properties": mapping.Properties}
+	if !m.elastic.Server.IsTypeless() {
+		mappings = map[string]interface{}{mapping.Name: mappings}
+	}
+	body := map[string]interface{}{
+		"settings": IndexSettings(),
+		"mappings": mappings,
+	}
+	if alias != "" {
+		body["aliases"] = map[string]interface{}{alias: map[string]interface{}{}}
+	}
+
+	_, err := m.elastic.CreateIndex(name).BodyJson(body).Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", name), err)
+	}
+	return nil
+}
+
+// This is only used for cleaning up, so failures are just logged.
+func (m *IndexManager) deleteIndex(name string) {
+	_, err := m.elastic.DeleteIndex(name).Do(m.ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		m.l.Errorf("Could not delete %s: %s", name, err)
+	}
+}
+
+func mappingNamed(name string) *Mapping {
+	for _, m := range Mappings() {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package esmodels
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/autarch/metagodoc/doc"
+
+	"github.com/olivere/elastic"
 )
 
 type ActivityStatus string
@@ -11,9 +16,11 @@ const (
 	DeadEndFork                    = "dead-end-fork"     // Forks with no commits
 	QuickFork                      = "quick-fork"        // Forks with less than 3 commits, all within a week from creation
 	NoRecentCommits                = "no-recent-commits" // No commits for ExpiresAfter
+	Empty                          = "empty"             // No commits on the default branch, so nothing to index
 
 	// No commits for ExpiresAfter and no imports.
 	// This is a status derived from NoRecentCommits and the imports count information in the db.
+	// See StatusWithImporters.
 	Inactive = "inactive"
 )
 
@@ -35,23 +42,315 @@ func (vt VCSType) String() string {
 }
 
 type Repository struct {
-	Name         string         `json:"name" esType:"keyword"`
-	FullName     string         `json:"full_name" esType:"keyword"`
-	Description  string         `json:"description" esType:"text" esAnalyzer:"english"`
-	VCS          string         `json:"vcs" esType:"keyword"`
-	PrimaryURL   string         `json:"primary_url" esType:"keyword"`
-	Issues       *Tickets       `json:"issues"`
-	PullRequests *Tickets       `json:"pull_requests"`
-	Owner        string         `json:"owner" esType:"keyword"`
-	Created      string         `json:"created" esType:"date"`
-	LastUpdated  string         `json:"last_updated" esType:"date"`
-	LastCrawled  string         `json:"last_crawled" esType:"date"`
-	Stars        int            `json:"stars" esType:"long"`
-	Forks        int            `json:"forks" esType:"long"`
-	IsFork       bool           `json:"is_fork" esType:"boolean"`
-	Status       ActivityStatus `json:"status" esType:"keyword"`
-	About        *About         `json:"about""`
-	Refs         []*Ref         `json:"refs"`
+	Name           string              `json:"name" esType:"keyword" esAutocomplete:"true" esRequired:"true"`
+	FullName       string              `json:"full_name" esType:"keyword" esAutocomplete:"true"`
+	Description    string              `json:"description" esType:"text" esAnalyzer:"english"`
+	VCS            string              `json:"vcs" esType:"keyword"`
+	PrimaryURL     string              `json:"primary_url" esType:"keyword" esRequired:"true"`
+	Issues         *Tickets            `json:"issues"`
+	PullRequests   *Tickets            `json:"pull_requests"`
+	Owner          string              `json:"owner" esType:"keyword"`
+	Created        string              `json:"created" esType:"date"`
+	LastUpdated    string              `json:"last_updated" esType:"date"`
+	LastCrawled    string              `json:"last_crawled" esType:"date" esRequired:"true"`
+	Stars          int                 `json:"stars" esType:"long"`
+	Forks          int                 `json:"forks" esType:"long"`
+	IsFork         bool                `json:"is_fork" esType:"boolean"`
+	ImportPathRoot string              `json:"import_path_root" esType:"keyword" esImportPath:"true"`
+	IsGoProject    bool                `json:"is_go_project" esType:"boolean"`
+	Categories     []string            `json:"categories" esType:"keyword"`
+	Status         ActivityStatus      `json:"status" esType:"keyword"`
+	StatusHistory  []*StatusTransition `json:"status_history"`
+	About          *About              `json:"about"`
+	ReleaseCadence *ReleaseCadence     `json:"release_cadence"`
+	Contributors   *Contributors       `json:"contributors"`
+	Testing        *TestSignals        `json:"testing"`
+	Refs           []*Ref              `json:"refs"`
+
+	// For the completion suggester. See SetSuggest.
+	Suggest *Suggest `json:"suggest" esType:"completion"`
+
+	// The newest version tag, and the newest which isn't a prerelease, not
+	// counting any versions retracted in go.mod. These can be tags we don't
+	// index, so they aren't necessarily in Refs.
+	LatestVersion       string `json:"latest_version" esType:"keyword"`
+	LatestStableVersion string `json:"latest_stable_version" esType:"keyword"`
+
+	// Whether the default branch has compiled binaries or very large files
+	// committed to it, and the paths of some of them. A repository like this
+	// is fetched with less history the next time it's crawled.
+	HasBinaryArtifacts bool     `json:"has_binary_artifacts" esType:"boolean"`
+	BinaryArtifacts    []string `json:"binary_artifacts" esType:"keyword"`
+
+	// Set by the indexer's retention job when the repository hasn't been
+	// crawled for a long time and can't be recrawled.
+	Stale bool `json:"stale" esType:"boolean"`
+
+	// If the indexer gets the same hash on the next crawl then nothing has
+	// changed, and only LastCrawled is updated.
+	ContentHash string `json:"content_hash" esType:"keyword"`
+
+	// See SetTenant. This is set by the indexer when it writes the document.
+	Tenant string `json:"tenant,omitempty" esType:"keyword"`
+
+	// How many other repositories import any of this repository's packages,
+	// and the IDs of the ones with the most stars. These are counted by the
+	// indexer's importers job rather than when the repository is crawled, so
+	// ImportersCounted says whether a zero means anything yet. See
+	// CarryImporters.
+	ImportedBy       int      `json:"imported_by" esType:"long"`
+	TopImporters     []string `json:"top_importers" esType:"keyword"`
+	ImportersCounted bool     `json:"importers_counted" esType:"boolean"`
+}
+
+// CarryImporters copies the importer counts from the previously indexed
+// version of the repository, prev, since crawling doesn't count them. A
+// repository with no recent commits which nobody imports is inactive rather
+// than just quiet, so this needs to be called before RecordStatusTransition.
+// It is fine to pass a nil prev.
+func (r *Repository) CarryImporters(prev *Repository) {
+	if prev == nil {
+		return
+	}
+
+	r.ImportedBy = prev.ImportedBy
+	r.TopImporters = prev.TopImporters
+	r.ImportersCounted = prev.ImportersCounted
+	r.Status = r.StatusWithImporters()
+}
+
+// StatusWithImporters returns the repository's status taking its importers
+// into account, which is only different for repositories with no recent
+// commits.
+func (r *Repository) StatusWithImporters() ActivityStatus {
+	switch {
+	case r.Status == NoRecentCommits && r.ImportersCounted && r.ImportedBy == 0:
+		return Inactive
+	case r.Status == Inactive && r.ImportedBy > 0:
+		return NoRecentCommits
+	default:
+		return r.Status
+	}
+}
+
+// StatusTransition records a change in a repository's activity status between
+// two crawls.
+type StatusTransition struct {
+	From ActivityStatus `json:"from" esType:"keyword"`
+	To   ActivityStatus `json:"to" esType:"keyword"`
+	At   string         `json:"at" esType:"date"`
+}
+
+// RecordStatusTransition carries over the status history from the previously
+// indexed version of the repository, prev, and appends a new transition if
+// the status has changed since then. It is fine to pass a nil prev for
+// repositories that have never been indexed.
+func (r *Repository) RecordStatusTransition(prev *Repository) {
+	if prev == nil {
+		return
+	}
+
+	r.StatusHistory = prev.StatusHistory
+	if prev.Status == "" || prev.Status == r.Status {
+		return
+	}
+
+	r.StatusHistory = append(r.StatusHistory, &StatusTransition{
+		From: prev.Status,
+		To:   r.Status,
+		At:   r.LastCrawled,
+	})
+}
+
+// How long a removed ref is kept in the document, so that anyone looking for
+// it can be told it's gone rather than that it never existed.
+const removedRefRetention = 30 * 24 * time.Hour
+
+// RecordRemovedRefs adds every ref in prev which is no longer in r, marked as
+// removed. Refs which were removed more than removedRefRetention ago are
+// dropped for good. It is fine to pass a nil prev.
+func (r *Repository) RecordRemovedRefs(prev *Repository) {
+	if prev == nil {
+		return
+	}
+
+	current := make(map[string]bool, len(r.Refs))
+	for _, ref := range r.Refs {
+		current[ref.Name] = true
+	}
+
+	now, err := time.Parse(DateTimeFormat, r.LastCrawled)
+	if err != nil {
+		now = time.Now().UTC()
+	}
+	for _, ref := range prev.Refs {
+		if current[ref.Name] {
+			continue
+		}
+
+		removed := *ref
+		removed.IsDefaultBranch = false
+		removed.Packages = nil
+		if removed.Removed == "" {
+			removed.Removed = FormatTime(now)
+		} else if t, err := time.Parse(DateTimeFormat, removed.Removed); err == nil && now.Sub(t) > removedRefRetention {
+			continue
+		}
+		r.Refs = append(r.Refs, &removed)
+	}
+}
+
+// RefsUnchanged returns true if r has the same refs as prev, each at the same
+// commit.
+func (r *Repository) RefsUnchanged(prev *Repository) bool {
+	if prev == nil || len(r.Refs) != len(prev.Refs) {
+		return false
+	}
+
+	commits := make(map[string]string, len(prev.Refs))
+	removed := make(map[string]string, len(prev.Refs))
+	for _, ref := range prev.Refs {
+		commits[ref.Name] = ref.LastSeenCommit
+		removed[ref.Name] = ref.Removed
+	}
+	for _, ref := range r.Refs {
+		// Refs without a commit can't be compared, so they always count
+		// as changed.
+		c, ok := commits[ref.Name]
+		if !ok || ref.LastSeenCommit == "" || c != ref.LastSeenCommit || removed[ref.Name] != ref.Removed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithoutRefs returns every field of the repository except its refs, for use
+// as a partial update. The refs hold nearly all of the data, so this is much
+// smaller than the full document.
+func (r *Repository) WithoutRefs() (map[string]interface{}, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "refs")
+
+	return doc, nil
+}
+
+// ChangedRefs returns the refs in r which are new since prev or are at a
+// different commit, for a partial update which only sends those refs. It
+// returns false if the whole document has to be written instead, because
+// there's no prev or a ref has been removed since then.
+func (r *Repository) ChangedRefs(prev *Repository) ([]*Ref, bool) {
+	if prev == nil {
+		return nil, false
+	}
+
+	prevRefs := make(map[string]*Ref, len(prev.Refs))
+	for _, ref := range prev.Refs {
+		prevRefs[ref.Name] = ref
+	}
+
+	var changed []*Ref
+	for _, ref := range r.Refs {
+		p, ok := prevRefs[ref.Name]
+		delete(prevRefs, ref.Name)
+		if ok && p.Removed != ref.Removed {
+			return nil, false
+		}
+		// Refs without a commit can't be compared, so they always count as
+		// changed.
+		if !ok || ref.LastSeenCommit == "" || p.LastSeenCommit != ref.LastSeenCommit {
+			changed = append(changed, ref)
+		}
+	}
+	if len(prevRefs) > 0 {
+		return nil, false
+	}
+
+	return changed, true
+}
+
+// Replaces the refs with the same names as params.refs, and puts every ref in
+// the order given by params.order, so the document ends up with the same refs
+// as a full write would give it.
+const refsUpdateScript = `
+Map byName = new HashMap();
+for (ref in ctx._source.refs) { byName.put(ref.name, ref); }
+for (ref in params.refs) { byName.put(ref.name, ref); }
+List refs = new ArrayList();
+for (name in params.order) { refs.add(byName.get(name)); }
+ctx._source.putAll(params.doc);
+ctx._source.refs = refs;
+`
+
+// RefsUpdateScript returns a script for a partial update which sets every
+// field of the repository except its refs, like WithoutRefs, and replaces
+// only the given refs. The other refs are left as they are in the index.
+func (r *Repository) RefsUpdateScript(changed []*Ref) (*elastic.Script, error) {
+	doc, err := r.WithoutRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]string, len(r.Refs))
+	for i, ref := range r.Refs {
+		order[i] = ref.Name
+	}
+
+	return elastic.NewScript(refsUpdateScript).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"doc":   doc,
+			"refs":  changed,
+			"order": order,
+		}), nil
+}
+
+// Suggest is the value of a completion suggester field. Suggestions are
+// ranked by weight, which we set to the number of stars.
+type Suggest struct {
+	Input  []string `json:"input"`
+	Weight int      `json:"weight,omitempty"`
+}
+
+func newSuggest(weight int, inputs ...string) *Suggest {
+	s := &Suggest{Weight: weight}
+	seen := make(map[string]bool)
+	for _, i := range inputs {
+		if i == "" || seen[i] {
+			continue
+		}
+		seen[i] = true
+		s.Input = append(s.Input, i)
+	}
+	return s
+}
+
+// SetTesting sets the repository's test signals to those of its default
+// branch. Refs indexed before we counted them don't have any, so neither does
+// the repository until the default branch changes.
+func (r *Repository) SetTesting() {
+	r.Testing = nil
+	for _, ref := range r.Refs {
+		if ref.IsDefaultBranch && ref.Removed == "" {
+			r.Testing = ref.Testing
+		}
+	}
+}
+
+// SetSuggest sets the repository's completion suggester inputs from its name,
+// full name, and import path. This needs to be called once everything else is
+// set.
+func (r *Repository) SetSuggest() {
+	r.Suggest = newSuggest(r.Stars, r.Name, r.FullName, r.ImportPathRoot)
 }
 
 type Tickets struct {
@@ -63,33 +362,263 @@ type Tickets struct {
 type About struct {
 	Content     string `json:"content" esType:"text" esAnalyzer:"english"`
 	ContentType string `json:"content_type" esType:"keyword"`
+
+	// These are set when Content is only the start of a bigger README. See
+	// AboutPolicy.
+	Truncated     bool   `json:"truncated" esType:"boolean"`
+	OriginalBytes int    `json:"original_bytes" esType:"long"`
+	Compressed    string `json:"compressed" esType:"binary"`
+	URL           string `json:"url" esType:"keyword"`
+}
+
+// ReleaseCadence summarizes how often a repository tags releases. The
+// durations are in days so they can be used directly for ranking and
+// display.
+type ReleaseCadence struct {
+	Releases             int     `json:"releases" esType:"long"`
+	FirstRelease         string  `json:"first_release" esType:"date"`
+	LastRelease          string  `json:"last_release" esType:"date"`
+	AverageDaysBetween   float64 `json:"average_days_between" esType:"double"`
+	DaysSinceLastRelease float64 `json:"days_since_last_release" esType:"double"`
+}
+
+// Contributors summarizes who has committed to the default branch over the
+// last year. A repository where one person makes nearly all of the commits is
+// flagged as having a single maintainer.
+type Contributors struct {
+	Commits             int     `json:"commits" esType:"long"`
+	Contributors        int     `json:"contributors" esType:"long"`
+	TopContributorShare float64 `json:"top_contributor_share" esType:"double"`
+	IsSingleMaintainer  bool    `json:"is_single_maintainer" esType:"boolean"`
 }
 
 type Package struct {
-	Name         string                 `json:"name" esType:"keyword"`
-	ImportPath   string                 `json:"import_path" esType:"keyword"`
-	Doc          string                 `json:"doc" esType:"text" esAnalyzer:"english"`
-	Synopsis     string                 `json:"synopsis" esType:"text" esAnalyzer:"english"`
-	Errors       []string               `json:"errors" esType:"keyword"`
-	IsCommand    bool                   `json:"is_command" esType:"boolean"`
-	Files        []*doc.File            `json:"files"`
-	TestFiles    []*doc.File            `json:"test_files"`
-	Imports      []string               `json:"imports" esType:"keyword"`
-	TestImports  []string               `json:"test_imports" esType:"keyword"`
-	XTestImports []string               `json:"x_test_imports" esType:"keyword"`
-	Consts       []*doc.Value           `json:"consts"`
-	Funcs        []*doc.Func            `json:"funcs"`
-	Types        []*doc.Type            `json:"types"`
-	Vars         []*doc.Value           `json:"vars"`
-	Examples     []*doc.Example         `json:"examples"`
-	Notes        map[string][]*doc.Note `json:"notes"`
+	Name                string                 `json:"name" esType:"keyword" esAutocomplete:"true"`
+	ImportPath          string                 `json:"import_path" esType:"keyword" esAutocomplete:"true" esImportPath:"true" esRequired:"true"`
+	CanonicalImportPath string                 `json:"canonical_import_path" esType:"keyword" esImportPath:"true"`
+	ImportPathMismatch  bool                   `json:"import_path_mismatch" esType:"boolean"`
+	Doc                 string                 `json:"doc" esType:"text" esAnalyzer:"english"`
+	Synopsis            string                 `json:"synopsis" esType:"text" esAnalyzer:"english"`
+	Errors              []*doc.Error           `json:"errors"`
+	IsCommand           bool                   `json:"is_command" esType:"boolean"`
+	IsInternal          bool                   `json:"is_internal" esType:"boolean"`
+	IsVendored          bool                   `json:"is_vendored" esType:"boolean"`
+	IsStdlib            bool                   `json:"is_stdlib" esType:"boolean"`
+	Files               []*doc.File            `json:"files"`
+	TestFiles           []*doc.File            `json:"test_files"`
+	IgnoredFiles        []*doc.File            `json:"ignored_files"`
+	GeneratedFiles      int                    `json:"generated_files" esType:"integer"`
+	HandWrittenFiles    int                    `json:"hand_written_files" esType:"integer"`
+	Stats               *CodeStats             `json:"stats"`
+	Complexity          *doc.Complexity        `json:"complexity"`
+	Quality             *doc.Quality           `json:"quality"`
+	Testing             *TestSignals           `json:"testing"`
+	Platforms           []string               `json:"platforms" esType:"keyword"`
+	EmbedPatterns       []string               `json:"embed_patterns" esType:"keyword"`
+	Imports             []string               `json:"imports" esType:"keyword"`
+	TestImports         []string               `json:"test_imports" esType:"keyword"`
+	XTestImports        []string               `json:"x_test_imports" esType:"keyword"`
+	Consts              []*doc.Value           `json:"consts"`
+	Funcs               []*doc.Func            `json:"funcs"`
+	Types               []*doc.Type            `json:"types"`
+	Vars                []*doc.Value           `json:"vars"`
+	Examples            []*doc.Example         `json:"examples"`
+	Notes               map[string][]*doc.Note `json:"notes"`
+
+	// The repository and ref the package was found in. Packages have their
+	// own index, see WritePackages.
+	RepositoryID string `json:"repository_id" esType:"keyword" esImportPath:"true" esRequired:"true"`
+	Ref          string `json:"ref" esType:"keyword" esRequired:"true"`
+
+	// For the completion suggester. This is set by WritePackages, like
+	// Tenant.
+	Suggest *Suggest `json:"suggest" esType:"completion"`
+	Tenant  string   `json:"tenant,omitempty" esType:"keyword"`
+
+	// How many packages in other repositories import this one, and the
+	// import paths of those in the repositories with the most stars. Like a
+	// repository's, these are counted by the indexer's importers job, and
+	// WritePackages carries them over when a package is written again, so
+	// they're only zero for a package which is new since its last run.
+	ImportedBy   int      `json:"imported_by" esType:"long"`
+	TopImporters []string `json:"top_importers" esType:"keyword"`
 }
 
+// A Warning is a problem with a ref's files which meant we couldn't index all
+// of them.
+type Warning struct {
+	Kind    string   `json:"kind" esType:"keyword"`
+	Paths   []string `json:"paths" esType:"keyword"`
+	Message string   `json:"message" esType:"text"`
+}
+
+// CodeStats are the size of a package, or of all of a ref's packages, for
+// filtering and ranking. The line counts include blank lines, and a comment
+// line is any line with a comment on it, even if it has code too. Generated
+// files are only counted if they're included in the docs, see
+// repository.Settings.ExcludeGenerated.
+type CodeStats struct {
+	GoFiles          int `json:"go_files" esType:"integer"`
+	TestFiles        int `json:"test_files" esType:"integer"`
+	Lines            int `json:"lines" esType:"integer"`
+	CommentLines     int `json:"comment_lines" esType:"integer"`
+	TestLines        int `json:"test_lines" esType:"integer"`
+	TestCommentLines int `json:"test_comment_lines" esType:"integer"`
+}
+
+// TestSignals hint at how well tested a package, ref, or repository is,
+// without running anything. A repository's are those of its default branch.
+type TestSignals struct {
+	// How many test files there are for each non-test Go file.
+	TestRatio float64 `json:"test_ratio" esType:"float"`
+	// Whether any of the tests loop over a table of cases, and whether there
+	// are test helpers which take a testing.TB or the like.
+	TableTests bool `json:"table_tests" esType:"boolean"`
+	Helpers    bool `json:"helpers" esType:"boolean"`
+	// For refs and repositories, the fraction of packages which have any
+	// tests at all.
+	TestedPackages float64 `json:"tested_packages" esType:"float"`
+}
+
+// NewTestSignals returns the test signals for a package with the given
+// numbers of Go and test files.
+func NewTestSignals(goFiles, testFiles int, tableTests, helpers bool) *TestSignals {
+	s := &TestSignals{TableTests: tableTests, Helpers: helpers}
+	if goFiles > 0 {
+		s.TestRatio = float64(testFiles) / float64(goFiles)
+	}
+	if testFiles > 0 {
+		s.TestedPackages = 1
+	}
+	return s
+}
+
+// CountStats sets the ref's Stats and Testing from its packages. Vendored
+// packages are left out, since they're someone else's code.
+func (r *Ref) CountStats() {
+	r.Stats = &CodeStats{}
+	r.Testing = &TestSignals{}
+	packages, tested := 0, 0
+	for _, p := range r.Packages {
+		if p.IsVendored || p.Stats == nil {
+			continue
+		}
+		packages++
+		if p.Stats.TestFiles > 0 {
+			tested++
+		}
+		if p.Testing != nil {
+			r.Testing.TableTests = r.Testing.TableTests || p.Testing.TableTests
+			r.Testing.Helpers = r.Testing.Helpers || p.Testing.Helpers
+		}
+		r.Stats.GoFiles += p.Stats.GoFiles
+		r.Stats.TestFiles += p.Stats.TestFiles
+		r.Stats.Lines += p.Stats.Lines
+		r.Stats.CommentLines += p.Stats.CommentLines
+		r.Stats.TestLines += p.Stats.TestLines
+		r.Stats.TestCommentLines += p.Stats.TestCommentLines
+	}
+	if r.Stats.GoFiles > 0 {
+		r.Testing.TestRatio = float64(r.Stats.TestFiles) / float64(r.Stats.GoFiles)
+	}
+	if packages > 0 {
+		r.Testing.TestedPackages = float64(tested) / float64(packages)
+	}
+}
+
+// An APIDiff is how a tag's exported API differs from that of the stable
+// version before it. See the indexer's apidiff package.
+type APIDiff struct {
+	Previous string `json:"previous" esType:"keyword"`
+	// Exported symbols, like "example.com/pkg.Type.Method", and whole
+	// packages, by import path, which were added, removed, or whose
+	// declarations changed.
+	Added   []string `json:"added" esType:"keyword"`
+	Removed []string `json:"removed" esType:"keyword"`
+	Changed []string `json:"changed" esType:"keyword"`
+	// True if any of the lists were too long to store in full.
+	Truncated bool `json:"truncated" esType:"boolean"`
+	// True if something was removed or changed in a way that could break
+	// code written for the previous version.
+	Incompatible bool `json:"incompatible" esType:"boolean"`
+	// True if the change was incompatible even though the version number
+	// says it's compatible, since it has the same major version.
+	Breaking bool `json:"breaking" esType:"boolean"`
+}
+
+// Dependencies says how heavy a ref's dependency tree is, from its go.mod and
+// go.sum files. A repository with several modules counts the dependencies of
+// all of them, leaving out its own modules.
+type Dependencies struct {
+	// The modules required without an "// indirect" comment.
+	Direct int `json:"direct" esType:"integer"`
+	// Every module in go.mod or with its code in go.sum, including Direct.
+	Total int `json:"total" esType:"integer"`
+	// The longest chain of requirements from one of the ref's modules. This
+	// is zero if the indexer wasn't given a module proxy to follow the chain
+	// with. See the indexer's modgraph package.
+	MaxDepth int `json:"max_depth" esType:"integer"`
+}
+
+// A Vulnerability is a known vulnerability in one of the modules required by
+// a ref, from the Go vulnerability database.
+type Vulnerability struct {
+	// Like "GO-2022-0001", along with any CVE or GHSA IDs.
+	ID      string   `json:"id" esType:"keyword"`
+	Aliases []string `json:"aliases" esType:"keyword"`
+	// The module and the version of it which the ref requires.
+	Module  string `json:"module" esType:"keyword"`
+	Version string `json:"version" esType:"keyword"`
+	// The first version of the module without the vulnerability. This is
+	// empty if there isn't one yet.
+	Fixed string `json:"fixed" esType:"keyword"`
+	// Either a word like "HIGH" or a CVSS vector, if the database has one.
+	Severity string `json:"severity" esType:"keyword"`
+	Summary  string `json:"summary" esType:"text"`
+}
+
+// The kinds of Warning.
+const (
+	// Some paths differ only by case, so they'd collide on a case-insensitive
+	// filesystem.
+	CaseCollision = "case_collision"
+	// Some paths aren't valid UTF-8.
+	InvalidPathName = "invalid_path_name"
+)
+
 type Ref struct {
-	Name            string     `json:"name" esType:"keyword"`
-	IsDefaultBranch bool       `json:"is_head" esType:"boolean"`
-	RefType         string     `json:"ref_type" esType:"keyword"`
-	LastSeenCommit  string     `json:"last_seen_commit" esType:"keyword"`
-	LastUpdated     string     `json:"last_updated" esType:"date"`
-	Packages        []*Package `json:"packages"`
+	Name            string `json:"name" esType:"keyword" esRequired:"true"`
+	IsDefaultBranch bool   `json:"is_head" esType:"boolean"`
+	RefType         string `json:"ref_type" esType:"keyword"`
+	LastSeenCommit  string `json:"last_seen_commit" esType:"keyword"`
+	LastUpdated     string `json:"last_updated" esType:"date"`
+	// The import path of the ref's root package, if it isn't the
+	// repository's ImportPathRoot. gopkg.in serves each major version of a
+	// repository under its own path, so a ref for another version has that
+	// version's path.
+	ImportPathRoot string `json:"import_path_root" esType:"keyword" esImportPath:"true"`
+	// When we noticed the ref had been deleted upstream. This is empty for
+	// refs which still exist. See RecordRemovedRefs.
+	Removed string `json:"removed" esType:"date"`
+	// Problems with the ref's files which didn't stop us indexing it.
+	Warnings []*Warning `json:"warnings"`
+	// The total size of the ref's packages, leaving out vendored ones. See
+	// CountStats.
+	Stats *CodeStats `json:"stats"`
+	// How well tested the ref's packages look. See CountStats.
+	Testing *TestSignals `json:"testing"`
+	// How the exported API differs from the previous version. This is only
+	// set for version tags, and only once we've indexed an earlier one.
+	APIDiff *APIDiff `json:"api_diff"`
+	// The size of the ref's module dependency tree. This is nil if the ref
+	// has no go.mod file.
+	Dependencies *Dependencies `json:"dependencies"`
+	// Known vulnerabilities in the versions of the modules the ref requires.
+	// This is empty if the indexer wasn't given a vulnerability database.
+	Vulnerabilities []*Vulnerability `json:"vulnerabilities"`
+
+	// A monorepo's packages can easily be bigger than Elasticsearch's
+	// document size limit, so these are written to the package index rather
+	// than being part of the repository's document.
+	Packages []*Package `json:"-"`
 }
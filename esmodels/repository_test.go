@@ -0,0 +1,158 @@
+package esmodels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefsUnchanged(t *testing.T) {
+	prev := &Repository{Refs: []*Ref{
+		{Name: "master", LastSeenCommit: "abc"},
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+	}}
+
+	r := &Repository{Refs: []*Ref{
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+		{Name: "master", LastSeenCommit: "abc"},
+	}}
+	assert.True(t, r.RefsUnchanged(prev), "same refs in a different order")
+	assert.False(t, r.RefsUnchanged(nil), "never indexed")
+
+	r.Refs[1].LastSeenCommit = "123"
+	assert.False(t, r.RefsUnchanged(prev), "new commit")
+
+	r.Refs = r.Refs[:1]
+	assert.False(t, r.RefsUnchanged(prev), "removed ref")
+
+	local := &Repository{Refs: []*Ref{{Name: "local"}}}
+	assert.False(t, local.RefsUnchanged(local), "refs without commits")
+
+	r.Refs = []*Ref{
+		{Name: "master", LastSeenCommit: "abc"},
+		{Name: "v1.0.0", LastSeenCommit: "def", Removed: "2020-01-02T03:04:05"},
+	}
+	assert.False(t, r.RefsUnchanged(prev), "newly removed ref")
+}
+
+func TestChangedRefs(t *testing.T) {
+	prev := &Repository{Refs: []*Ref{
+		{Name: "master", LastSeenCommit: "abc"},
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+	}}
+
+	r := &Repository{Refs: []*Ref{
+		{Name: "master", LastSeenCommit: "123"},
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+		{Name: "v1.1.0", LastSeenCommit: "456"},
+	}}
+	changed, partial := r.ChangedRefs(prev)
+	assert.True(t, partial)
+	assert.Equal(t, []*Ref{r.Refs[0], r.Refs[2]}, changed, "new and moved refs have changed")
+
+	_, partial = r.ChangedRefs(nil)
+	assert.False(t, partial, "never indexed")
+
+	_, partial = r.ChangedRefs(&Repository{Refs: append(prev.Refs, &Ref{Name: "gone", LastSeenCommit: "789"})})
+	assert.False(t, partial, "removed ref")
+
+	r.Refs[1].Removed = "2020-01-02T03:04:05"
+	_, partial = r.ChangedRefs(prev)
+	assert.False(t, partial, "newly removed ref")
+
+	script, err := r.RefsUpdateScript(changed)
+	must(t, err)
+	src, err := script.Source()
+	must(t, err)
+	params := src.(map[string]interface{})["params"].(map[string]interface{})
+	assert.Equal(t, []string{"master", "v1.0.0", "v1.1.0"}, params["order"], "every ref is kept in order")
+	assert.Equal(t, changed, params["refs"], "only the changed refs are sent")
+	assert.NotContains(t, params["doc"], "refs")
+}
+
+func TestRecordRemovedRefs(t *testing.T) {
+	prev := &Repository{Refs: []*Ref{
+		{Name: "master", LastSeenCommit: "abc", IsDefaultBranch: true},
+		{Name: "v1.0.0", LastSeenCommit: "def"},
+		{Name: "v0.9.0", LastSeenCommit: "789", Removed: "2020-01-20T00:00:00"},
+		{Name: "v0.1.0", LastSeenCommit: "456", Removed: "2019-12-01T00:00:00"},
+	}}
+	r := &Repository{
+		LastCrawled: "2020-02-01T00:00:00",
+		Refs:        []*Ref{{Name: "main", LastSeenCommit: "abc", IsDefaultBranch: true}},
+	}
+	r.RecordRemovedRefs(prev)
+
+	removed := make(map[string]string)
+	for _, ref := range r.Refs {
+		removed[ref.Name] = ref.Removed
+		if ref.Removed != "" {
+			assert.False(t, ref.IsDefaultBranch, ref.Name)
+		}
+	}
+	assert.Equal(
+		t,
+		map[string]string{
+			"main":   "",
+			"master": "2020-02-01T00:00:00",
+			"v1.0.0": "2020-02-01T00:00:00",
+			"v0.9.0": "2020-01-20T00:00:00",
+		},
+		removed,
+		"refs that are gone are marked as removed until they've been gone for a while",
+	)
+	assert.Equal(t, "", prev.Refs[0].Removed, "prev is left alone")
+
+	r = &Repository{}
+	r.RecordRemovedRefs(nil)
+	assert.Empty(t, r.Refs)
+}
+
+func TestCarryImporters(t *testing.T) {
+	prev := &Repository{Status: NoRecentCommits}
+	r := &Repository{Status: NoRecentCommits}
+	r.CarryImporters(prev)
+	assert.Equal(t, ActivityStatus(NoRecentCommits), r.Status, "importers haven't been counted yet")
+
+	prev = &Repository{Status: Inactive, ImportersCounted: true}
+	r = &Repository{Status: NoRecentCommits}
+	r.CarryImporters(prev)
+	assert.Equal(t, ActivityStatus(Inactive), r.Status)
+	r.RecordStatusTransition(prev)
+	assert.Empty(t, r.StatusHistory, "still inactive")
+
+	prev = &Repository{Status: Inactive, ImportersCounted: true, ImportedBy: 2, TopImporters: []string{"github.com/a/b", "github.com/c/d"}}
+	r = &Repository{Status: NoRecentCommits}
+	r.CarryImporters(prev)
+	assert.Equal(t, ActivityStatus(NoRecentCommits), r.Status)
+	assert.Equal(t, 2, r.ImportedBy)
+	assert.Equal(t, prev.TopImporters, r.TopImporters)
+
+	r = &Repository{Status: Active}
+	r.CarryImporters(&Repository{Status: Inactive, ImportersCounted: true})
+	assert.Equal(t, Active, r.Status)
+
+	r = &Repository{Status: NoRecentCommits}
+	r.CarryImporters(nil)
+	assert.Equal(t, ActivityStatus(NoRecentCommits), r.Status, "never indexed")
+}
+
+func TestWithoutRefs(t *testing.T) {
+	r := &Repository{Name: "bar", Stars: 42, Refs: []*Ref{{Name: "master"}}}
+	doc, err := r.WithoutRefs()
+	must(t, err)
+
+	assert.Equal(t, "bar", doc["name"])
+	assert.Equal(t, float64(42), doc["stars"])
+	assert.NotContains(t, doc, "refs")
+}
+
+func TestSetSuggest(t *testing.T) {
+	r := &Repository{Name: "bar", FullName: "foo/bar", ImportPathRoot: "github.com/foo/bar", Stars: 7}
+	r.SetSuggest()
+	assert.Equal(t, &Suggest{Input: []string{"bar", "foo/bar", "github.com/foo/bar"}, Weight: 7}, r.Suggest)
+
+	r = &Repository{Name: "bar", FullName: "bar"}
+	r.SetSuggest()
+	assert.Equal(t, []string{"bar"}, r.Suggest.Input, "duplicates and empty inputs are skipped")
+}
@@ -0,0 +1,101 @@
+package esmodels
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// snapshotIndices returns every index we own. The mapped indices are aliases,
+// which Elasticsearch resolves to the real index when taking a snapshot. The
+// aliases are saved in the snapshot too.
+func snapshotIndices() []string {
+	var indices []string
+	for _, mapping := range Mappings() {
+		indices = append(indices, IndexName(mapping))
+	}
+	return append(indices, Index("schema"), Index("queue"))
+}
+
+// CreateSnapshotRepository registers a snapshot repository with the cluster.
+// The type is usually "fs", with a "location" setting that's a path listed in
+// every node's path.repo, or "s3", with a "bucket" setting, which needs the
+// repository-s3 plugin. See the Elasticsearch snapshot docs for the rest of
+// the settings. The repository is verified once it's created.
+func (m *IndexManager) CreateSnapshotRepository(name, typ string, settings map[string]interface{}) error {
+	_, err := m.elastic.
+		SnapshotCreateRepository(name).
+		Type(typ).
+		Settings(settings).
+		Verify(true).
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not create the %s snapshot repository: {{err}}", name), err)
+	}
+	return nil
+}
+
+// Snapshot takes a snapshot of every index, waiting until it's done. The
+// cluster's global state isn't included, so a snapshot can be restored into
+// a cluster that's used for other things.
+func (m *IndexManager) Snapshot(repository, snapshot string) error {
+	m.l.Infof("Taking snapshot %s in %s", snapshot, repository)
+	resp, err := m.elastic.
+		SnapshotCreate(repository, snapshot).
+		WaitForCompletion(true).
+		BodyJson(map[string]interface{}{
+			"indices":              strings.Join(snapshotIndices(), ","),
+			"ignore_unavailable":   true,
+			"include_global_state": false,
+		}).
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Could not take snapshot: {{err}}", err)
+	}
+	if resp.Snapshot != nil && resp.Snapshot.State != "SUCCESS" {
+		return fmt.Errorf("Snapshot %s finished with state %s: %v", snapshot, resp.Snapshot.State, resp.Snapshot.Failures)
+	}
+
+	m.l.Infof("Snapshot %s is done", snapshot)
+	return nil
+}
+
+// Restore restores every index, and its alias, from a snapshot, waiting until
+// it's done. Elasticsearch won't restore over an open index, and we don't
+// want to throw data away behind anyone's back, so this fails if any of our
+// indices already exist. Delete them first to replace them.
+//
+// The snapshot may be from an older schema version, so run a migration after
+// restoring.
+func (m *IndexManager) Restore(repository, snapshot string) error {
+	for _, index := range snapshotIndices() {
+		exists, err := m.elastic.IndexExists(index).Do(m.ctx)
+		if err != nil {
+			return errwrap.Wrapf("IndexExists: {{err}}", err)
+		}
+		if exists {
+			return fmt.Errorf("Cannot restore over the existing %s index", index)
+		}
+	}
+
+	m.l.Infof("Restoring snapshot %s from %s", snapshot, repository)
+	// The client library has no restore service.
+	_, err := m.elastic.PerformRequest(m.ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   fmt.Sprintf("/_snapshot/%s/%s/_restore", url.PathEscape(repository), url.PathEscape(snapshot)),
+		Params: url.Values{"wait_for_completion": []string{"true"}},
+		Body: map[string]interface{}{
+			"include_global_state": false,
+			"include_aliases":      true,
+		},
+	})
+	if err != nil {
+		return errwrap.Wrapf("Could not restore snapshot: {{err}}", err)
+	}
+
+	m.l.Infof("Snapshot %s is restored", snapshot)
+	return nil
+}
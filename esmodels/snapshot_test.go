@@ -0,0 +1,67 @@
+package esmodels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSnapshotServer has a repository index and nothing else, and records
+// the body of every snapshot request.
+type fakeSnapshotServer struct {
+	snapshots []map[string]interface{}
+	restored  bool
+}
+
+func (s *fakeSnapshotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "HEAD" && (r.URL.Path == "/" || r.URL.Path == "/"+Index("repository")):
+		return
+	case r.Method == "HEAD":
+		w.WriteHeader(404)
+	case r.Method == "PUT" && r.URL.Path == "/_snapshot/backups/nightly":
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.snapshots = append(s.snapshots, body)
+		fmt.Fprint(w, `{"snapshot": {"snapshot": "nightly", "state": "SUCCESS"}}`)
+	case r.Method == "POST":
+		s.restored = true
+		fmt.Fprint(w, `{}`)
+	default:
+		fmt.Fprint(w, `{"version": {"number": "6.8.0"}}`)
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	fake := &fakeSnapshotServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	client, err := elc.NewClient(elc.NewParams{URLs: []string{server.URL}, DisableSniffing: true})
+	must(t, err)
+	m := NewIndexManager(NewIndexManagerParams{Logger: l, Elastic: client})
+
+	must(t, m.Snapshot("backups", "nightly"))
+	if assert.Len(t, fake.snapshots, 1) {
+		assert.Equal(
+			t,
+			"metagodoc-repository,metagodoc-author,metagodoc-tombstone,metagodoc-package,metagodoc-symbol,metagodoc-crawl_report,metagodoc-schema,metagodoc-queue",
+			fake.snapshots[0]["indices"],
+			"every index is in the snapshot",
+		)
+		assert.Equal(t, false, fake.snapshots[0]["include_global_state"])
+	}
+
+	err = m.Restore("backups", "nightly")
+	assert.EqualError(t, err, "Cannot restore over the existing metagodoc-repository index")
+	assert.False(t, fake.restored, "nothing is restored over an existing index")
+}
@@ -0,0 +1,145 @@
+package esmodels
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/autarch/metagodoc/doc"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// A Symbol is an exported const, var, func, type, or method in a package.
+// Symbols have their own index so that symbol queries don't have to dig
+// through nested package documents. They're routed by import path, so all of
+// a package's symbols live on the same shard.
+type Symbol struct {
+	Name string `json:"name" esType:"keyword" esRequired:"true"`
+	// One of "const", "var", "func", "type", or "method".
+	Kind string `json:"kind" esType:"keyword" esRequired:"true"`
+	// For methods, the receiver, like "T" or "*T".
+	Recv         string `json:"recv" esType:"keyword"`
+	Doc          string `json:"doc" esType:"text" esAnalyzer:"english"`
+	ImportPath   string `json:"import_path" esType:"keyword" esImportPath:"true"`
+	RepositoryID string `json:"repository_id" esType:"keyword" esImportPath:"true"`
+	Ref          string `json:"ref" esType:"keyword"`
+	Tenant       string `json:"tenant,omitempty" esType:"keyword"`
+}
+
+// ID returns the ID of the symbol's document.
+func (s *Symbol) ID() string {
+	name := s.Name
+	if s.Recv != "" {
+		name = strings.TrimPrefix(s.Recv, "*") + "." + name
+	}
+	return PackageID(s.RepositoryID, s.ImportPath, s.Ref) + "#" + name
+}
+
+// Symbols returns every symbol in the package. The package's RepositoryID,
+// Ref, and Tenant must already be set.
+func (p *Package) Symbols() []*Symbol {
+	var syms []*Symbol
+	add := func(name, kind, recv, doc string) {
+		syms = append(syms, &Symbol{
+			Name:         name,
+			Kind:         kind,
+			Recv:         recv,
+			Doc:          doc,
+			ImportPath:   p.ImportPath,
+			RepositoryID: p.RepositoryID,
+			Ref:          p.Ref,
+			Tenant:       p.Tenant,
+		})
+	}
+	addValues := func(kind string, values []*doc.Value) {
+		for _, v := range values {
+			for _, n := range v.Names {
+				add(n, kind, "", v.Doc)
+			}
+		}
+	}
+	addFuncs := func(kind string, funcs []*doc.Func) {
+		for _, f := range funcs {
+			add(f.Name, kind, f.Recv, f.Doc)
+		}
+	}
+
+	addValues("const", p.Consts)
+	addValues("var", p.Vars)
+	addFuncs("func", p.Funcs)
+	for _, t := range p.Types {
+		add(t.Name, "type", "", t.Doc)
+		addValues("const", t.Consts)
+		addValues("var", t.Vars)
+		addFuncs("func", t.Funcs)
+		addFuncs("method", t.Methods)
+	}
+
+	return syms
+}
+
+func writeSymbols(w DocumentWriter, p *Package) {
+	index := IndexName(mappingNamed("symbol"))
+	for _, s := range p.Symbols() {
+		w.IndexWithRouting(index, "symbol", s.ID(), s.ImportPath, s)
+	}
+}
+
+// RebuildSymbols replaces the symbol index with symbols extracted from the
+// package index. Nothing else is touched, so this is how to fill in the
+// symbol index after changing how symbols are extracted.
+func (m *IndexManager) RebuildSymbols() error {
+	index := IndexName(mappingNamed("symbol"))
+	m.l.Infof("Deleting everything in %s", index)
+	_, err := m.elastic.
+		DeleteByQuery(index).
+		Type(m.elastic.SearchTypes("symbol")...).
+		Query(elastic.NewMatchAllQuery()).
+		ProceedOnVersionConflict().
+		Do(m.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not empty %s: {{err}}", index), err)
+	}
+
+	w, err := NewBulkWriter(NewBulkWriterParams{
+		Logger:  m.l,
+		Elastic: m.elastic,
+		Context: m.ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	scroll := m.elastic.
+		Scroll(IndexName(mappingNamed("package"))).
+		Type(m.elastic.SearchTypes("package")...).
+		Size(500)
+	n := 0
+	for {
+		result, err := scroll.Do(m.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.Close()
+			return errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			p := &Package{}
+			err := json.Unmarshal(*hit.Source, p)
+			if err != nil {
+				w.Close()
+				return errwrap.Wrapf(fmt.Sprintf("Could not unmarshal package %s: {{err}}", hit.Id), err)
+			}
+			writeSymbols(w, p)
+			n++
+		}
+	}
+
+	m.l.Infof("Wrote symbols for %d packages", n)
+	return w.Close()
+}
@@ -0,0 +1,44 @@
+package esmodels
+
+import (
+	"testing"
+
+	"github.com/autarch/metagodoc/doc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSymbols(t *testing.T) {
+	p := &Package{
+		ImportPath:   "github.com/foo/bar",
+		RepositoryID: "github.com/foo/bar",
+		Ref:          "master",
+		Consts:       []*doc.Value{{Names: []string{"A", "B"}}},
+		Funcs:        []*doc.Func{{Name: "New"}},
+		Types: []*doc.Type{
+			{
+				Name:    "T",
+				Funcs:   []*doc.Func{{Name: "NewT"}},
+				Methods: []*doc.Func{{Name: "Close", Recv: "*T"}},
+			},
+		},
+	}
+
+	var ids []string
+	for _, s := range p.Symbols() {
+		assert.Equal(t, "master", s.Ref)
+		ids = append(ids, s.Kind+" "+s.ID())
+	}
+	assert.Equal(
+		t,
+		[]string{
+			"const github.com/foo/bar:github.com/foo/bar@master#A",
+			"const github.com/foo/bar:github.com/foo/bar@master#B",
+			"func github.com/foo/bar:github.com/foo/bar@master#New",
+			"type github.com/foo/bar:github.com/foo/bar@master#T",
+			"func github.com/foo/bar:github.com/foo/bar@master#NewT",
+			"method github.com/foo/bar:github.com/foo/bar@master#T.Close",
+		},
+		ids,
+	)
+}
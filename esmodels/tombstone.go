@@ -0,0 +1,22 @@
+package esmodels
+
+// A Tombstone marks a repository that we know about but have deliberately
+// not indexed, or that has gone away. These are small documents so that
+// consumers can tell "never heard of it" apart from "skipped on purpose".
+type Tombstone struct {
+	ID      string `json:"id" esType:"keyword" esImportPath:"true" esRequired:"true"`
+	Kind    string `json:"kind" esType:"keyword" esRequired:"true"`
+	Reason  string `json:"reason" esType:"text"`
+	Created string `json:"created" esType:"date" esRequired:"true"`
+	// See SetTenant.
+	Tenant string `json:"tenant,omitempty" esType:"keyword"`
+}
+
+const (
+	TombstoneSkipped = "skipped"
+	// The repository was indexed but the host now says it doesn't exist.
+	TombstoneNotFound = "not-found"
+	// The host won't serve the repository for legal reasons, usually a DMCA
+	// takedown.
+	TombstoneUnavailable = "unavailable-for-legal-reasons"
+)
@@ -0,0 +1,133 @@
+package esmodels
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Elasticsearch refuses to index a keyword longer than this many bytes.
+const maxKeywordBytes = 32766
+
+// MaxAboutContentBytes is the largest About content we'll store. READMEs
+// bigger than this are almost always generated, and they bloat the repository
+// document for no benefit to search.
+const MaxAboutContentBytes = 512 * 1024
+
+// A ValidationError lists everything wrong with a document. Each problem
+// starts with the path to the field as it appears in the JSON document, like
+// "refs[2].last_updated".
+type ValidationError struct {
+	Index    string
+	ID       string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid document %s/%s: %s", e.Index, e.ID, strings.Join(e.Problems, "; "))
+}
+
+// Validate checks a document against the rules in its struct tags before it's
+// sent to Elasticsearch, so problems show up in our logs rather than as
+// mapping exceptions in the cluster's. Fields tagged with esRequired:"true"
+// must not be empty, dates must be in DateTimeFormat, and keywords must be
+// short enough to index. Documents which aren't structs, like partial
+// updates, aren't checked.
+func Validate(index, id string, doc interface{}) error {
+	v := reflect.ValueOf(doc)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var problems []string
+	validateStruct(v, "", &problems)
+	if a, ok := doc.(*Repository); ok && a.About != nil && len(a.About.Content) > MaxAboutContentBytes {
+		problems = append(problems, fmt.Sprintf("about.content is %d bytes, the maximum is %d", len(a.About.Content), MaxAboutContentBytes))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Index: index, ID: id, Problems: problems}
+}
+
+func validateStruct(v reflect.Value, prefix string, problems *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := propertyName(f)
+		if name == "" || f.PkgPath != "" {
+			continue
+		}
+		validateField(v.Field(i), f, prefix+name, problems)
+	}
+}
+
+func validateField(v reflect.Value, f reflect.StructField, path string, problems *[]string) {
+	if f.Tag.Get("esRequired") == "true" && isEmpty(v) {
+		*problems = append(*problems, path+" is required")
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		validateString(v.String(), f.Tag.Get("esType"), path, problems)
+	case reflect.Ptr:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+			validateStruct(v.Elem(), path+".", problems)
+		}
+	case reflect.Struct:
+		validateStruct(v, path+".", problems)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if e.Kind() == reflect.Ptr {
+				if e.IsNil() {
+					continue
+				}
+				e = e.Elem()
+			}
+			switch e.Kind() {
+			case reflect.Struct:
+				validateStruct(e, p+".", problems)
+			case reflect.String:
+				validateString(e.String(), f.Tag.Get("esType"), p, problems)
+			}
+		}
+	}
+}
+
+func validateString(s, esType, path string, problems *[]string) {
+	switch esType {
+	case "date":
+		if s == "" {
+			return
+		}
+		_, err := time.Parse(DateTimeFormat, s)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s is not a valid date: %q", path, s))
+		}
+	case "keyword":
+		if len(s) > maxKeywordBytes {
+			*problems = append(*problems, fmt.Sprintf("%s is %d bytes, which is too long for a keyword", path, len(s)))
+		}
+	}
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package esmodels
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	r := &Repository{
+		Name:        "metagodoc",
+		PrimaryURL:  "https://github.com/autarch/metagodoc",
+		LastCrawled: "2018-01-02T03:04:05",
+	}
+	assert.Nil(t, Validate("repository", "r", r), "valid repository")
+
+	r.LastCrawled = "yesterday"
+	r.PrimaryURL = ""
+	r.About = &About{Content: strings.Repeat("x", MaxAboutContentBytes+1)}
+	err := Validate("repository", "r", r)
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(
+			t,
+			[]string{
+				"primary_url is required",
+				`last_crawled is not a valid date: "yesterday"`,
+				"about.content is 524289 bytes, the maximum is 524288",
+			},
+			err.(*ValidationError).Problems,
+		)
+	}
+
+	err = Validate("symbol", "s", &Symbol{Name: "Foo", ImportPath: strings.Repeat("a", maxKeywordBytes+1)})
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(
+			t,
+			[]string{"kind is required", "import_path is 32767 bytes, which is too long for a keyword"},
+			err.(*ValidationError).Problems,
+		)
+	}
+
+	assert.Nil(t, Validate("repository", "r", map[string]interface{}{"stale": true}), "partial updates are not checked")
+}
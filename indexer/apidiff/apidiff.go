@@ -0,0 +1,226 @@
+// Package apidiff compares the exported API of two versions of a
+// repository's packages. This is a rough version of what
+// golang.org/x/exp/apidiff does, working from the declarations we've already
+// extracted rather than type checking anything. A declaration which changes
+// at all is counted as changed, and every change is assumed to be
+// incompatible except for new struct fields.
+package apidiff
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// Each list in a diff is cut off at this many symbols. Renaming a module's
+// packages would otherwise list every symbol in it.
+const maxSymbols = 200
+
+// Previous returns the name of the stable version tag which comes right
+// before the named tag, or false if there isn't one or the named tag isn't a
+// version. Removed refs are ignored.
+func Previous(refs []*esmodels.Ref, name string) (string, bool) {
+	v, ok := semver(name)
+	if !ok {
+		return "", false
+	}
+
+	var prev string
+	var prevV *version.Version
+	for _, r := range refs {
+		if r.RefType != "tag" || r.Removed != "" {
+			continue
+		}
+		rv, ok := semver(r.Name)
+		if !ok || rv.Prerelease() != "" || !rv.LessThan(v) {
+			continue
+		}
+		if prevV == nil || rv.GreaterThan(prevV) {
+			prev, prevV = r.Name, rv
+		}
+	}
+	return prev, prevV != nil
+}
+
+// ClaimsCompatible returns true if going from the previous version to the
+// next promises not to break anything. Under semantic versioning that's any
+// minor or patch release from v1 on, but not a prerelease.
+func ClaimsCompatible(prev, next string) bool {
+	pv, ok := semver(prev)
+	if !ok {
+		return false
+	}
+	nv, ok := semver(next)
+	if !ok {
+		return false
+	}
+	major := nv.Segments()[0]
+	return major > 0 && major == pv.Segments()[0] && nv.Prerelease() == ""
+}
+
+// Go only treats tags like "v1.2.3" as versions, but go-version would also
+// accept "v1.2" or "1.2.3".
+func semver(name string) (*version.Version, bool) {
+	if !strings.HasPrefix(name, "v") {
+		return nil, false
+	}
+	core := strings.SplitN(strings.SplitN(name, "+", 2)[0], "-", 2)[0]
+	if strings.Count(core, ".") != 2 {
+		return nil, false
+	}
+	v, err := version.NewVersion(name)
+	return v, err == nil
+}
+
+// Diff compares the packages of the tag named next with those of the tag
+// named prev. A package which was added or removed is listed by its import
+// path, rather than as every symbol in it.
+func Diff(prev, next string, prevPkgs, nextPkgs []*esmodels.Package) *esmodels.APIDiff {
+	d := &esmodels.APIDiff{Previous: prev}
+	before, after := api(prevPkgs), api(nextPkgs)
+
+	for _, name := range sortedKeys(after) {
+		sym := after[name]
+		old, ok := before[name]
+		switch {
+		case !ok && (name == sym.pkg || before[sym.pkg] != nil):
+			d.Added = appendSymbol(d, d.Added, name)
+		case ok && old.decl != sym.decl:
+			d.Changed = appendSymbol(d, d.Changed, name)
+			if !compatible(old.decl, sym.decl) {
+				d.Incompatible = true
+			}
+		}
+	}
+	for _, name := range sortedKeys(before) {
+		sym := before[name]
+		if after[name] == nil && (name == sym.pkg || after[sym.pkg] != nil) {
+			d.Removed = appendSymbol(d, d.Removed, name)
+			d.Incompatible = true
+		}
+	}
+
+	d.Breaking = d.Incompatible && ClaimsCompatible(prev, next)
+	return d
+}
+
+func appendSymbol(d *esmodels.APIDiff, list []string, name string) []string {
+	if len(list) == maxSymbols {
+		d.Truncated = true
+		return list
+	}
+	return append(list, name)
+}
+
+func sortedKeys(m map[string]*symbol) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type symbol struct {
+	// The import path of the symbol's package.
+	pkg  string
+	decl string
+}
+
+// api returns every exported symbol in the packages which other modules can
+// import, keyed by names like "example.com/pkg.Type.Method", along with
+// each package itself, keyed by its import path.
+func api(pkgs []*esmodels.Package) map[string]*symbol {
+	syms := make(map[string]*symbol)
+	for _, p := range pkgs {
+		if p.IsInternal || p.IsVendored || p.IsCommand || p.Name == "main" {
+			continue
+		}
+
+		ip := p.ImportPath
+		syms[ip] = &symbol{pkg: ip}
+		add := func(name, decl string) {
+			syms[ip+"."+name] = &symbol{pkg: ip, decl: decl}
+		}
+		for _, v := range append(p.Consts, p.Vars...) {
+			for _, n := range v.Names {
+				add(n, valueDecl(v.Decl.Text, n))
+			}
+		}
+		for _, f := range p.Funcs {
+			add(f.Name, normalize(f.Decl.Text))
+		}
+		for _, t := range p.Types {
+			add(t.Name, normalize(t.Decl.Text))
+			for _, v := range append(t.Consts, t.Vars...) {
+				for _, n := range v.Names {
+					add(n, valueDecl(v.Decl.Text, n))
+				}
+			}
+			for _, f := range t.Funcs {
+				add(f.Name, normalize(f.Decl.Text))
+			}
+			for _, m := range t.Methods {
+				add(t.Name+"."+m.Name, normalize(m.Decl.Text))
+			}
+		}
+	}
+	return syms
+}
+
+// normalize drops comments and indentation from a declaration, so that only
+// changes to the code itself count.
+func normalize(decl string) string {
+	var lines []string
+	for _, l := range strings.Split(decl, "\n") {
+		if i := strings.Index(l, "//"); i >= 0 {
+			l = l[:i]
+		}
+		l = strings.Join(strings.Fields(l), " ")
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// valueDecl returns the line of a const or var declaration which declares
+// name, so that changing one constant in a block doesn't count as changing
+// all of them. Constants which take their value from iota on an earlier line
+// can still shift without their own line changing, which we miss.
+func valueDecl(decl, name string) string {
+	decl = normalize(decl)
+	for _, l := range strings.Split(decl, "\n") {
+		lhs := strings.SplitN(l, "=", 2)[0]
+		lhs = strings.TrimPrefix(strings.TrimPrefix(lhs, "const "), "var ")
+		// Each name is followed by a comma, except the last, which may be
+		// followed by the type.
+		for _, part := range strings.Split(lhs, ",") {
+			if f := strings.Fields(part); len(f) > 0 && f[0] == name {
+				return l
+			}
+		}
+	}
+	return decl
+}
+
+// compatible returns true if code using the old declaration still works with
+// the new one. We only know that for structs which gained fields.
+func compatible(old, new string) bool {
+	if !strings.HasSuffix(strings.SplitN(old, "\n", 2)[0], "struct {") {
+		return false
+	}
+	have := make(map[string]bool)
+	for _, l := range strings.Split(new, "\n") {
+		have[l] = true
+	}
+	for _, l := range strings.Split(old, "\n") {
+		if !have[l] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package apidiff
+
+import (
+	"testing"
+
+	"github.com/autarch/metagodoc/doc"
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrevious(t *testing.T) {
+	refs := []*esmodels.Ref{
+		{Name: "master", RefType: "branch"},
+		{Name: "v0.9.0", RefType: "tag"},
+		{Name: "v1.0.0", RefType: "tag"},
+		{Name: "v1.1.0-rc.1", RefType: "tag"},
+		{Name: "v1.1.0", RefType: "tag", Removed: "2020-01-01T00:00:00Z"},
+		{Name: "v1.2", RefType: "tag"},
+		{Name: "v1.2.0", RefType: "tag"},
+	}
+
+	prev, ok := Previous(refs, "v1.2.0")
+	assert.True(t, ok)
+	assert.Equal(t, "v1.0.0", prev, "prereleases, removed refs, and short tags are skipped")
+
+	prev, ok = Previous(refs, "v1.0.0")
+	assert.True(t, ok)
+	assert.Equal(t, "v0.9.0", prev)
+
+	_, ok = Previous(refs, "v0.9.0")
+	assert.False(t, ok)
+	_, ok = Previous(refs, "master")
+	assert.False(t, ok)
+}
+
+func TestClaimsCompatible(t *testing.T) {
+	assert.True(t, ClaimsCompatible("v1.0.0", "v1.3.2"))
+	assert.False(t, ClaimsCompatible("v1.3.2", "v2.0.0"))
+	assert.False(t, ClaimsCompatible("v0.1.0", "v0.2.0"), "anything goes before v1")
+	assert.False(t, ClaimsCompatible("v1.0.0", "v1.1.0-beta"))
+	assert.False(t, ClaimsCompatible("master", "v1.1.0"))
+}
+
+func testPackage(importPath string, decls map[string]string) *esmodels.Package {
+	p := &esmodels.Package{Name: "pkg", ImportPath: importPath}
+	for name, decl := range decls {
+		p.Funcs = append(p.Funcs, &doc.Func{Name: name, Decl: doc.Code{Text: decl}})
+	}
+	return p
+}
+
+func TestDiff(t *testing.T) {
+	constBlock := func(b string) *doc.Value {
+		return &doc.Value{
+			Names: []string{"A", "B"},
+			Decl:  doc.Code{Text: "const (\n\tA = 1 // The first.\n\tB = " + b + "\n)"},
+		}
+	}
+
+	old := testPackage("example.com/m", map[string]string{
+		"New":  "func New() *T",
+		"Gone": "func Gone()",
+	})
+	old.Types = []*doc.Type{{Name: "T", Decl: doc.Code{Text: "type T struct {\n\tA int\n}"}}}
+	old.Consts = []*doc.Value{constBlock("2")}
+
+	next := testPackage("example.com/m", map[string]string{
+		"New":   "func New() *T // Now documented.",
+		"Fresh": "func Fresh()",
+	})
+	next.Types = []*doc.Type{{Name: "T", Decl: doc.Code{Text: "type T struct {\n\tA int\n\tB string\n}"}}}
+	next.Consts = []*doc.Value{constBlock("3")}
+
+	internal := testPackage("example.com/m/internal/x", map[string]string{"F": "func F()"})
+	internal.IsInternal = true
+
+	d := Diff("v1.0.0", "v1.1.0", []*esmodels.Package{
+		old,
+		testPackage("example.com/m/old", map[string]string{"F": "func F()"}),
+		{Name: "main", ImportPath: "example.com/m/cmd/tool"},
+	}, []*esmodels.Package{next, internal})
+
+	assert.Equal(t, "v1.0.0", d.Previous)
+	assert.Equal(t, []string{"example.com/m.Fresh"}, d.Added, "internal packages aren't part of the API")
+	assert.Equal(t, []string{"example.com/m.Gone", "example.com/m/old"}, d.Removed, "a removed package is listed once")
+	assert.Equal(t, []string{"example.com/m.B", "example.com/m.T"}, d.Changed, "only the changed line of a const block counts")
+	assert.True(t, d.Incompatible)
+	assert.True(t, d.Breaking)
+	assert.False(t, d.Truncated)
+
+	d = Diff("v1.0.0", "v2.0.0", []*esmodels.Package{old}, []*esmodels.Package{old})
+	assert.Empty(t, d.Added)
+	assert.Empty(t, d.Removed)
+	assert.Empty(t, d.Changed)
+	assert.False(t, d.Breaking)
+
+	// A new struct field on its own is compatible.
+	withField := testPackage("example.com/m", nil)
+	withField.Types = next.Types
+	withoutField := testPackage("example.com/m", nil)
+	withoutField.Types = old.Types
+	d = Diff("v1.0.0", "v1.1.0", []*esmodels.Package{withoutField}, []*esmodels.Package{withField})
+	assert.Equal(t, []string{"example.com/m.T"}, d.Changed)
+	assert.False(t, d.Incompatible)
+	assert.False(t, d.Breaking)
+}
@@ -0,0 +1,587 @@
+// Package config loads the indexer's settings. Every setting can come from
+// an environment variable, a YAML config file, or a default, in that order of
+// precedence. So a setting in the file is only used if its environment
+// variable isn't set, which makes it easy to override one thing, like a token,
+// without editing the file. The variables are documented in the env package.
+// An empty variable counts as not being set, except for METAGODOC_SEED_LISTS,
+// where an empty list turns seeding off. Boolean variables can only turn
+// something on, since any value other than an empty string means true.
+//
+// A file looks like this, and every setting in it is optional:
+//
+//	cache_root: /var/cache/metagodoc
+//	github_token: abc123
+//	log_level: info
+//	log_format: json
+//	elastic:
+//	  urls: [http://es1:9200, http://es2:9200]
+//	  index_prefix: metagodoc-staging-
+//	tag_policy: per_major=5,since=2018-01-01
+//	concurrency:
+//	  workers: 4
+//	  stage_workers: fetch=8
+//	budget:
+//	  max_repositories: 1000
+//	  max_duration: 6h
+//	retention:
+//	  horizon: 2160h
+//	  action: delete
+//	packages:
+//	  index_internal: true
+//	  vulndb_url: https://vuln.go.dev
+//	  module_proxy_url: https://proxy.golang.org
+//	daemon:
+//	  enabled: true
+//	  round_interval: 12h
+//	alerts:
+//	  webhooks: [https://hooks.slack.com/services/T000/B000/XXXX]
+//	  failure_rate: 0.25
+//
+// The field names are the same as in Config.
+//
+// Sending the indexer SIGHUP loads the config again. Only some settings can
+// change without a restart, see indexer.Indexer.Reload.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/env"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/indexer"
+	"github.com/autarch/metagodoc/indexer/modgraph"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+	"github.com/autarch/metagodoc/indexer/vulndb"
+
+	"github.com/hashicorp/errwrap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// How long the repositories in progress get to finish when the indexer is
+// stopped, if the config doesn't say.
+const DefaultShutdownTimeout = 5 * time.Minute
+
+type Config struct {
+	CacheRoot   string `yaml:"cache_root"`
+	GitHubToken string `yaml:"github_token"`
+	// See indexer.NewParams.
+	Tenant string `yaml:"tenant"`
+	// Production mode only changes how logs are written, and the level and
+	// format override that. See logger.NewParams.
+	Production bool   `yaml:"production"`
+	LogLevel   string `yaml:"log_level"`
+	LogFormat  string `yaml:"log_format"`
+	// The address to serve metrics, expvar, and pprof on, if any.
+	DebugAddr string `yaml:"debug_addr"`
+	// The address to serve the admin API on, if any, and the token it
+	// requires. See indexer.AdminHandler.
+	AdminAddr  string `yaml:"admin_addr"`
+	AdminToken string `yaml:"admin_token"`
+	// The OpenTelemetry collector to send traces to, if any.
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	Elastic      Elastic `yaml:"elastic"`
+	// Either "file" or "elastic".
+	QueueBackend string `yaml:"queue_backend"`
+	// See indexer.NewParams for these.
+	Output       string        `yaml:"output"`
+	DryRun       bool          `yaml:"dry_run"`
+	SkipList     string        `yaml:"skip_list"`
+	AllowList    string        `yaml:"allow_list"`
+	SeedLists    []string      `yaml:"seed_lists"`
+	TagPolicy    string        `yaml:"tag_policy"`
+	TagPolicies  string        `yaml:"tag_policies"`
+	RepoPolicies string        `yaml:"repo_policies"`
+	RateLimits   string        `yaml:"rate_limits"`
+	FetchDepth   int           `yaml:"fetch_depth"`
+	RepoTimeout  time.Duration `yaml:"repo_timeout"`
+	MaxFailures  int           `yaml:"max_failures"`
+	// Where to write crawl reports, and whether to store them in
+	// Elasticsearch too. See indexer.NewParams.
+	CrawlReports          string `yaml:"crawl_reports"`
+	CrawlReportsToElastic bool   `yaml:"crawl_reports_to_elastic"`
+	// How long the repositories in progress get to finish after the first
+	// SIGINT or SIGTERM. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// The most disk space cached clones may use.
+	MaxCloneCacheBytes int64       `yaml:"max_clone_cache_bytes"`
+	Concurrency        Concurrency `yaml:"concurrency"`
+	Budget             Budget      `yaml:"budget"`
+	Retention          Retention   `yaml:"retention"`
+	About              About       `yaml:"about"`
+	Packages           Packages    `yaml:"packages"`
+	Daemon             Daemon      `yaml:"daemon"`
+	Alerts             Alerts      `yaml:"alerts"`
+}
+
+type Elastic struct {
+	URLs            []string `yaml:"urls"`
+	IndexPrefix     string   `yaml:"index_prefix"`
+	DisableSniffing bool     `yaml:"disable_sniffing"`
+	Trace           bool     `yaml:"trace"`
+}
+
+type Concurrency struct {
+	Workers      int    `yaml:"workers"`
+	StageWorkers string `yaml:"stage_workers"`
+	MaxClones    int    `yaml:"max_clones"`
+	MaxAPICalls  int    `yaml:"max_api_calls"`
+}
+
+type Budget struct {
+	MaxRepositories int           `yaml:"max_repositories"`
+	MaxCloneBytes   int64         `yaml:"max_clone_bytes"`
+	MaxDuration     time.Duration `yaml:"max_duration"`
+}
+
+type Retention struct {
+	Horizon time.Duration `yaml:"horizon"`
+	Action  string        `yaml:"action"`
+}
+
+// About is how READMEs too big to keep in the repository document are
+// stored. See esmodels.AboutPolicy.
+type About struct {
+	Policy      string `yaml:"policy"`
+	InlineBytes int    `yaml:"inline_bytes"`
+	StoreDir    string `yaml:"store_dir"`
+	StoreURL    string `yaml:"store_url"`
+}
+
+// Daemon keeps the indexer running instead of stopping once the budget runs
+// out. See indexer.Daemon.
+type Daemon struct {
+	Enabled          bool          `yaml:"enabled"`
+	RoundInterval    time.Duration `yaml:"round_interval"`
+	SeedInterval     time.Duration `yaml:"seed_interval"`
+	ScheduleInterval time.Duration `yaml:"schedule_interval"`
+}
+
+// Alerts are posted to webhooks when the crawl is in trouble. See
+// indexer.Alerts.
+type Alerts struct {
+	Webhooks    []string      `yaml:"webhooks"`
+	FailureRate float64       `yaml:"failure_rate"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+}
+
+// Packages says which packages are indexed, and how.
+type Packages struct {
+	ExcludeGenerated bool `yaml:"exclude_generated"`
+	IndexTestdata    bool `yaml:"index_testdata"`
+	IndexInternal    bool `yaml:"index_internal"`
+	SummarizeVendor  bool `yaml:"summarize_vendor"`
+
+	// See indexer.NewParams.VulnDBURL.
+	VulnDBURL string `yaml:"vulndb_url"`
+	// See indexer.NewParams.ModuleProxyURL.
+	ModuleProxyURL string `yaml:"module_proxy_url"`
+}
+
+// FromEnv returns the config from the environment alone.
+func FromEnv() (*Config, error) {
+	c := &Config{
+		CacheRoot:    env.Root(),
+		GitHubToken:  env.GitHubToken(),
+		Tenant:       env.Tenant(),
+		Production:   env.IsProd(),
+		LogLevel:     env.LogLevel(),
+		LogFormat:    env.LogFormat(),
+		DebugAddr:    env.DebugAddr(),
+		AdminAddr:    env.AdminAddr(),
+		AdminToken:   env.AdminToken(),
+		OTLPEndpoint: env.OTLPEndpoint(),
+		QueueBackend: env.QueueBackend(),
+		Output:       env.Output(),
+		DryRun:       env.DryRun(),
+		CrawlReports: env.CrawlReports(),
+		SkipList:     env.SkipList(),
+		AllowList:    env.AllowList(),
+		SeedLists:    env.SeedLists(),
+		TagPolicy:    env.TagPolicy(),
+		TagPolicies:  env.TagPolicies(),
+		RepoPolicies: env.RepoPolicies(),
+		RateLimits:   env.RateLimits(),
+		Elastic: Elastic{
+			URLs:            env.ElasticURLs(),
+			IndexPrefix:     env.IndexPrefix(),
+			DisableSniffing: env.DisableElasticSniffing(),
+			Trace:           env.TraceElastic(),
+		},
+		Retention: Retention{Action: env.RetentionAction()},
+		About: About{
+			Policy:   env.AboutPolicy(),
+			StoreDir: env.AboutStoreDir(),
+			StoreURL: env.AboutStoreURL(),
+		},
+		Packages: Packages{
+			ExcludeGenerated: env.ExcludeGenerated(),
+			IndexTestdata:    env.IndexTestdata(),
+			IndexInternal:    env.IndexInternal(),
+			SummarizeVendor:  env.SummarizeVendor(),
+			VulnDBURL:        env.VulnDBURL(),
+			ModuleProxyURL:   env.ModuleProxyURL(),
+		},
+		Concurrency: Concurrency{StageWorkers: env.StageWorkers()},
+		Daemon:      Daemon{Enabled: env.Daemon()},
+		Alerts:      Alerts{Webhooks: env.AlertWebhooks()},
+	}
+	c.CrawlReportsToElastic = env.CrawlReportsToElastic()
+
+	var err error
+	c.FetchDepth, err = env.FetchDepth()
+	if err != nil {
+		return nil, err
+	}
+	c.RepoTimeout, err = env.RepoTimeout()
+	if err != nil {
+		return nil, err
+	}
+	c.MaxFailures, err = env.MaxFailures()
+	if err != nil {
+		return nil, err
+	}
+	c.ShutdownTimeout, err = env.ShutdownTimeout()
+	if err != nil {
+		return nil, err
+	}
+	c.MaxCloneCacheBytes, err = env.MaxCloneCacheBytes()
+	if err != nil {
+		return nil, err
+	}
+	c.Concurrency.Workers, err = env.Workers()
+	if err != nil {
+		return nil, err
+	}
+	c.Concurrency.MaxClones, err = env.MaxClones()
+	if err != nil {
+		return nil, err
+	}
+	c.Concurrency.MaxAPICalls, err = env.MaxAPICalls()
+	if err != nil {
+		return nil, err
+	}
+	c.Budget.MaxRepositories, err = env.MaxRepositories()
+	if err != nil {
+		return nil, err
+	}
+	c.Budget.MaxCloneBytes, err = env.MaxCloneBytes()
+	if err != nil {
+		return nil, err
+	}
+	c.Budget.MaxDuration, err = env.MaxDuration()
+	if err != nil {
+		return nil, err
+	}
+	c.Retention.Horizon, err = env.RetentionHorizon()
+	if err != nil {
+		return nil, err
+	}
+	c.About.InlineBytes, err = env.AboutInlineBytes()
+	if err != nil {
+		return nil, err
+	}
+	c.Daemon.RoundInterval, err = env.RoundInterval()
+	if err != nil {
+		return nil, err
+	}
+	c.Daemon.SeedInterval, err = env.SeedInterval()
+	if err != nil {
+		return nil, err
+	}
+	c.Daemon.ScheduleInterval, err = env.ScheduleInterval()
+	if err != nil {
+		return nil, err
+	}
+	c.Alerts.FailureRate, err = env.AlertFailureRate()
+	if err != nil {
+		return nil, err
+	}
+	c.Alerts.Cooldown, err = env.AlertCooldown()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load returns the config from the YAML file at the given path, with any
+// settings whose environment variables are set replacing what's in the file.
+// If the path is empty then only the environment is used.
+func Load(path string) (*Config, error) {
+	c, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s: {{err}}", path), err)
+		}
+
+		// The environment's config has the defaults for anything that
+		// isn't in the file.
+		e := c
+		c = &Config{}
+		*c = *e
+		err = yaml.UnmarshalStrict(b, c)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid config in %s: {{err}}", path), err)
+		}
+		for _, o := range envOverrides {
+			if isSet(o.name) {
+				o.apply(c, e)
+			}
+		}
+	}
+
+	err = c.Validate()
+	if err != nil {
+		if path != "" {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid config in %s: {{err}}", path), err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func isSet(name string) bool {
+	if name == "METAGODOC_SEED_LISTS" {
+		_, ok := os.LookupEnv(name)
+		return ok
+	}
+	return os.Getenv(name) != ""
+}
+
+// Each of these copies one setting from the environment's config, e, to c.
+var envOverrides = []struct {
+	name  string
+	apply func(c, e *Config)
+}{
+	{"METAGODOC_ROOT", func(c, e *Config) { c.CacheRoot = e.CacheRoot }},
+	{"METAGODOC_GITHUB_TOKEN", func(c, e *Config) { c.GitHubToken = e.GitHubToken }},
+	{"METAGODOC_PRODUCTION", func(c, e *Config) { c.Production = e.Production }},
+	{"METAGODOC_LOG_LEVEL", func(c, e *Config) { c.LogLevel = e.LogLevel }},
+	{"METAGODOC_LOG_FORMAT", func(c, e *Config) { c.LogFormat = e.LogFormat }},
+	{"METAGODOC_DEBUG_ADDR", func(c, e *Config) { c.DebugAddr = e.DebugAddr }},
+	{"METAGODOC_ADMIN_ADDR", func(c, e *Config) { c.AdminAddr = e.AdminAddr }},
+	{"METAGODOC_ADMIN_TOKEN", func(c, e *Config) { c.AdminToken = e.AdminToken }},
+	{"METAGODOC_OTLP_ENDPOINT", func(c, e *Config) { c.OTLPEndpoint = e.OTLPEndpoint }},
+	{"METAGODOC_TENANT", func(c, e *Config) { c.Tenant = e.Tenant }},
+	{"METAGODOC_QUEUE_BACKEND", func(c, e *Config) { c.QueueBackend = e.QueueBackend }},
+	{"METAGODOC_OUTPUT", func(c, e *Config) { c.Output = e.Output }},
+	{"METAGODOC_DRY_RUN", func(c, e *Config) { c.DryRun = e.DryRun }},
+	{"METAGODOC_CRAWL_REPORTS", func(c, e *Config) { c.CrawlReports = e.CrawlReports }},
+	{"METAGODOC_CRAWL_REPORTS_ELASTIC", func(c, e *Config) { c.CrawlReportsToElastic = e.CrawlReportsToElastic }},
+	{"METAGODOC_SKIP_LIST", func(c, e *Config) { c.SkipList = e.SkipList }},
+	{"METAGODOC_ALLOW_LIST", func(c, e *Config) { c.AllowList = e.AllowList }},
+	{"METAGODOC_SEED_LISTS", func(c, e *Config) { c.SeedLists = e.SeedLists }},
+	{"METAGODOC_TAG_POLICY", func(c, e *Config) { c.TagPolicy = e.TagPolicy }},
+	{"METAGODOC_TAG_POLICIES", func(c, e *Config) { c.TagPolicies = e.TagPolicies }},
+	{"METAGODOC_REPO_POLICIES", func(c, e *Config) { c.RepoPolicies = e.RepoPolicies }},
+	{"METAGODOC_RATE_LIMITS", func(c, e *Config) { c.RateLimits = e.RateLimits }},
+	{"METAGODOC_FETCH_DEPTH", func(c, e *Config) { c.FetchDepth = e.FetchDepth }},
+	{"METAGODOC_REPO_TIMEOUT", func(c, e *Config) { c.RepoTimeout = e.RepoTimeout }},
+	{"METAGODOC_MAX_FAILURES", func(c, e *Config) { c.MaxFailures = e.MaxFailures }},
+	{"METAGODOC_SHUTDOWN_TIMEOUT", func(c, e *Config) { c.ShutdownTimeout = e.ShutdownTimeout }},
+	{"METAGODOC_MAX_CLONE_CACHE_BYTES", func(c, e *Config) { c.MaxCloneCacheBytes = e.MaxCloneCacheBytes }},
+	{"METAGODOC_ELASTIC_URLS", func(c, e *Config) { c.Elastic.URLs = e.Elastic.URLs }},
+	{"METAGODOC_INDEX_PREFIX", func(c, e *Config) { c.Elastic.IndexPrefix = e.Elastic.IndexPrefix }},
+	{"METAGODOC_ELASTIC_NO_SNIFF", func(c, e *Config) { c.Elastic.DisableSniffing = e.Elastic.DisableSniffing }},
+	{"METAGODOC_TRACE_ELASTIC", func(c, e *Config) { c.Elastic.Trace = e.Elastic.Trace }},
+	{"METAGODOC_WORKERS", func(c, e *Config) { c.Concurrency.Workers = e.Concurrency.Workers }},
+	{"METAGODOC_STAGE_WORKERS", func(c, e *Config) { c.Concurrency.StageWorkers = e.Concurrency.StageWorkers }},
+	{"METAGODOC_MAX_CLONES", func(c, e *Config) { c.Concurrency.MaxClones = e.Concurrency.MaxClones }},
+	{"METAGODOC_MAX_API_CALLS", func(c, e *Config) { c.Concurrency.MaxAPICalls = e.Concurrency.MaxAPICalls }},
+	{"METAGODOC_MAX_REPOSITORIES", func(c, e *Config) { c.Budget.MaxRepositories = e.Budget.MaxRepositories }},
+	{"METAGODOC_MAX_CLONE_BYTES", func(c, e *Config) { c.Budget.MaxCloneBytes = e.Budget.MaxCloneBytes }},
+	{"METAGODOC_MAX_DURATION", func(c, e *Config) { c.Budget.MaxDuration = e.Budget.MaxDuration }},
+	{"METAGODOC_RETENTION_HORIZON", func(c, e *Config) { c.Retention.Horizon = e.Retention.Horizon }},
+	{"METAGODOC_RETENTION_ACTION", func(c, e *Config) { c.Retention.Action = e.Retention.Action }},
+	{"METAGODOC_ABOUT_POLICY", func(c, e *Config) { c.About.Policy = e.About.Policy }},
+	{"METAGODOC_ABOUT_INLINE_BYTES", func(c, e *Config) { c.About.InlineBytes = e.About.InlineBytes }},
+	{"METAGODOC_ABOUT_STORE_DIR", func(c, e *Config) { c.About.StoreDir = e.About.StoreDir }},
+	{"METAGODOC_ABOUT_STORE_URL", func(c, e *Config) { c.About.StoreURL = e.About.StoreURL }},
+	{"METAGODOC_EXCLUDE_GENERATED", func(c, e *Config) { c.Packages.ExcludeGenerated = e.Packages.ExcludeGenerated }},
+	{"METAGODOC_INDEX_TESTDATA", func(c, e *Config) { c.Packages.IndexTestdata = e.Packages.IndexTestdata }},
+	{"METAGODOC_INDEX_INTERNAL", func(c, e *Config) { c.Packages.IndexInternal = e.Packages.IndexInternal }},
+	{"METAGODOC_SUMMARIZE_VENDOR", func(c, e *Config) { c.Packages.SummarizeVendor = e.Packages.SummarizeVendor }},
+	{"METAGODOC_VULNDB_URL", func(c, e *Config) { c.Packages.VulnDBURL = e.Packages.VulnDBURL }},
+	{"METAGODOC_MODULE_PROXY_URL", func(c, e *Config) { c.Packages.ModuleProxyURL = e.Packages.ModuleProxyURL }},
+	{"METAGODOC_DAEMON", func(c, e *Config) { c.Daemon.Enabled = e.Daemon.Enabled }},
+	{"METAGODOC_ROUND_INTERVAL", func(c, e *Config) { c.Daemon.RoundInterval = e.Daemon.RoundInterval }},
+	{"METAGODOC_SEED_INTERVAL", func(c, e *Config) { c.Daemon.SeedInterval = e.Daemon.SeedInterval }},
+	{"METAGODOC_SCHEDULE_INTERVAL", func(c, e *Config) { c.Daemon.ScheduleInterval = e.Daemon.ScheduleInterval }},
+	{"METAGODOC_ALERT_WEBHOOKS", func(c, e *Config) { c.Alerts.Webhooks = e.Alerts.Webhooks }},
+	{"METAGODOC_ALERT_FAILURE_RATE", func(c, e *Config) { c.Alerts.FailureRate = e.Alerts.FailureRate }},
+	{"METAGODOC_ALERT_COOLDOWN", func(c, e *Config) { c.Alerts.Cooldown = e.Alerts.Cooldown }},
+}
+
+// Validate checks the settings which would otherwise only fail once the
+// indexer got around to using them.
+func (c *Config) Validate() error {
+	if c.CacheRoot == "" {
+		return fmt.Errorf("cache_root cannot be empty")
+	}
+
+	switch c.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("Unknown log level: %s", c.LogLevel)
+	}
+
+	switch c.LogFormat {
+	case "", "json", "console":
+	default:
+		return fmt.Errorf("Unknown log format: %s", c.LogFormat)
+	}
+
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		return fmt.Errorf("admin_token is required when admin_addr is set")
+	}
+
+	if c.OTLPEndpoint != "" && !strings.HasPrefix(c.OTLPEndpoint, "http://") && !strings.HasPrefix(c.OTLPEndpoint, "https://") {
+		return fmt.Errorf("Invalid otlp_endpoint %q, expected an http or https URL", c.OTLPEndpoint)
+	}
+
+	switch c.QueueBackend {
+	case "", "file", "elastic":
+	default:
+		return fmt.Errorf("Unknown queue backend: %s", c.QueueBackend)
+	}
+
+	for name, n := range map[string]int64{
+		"fetch_depth":               int64(c.FetchDepth),
+		"repo_timeout":              int64(c.RepoTimeout),
+		"max_failures":              int64(c.MaxFailures),
+		"shutdown_timeout":          int64(c.ShutdownTimeout),
+		"max_clone_cache_bytes":     c.MaxCloneCacheBytes,
+		"concurrency.workers":       int64(c.Concurrency.Workers),
+		"concurrency.max_clones":    int64(c.Concurrency.MaxClones),
+		"concurrency.max_api_calls": int64(c.Concurrency.MaxAPICalls),
+		"budget.max_repositories":   int64(c.Budget.MaxRepositories),
+		"budget.max_clone_bytes":    c.Budget.MaxCloneBytes,
+		"budget.max_duration":       int64(c.Budget.MaxDuration),
+		"retention.horizon":         int64(c.Retention.Horizon),
+	} {
+		if n < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+
+	_, err := indexer.ParseStages(c.Concurrency.StageWorkers, c.Concurrency.Workers)
+	if err != nil {
+		return err
+	}
+	_, err = tagpolicy.Parse(c.TagPolicy)
+	if err != nil {
+		return err
+	}
+	err = c.retention().Validate()
+	if err != nil {
+		return err
+	}
+	err = c.daemon().Validate()
+	if err != nil {
+		return err
+	}
+	err = c.alerts().Validate()
+	if err != nil {
+		return err
+	}
+	if c.Packages.VulnDBURL != "" {
+		_, err = vulndb.New(c.Packages.VulnDBURL)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Packages.ModuleProxyURL != "" {
+		_, err = modgraph.New(c.Packages.ModuleProxyURL)
+		if err != nil {
+			return err
+		}
+	}
+	return c.aboutPolicy().Validate()
+}
+
+// Params returns the parameters for indexer.New. The caller still has to
+// set the Logger, and the Context if the crawl can be stopped.
+func (c *Config) Params() indexer.NewParams {
+	return indexer.NewParams{
+		GitHubToken:  c.GitHubToken,
+		CacheRoot:    c.CacheRoot,
+		TraceElastic: c.Elastic.Trace,
+		ElasticURLs:  c.Elastic.URLs,
+		IndexPrefix:  c.Elastic.IndexPrefix,
+		Tenant:       c.Tenant,
+		QueueBackend: c.QueueBackend,
+		SkipList:     c.SkipList,
+		AllowList:    c.AllowList,
+		TagPolicy:    c.TagPolicy,
+		TagPolicies:  c.TagPolicies,
+		RepoPolicies: c.RepoPolicies,
+		RateLimits:   c.RateLimits,
+		SeedLists:    c.SeedLists,
+		Budget: indexer.Budget{
+			MaxRepositories: c.Budget.MaxRepositories,
+			MaxCloneBytes:   c.Budget.MaxCloneBytes,
+			MaxDuration:     c.Budget.MaxDuration,
+		},
+		Workers:      c.Concurrency.Workers,
+		StageWorkers: c.Concurrency.StageWorkers,
+		MaxClones:    c.Concurrency.MaxClones,
+		MaxAPICalls:  c.Concurrency.MaxAPICalls,
+		Retention:    c.retention(),
+		Daemon:       c.daemon(),
+		Alerts:       c.alerts(),
+		About:        c.aboutPolicy(),
+		DryRun:       c.DryRun,
+		Output:       c.Output,
+		CrawlReports: c.CrawlReports,
+
+		DisableElasticSniffing: c.Elastic.DisableSniffing,
+		CrawlReportsToElastic:  c.CrawlReportsToElastic,
+		MaxCloneCacheBytes:     c.MaxCloneCacheBytes,
+		FetchDepth:             c.FetchDepth,
+		ExcludeGenerated:       c.Packages.ExcludeGenerated,
+		IndexTestdata:          c.Packages.IndexTestdata,
+		IndexInternal:          c.Packages.IndexInternal,
+		SummarizeVendor:        c.Packages.SummarizeVendor,
+		VulnDBURL:              c.Packages.VulnDBURL,
+		ModuleProxyURL:         c.Packages.ModuleProxyURL,
+		RepoTimeout:            c.RepoTimeout,
+		MaxFailures:            c.MaxFailures,
+	}
+}
+
+func (c *Config) retention() indexer.Retention {
+	return indexer.Retention{Horizon: c.Retention.Horizon, Action: c.Retention.Action}
+}
+
+func (c *Config) daemon() indexer.Daemon {
+	return indexer.Daemon{
+		Enabled:          c.Daemon.Enabled,
+		RoundInterval:    c.Daemon.RoundInterval,
+		SeedInterval:     c.Daemon.SeedInterval,
+		ScheduleInterval: c.Daemon.ScheduleInterval,
+	}
+}
+
+func (c *Config) alerts() indexer.Alerts {
+	return indexer.Alerts{
+		Webhooks:    c.Alerts.Webhooks,
+		FailureRate: c.Alerts.FailureRate,
+		Cooldown:    c.Alerts.Cooldown,
+	}
+}
+
+func (c *Config) aboutPolicy() esmodels.AboutPolicy {
+	p := esmodels.AboutPolicy{Mode: c.About.Policy, InlineBytes: c.About.InlineBytes}
+	if c.About.StoreDir != "" {
+		p.Store = &esmodels.DirAboutStore{Dir: c.About.StoreDir, BaseURL: c.About.StoreURL}
+	}
+	return p
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// setenv sets an environment variable and returns a function which restores
+// its previous value.
+func setenv(t *testing.T, name, value string) func() {
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, dir, yaml string) string {
+	path := filepath.Join(dir, "indexer.yaml")
+	err := ioutil.WriteFile(path, []byte(yaml), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	defer setenv(t, "METAGODOC_ROOT", "/from/env")()
+	defer setenv(t, "METAGODOC_INDEX_PREFIX", "env-")()
+	defer setenv(t, "METAGODOC_WORKERS", "2")()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, "/from/env", c.CacheRoot)
+	assert.Equal(t, 2, c.Concurrency.Workers)
+
+	c, err = Load(writeConfig(t, dir, `
+cache_root: /from/file
+github_token: file-token
+elastic:
+  urls: [http://es1:9200, http://es2:9200]
+concurrency:
+  workers: 5
+  max_clones: 3
+budget:
+  max_duration: 6h
+retention:
+  horizon: 720h
+  action: delete
+packages:
+  index_internal: true
+daemon:
+  enabled: true
+  round_interval: 12h
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "/from/env", c.CacheRoot, "the environment wins over the file")
+	assert.Equal(t, 2, c.Concurrency.Workers)
+	assert.Equal(t, "env-", c.Elastic.IndexPrefix)
+	assert.Equal(t, "file-token", c.GitHubToken, "the file is used for what the environment doesn't set")
+
+	p := c.Params()
+	assert.Equal(t, "/from/env", p.CacheRoot)
+	assert.Equal(t, []string{"http://es1:9200", "http://es2:9200"}, p.ElasticURLs)
+	assert.Equal(t, 3, p.MaxClones)
+	assert.Equal(t, 6*time.Hour, p.Budget.MaxDuration)
+	assert.Equal(t, 720*time.Hour, p.Retention.Horizon)
+	assert.Equal(t, "delete", p.Retention.Action)
+	assert.True(t, p.IndexInternal)
+	assert.False(t, p.IndexTestdata)
+	assert.True(t, p.Daemon.Enabled)
+	assert.Equal(t, 12*time.Hour, p.Daemon.RoundInterval)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for name, yaml := range map[string]string{
+		"unknown setting":  "cache_dir: /tmp\n",
+		"bad duration":     "budget:\n  max_duration: soon\n",
+		"negative":         "concurrency:\n  workers: -1\n",
+		"queue backend":    "queue_backend: redis\n",
+		"log level":        "log_level: loud\n",
+		"stage workers":    "concurrency:\n  stage_workers: parse=2\n",
+		"tag policy":       "tag_policy: per_major=lots\n",
+		"retention action": "retention:\n  action: shred\n",
+		"empty cache root": "cache_root: ''\n",
+		"daemon interval":  "daemon:\n  seed_interval: -1h\n",
+		"alert webhook":    "alerts:\n  webhooks: [hooks.example.com]\n",
+		"vulndb url":       "packages:\n  vulndb_url: vuln.go.dev\n",
+		"module proxy url": "packages:\n  module_proxy_url: proxy.golang.org\n",
+	} {
+		_, err := Load(writeConfig(t, dir, yaml))
+		assert.Error(t, err, name)
+	}
+
+	_, err := Load(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err, "missing file")
+}
+
+// Every environment variable should be able to override the config file.
+func TestEnvOverrides(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("..", "..", "env", "env.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overridden := make(map[string]bool)
+	for _, o := range envOverrides {
+		overridden[o.name] = true
+	}
+	for _, name := range regexp.MustCompile(`"(METAGODOC_[A-Z_]+)"`).FindAllStringSubmatch(string(b), -1) {
+		if name[1] != "METAGODOC_CONFIG" {
+			assert.True(t, overridden[name[1]], name[1])
+		}
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	defer setenv(t, "METAGODOC_SEED_LISTS", "")()
+	c, err := Load(writeConfig(t, dir, "seed_lists: [https://example.com/list.md]\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, c.SeedLists, "an empty seed list still wins")
+}
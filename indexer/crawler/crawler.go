@@ -1,22 +1,46 @@
 package crawler
 
 import (
+	"fmt"
 	"net/url"
 	"time"
 
 	"github.com/autarch/metagodoc/indexer/repository"
 )
 
+// A Result is sent by a crawler for each repository it discovers. The URL
+// can be turned into a repository.Repository by passing it back to the
+// crawler's CrawlOne method.
 type Result struct {
-	Crawler    Crawler
-	Repository repository.Repository
-	Exhausted  bool
-	Error      error
+	Crawler Crawler
+	URL     *url.URL
+	// The number of stars the repository has, if the crawler knows it. This
+	// is used to prioritize the crawl queue.
+	Stars     int
+	Exhausted bool
+	Error     error
 }
 
 type Crawler interface {
 	Name() string
+	Handles(*url.URL) bool
 	SleepDuration() time.Duration
 	CrawlAll(ch chan *Result)
 	CrawlOne(*url.URL) (repository.Repository, error)
+	// Check asks the upstream host whether the repository still exists. It
+	// returns a *GoneError if it doesn't, and nil if it does.
+	Check(*url.URL) error
+}
+
+// A GoneError is returned when the upstream host says a repository has been
+// deleted or can no longer be served, for example because of a DMCA takedown.
+type GoneError struct {
+	URL *url.URL
+	// Either 404 or 451.
+	StatusCode int
+	Reason     string
+}
+
+func (e *GoneError) Error() string {
+	return fmt.Sprintf("%s is gone (%d): %s", e.URL, e.StatusCode, e.Reason)
 }
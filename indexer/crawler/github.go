@@ -3,12 +3,19 @@ package crawler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/autarch/metagodoc/indexer/ratelimit"
 	"github.com/autarch/metagodoc/indexer/repository"
 	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
 	"github.com/google/go-github/github"
 	"github.com/hashicorp/errwrap"
 
@@ -16,16 +23,34 @@ import (
 )
 
 type githubCrawler struct {
-	l             *logger.Logger
-	cacheRoot     string
-	github        *github.Client
-	currentResult *github.RepositoriesSearchResult
-	currentIdx    int
-	nextPage      int
-	ctx           context.Context
+	l         *logger.Logger
+	cacheRoot string
+	github    *github.Client
+	limiter   *ratelimit.Limiter
+	settings  repository.Settings
+	ctx       context.Context
+
+	// The slices of the search space left to crawl in the current pass.
+	slices   []searchSlice
+	current  *searchSlice
+	nextPage int
+
+	// Each pass searches for repositories created since the start of the
+	// previous pass, so after the first pass we only look for new
+	// repositories.
+	inPass    bool
+	passStart time.Time
+	since     time.Time
 }
 
-func NewGitHubCrawler(l *logger.Logger, cacheRoot string, token string, ctx context.Context) (Crawler, error) {
+func NewGitHubCrawler(
+	l *logger.Logger,
+	cacheRoot string,
+	token string,
+	limiter *ratelimit.Limiter,
+	settings repository.Settings,
+	ctx context.Context,
+) (Crawler, error) {
 	if token == "" {
 		return nil, errors.New("Cannot crawl GitHub without an access token")
 	}
@@ -33,19 +58,111 @@ func NewGitHubCrawler(l *logger.Logger, cacheRoot string, token string, ctx cont
 	return &githubCrawler{
 		l:         l,
 		cacheRoot: cacheRoot,
-		github:    githubClient(token),
-		nextPage:  1,
+		github:    githubClient(token, limiter),
+		limiter:   limiter,
+		settings:  settings,
 		ctx:       ctx,
+		since:     searchEpoch,
 	}, nil
 }
 
-func githubClient(token string) *github.Client {
+func githubClient(token string, limiter *ratelimit.Limiter) *github.Client {
 	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
 	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = &quotaTransport{RoundTripper: limiter.Transport(tc.Transport), token: tokenHint(token)}
 	return github.NewClient(tc)
 }
 
+// quotaTransport counts our API requests and records how many GitHub says we
+// have left, so we can see it on /metrics before we run out. The gauge is
+// only set from the core quota, since searches have a much smaller quota of
+// their own which would otherwise overwrite it.
+type quotaTransport struct {
+	http.RoundTripper
+	token string
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	metrics.GitHubRequests.Add(1)
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		if recordQuota(t.token, resp.Header, remaining).Resource == "core" {
+			metrics.GitHubQuotaRemaining.Set(float64(remaining))
+		}
+	}
+	return resp, nil
+}
+
+// A GitHubQuota is what GitHub last told us about one of the rate limits for
+// one of our tokens. Each token has several, like "core" for most API calls
+// and "search" for searches.
+type GitHubQuota struct {
+	// Just the end of the token, so it can be told apart from the others.
+	Token     string    `json:"token"`
+	Resource  string    `json:"resource"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	Updated   time.Time `json:"updated"`
+}
+
+var quotas = struct {
+	m  map[string]*GitHubQuota
+	mu sync.Mutex
+}{m: make(map[string]*GitHubQuota)}
+
+func tokenHint(token string) string {
+	if len(token) <= 4 {
+		return "..."
+	}
+	return "..." + token[len(token)-4:]
+}
+
+func recordQuota(token string, h http.Header, remaining int) *GitHubQuota {
+	q := &GitHubQuota{
+		Token:     token,
+		Resource:  h.Get("X-RateLimit-Resource"),
+		Remaining: remaining,
+		Updated:   time.Now().UTC(),
+	}
+	if q.Resource == "" {
+		q.Resource = "core"
+	}
+	q.Limit, _ = strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		q.Reset = time.Unix(reset, 0).UTC()
+	}
+
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	quotas.m[q.Token+" "+q.Resource] = q
+	return q
+}
+
+// GitHubQuotas returns the latest rate limits for each token we've used,
+// sorted by token and resource.
+func GitHubQuotas() []*GitHubQuota {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+
+	all := []*GitHubQuota{}
+	for _, q := range quotas.m {
+		c := *q
+		all = append(all, &c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Token != all[j].Token {
+			return all[i].Token < all[j].Token
+		}
+		return all[i].Resource < all[j].Resource
+	})
+	return all
+}
+
 type githubTransport struct {
 	token string
 	*http.Transport
@@ -60,6 +177,10 @@ func (gh *githubCrawler) Name() string {
 	return "GitHub"
 }
 
+func (gh *githubCrawler) Handles(u *url.URL) bool {
+	return u.Host == "github.com"
+}
+
 func (gh *githubCrawler) SleepDuration() time.Duration {
 	return time.Duration(15) * time.Minute
 }
@@ -74,66 +195,148 @@ func (gh *githubCrawler) CrawlAll(ch chan *Result) {
 }
 
 func (gh *githubCrawler) crawlNextPage(ch chan *Result) bool {
-	if gh.nextPage == 0 {
-		ch <- gh.newResult(nil, nil, true)
-		return false
+	if gh.current == nil {
+		if len(gh.slices) == 0 {
+			if gh.inPass {
+				gh.l.Info("Finished searching GitHub")
+				gh.inPass = false
+				gh.since = gh.passStart.Add(-oneDay)
+				ch <- gh.newResult(nil, nil, true)
+				return false
+			}
+			gh.startPass()
+		}
+
+		next := gh.slices[len(gh.slices)-1]
+		gh.slices = gh.slices[:len(gh.slices)-1]
+		gh.current = &next
+		gh.nextPage = 1
 	}
 
-	result, err := gh.getNextPage()
+	result, resp, err := gh.search(*gh.current, gh.nextPage)
 	if err != nil {
-		// This should end up putting the crawler to sleep.
+		// This should end up putting the crawler to sleep. We will pick up
+		// where we left off when it wakes.
 		ch <- gh.newResult(nil, err, false)
 		return false
 	}
 
+	if gh.nextPage == 1 && result.GetTotal() > searchLimit {
+		if parts := gh.current.split(); parts != nil {
+			gh.l.Infof("Found %d repositories for %q, splitting the search", result.GetTotal(), gh.current.query())
+			// We push these in reverse order so that we search them in
+			// order.
+			for i := len(parts) - 1; i >= 0; i-- {
+				gh.slices = append(gh.slices, parts[i])
+			}
+			gh.current = nil
+			return true
+		}
+		gh.l.Infof("Found %d repositories for %q but cannot split the search any further", result.GetTotal(), gh.current.query())
+	}
+
 	for _, r := range result.Repositories {
-		// If we just pass in &r then the reference will change inside the
-		// githubRepository object as we go through the loop.
-		copy := r
-		ghRepo, err := repository.NewGitHubRepository(
-			gh.l,
-			&copy,
-			gh.github,
-			gh.cacheRoot,
-			gh.ctx,
-		)
-		// If the repo was not crawled but there is no error (for example
-		// because it was skipped intentionally) then there's no result to
-		// send.
-		if ghRepo != nil || err != nil {
-			ch <- gh.newResult(ghRepo, err, false)
+		u, err := url.Parse(r.GetHTMLURL())
+		if err != nil {
+			ch <- gh.newResult(nil, errwrap.Wrapf(fmt.Sprintf("Could not parse %s: {{err}}", r.GetHTMLURL()), err), false)
+			continue
 		}
+
+		res := gh.newResult(u, nil, false)
+		res.Stars = r.GetStargazersCount()
+		ch <- res
+	}
+
+	if resp.NextPage == 0 {
+		gh.current = nil
+	} else {
+		gh.nextPage = resp.NextPage
 	}
 
 	return true
 }
 
-func (gh *githubCrawler) newResult(r repository.Repository, err error, ex bool) *Result {
-	return &Result{Crawler: gh, Repository: r, Error: err, Exhausted: ex}
+func (gh *githubCrawler) startPass() {
+	gh.inPass = true
+	gh.passStart = time.Now()
+	gh.slices = []searchSlice{newSearchSlice(gh.since, gh.passStart)}
+	gh.l.Infof("Searching GitHub for Go repositories created since %s", gh.since.Format(searchDateFormat))
 }
 
-func (gh *githubCrawler) getNextPage() (*github.RepositoriesSearchResult, error) {
-	gh.l.Infof("Searching for repositories where language=go, page %d", gh.nextPage)
+func (gh *githubCrawler) newResult(u *url.URL, err error, ex bool) *Result {
+	return &Result{Crawler: gh, URL: u, Error: err, Exhausted: ex}
+}
+
+func (gh *githubCrawler) search(s searchSlice, page int) (*github.RepositoriesSearchResult, *github.Response, error) {
+	gh.l.Infof("Searching for %q, page %d", s.query(), page)
 	result, resp, err := gh.github.Search.Repositories(
 		gh.ctx,
-		"language=go",
-		&github.SearchOptions{ListOptions: github.ListOptions{Page: gh.nextPage}},
+		s.query(),
+		&github.SearchOptions{ListOptions: github.ListOptions{Page: page, PerPage: 100}},
 	)
 	if err != nil {
-		return nil, errwrap.Wrapf("GitHub search error: {{err}}", err)
+		return nil, nil, errwrap.Wrapf("GitHub search error: {{err}}", err)
+	}
+
+	return result, resp, nil
+}
+
+func (gh *githubCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	// The search results have everything we need, but the repository may
+	// not be crawled until long after it was found, so we always get it
+	// again.
+	ghr, err := gh.getRepository(u)
+	if err != nil {
+		return nil, err
 	}
 
-	if result.GetTotal() == 0 {
-		gh.l.Infof("Did not find any GitHub repositories on page %d", gh.nextPage)
-		return nil, nil
+	ghRepo, err := repository.NewGitHubRepository(
+		gh.l,
+		ghr,
+		gh.github,
+		gh.cacheRoot,
+		gh.limiter,
+		gh.settings,
+		gh.ctx,
+	)
+	// The repository may have been skipped intentionally, in which case
+	// there's no repository or error. We need to return an untyped nil in
+	// that case rather than a nil *githubRepository.
+	if ghRepo == nil || err != nil {
+		return nil, err
 	}
 
-	gh.l.Infof("Found %d repositories", result.GetTotal())
-	gh.nextPage = resp.NextPage
+	return ghRepo, nil
+}
 
-	return result, nil
+func (gh *githubCrawler) Check(u *url.URL) error {
+	_, err := gh.getRepository(u)
+	return err
 }
 
-func (gh *githubCrawler) CrawlOne(*url.URL) (repository.Repository, error) {
-	return nil, nil
+func (gh *githubCrawler) getRepository(u *url.URL) (*github.Repository, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s is not a GitHub repository URL", u)
+	}
+
+	ghr, _, err := gh.github.Repositories.Get(gh.ctx, parts[0], parts[1])
+	if err == nil {
+		return ghr, nil
+	}
+
+	if er, ok := err.(*github.ErrorResponse); ok && er.Response != nil {
+		switch er.Response.StatusCode {
+		case http.StatusNotFound:
+			return nil, &GoneError{URL: u, StatusCode: http.StatusNotFound, Reason: er.Message}
+		case http.StatusUnavailableForLegalReasons:
+			reason := er.Message
+			if er.Block != nil && er.Block.Reason != "" {
+				reason = er.Block.Reason
+			}
+			return nil, &GoneError{URL: u, StatusCode: http.StatusUnavailableForLegalReasons, Reason: reason}
+		}
+	}
+
+	return nil, errwrap.Wrapf(fmt.Sprintf("Could not get %s from GitHub: {{err}}", u), err)
 }
@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "30")
+		w.Header().Set("X-RateLimit-Remaining", "29")
+		w.Header().Set("X-RateLimit-Reset", "1700000000")
+		w.Header().Set("X-RateLimit-Resource", "search")
+	}))
+	defer srv.Close()
+
+	metrics.GitHubQuotaRemaining.Set(4000)
+	c := &http.Client{Transport: &quotaTransport{RoundTripper: http.DefaultTransport, token: tokenHint("secret-token-abcd")}}
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var got *GitHubQuota
+	for _, q := range GitHubQuotas() {
+		if q.Token == "...abcd" && q.Resource == "search" {
+			got = q
+		}
+	}
+	if assert.NotNil(t, got, "the quota is recorded without the whole token") {
+		assert.Equal(t, 30, got.Limit)
+		assert.Equal(t, 29, got.Remaining)
+		assert.Equal(t, time.Unix(1700000000, 0).UTC(), got.Reset)
+	}
+	assert.Equal(t, float64(4000), metrics.GitHubQuotaRemaining.Value(), "the gauge is only set from the core quota")
+}
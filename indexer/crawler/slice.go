@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"fmt"
+	"time"
+)
+
+// GitHub will only return the first 1,000 results for any search.
+const searchLimit = 1000
+
+const oneDay = 24 * time.Hour
+
+const searchDateFormat = "2006-01-02"
+
+// The earliest date we search from. GitHub launched in 2008 and Go was
+// released in 2009, so there's nothing to find before this.
+var searchEpoch = time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// A searchSlice is one piece of the space of Go repositories on GitHub. In
+// order to get past the search result limit we carve the space up by creation
+// date and, when a single day has too many results, by star count, until each
+// slice is small enough to be paged through completely.
+type searchSlice struct {
+	// Both dates are inclusive and are truncated to the day.
+	from time.Time
+	to   time.Time
+
+	stars *starRange
+}
+
+// A starRange is an inclusive range of star counts. If max is less than zero
+// then the range has no upper bound.
+type starRange struct {
+	min int
+	max int
+}
+
+// These are the star ranges we use when a single day has too many
+// repositories. Most repositories have very few stars, so the ranges are
+// narrow at the bottom.
+var starBuckets = []*starRange{
+	{0, 0},
+	{1, 1},
+	{2, 4},
+	{5, 19},
+	{20, 99},
+	{100, 499},
+	{500, -1},
+}
+
+func newSearchSlice(from, to time.Time) searchSlice {
+	return searchSlice{
+		from: from.UTC().Truncate(oneDay),
+		to:   to.UTC().Truncate(oneDay),
+	}
+}
+
+func (s searchSlice) query() string {
+	q := "language:Go"
+	if s.from.Equal(s.to) {
+		q += " created:" + s.from.Format(searchDateFormat)
+	} else {
+		q += fmt.Sprintf(" created:%s..%s", s.from.Format(searchDateFormat), s.to.Format(searchDateFormat))
+	}
+
+	if s.stars != nil {
+		if s.stars.max < 0 {
+			q += fmt.Sprintf(" stars:>=%d", s.stars.min)
+		} else if s.stars.min == s.stars.max {
+			q += fmt.Sprintf(" stars:%d", s.stars.min)
+		} else {
+			q += fmt.Sprintf(" stars:%d..%d", s.stars.min, s.stars.max)
+		}
+	}
+
+	return q
+}
+
+// split divides the slice into smaller slices. Date ranges are split in half
+// until they cover a single day, and then single days are split by star
+// count. It returns nil if the slice cannot be split any further.
+func (s searchSlice) split() []searchSlice {
+	if s.to.After(s.from) {
+		days := int(s.to.Sub(s.from) / oneDay)
+		mid := s.from.Add(time.Duration(days/2) * oneDay)
+		return []searchSlice{
+			{from: s.from, to: mid},
+			{from: mid.Add(oneDay), to: s.to},
+		}
+	}
+
+	if s.stars == nil {
+		var slices []searchSlice
+		for _, b := range starBuckets {
+			slices = append(slices, searchSlice{from: s.from, to: s.to, stars: b})
+		}
+		return slices
+	}
+
+	if s.stars.max > s.stars.min {
+		mid := s.stars.min + (s.stars.max-s.stars.min)/2
+		return []searchSlice{
+			{from: s.from, to: s.to, stars: &starRange{s.stars.min, mid}},
+			{from: s.from, to: s.to, stars: &starRange{mid + 1, s.stars.max}},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse(searchDateFormat, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSearchSliceQuery(t *testing.T) {
+	s := newSearchSlice(day("2018-01-01"), day("2018-01-31"))
+	assert.Equal(t, "language:Go created:2018-01-01..2018-01-31", s.query())
+
+	s = newSearchSlice(day("2018-01-01"), day("2018-01-01"))
+	assert.Equal(t, "language:Go created:2018-01-01", s.query())
+
+	s.stars = &starRange{2, 4}
+	assert.Equal(t, "language:Go created:2018-01-01 stars:2..4", s.query())
+
+	s.stars = &starRange{500, -1}
+	assert.Equal(t, "language:Go created:2018-01-01 stars:>=500", s.query())
+}
+
+func TestSearchSliceSplit(t *testing.T) {
+	s := newSearchSlice(day("2018-01-01"), day("2018-01-04"))
+	parts := s.split()
+	if assert.Len(t, parts, 2) {
+		assert.Equal(t, "language:Go created:2018-01-01..2018-01-02", parts[0].query())
+		assert.Equal(t, "language:Go created:2018-01-03..2018-01-04", parts[1].query())
+	}
+
+	parts = newSearchSlice(day("2018-01-01"), day("2018-01-01")).split()
+	assert.Len(t, parts, len(starBuckets), "a single day is split by stars")
+
+	parts = parts[3].split()
+	if assert.Len(t, parts, 2) {
+		assert.Equal(t, "language:Go created:2018-01-01 stars:5..12", parts[0].query())
+		assert.Equal(t, "language:Go created:2018-01-01 stars:13..19", parts[1].query())
+	}
+
+	s = newSearchSlice(day("2018-01-01"), day("2018-01-01"))
+	s.stars = &starRange{0, 0}
+	assert.Nil(t, s.split(), "a single star count on a single day cannot be split")
+}
@@ -5,6 +5,7 @@ package directory
 
 import (
 	"bytes"
+	"fmt"
 	"go/build"
 	"io"
 	"io/ioutil"
@@ -14,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // File represents a file.
@@ -31,38 +33,142 @@ type File struct {
 type Directory struct {
 	Path       string
 	ImportPath string
-	Files      []*File
+	// The path from the go.mod file the directory belongs to, if there is
+	// one.
+	Module string
+	Files  []*File
+	// The Go and assembly files we didn't read.
+	Skipped []*SkippedFile
+	// Assembly files are only used to work out which platforms the package
+	// builds on, so only the start of each is read, which is where its build
+	// constraints are. See asmHeaderSize.
+	AsmFiles []*File
+	// Whether generated files are left out of the package's documentation
+	// and source size. Their declarations are still documented, but a
+	// package comment in a generated file is ignored, so the synopsis comes
+	// from a file someone wrote.
+	ExcludeGenerated bool
 }
 
+// A SkippedFile is a Go file which we didn't read, and why.
+type SkippedFile struct {
+	Name   string
+	Reason string
+	// True if the file was skipped because of what's in it rather than its
+	// size.
+	Binary bool
+}
+
+// Some repos vendor enormous generated files, or have binaries that happen to
+// be named *.go. We don't want to hold any of that in memory, and there's
+// nothing useful to document in them anyway.
+const (
+	MaxFileSize    = 1 << 20
+	MaxPackageSize = 8 << 20
+)
+
+// Build constraints have to come before anything but comments, so this much
+// of an assembly file is plenty. Assembly files count towards MaxPackageSize
+// too, and once it's reached the rest are left out quietly.
+const asmHeaderSize = 4 << 10
+
 func New(dir string, importPath, rootURL string) *Directory {
-	return &Directory{
+	d := &Directory{
 		Path:       dir,
 		ImportPath: importPath,
-		Files:      goFiles(dir, rootURL),
 	}
+	d.Files, d.Skipped, d.AsmFiles = goFiles(dir, rootURL)
+	return d
 }
 
-func goFiles(dir, rootURL string) []*File {
+func goFiles(dir, rootURL string) ([]*File, []*SkippedFile, []*File) {
 	contents, err := ioutil.ReadDir(dir)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	var files []*File
+	var files, asm []*File
+	var skipped []*SkippedFile
+	var total int64
 	for _, f := range contents {
+		if strings.HasSuffix(f.Name(), ".s") && f.Mode().IsRegular() {
+			size := f.Size()
+			if size > asmHeaderSize {
+				size = asmHeaderSize
+			}
+			if total+size > MaxPackageSize {
+				continue
+			}
+			c, err := readHeader(filepath.Join(dir, f.Name()), asmHeaderSize)
+			if err != nil {
+				skipped = append(skipped, &SkippedFile{
+					Name:   f.Name(),
+					Reason: fmt.Sprintf("skipped because it could not be read: %s", err),
+				})
+				continue
+			}
+			total += int64(len(c))
+			asm = append(asm, &File{Name: f.Name(), Data: c})
+			continue
+		}
 		if !isDocFile(f.Name()) {
 			continue
 		}
+		// Symlinks may point outside the repo, so we only read plain files.
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		if f.Size() > MaxFileSize {
+			skipped = append(skipped, &SkippedFile{
+				Name:   f.Name(),
+				Reason: fmt.Sprintf("skipped because it is %d bytes, which is more than the limit of %d", f.Size(), MaxFileSize),
+			})
+			continue
+		}
+		if total+f.Size() > MaxPackageSize {
+			skipped = append(skipped, &SkippedFile{
+				Name:   f.Name(),
+				Reason: fmt.Sprintf("skipped because the package's files are more than the limit of %d bytes", MaxPackageSize),
+			})
+			continue
+		}
 
 		c, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
 		if err != nil {
 			log.Panic(err)
 		}
+		// Go source is always UTF-8 and never contains a NUL.
+		if bytes.IndexByte(c, 0) != -1 || !utf8.Valid(c) {
+			skipped = append(skipped, &SkippedFile{
+				Name:   f.Name(),
+				Reason: "skipped because it is not a text file",
+				Binary: true,
+			})
+			continue
+		}
+		total += int64(len(c))
 
 		url := strings.Join([]string{rootURL, f.Name()}, "/")
 		files = append(files, &File{Name: f.Name(), Data: c, BrowseURL: url})
 	}
-	return files
+	return files, skipped, asm
+}
+
+// readHeader returns up to the first n bytes of the file at path.
+func readHeader(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, n)
+	read, err := io.ReadFull(f, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return b[:read], err
 }
 
 func isDocFile(n string) bool {
@@ -73,6 +179,17 @@ func isDocFile(n string) bool {
 }
 
 func (dir *Directory) Import(ctx *build.Context, mode build.ImportMode) (*build.Package, error) {
+	return dir.context(ctx).ImportDir(".", mode)
+}
+
+// MatchFile returns true if the named Go or assembly file would be built in
+// the given context.
+func (dir *Directory) MatchFile(ctx *build.Context, name string) (bool, error) {
+	return dir.context(ctx).MatchFile(".", name)
+}
+
+// context returns a copy of ctx which reads the directory's files.
+func (dir *Directory) context(ctx *build.Context) *build.Context {
 	safeCopy := *ctx
 	ctx = &safeCopy
 	ctx.JoinPath = path.Join
@@ -82,7 +199,7 @@ func (dir *Directory) Import(ctx *build.Context, mode build.ImportMode) (*build.
 	ctx.HasSubdir = func(root, dir string) (rel string, ok bool) { return "", false }
 	ctx.ReadDir = dir.readDir
 	ctx.OpenFile = dir.openFile
-	return ctx.ImportDir(".", mode)
+	return ctx
 }
 
 type fileInfo struct{ f *File }
@@ -107,9 +224,11 @@ func (dir *Directory) readDir(name string) ([]os.FileInfo, error) {
 
 func (dir *Directory) openFile(path string) (io.ReadCloser, error) {
 	name := strings.TrimPrefix(path, "./")
-	for _, f := range dir.Files {
-		if f.Name == name {
-			return ioutil.NopCloser(bytes.NewReader(f.Data)), nil
+	for _, files := range [][]*File{dir.Files, dir.AsmFiles} {
+		for _, f := range files {
+			if f.Name == name {
+				return ioutil.NopCloser(bytes.NewReader(f.Data)), nil
+			}
 		}
 	}
 	return nil, os.ErrNotExist
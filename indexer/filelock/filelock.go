@@ -0,0 +1,70 @@
+// Package filelock takes the advisory locks which keep indexers sharing a
+// cache root from using the same clone or queue at once. Where flock is
+// available a lock goes away with the process holding it, so a crash never
+// leaves anything locked. See filelock_other.go for everywhere else.
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A LockedError is returned by Lock when another process holds the lock.
+type LockedError struct {
+	Path string
+	// The process holding the lock, if we could tell.
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Owner())
+}
+
+// Owner describes the process holding the lock, for error messages.
+func (e *LockedError) Owner() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("another process (pid %d)", e.PID)
+	}
+	return "another process"
+}
+
+// lockFile returns this when someone else holds the lock.
+var errLocked = errors.New("locked")
+
+// Lock takes the lock on the file at path without waiting for it, creating
+// the file if need be. The file is never deleted, since another process may
+// be about to lock it.
+func Lock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f)
+	if err == errLocked {
+		b, _ := ioutil.ReadAll(f)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		f.Close()
+		return nil, &LockedError{Path: path, PID: pid}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not lock %s: %s", path, err)
+	}
+
+	// The PID is only there to make the error above more helpful.
+	if f.Truncate(0) == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// Unlock releases a lock taken by Lock.
+func Unlock(f *os.File) {
+	unlockFile(f)
+	f.Close()
+}
@@ -0,0 +1,30 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package filelock
+
+import "os"
+
+// Without flock, holding the lock means having created a file next to the
+// lock file, which only one process can do. Unlike flock this outlives the
+// process, so one which crashes while holding the lock leaves it held until
+// the .held file is deleted by hand. The PID in the lock file says
+// which process that was.
+func lockFile(f *os.File) error {
+	held, err := os.OpenFile(heldPath(f), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return errLocked
+	}
+	if err != nil {
+		return err
+	}
+	return held.Close()
+}
+
+func unlockFile(f *os.File) {
+	os.Remove(heldPath(f))
+}
+
+func heldPath(f *os.File) string {
+	return f.Name() + ".held"
+}
@@ -0,0 +1,37 @@
+package filelock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "thing.lock")
+	f, err := Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the file again stands in for another process.
+	_, err = Lock(path)
+	if assert.IsType(t, &LockedError{}, err) {
+		assert.Equal(t, os.Getpid(), err.(*LockedError).PID)
+		assert.Contains(t, err.Error(), "another process (pid ")
+	}
+
+	Unlock(f)
+	f, err = Lock(path)
+	if assert.NoError(t, err, "the lock can be taken again once it's released") {
+		Unlock(f)
+	}
+}
@@ -0,0 +1,304 @@
+// Package importpath finds the repository that contains a package, given the
+// package's import path. For hosts we know about, like GitHub, this is just a
+// matter of picking apart the path. For everything else we do what the go
+// tool does, which is to fetch the path with "?go-get=1" and look for a
+// go-import meta tag pointing at the real repository.
+package importpath
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// A Root describes the repository at the root of an import path.
+type Root struct {
+	// The import path of the repository's root package, for example
+	// "gopkg.in/yaml.v2" or "github.com/stretchr/testify".
+	ImportPrefix string
+	// The URL of the repository that contains the code, for example
+	// "https://github.com/go-yaml/yaml".
+	RepoURL *url.URL
+	// True if the import prefix is on a different host from the repository.
+	IsVanity bool
+}
+
+type Resolver struct {
+	client *http.Client
+	// Keyed by import prefix.
+	cache map[string]*Root
+	// Keyed by the import path we couldn't resolve.
+	failed map[string]failure
+	mu     sync.Mutex
+}
+
+type failure struct {
+	err error
+	at  time.Time
+}
+
+// A failed lookup is usually a host which is down, or which doesn't serve
+// go-import meta tags at all, so there's no point asking again for a while.
+const failureTTL = time.Hour
+
+func NewResolver(client *http.Client) *Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Resolver{
+		client: client,
+		cache:  make(map[string]*Root),
+		failed: make(map[string]failure),
+	}
+}
+
+// The golang.org/x repositories. These are hosted on go.googlesource.com,
+// which we can't crawl, but each one is mirrored at github.com/golang/<name>.
+var goXRepos = map[string]bool{
+	"arch":       true,
+	"benchmarks": true,
+	"blog":       true,
+	"build":      true,
+	"crypto":     true,
+	"debug":      true,
+	"exp":        true,
+	"image":      true,
+	"lint":       true,
+	"mobile":     true,
+	"mod":        true,
+	"net":        true,
+	"oauth2":     true,
+	"perf":       true,
+	"review":     true,
+	"sync":       true,
+	"sys":        true,
+	"talks":      true,
+	"term":       true,
+	"text":       true,
+	"time":       true,
+	"tools":      true,
+	"tour":       true,
+	"vgo":        true,
+	"website":    true,
+}
+
+// GoXImportPrefix returns the golang.org/x import path for a repository ID if
+// the repository is the GitHub mirror of one of the golang.org/x
+// repositories, for example "golang.org/x/net" for "github.com/golang/net".
+func GoXImportPrefix(id string) (string, bool) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 || parts[0] != "github.com" || parts[1] != "golang" || !goXRepos[parts[2]] {
+		return "", false
+	}
+	return "golang.org/x/" + parts[2], true
+}
+
+var gopkgInRE = regexp.MustCompile(`^gopkg\.in/(?:([a-zA-Z0-9][-a-zA-Z0-9]*)/)?([a-zA-Z][-.a-zA-Z0-9]*)\.v[0-9]+(?:-unstable)?`)
+
+// Resolve returns the root of the repository containing the given import
+// path.
+func (r *Resolver) Resolve(ctx context.Context, importPath string) (*Root, error) {
+	importPath = strings.Trim(importPath, "/")
+	parts := strings.Split(importPath, "/")
+
+	switch parts[0] {
+	case "github.com":
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("%s is not a valid GitHub import path", importPath)
+		}
+		prefix := strings.Join(parts[:3], "/")
+		return &Root{
+			ImportPrefix: prefix,
+			RepoURL:      &url.URL{Scheme: "https", Host: parts[0], Path: "/" + strings.Join(parts[1:3], "/")},
+		}, nil
+	case "golang.org":
+		if len(parts) >= 3 && parts[1] == "x" && goXRepos[parts[2]] {
+			return &Root{
+				ImportPrefix: strings.Join(parts[:3], "/"),
+				RepoURL:      &url.URL{Scheme: "https", Host: "github.com", Path: "/golang/" + parts[2]},
+				IsVanity:     true,
+			}, nil
+		}
+	case "gopkg.in":
+		// gopkg.in serves the go-import meta tag, but it points back at
+		// gopkg.in itself, which proxies to GitHub. We want the real GitHub
+		// repository.
+		m := gopkgInRE.FindStringSubmatch(importPath)
+		if m == nil {
+			return nil, fmt.Errorf("%s is not a valid gopkg.in import path", importPath)
+		}
+		owner := m[1]
+		if owner == "" {
+			owner = "go-" + m[2]
+		}
+		return &Root{
+			ImportPrefix: m[0],
+			RepoURL:      &url.URL{Scheme: "https", Host: "github.com", Path: "/" + owner + "/" + m[2]},
+			IsVanity:     true,
+		}, nil
+	}
+
+	if !strings.Contains(parts[0], ".") {
+		return nil, fmt.Errorf("%s is not a remote import path", importPath)
+	}
+
+	root, err := r.cached(parts)
+	if root != nil || err != nil {
+		return root, err
+	}
+
+	root, err = r.fetch(ctx, importPath)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		// Being cancelled says nothing about the host.
+		if ctx.Err() == nil {
+			r.failed[importPath] = failure{err: err, at: time.Now()}
+		}
+		return nil, err
+	}
+	r.cache[root.ImportPrefix] = root
+
+	return root, nil
+}
+
+// cached returns the root, or the error, we got for the longest prefix of the
+// import path we've already looked up. It returns nil for both if we haven't
+// looked up any of them.
+func (r *Resolver) cached(parts []string) (*Root, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(parts); i > 0; i-- {
+		prefix := strings.Join(parts[:i], "/")
+		if root, ok := r.cache[prefix]; ok {
+			return root, nil
+		}
+		if f, ok := r.failed[prefix]; ok {
+			if time.Since(f.at) < failureTTL {
+				return nil, f.err
+			}
+			delete(r.failed, prefix)
+		}
+	}
+	return nil, nil
+}
+
+func (r *Resolver) fetch(ctx context.Context, importPath string) (*Root, error) {
+	u := fmt.Sprintf("https://%s?go-get=1", importPath)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not fetch %s: {{err}}", u), err)
+	}
+	defer resp.Body.Close()
+
+	imports, err := parseMetaGoImports(resp.Body)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse %s: {{err}}", u), err)
+	}
+
+	for _, mi := range imports {
+		if mi.vcs != "git" {
+			continue
+		}
+		if importPath != mi.prefix && !strings.HasPrefix(importPath, mi.prefix+"/") {
+			continue
+		}
+
+		repoURL, err := url.Parse(mi.repoRoot)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid repository URL in go-import meta tag for %s: {{err}}", importPath), err)
+		}
+		repoURL.Path = strings.TrimSuffix(repoURL.Path, ".git")
+
+		return &Root{
+			ImportPrefix: mi.prefix,
+			RepoURL:      repoURL,
+			IsVanity:     !strings.HasPrefix(mi.prefix, repoURL.Host+repoURL.Path),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("No go-import meta tag for a git repository found at %s", u)
+}
+
+type metaImport struct {
+	prefix   string
+	vcs      string
+	repoRoot string
+}
+
+// This is more or less what cmd/go does in its discovery.go. HTML isn't XML,
+// but the decoder's non-strict mode copes with the head of most pages, which
+// is all we care about.
+func parseMetaGoImports(r io.Reader) ([]metaImport, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "utf-8", "ascii":
+			return input, nil
+		default:
+			return nil, fmt.Errorf("Cannot decode page in %q charset", charset)
+		}
+	}
+	d.Strict = false
+
+	var imports []metaImport
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(imports) > 0 {
+				break
+			}
+			return nil, err
+		}
+
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			break
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			break
+		}
+
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+		if attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+
+		if f := strings.Fields(attrValue(e.Attr, "content")); len(f) == 3 {
+			imports = append(imports, metaImport{
+				prefix:   f[0],
+				vcs:      f[1],
+				repoRoot: f[2],
+			})
+		}
+	}
+
+	return imports, nil
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package importpath
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveKnownHosts(t *testing.T) {
+	r := NewResolver(nil)
+
+	root, err := r.Resolve(context.Background(), "github.com/stretchr/testify/assert")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "github.com/stretchr/testify", root.ImportPrefix)
+		assert.Equal(t, "https://github.com/stretchr/testify", root.RepoURL.String())
+		assert.False(t, root.IsVanity)
+	}
+
+	root, err = r.Resolve(context.Background(), "gopkg.in/yaml.v2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gopkg.in/yaml.v2", root.ImportPrefix)
+		assert.Equal(t, "https://github.com/go-yaml/yaml", root.RepoURL.String())
+		assert.True(t, root.IsVanity)
+	}
+
+	root, err = r.Resolve(context.Background(), "gopkg.in/olivere/elastic.v5/config")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gopkg.in/olivere/elastic.v5", root.ImportPrefix)
+		assert.Equal(t, "https://github.com/olivere/elastic", root.RepoURL.String())
+	}
+
+	root, err = r.Resolve(context.Background(), "golang.org/x/net/html/atom")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "golang.org/x/net", root.ImportPrefix)
+		assert.Equal(t, "https://github.com/golang/net", root.RepoURL.String())
+		assert.True(t, root.IsVanity)
+	}
+
+	_, err = r.Resolve(context.Background(), "net/http")
+	assert.Error(t, err, "stdlib paths cannot be resolved")
+}
+
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+<meta name="go-import" content="k8s.io/client-go git https://github.com/kubernetes/client-go">
+<meta name="go-source" content="k8s.io/client-go https://github.com/kubernetes/client-go https://github.com/kubernetes/client-go/tree/master{/dir} https://github.com/kubernetes/client-go/blob/master{/dir}/{file}#L{line}">
+</head>
+<body>
+<meta name="go-import" content="ignored git https://example.com/ignored">
+</body>
+</html>
+`
+
+func TestGoXImportPrefix(t *testing.T) {
+	prefix, ok := GoXImportPrefix("github.com/golang/tools")
+	assert.True(t, ok)
+	assert.Equal(t, "golang.org/x/tools", prefix)
+
+	_, ok = GoXImportPrefix("github.com/golang/protobuf")
+	assert.False(t, ok, "not every golang repository is in golang.org/x")
+
+	_, ok = GoXImportPrefix("github.com/someone/tools")
+	assert.False(t, ok)
+}
+
+func TestParseMetaGoImports(t *testing.T) {
+	imports, err := parseMetaGoImports(strings.NewReader(page))
+	if assert.NoError(t, err) {
+		assert.Equal(
+			t,
+			[]metaImport{{"k8s.io/client-go", "git", "https://github.com/kubernetes/client-go"}},
+			imports,
+		)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestResolveCache(t *testing.T) {
+	var fetched []string
+	r := NewResolver(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.Host+req.URL.Path)
+		if req.URL.Host == "down.example.com" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(page)),
+			Request:    req,
+		}, nil
+	})})
+
+	for _, ip := range []string{"k8s.io/client-go/kubernetes", "k8s.io/client-go/rest", "k8s.io/client-go"} {
+		root, err := r.Resolve(context.Background(), ip)
+		if assert.NoError(t, err, ip) {
+			assert.Equal(t, "k8s.io/client-go", root.ImportPrefix, ip)
+		}
+	}
+	assert.Equal(t, []string{"k8s.io/client-go/kubernetes"}, fetched, "every path under a prefix is resolved from the cache")
+
+	fetched = nil
+	_, err := r.Resolve(context.Background(), "down.example.com/thing")
+	assert.Error(t, err)
+	_, err = r.Resolve(context.Background(), "down.example.com/thing/sub")
+	assert.Error(t, err, "failures are cached too")
+	assert.Equal(t, []string{"down.example.com/thing"}, fetched)
+
+	r.failed["down.example.com/thing"] = failure{err: err, at: time.Now().Add(-failureTTL)}
+	_, err = r.Resolve(context.Background(), "down.example.com/thing")
+	assert.Error(t, err)
+	assert.Len(t, fetched, 2, "failures are tried again after a while")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.Resolve(ctx, "other.example.com/thing")
+	assert.Error(t, err)
+	assert.NotContains(t, r.failed, "other.example.com/thing", "a cancelled lookup isn't a failure")
+}
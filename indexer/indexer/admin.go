@@ -0,0 +1,461 @@
+package indexer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/queue"
+)
+
+// The admin API lets an operator poke at a running crawl. Every request
+// needs an "Authorization: Bearer <token>" header, and everything is JSON.
+//
+//	GET  /status              whether the crawl is paused, and how many items are in each state
+//	POST /pause               stop taking repositories off the queue
+//	POST /resume              start again
+//	GET  /queue?state=&limit= queue items, sorted by when they're next due
+//	POST /queue               {"repository": "<URL or import path>"} adds a repository, or makes it due now
+//	GET  /failures?limit=     the most recently failed items
+//	POST /reindex             {"repository": "<ID>", "refs": ["v1.2.0"]} walks the refs again on the next crawl
+//	GET  /dead-letters?limit= items which failed too many times in a row, with their recent errors
+//	POST /retry               {"repository": "<ID>"} takes an item off the dead-letter list and makes it due now
+//	GET  /throughput          GitHub quotas, queue depth, clones and API calls in progress, and recent totals
+
+const defaultAdminLimit = 100
+
+// pause holds up discovery while the crawl is paused through the admin API.
+// Repositories already in progress carry on.
+type pause struct {
+	// This is closed on resume. It's nil when we're not paused.
+	resumed chan struct{}
+	mu      sync.Mutex
+}
+
+// Pause stops discovery from taking anything else off the queue until Resume
+// is called. It returns false if the crawl was already paused.
+func (idx *Indexer) Pause() bool {
+	idx.pause.mu.Lock()
+	defer idx.pause.mu.Unlock()
+	if idx.pause.resumed != nil {
+		return false
+	}
+	idx.pause.resumed = make(chan struct{})
+	idx.l.Info("Pausing the crawl")
+	return true
+}
+
+// Resume undoes Pause. It returns false if the crawl wasn't paused.
+func (idx *Indexer) Resume() bool {
+	idx.pause.mu.Lock()
+	defer idx.pause.mu.Unlock()
+	if idx.pause.resumed == nil {
+		return false
+	}
+	close(idx.pause.resumed)
+	idx.pause.resumed = nil
+	idx.l.Info("Resuming the crawl")
+	return true
+}
+
+func (idx *Indexer) Paused() bool {
+	idx.pause.mu.Lock()
+	defer idx.pause.mu.Unlock()
+	return idx.pause.resumed != nil
+}
+
+// waitWhilePaused blocks a discovery worker until the crawl is resumed or
+// stopped.
+func (idx *Indexer) waitWhilePaused() {
+	idx.pause.mu.Lock()
+	resumed := idx.pause.resumed
+	idx.pause.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+
+	select {
+	case <-resumed:
+	case <-idx.done:
+	case <-idx.ctx.Done():
+	}
+}
+
+// ServeAdmin listens on addr and serves the admin API in the background. Like
+// metrics.Serve, anything that goes wrong after it starts listening is just
+// logged.
+func (idx *Indexer) ServeAdmin(addr, token string) error {
+	if idx.err != nil {
+		return idx.err
+	}
+	if token == "" {
+		return fmt.Errorf("The admin API needs a token")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	idx.l.Infof("Serving the admin API on http://%s/", ln.Addr())
+	go func() {
+		err := http.Serve(ln, idx.AdminHandler(token))
+		if err != nil {
+			idx.l.Errorf("Admin server stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// AdminHandler returns a handler for the admin API which only accepts
+// requests with the given token.
+func (idx *Indexer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", idx.adminStatus)
+	mux.HandleFunc("/pause", idx.adminPause)
+	mux.HandleFunc("/resume", idx.adminResume)
+	mux.HandleFunc("/queue", idx.adminQueue)
+	mux.HandleFunc("/failures", idx.adminFailures)
+	mux.HandleFunc("/reindex", idx.adminReindex)
+	mux.HandleFunc("/dead-letters", idx.adminDeadLetters)
+	mux.HandleFunc("/retry", idx.adminRetry)
+	mux.HandleFunc("/throughput", idx.adminThroughput)
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, fmt.Errorf("A valid bearer token is required"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type adminStatus struct {
+	Paused bool                `json:"paused"`
+	Done   bool                `json:"done"`
+	Queue  map[queue.State]int `json:"queue"`
+}
+
+func (idx *Indexer) adminStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	s := adminStatus{Paused: idx.Paused(), Done: idx.isDone(), Queue: make(map[queue.State]int)}
+	for _, i := range idx.queue.Items() {
+		s.Queue[i.State]++
+	}
+	writeAdminJSON(w, http.StatusOK, s)
+}
+
+func (idx *Indexer) adminPause(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	idx.Pause()
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (idx *Indexer) adminResume(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	idx.Resume()
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (idx *Indexer) adminQueue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, err := adminLimit(r)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		state := queue.State(r.URL.Query().Get("state"))
+
+		var items []*queue.Item
+		for _, i := range idx.queue.Items() {
+			if state == "" || i.State == state {
+				items = append(items, i)
+			}
+		}
+		sort.SliceStable(items, func(a, b int) bool { return items[a].NextCrawlAt.Before(items[b].NextCrawlAt) })
+		writeAdminJSON(w, http.StatusOK, truncateItems(items, limit))
+
+	case http.MethodPost:
+		var req struct {
+			Repository string `json:"repository"`
+		}
+		if !readAdminJSON(w, r, &req) {
+			return
+		}
+		if req.Repository == "" {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("repository is required"))
+			return
+		}
+
+		item, err := idx.enqueue(req.Repository)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = idx.queue.Schedule(item.ID, item.URL, time.Now(), nil)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		idx.l.Infof("Queued %s through the admin API", item.ID)
+		writeAdminJSON(w, http.StatusOK, idx.queue.Get(item.ID))
+
+	default:
+		allowMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (idx *Indexer) adminFailures(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, err := adminLimit(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var items []*queue.Item
+	for _, i := range idx.queue.Items() {
+		if i.State == queue.Failed {
+			items = append(items, i)
+		}
+	}
+	sort.SliceStable(items, func(a, b int) bool { return items[a].Updated.After(items[b].Updated) })
+	writeAdminJSON(w, http.StatusOK, truncateItems(items, limit))
+}
+
+func (idx *Indexer) adminReindex(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Repository string   `json:"repository"`
+		Refs       []string `json:"refs"`
+	}
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Repository == "" || len(req.Refs) == 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("repository and refs are required"))
+		return
+	}
+	if idx.queue.Get(req.Repository) == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%s is not in the queue", req.Repository))
+		return
+	}
+
+	err := idx.queue.Reindex(req.Repository, req.Refs)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	idx.l.Infof("Reindexing %s of %s through the admin API", strings.Join(req.Refs, ", "), req.Repository)
+	writeAdminJSON(w, http.StatusOK, idx.queue.Get(req.Repository))
+}
+
+func (idx *Indexer) adminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, err := adminLimit(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var items []*queue.Item
+	for _, i := range idx.queue.Items() {
+		if i.State == queue.DeadLetter {
+			items = append(items, i)
+		}
+	}
+	sort.SliceStable(items, func(a, b int) bool { return items[a].Updated.After(items[b].Updated) })
+	writeAdminJSON(w, http.StatusOK, truncateItems(items, limit))
+}
+
+func (idx *Indexer) adminRetry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Repository string `json:"repository"`
+	}
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Repository == "" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("repository is required"))
+		return
+	}
+	if idx.queue.Get(req.Repository) == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%s is not in the queue", req.Repository))
+		return
+	}
+
+	retried, err := idx.queue.Retry(req.Repository)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !retried {
+		writeAdminError(w, http.StatusConflict, fmt.Errorf("%s is not on the dead-letter list", req.Repository))
+		return
+	}
+	idx.l.Infof("Retrying %s through the admin API", req.Repository)
+	writeAdminJSON(w, http.StatusOK, idx.queue.Get(req.Repository))
+}
+
+// adminThroughput is for working out why the crawl is slow right now.
+type adminThroughput struct {
+	GitHub []*crawler.GitHubQuota `json:"github"`
+	Queue  struct {
+		// Items waiting for a worker.
+		Due        int `json:"due"`
+		InProgress int `json:"in_progress"`
+		// Items which aren't due yet.
+		Scheduled  int `json:"scheduled"`
+		DeadLetter int `json:"dead_letter"`
+		// How long the item which has been due the longest has waited.
+		OldestDue string `json:"oldest_due,omitempty"`
+	} `json:"queue"`
+	// The limits are 0 when there's no limit.
+	Clones   adminSlots `json:"clones"`
+	APICalls adminSlots `json:"api_calls"`
+	// Crawlers which are waiting before they look for more repositories,
+	// and when they'll start again.
+	SleepingCrawlers map[string]time.Time `json:"sleeping_crawlers"`
+	BudgetExhausted  string               `json:"budget_exhausted,omitempty"`
+	Paused           bool                 `json:"paused"`
+	// Totals of what the pipeline did over the last 5, 15, and 60 minutes,
+	// like "indexed", "failed", "documents", and "clone_bytes".
+	Recent map[string]map[string]int64 `json:"recent"`
+}
+
+type adminSlots struct {
+	InUse int `json:"in_use"`
+	Limit int `json:"limit"`
+}
+
+func (idx *Indexer) adminThroughput(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	now := time.Now()
+	t := adminThroughput{
+		GitHub:           crawler.GitHubQuotas(),
+		SleepingCrawlers: make(map[string]time.Time),
+		BudgetExhausted:  idx.budget.exhausted(),
+		Paused:           idx.Paused(),
+		Recent:           make(map[string]map[string]int64),
+	}
+
+	var oldest time.Time
+	for _, i := range idx.queue.Items() {
+		switch {
+		case i.State == queue.InProgress:
+			t.Queue.InProgress++
+		case i.State == queue.DeadLetter:
+			t.Queue.DeadLetter++
+		case i.NextCrawlAt.After(now):
+			t.Queue.Scheduled++
+		default:
+			t.Queue.Due++
+			// Requested repositories are due at the zero time, which
+			// would make for a silly wait.
+			if !i.NextCrawlAt.IsZero() && (oldest.IsZero() || i.NextCrawlAt.Before(oldest)) {
+				oldest = i.NextCrawlAt
+			}
+		}
+	}
+	if !oldest.IsZero() {
+		t.Queue.OldestDue = now.Sub(oldest).Round(time.Second).String()
+	}
+
+	if idx.limiter != nil {
+		t.Clones.InUse, t.Clones.Limit, t.APICalls.InUse, t.APICalls.Limit = idx.limiter.InUse()
+	}
+
+	idx.crawlers.mu.Lock()
+	for c, until := range idx.crawlers.sleeping {
+		t.SleepingCrawlers[c.Name()] = until
+	}
+	idx.crawlers.mu.Unlock()
+
+	for _, m := range []int{5, 15, 60} {
+		t.Recent[fmt.Sprintf("%dm", m)] = idx.throughput.since(now, m)
+	}
+	writeAdminJSON(w, http.StatusOK, t)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed here", r.Method))
+	return false
+}
+
+func adminLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultAdminLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid limit: %s", v)
+	}
+	return n, nil
+}
+
+func truncateItems(items []*queue.Item, limit int) []*queue.Item {
+	if items == nil {
+		return []*queue.Item{}
+	}
+	if len(items) > limit {
+		return items[:limit]
+	}
+	return items
+}
+
+func readAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid JSON body: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
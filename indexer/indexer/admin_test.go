@@ -0,0 +1,124 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/queue"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	idx := testIndexer(t)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+	h := idx.AdminHandler("secret")
+
+	call := func(method, path, body string, v interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if v != nil {
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), v), rec.Body.String())
+		}
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "requests need the token")
+
+	var item queue.Item
+	assert.Equal(t, http.StatusOK, call("POST", "/queue", `{"repository": "https://github.com/example/thing"}`, &item))
+	assert.Equal(t, "github.com/example/thing", item.ID)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/queue", `{}`, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, call("DELETE", "/queue", "", nil))
+
+	// The pipeline claims the first item and fails it.
+	_, err := idx.queue.Add("github.com/example/other", "https://github.com/example/other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.queue.Fail(claimed.ID, errors.New("boom"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []*queue.Item
+	assert.Equal(t, http.StatusOK, call("GET", "/queue?state=pending", "", &items))
+	if assert.Len(t, items, 1) {
+		assert.NotEqual(t, claimed.ID, items[0].ID)
+	}
+	assert.Equal(t, http.StatusOK, call("GET", "/failures?limit=5", "", &items))
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, claimed.ID, items[0].ID)
+		assert.Equal(t, "boom", items[0].LastError)
+	}
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/failures?limit=none", "", nil))
+
+	assert.Equal(t, http.StatusOK, call("POST", "/reindex", `{"repository": "github.com/example/thing", "refs": ["v1.0.0"]}`, &item))
+	assert.Equal(t, []string{"v1.0.0"}, item.Reindex)
+	assert.Equal(t, http.StatusNotFound, call("POST", "/reindex", `{"repository": "github.com/example/gone", "refs": ["master"]}`, nil))
+
+	// With a limit of one failure the next one is dead-lettered.
+	idx.queue.SetMaxFailures(1)
+	_, err = idx.queue.Fail(claimed.ID, errors.New("boom again"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, call("GET", "/dead-letters", "", &items))
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, claimed.ID, items[0].ID)
+		assert.Len(t, items[0].Failures, 2)
+	}
+	assert.Equal(t, http.StatusConflict, call("POST", "/retry", `{"repository": "github.com/example/other"}`, nil))
+	assert.Equal(t, http.StatusNotFound, call("POST", "/retry", `{"repository": "github.com/example/gone"}`, nil))
+	assert.Equal(t, http.StatusOK, call("POST", "/retry", `{"repository": "`+claimed.ID+`"}`, &item))
+	assert.Equal(t, queue.Pending, item.State)
+	assert.Equal(t, http.StatusOK, call("GET", "/dead-letters", "", &items))
+	assert.Empty(t, items)
+
+	idx.throughput.count("indexed", 2)
+	var tp adminThroughput
+	assert.Equal(t, http.StatusOK, call("GET", "/throughput", "", &tp))
+	assert.Equal(t, 2, tp.Queue.Due)
+	assert.Equal(t, map[string]int64{"indexed": 2}, tp.Recent["5m"])
+	assert.NotNil(t, tp.GitHub)
+
+	var status adminStatus
+	assert.Equal(t, http.StatusOK, call("POST", "/pause", "", nil))
+	assert.Equal(t, http.StatusOK, call("GET", "/status", "", &status))
+	assert.True(t, status.Paused)
+	assert.Equal(t, map[queue.State]int{queue.Pending: 2}, status.Queue)
+
+	// Discovery waits while the crawl is paused.
+	discovered := make(chan *job)
+	go func() { discovered <- idx.discoverNext() }()
+	select {
+	case <-discovered:
+		t.Fatal("discovery should wait while the crawl is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, http.StatusOK, call("POST", "/resume", "", nil))
+	select {
+	case j := <-discovered:
+		if assert.NotNil(t, j) {
+			assert.True(t, j.force, "a repository with refs to reindex is indexed even if it hasn't changed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("discovery should carry on once the crawl is resumed")
+	}
+	assert.False(t, idx.Paused())
+}
@@ -0,0 +1,241 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/metrics"
+)
+
+// Alerts are posted to webhooks when an unattended crawl needs someone to
+// look at it: when too many repositories are failing, when the GitHub quota
+// is used up, or when Elasticsearch stops accepting documents. Each alert is
+// a JSON object with a "text" field, which is all a Slack incoming webhook
+// needs, along with "kind" and "tenant" fields for anything else.
+type Alerts struct {
+	Webhooks []string
+	// An alert is sent when at least this fraction of the last alertWindow
+	// repositories failed. Defaults to half of them.
+	FailureRate float64
+	// The same kind of alert isn't sent again until this long has passed.
+	// Defaults to an hour.
+	Cooldown time.Duration
+}
+
+const (
+	defaultAlertFailureRate = 0.5
+	defaultAlertCooldown    = time.Hour
+)
+
+// The failure rate is worked out over this many repositories.
+const alertWindow = 50
+
+// How often we check the quota and Elasticsearch.
+const alertCheckInterval = time.Minute
+
+// Validate returns an error if the failure rate isn't a fraction, the cooldown
+// is negative, or a webhook isn't an http or https URL.
+func (a Alerts) Validate() error {
+	if a.FailureRate < 0 || a.FailureRate > 1 {
+		return fmt.Errorf("The alert failure rate must be between 0 and 1: %v", a.FailureRate)
+	}
+	if a.Cooldown < 0 {
+		return fmt.Errorf("The alert cooldown cannot be negative: %s", a.Cooldown)
+	}
+	for _, w := range a.Webhooks {
+		u, err := url.Parse(w)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid alert webhook %q, expected an http or https URL", w)
+		}
+	}
+	return nil
+}
+
+func (a Alerts) withDefaults() Alerts {
+	if a.FailureRate == 0 {
+		a.FailureRate = defaultAlertFailureRate
+	}
+	if a.Cooldown == 0 {
+		a.Cooldown = defaultAlertCooldown
+	}
+	return a
+}
+
+type alerter struct {
+	Alerts
+	client *http.Client
+	// Whether each of the most recent repositories failed, as a ring.
+	outcomes []bool
+	next     int
+	// When each kind of alert was last sent.
+	sent map[string]time.Time
+	// metrics.DocsFailed as of the last check.
+	docsFailed int64
+	sending    sync.WaitGroup
+	mu         sync.Mutex
+}
+
+// newAlerter returns nil if there are no webhooks, which sends nothing.
+func newAlerter(a Alerts) *alerter {
+	if len(a.Webhooks) == 0 {
+		return nil
+	}
+	return &alerter{
+		Alerts:     a.withDefaults(),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		sent:       make(map[string]time.Time),
+		docsFailed: metrics.DocsFailed.Value(),
+	}
+}
+
+type alert struct {
+	Kind   string `json:"kind"`
+	Text   string `json:"text"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// alert sends an alert to every webhook in the background, unless one of the
+// same kind was sent recently.
+func (idx *Indexer) alert(kind, format string, args ...interface{}) {
+	a := idx.alerts
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if last, ok := a.sent[kind]; ok && time.Since(last) < a.Cooldown {
+		a.mu.Unlock()
+		return
+	}
+	a.sent[kind] = time.Now()
+	a.mu.Unlock()
+
+	msg := alert{Kind: kind, Text: fmt.Sprintf(format, args...), Tenant: esmodels.Tenant()}
+	if msg.Tenant != "" {
+		msg.Text = fmt.Sprintf("[%s] %s", msg.Tenant, msg.Text)
+	}
+	idx.l.Warnf("Sending alert: %s", msg.Text)
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		idx.l.Errorf("Could not encode the alert: %s", err)
+		return
+	}
+	for _, w := range a.Webhooks {
+		a.sending.Add(1)
+		go func(w string) {
+			defer a.sending.Done()
+			err := a.post(w, b)
+			if err != nil {
+				// The URL may have a secret in it, like Slack's do, so
+				// we only log the host.
+				host := ""
+				if u, err := url.Parse(w); err == nil {
+					host = u.Host
+				}
+				idx.l.Errorf("Could not send an alert to %s: %s", host, err)
+			}
+		}(w)
+	}
+}
+
+func (a *alerter) post(webhook string, body []byte) error {
+	resp, err := a.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// This includes the URL, which we don't want in the logs.
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Got a %d response", resp.StatusCode)
+	}
+	return nil
+}
+
+// waitForAlerts waits for any alerts which are still being sent, so that they
+// aren't lost when the indexer exits.
+func (idx *Indexer) waitForAlerts() {
+	if idx.alerts != nil {
+		idx.alerts.sending.Wait()
+	}
+}
+
+// recordOutcome notes whether a repository failed, and sends an alert if too
+// many of the recent ones have.
+func (idx *Indexer) recordOutcome(failed bool) {
+	a := idx.alerts
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if len(a.outcomes) < alertWindow {
+		a.outcomes = append(a.outcomes, failed)
+	} else {
+		a.outcomes[a.next] = failed
+		a.next = (a.next + 1) % alertWindow
+	}
+	failures := 0
+	for _, f := range a.outcomes {
+		if f {
+			failures++
+		}
+	}
+	n := len(a.outcomes)
+	a.mu.Unlock()
+
+	if n == alertWindow && float64(failures) >= a.FailureRate*float64(n) {
+		idx.alert("failure_rate", "%d of the last %d repositories could not be indexed", failures, n)
+	}
+}
+
+// alertLoop checks the GitHub quota and Elasticsearch writes every so often
+// until the crawl ends.
+func (idx *Indexer) alertLoop() {
+	if idx.alerts == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(alertCheckInterval):
+		case <-idx.done:
+			return
+		case <-idx.ctx.Done():
+			return
+		}
+		idx.checkAlerts()
+	}
+}
+
+func (idx *Indexer) checkAlerts() {
+	// Only the core quota matters here, since running out of searches just
+	// slows down discovery. A quota whose reset time has passed has been
+	// refilled, even if we haven't made a request since.
+	now := time.Now()
+	for _, q := range crawler.GitHubQuotas() {
+		if q.Resource == "core" && q.Remaining == 0 && q.Reset.After(now) {
+			idx.alert("github_quota", "The GitHub API quota for the token ending in %s is used up until %s", q.Token, q.Reset.Format(time.RFC3339))
+		}
+	}
+
+	a := idx.alerts
+	docsFailed := metrics.DocsFailed.Value()
+	a.mu.Lock()
+	failed := docsFailed - a.docsFailed
+	a.docsFailed = docsFailed
+	a.mu.Unlock()
+	if failed > 0 {
+		idx.alert("elasticsearch", "%d documents could not be written to Elasticsearch", failed)
+	}
+}
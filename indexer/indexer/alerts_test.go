@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/autarch/metagodoc/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerts(t *testing.T) {
+	var got []alert
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&a))
+		mu.Lock()
+		got = append(got, a)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	idx := testIndexer(t)
+	idx.alerts = newAlerter(Alerts{Webhooks: []string{srv.URL}, FailureRate: 0.2})
+
+	// Nine failures in the window isn't enough.
+	for i := 0; i < alertWindow; i++ {
+		idx.recordOutcome(i >= alertWindow-9)
+	}
+	idx.waitForAlerts()
+	assert.Empty(t, got)
+
+	// The window slides, so the oldest success drops out.
+	idx.recordOutcome(true)
+	idx.recordOutcome(true)
+	idx.waitForAlerts()
+	if assert.Len(t, got, 1, "repeated alerts wait for the cooldown") {
+		assert.Equal(t, "failure_rate", got[0].Kind)
+		assert.Equal(t, "10 of the last 50 repositories could not be indexed", got[0].Text)
+	}
+
+	metrics.DocsFailed.Add(3)
+	idx.checkAlerts()
+	idx.checkAlerts()
+	idx.waitForAlerts()
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, "elasticsearch", got[1].Kind)
+		assert.Equal(t, "3 documents could not be written to Elasticsearch", got[1].Text)
+	}
+
+	idx.alerts = nil
+	idx.recordOutcome(true)
+	idx.alert("github_quota", "nobody hears this")
+	idx.waitForAlerts()
+	assert.Len(t, got, 2, "nothing is sent without webhooks")
+}
+
+func TestAlertPostHidesURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+
+	hook := srv.URL + "/hooks/secret-token"
+	a := newAlerter(Alerts{Webhooks: []string{hook}})
+	err := a.post(hook, []byte("{}"))
+	if assert.Error(t, err) {
+		assert.False(t, strings.Contains(err.Error(), "secret-token"), "the error doesn't include the webhook URL")
+	}
+}
+
+func TestAlertsValidate(t *testing.T) {
+	assert.Nil(t, Alerts{Webhooks: []string{"https://hooks.example.com/x"}}.Validate())
+	assert.Error(t, Alerts{FailureRate: 1.5}.Validate())
+	assert.Error(t, Alerts{Cooldown: -1}.Validate())
+	assert.Error(t, Alerts{Webhooks: []string{"hooks.example.com"}}.Validate())
+}
@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"encoding/json"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/apidiff"
+
+	"github.com/olivere/elastic"
+)
+
+// diffAPIs compares the API of every tag we've just indexed with the stable
+// version before it. Tags don't usually move, so a tag which was already
+// indexed keeps the diff it had. If the previous version wasn't indexed again
+// this time we have to get its packages from Elasticsearch, and if we can't
+// then the tag goes without a diff until it's next reindexed.
+func (idx *Indexer) diffAPIs(j *job) {
+	// Packages are only written for refs which have them, so the ones we
+	// get from Elasticsearch are kept here rather than on the ref, where
+	// they'd be written back without most of their fields.
+	pkgs := make(map[string][]*esmodels.Package)
+	for _, r := range j.model.Refs {
+		pkgs[r.Name] = r.Packages
+	}
+
+	for _, r := range j.model.Refs {
+		if r.RefType != "tag" || r.Removed != "" || r.APIDiff != nil || len(r.Packages) == 0 {
+			continue
+		}
+		prev, ok := apidiff.Previous(j.model.Refs, r.Name)
+		if !ok {
+			continue
+		}
+
+		if len(pkgs[prev]) == 0 {
+			loaded, err := idx.refPackages(j, prev)
+			if err != nil {
+				j.l.Warnf("Could not get the packages in %s to compare with %s: %s", prev, r.Name, err)
+				continue
+			}
+			if len(loaded) == 0 {
+				continue
+			}
+			pkgs[prev] = loaded
+		}
+
+		r.APIDiff = apidiff.Diff(prev, r.Name, pkgs[prev], r.Packages)
+		if r.APIDiff.Breaking {
+			j.l.Infof("%s breaks the API of %s", r.Name, prev)
+		}
+	}
+}
+
+// refPackages gets the indexed packages for one of the job's refs, with just
+// enough of each to compare APIs.
+func (idx *Indexer) refPackages(j *job, ref string) ([]*esmodels.Package, error) {
+	if idx.elastic == nil {
+		return nil, nil
+	}
+
+	q := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("repository_id", j.repo.ID()),
+		elastic.NewTermQuery("ref", ref),
+	)
+	fields := []string{"name", "import_path", "is_internal", "is_vendored", "is_command", "consts", "vars", "funcs", "types"}
+	var pkgs []*esmodels.Package
+	err := idx.scrollAll("package", q, fields, func(id string, source []byte) error {
+		p := &esmodels.Package{}
+		err := json.Unmarshal(source, p)
+		if err != nil {
+			return err
+		}
+		pkgs = append(pkgs, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
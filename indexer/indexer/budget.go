@@ -0,0 +1,88 @@
+package indexer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Budget limits how much work a single run of the indexer does. A zero
+// value for any limit means there is no limit.
+type Budget struct {
+	MaxRepositories int
+	MaxCloneBytes   int64
+	MaxDuration     time.Duration
+}
+
+type budget struct {
+	Budget
+	start        time.Time
+	repositories int
+	cloneBytes   int64
+	// In daemon mode this is closed when the budget is refilled, and paused
+	// is true once a worker has noticed that it ran out.
+	refilled chan struct{}
+	paused   bool
+	mu       sync.Mutex
+}
+
+func newBudget(b Budget) *budget {
+	return &budget{
+		Budget:   b,
+		start:    time.Now(),
+		refilled: make(chan struct{}),
+	}
+}
+
+// reset starts the budget over for a new round.
+func (b *budget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.start = time.Now()
+	b.repositories = 0
+	b.cloneBytes = 0
+	b.paused = false
+	close(b.refilled)
+	b.refilled = make(chan struct{})
+}
+
+// pause returns a channel which is closed when the budget is next reset. The
+// bool is true for the first caller after the budget ran out.
+func (b *budget) pause() (<-chan struct{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	first := !b.paused
+	b.paused = true
+	return b.refilled, first
+}
+
+// spend records a repository that was cloned or fetched. Repositories count
+// against the budget whether or not they end up being indexed successfully,
+// since the work was done either way.
+func (b *budget) spend(cloneBytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.repositories++
+	b.cloneBytes += cloneBytes
+}
+
+// exhausted returns a description of the first limit that has been reached,
+// or an empty string if there's budget left.
+func (b *budget) exhausted() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.MaxRepositories > 0 && b.repositories >= b.MaxRepositories {
+		return fmt.Sprintf("indexed %d repositories", b.repositories)
+	}
+	if b.MaxCloneBytes > 0 && b.cloneBytes >= b.MaxCloneBytes {
+		return fmt.Sprintf("cloned %d bytes", b.cloneBytes)
+	}
+	if b.MaxDuration > 0 && time.Since(b.start) >= b.MaxDuration {
+		return fmt.Sprintf("ran for %s", b.MaxDuration)
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/metrics"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Only this many failures are listed in a crawl report. The categories still
+// count every one of them.
+const maxReportedFailures = 100
+
+// crawlReport gathers an esmodels.CrawlReport as the run goes. Recording
+// things with a nil report does nothing, so IndexOne doesn't need one.
+type crawlReport struct {
+	r esmodels.CrawlReport
+	// The GitHub request counter at the start of the run, since it covers
+	// the whole process.
+	githubRequests int64
+	// Documents sent to the writer. See countingWriter.
+	docs int64
+	mu   sync.Mutex
+}
+
+func newCrawlReport() *crawlReport {
+	return &crawlReport{
+		r: esmodels.CrawlReport{
+			Started:           esmodels.FormatTime(time.Now()),
+			Tenant:            esmodels.Tenant(),
+			FailureCategories: make(map[string]int),
+			Failures:          []*esmodels.CrawlFailure{},
+		},
+		githubRequests: metrics.GitHubRequests.Value(),
+	}
+}
+
+func (c *crawlReport) succeeded() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Attempted++
+	c.r.Succeeded++
+}
+
+func (c *crawlReport) skipped() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Attempted++
+	c.r.Skipped++
+}
+
+func (c *crawlReport) failed(id, category string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Attempted++
+	c.r.Failed++
+	c.r.FailureCategories[category]++
+	if len(c.r.Failures) < maxReportedFailures {
+		c.r.Failures = append(c.r.Failures, &esmodels.CrawlFailure{ID: id, Category: category, Error: err.Error()})
+	}
+}
+
+func (c *crawlReport) fetched(bytes int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.CloneBytes += bytes
+}
+
+// stop records why the run ended. Only the first reason counts, since
+// whatever comes after is a consequence of it.
+func (c *crawlReport) stop(reason string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r.StopReason == "" {
+		c.r.StopReason = reason
+	}
+}
+
+// finish returns the completed report.
+func (c *crawlReport) finish(stopReason string) *esmodels.CrawlReport {
+	c.stop(stopReason)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.r
+	r.Finished = esmodels.FormatTime(time.Now())
+	r.DocumentsWritten = atomic.LoadInt64(&c.docs)
+	r.GitHubRequests = metrics.GitHubRequests.Value() - c.githubRequests
+	r.GitHubQuotaRemaining = -1
+	if metrics.GitHubRequests.Value() > 0 {
+		r.GitHubQuotaRemaining = int64(metrics.GitHubQuotaRemaining.Value())
+	}
+	return &r
+}
+
+// countingWriter counts the documents written for the crawl report, and for
+// the throughput if that's set.
+type countingWriter struct {
+	esmodels.DocumentWriter
+	report     func() *crawlReport
+	throughput *throughput
+}
+
+func (w *countingWriter) count() {
+	if r := w.report(); r != nil {
+		atomic.AddInt64(&r.docs, 1)
+	}
+	if w.throughput != nil {
+		w.throughput.count("documents", 1)
+	}
+}
+
+func (w *countingWriter) Index(index, typ, id string, doc interface{}) {
+	w.count()
+	w.DocumentWriter.Index(index, typ, id, doc)
+}
+
+func (w *countingWriter) IndexWithRouting(index, typ, id, routing string, doc interface{}) {
+	w.count()
+	w.DocumentWriter.IndexWithRouting(index, typ, id, routing, doc)
+}
+
+func (w *countingWriter) Update(index, typ, id string, doc interface{}) {
+	w.count()
+	w.DocumentWriter.Update(index, typ, id, doc)
+}
+
+func (w *countingWriter) UpdateWithScript(index, typ, id string, script *elastic.Script) {
+	w.count()
+	w.DocumentWriter.UpdateWithScript(index, typ, id, script)
+}
+
+func (w *countingWriter) Batch() esmodels.DocumentWriter {
+	return &countingWriter{DocumentWriter: w.DocumentWriter.Batch(), report: w.report, throughput: w.throughput}
+}
+
+// currentReport returns the report for the run in progress. This is nil
+// outside of IndexAll.
+func (idx *Indexer) currentReport() *crawlReport {
+	idx.crawlReportMu.Lock()
+	defer idx.crawlReportMu.Unlock()
+	return idx.crawlReport
+}
+
+// swapReport replaces the report for the run in progress, returning the old
+// one, if any.
+func (idx *Indexer) swapReport(next *crawlReport) *crawlReport {
+	idx.crawlReportMu.Lock()
+	defer idx.crawlReportMu.Unlock()
+	prev := idx.crawlReport
+	idx.crawlReport = next
+	return prev
+}
+
+// endReport finishes the report for the run in progress and writes it to the
+// report directory, and to Elasticsearch if that was asked for.
+func (idx *Indexer) endReport(c *crawlReport, stopReason string) {
+	if c == nil {
+		return
+	}
+	if idx.ctx.Err() != nil {
+		stopReason = "cancelled"
+	}
+	r := c.finish(stopReason)
+
+	idx.l.Infow(
+		"Crawl report",
+		"attempted", r.Attempted,
+		"succeeded", r.Succeeded,
+		"skipped", r.Skipped,
+		"failed", r.Failed,
+		"documents", r.DocumentsWritten,
+		"stop_reason", r.StopReason,
+	)
+
+	path, err := idx.writeReportFile(r)
+	if err != nil {
+		idx.l.Errorf("Could not write the crawl report: %s", err)
+	} else {
+		idx.l.Infof("Wrote the crawl report to %s", path)
+	}
+
+	if !idx.crawlReportsToElastic || idx.elastic == nil || idx.dryRun {
+		return
+	}
+	// The crawl context may be cancelled by now, and the report is most
+	// interesting when it was.
+	_, err = idx.elastic.
+		Index().
+		Index(esmodels.Index("crawl_report")).
+		Type(idx.elastic.Type("crawl_report")).
+		Id(r.Started).
+		BodyJson(r).
+		Do(context.Background())
+	if err != nil {
+		idx.l.Errorf("Could not write the crawl report to Elasticsearch: %s", err)
+	}
+}
+
+// Reports are named after the time the run started, so they sort in order.
+func (idx *Indexer) writeReportFile(r *esmodels.CrawlReport) (string, error) {
+	dir := idx.crawlReports
+	if dir == "" {
+		dir = idx.statePath("crawl-reports")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", dir), err)
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(":", "", "-", "").Replace(r.Started)
+	path := filepath.Join(dir, name+".json")
+	return path, ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,62 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrawlReport(t *testing.T) {
+	idx := testIndexer(t)
+	idx.crawlReports = filepath.Join(idx.cacheRoot, "reports")
+	idx.writer = &countingWriter{DocumentWriter: idx.writer, report: idx.currentReport}
+
+	// Nothing is recorded outside of a run.
+	idx.currentReport().succeeded()
+	idx.writer.Index(esmodels.Index("repository"), "repository", "github.com/example/early", &esmodels.Repository{})
+
+	idx.swapReport(newCrawlReport())
+	r := idx.currentReport()
+	r.succeeded()
+	r.skipped()
+	r.failed("github.com/example/broken", "fetch", errors.New("boom"))
+	r.fetched(1024)
+	r.stop("budget exhausted: indexed 3 repositories")
+	idx.writer.Index(esmodels.Index("repository"), "repository", "github.com/example/thing", &esmodels.Repository{})
+	idx.writer.Update(esmodels.Index("repository"), "repository", "github.com/example/other", map[string]bool{"stale": false})
+	idx.endReport(idx.swapReport(nil), "stopped")
+	assert.Nil(t, idx.currentReport())
+
+	files, err := filepath.Glob(filepath.Join(idx.crawlReports, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got esmodels.CrawlReport
+	if !assert.Nil(t, json.Unmarshal(b, &got)) {
+		return
+	}
+
+	assert.Equal(t, 3, got.Attempted)
+	assert.Equal(t, 1, got.Succeeded)
+	assert.Equal(t, 1, got.Skipped)
+	assert.Equal(t, 1, got.Failed)
+	assert.Equal(t, map[string]int{"fetch": 1}, got.FailureCategories)
+	assert.Equal(t, []*esmodels.CrawlFailure{{ID: "github.com/example/broken", Category: "fetch", Error: "boom"}}, got.Failures)
+	assert.Equal(t, int64(2), got.DocumentsWritten)
+	assert.Equal(t, int64(1024), got.CloneBytes)
+	assert.Equal(t, "budget exhausted: indexed 3 repositories", got.StopReason, "the first reason wins")
+	assert.NotEmpty(t, got.Finished)
+}
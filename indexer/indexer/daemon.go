@@ -0,0 +1,107 @@
+package indexer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Daemon settings keep the indexer running indefinitely, rather than having
+// cron start a new run every so often. Crawling, the queue, rescheduling,
+// reconciliation, and retention all carry on in the one process. The Budget
+// becomes a limit on each round instead of on the whole run, and when a
+// round's budget runs out the pipeline waits for the next round rather than
+// stopping.
+type Daemon struct {
+	Enabled bool
+	// How often a new round starts with a fresh budget. Defaults to a day.
+	RoundInterval time.Duration
+	// How often the seed lists are read again. Defaults to a day.
+	SeedInterval time.Duration
+	// How often every indexed repository is rescheduled. Defaults to six
+	// hours.
+	ScheduleInterval time.Duration
+}
+
+const defaultRoundInterval = 24 * time.Hour
+const defaultSeedInterval = 24 * time.Hour
+
+// Validate returns an error if any of the intervals are negative.
+func (d Daemon) Validate() error {
+	for name, i := range map[string]time.Duration{
+		"round":    d.RoundInterval,
+		"seed":     d.SeedInterval,
+		"schedule": d.ScheduleInterval,
+	} {
+		if i < 0 {
+			return fmt.Errorf("The daemon's %s interval cannot be negative: %s", name, i)
+		}
+	}
+	return nil
+}
+
+func (d Daemon) withDefaults() Daemon {
+	if d.RoundInterval == 0 {
+		d.RoundInterval = defaultRoundInterval
+	}
+	if d.SeedInterval == 0 {
+		d.SeedInterval = defaultSeedInterval
+	}
+	if d.ScheduleInterval == 0 {
+		d.ScheduleInterval = scheduleInterval
+	}
+	return d
+}
+
+// roundLoop refills the budget at the start of every round, and writes the
+// crawl report for the round that ended.
+func (idx *Indexer) roundLoop() {
+	if !idx.daemon.Enabled {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(idx.daemon.RoundInterval):
+		case <-idx.done:
+			return
+		case <-idx.ctx.Done():
+			return
+		}
+		idx.l.Info("Starting a new round with a fresh crawl budget")
+		idx.endReport(idx.swapReport(newCrawlReport()), "round ended")
+		idx.budget.reset()
+	}
+}
+
+// seedLoop seeds the queue once, or every SeedInterval in daemon mode, so
+// that new entries in the curated lists are picked up.
+func (idx *Indexer) seedLoop() {
+	for {
+		idx.seed()
+		if !idx.daemon.Enabled {
+			return
+		}
+
+		select {
+		case <-time.After(idx.daemon.SeedInterval):
+		case <-idx.done:
+			return
+		case <-idx.ctx.Done():
+			return
+		}
+	}
+}
+
+// waitForRound blocks a discovery worker until the next round starts.
+func (idx *Indexer) waitForRound(reason string) {
+	refilled, first := idx.budget.pause()
+	if first {
+		idx.l.Infof("Crawl budget exhausted after this round %s - waiting for the next round", reason)
+	}
+
+	select {
+	case <-refilled:
+	case <-idx.done:
+	case <-idx.ctx.Done():
+	}
+}
@@ -0,0 +1,38 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemonRounds(t *testing.T) {
+	idx := testIndexer(t)
+	idx.daemon = Daemon{Enabled: true}.withDefaults()
+	idx.budget = newBudget(Budget{MaxRepositories: 1})
+	idx.budget.spend(0)
+
+	waited := make(chan struct{})
+	go func() {
+		assert.Nil(t, idx.discoverNext())
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("discovery should wait for the next round")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, idx.isDone(), "running out of budget doesn't stop the daemon")
+
+	idx.budget.reset()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("discovery should carry on once the budget is refilled")
+	}
+	assert.Empty(t, idx.budget.exhausted())
+
+	assert.Error(t, Daemon{SeedInterval: -time.Hour}.Validate())
+}
@@ -0,0 +1,109 @@
+package indexer
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/autarch/metagodoc/esmodels"
+)
+
+// In dry run mode nothing is written to Elasticsearch. Instead we write one
+// of these as a line of JSON for each write we would have done.
+type reportEntry struct {
+	ID string `json:"id"`
+	// One of "create", "update", "touch", "tombstone", "expire", or
+	// "purge". A touch only updates the crawl time of an unchanged
+	// repository.
+	Action string `json:"action"`
+
+	// For tombstones, and the retention action for expired repositories.
+	Kind   string `json:"kind,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// For repositories.
+	Status         esmodels.ActivityStatus `json:"status,omitempty"`
+	PreviousStatus esmodels.ActivityStatus `json:"previous_status,omitempty"`
+	Refs           []string                `json:"refs,omitempty"`
+	AddedRefs      []string                `json:"added_refs,omitempty"`
+	RemovedRefs    []string                `json:"removed_refs,omitempty"`
+	// The number of packages which would be written to the package index.
+	// Only refs which changed since the last crawl have their packages
+	// written.
+	Packages int `json:"packages"`
+}
+
+func (idx *Indexer) report(e *reportEntry) {
+	idx.reportMu.Lock()
+	defer idx.reportMu.Unlock()
+
+	err := json.NewEncoder(idx.reportOut).Encode(e)
+	if err != nil {
+		idx.l.Errorf("Could not write dry run report for %s: %s", e.ID, err)
+	}
+}
+
+// repositoryChanges describes what indexing the model would change, compared
+// to the currently indexed document. The previous document is nil if the
+// repository has never been indexed.
+func repositoryChanges(id string, prev, model *esmodels.Repository) *reportEntry {
+	e := &reportEntry{
+		ID:     id,
+		Action: "create",
+		Status: model.Status,
+	}
+
+	refs := refNames(model)
+	e.Refs = sortedKeys(refs)
+	for _, ref := range model.Refs {
+		e.Packages += len(ref.Packages)
+	}
+
+	if prev == nil {
+		return e
+	}
+
+	e.Action = "update"
+	if prev.Status != model.Status {
+		e.PreviousStatus = prev.Status
+	}
+
+	e.AddedRefs, e.RemovedRefs = difference(refNames(prev), refs)
+
+	return e
+}
+
+func refNames(r *esmodels.Repository) map[string]bool {
+	refs := make(map[string]bool)
+	for _, ref := range r.Refs {
+		if ref.Removed == "" {
+			refs[ref.Name] = true
+		}
+	}
+	return refs
+}
+
+func difference(before, after map[string]bool) ([]string, []string) {
+	var added, removed []string
+	for k := range after {
+		if !before[k] {
+			added = append(added, k)
+		}
+	}
+	for k := range before {
+		if !after[k] {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,297 @@
+package indexer
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// How often the importers of every package are counted. Each run reads the
+// whole index, so there's no point doing it more often than the index
+// changes much.
+const importersInterval = 24 * time.Hour
+
+// How many of the most starred importers are stored on each document.
+const maxTopImporters = 10
+
+func (idx *Indexer) importersLoop() {
+	if idx.elastic == nil {
+		return
+	}
+
+	for !idx.isDone() {
+		err := idx.countImporters()
+		if err != nil {
+			idx.l.Errorf("Could not count importers: %s", err)
+		}
+
+		select {
+		case <-time.After(importersInterval):
+		case <-idx.done:
+			return
+		}
+	}
+}
+
+// importersGraph inverts the imports of every indexed package. Only the
+// default branch of each repository counts as an importer, and vendored
+// packages don't count at all, since neither says anything about what the
+// repository actually uses. Imports from inside the same repository aren't
+// counted either.
+type importersGraph struct {
+	stars map[string]int
+	heads map[string]string
+	// Import path to the packages which import it.
+	importers map[string][]importer
+	// Repository ID to the import paths of its packages, in any ref.
+	packages map[string]map[string]bool
+}
+
+type importer struct {
+	importPath   string
+	repositoryID string
+}
+
+func newImportersGraph() *importersGraph {
+	return &importersGraph{
+		stars:     make(map[string]int),
+		heads:     make(map[string]string),
+		importers: make(map[string][]importer),
+		packages:  make(map[string]map[string]bool),
+	}
+}
+
+func (g *importersGraph) addRepository(id string, r *esmodels.Repository) {
+	g.stars[id] = r.Stars
+	for _, ref := range r.Refs {
+		if ref.IsDefaultBranch {
+			g.heads[id] = ref.Name
+		}
+	}
+}
+
+// addPackage must be called after every repository has been added, so that
+// we know which of its refs is the default branch.
+func (g *importersGraph) addPackage(p *esmodels.Package) {
+	if g.packages[p.RepositoryID] == nil {
+		g.packages[p.RepositoryID] = make(map[string]bool)
+	}
+	g.packages[p.RepositoryID][p.ImportPath] = true
+
+	if p.IsVendored || p.Ref != g.heads[p.RepositoryID] {
+		return
+	}
+	from := importer{importPath: p.ImportPath, repositoryID: p.RepositoryID}
+	for _, ip := range p.Imports {
+		if ip != p.ImportPath {
+			g.importers[ip] = append(g.importers[ip], from)
+		}
+	}
+}
+
+// packageImporters returns how many packages import the given package, and
+// the import paths of the ones in the most starred repositories.
+func (g *importersGraph) packageImporters(importPath, repoID string) (int, []string) {
+	seen := make(map[string]bool)
+	var from []importer
+	for _, i := range g.importers[importPath] {
+		if i.repositoryID == repoID || seen[i.importPath] {
+			continue
+		}
+		seen[i.importPath] = true
+		from = append(from, i)
+	}
+
+	g.sortImporters(from, func(i importer) string { return i.importPath })
+	var top []string
+	for _, i := range from {
+		if len(top) == maxTopImporters {
+			break
+		}
+		top = append(top, i.importPath)
+	}
+	return len(from), top
+}
+
+// repositoryImporters returns how many other repositories import any of the
+// given repository's packages, and the IDs of the most starred of them.
+func (g *importersGraph) repositoryImporters(id string) (int, []string) {
+	seen := make(map[string]bool)
+	var from []importer
+	for ip := range g.packages[id] {
+		for _, i := range g.importers[ip] {
+			if i.repositoryID == id || seen[i.repositoryID] {
+				continue
+			}
+			seen[i.repositoryID] = true
+			from = append(from, i)
+		}
+	}
+
+	g.sortImporters(from, func(i importer) string { return i.repositoryID })
+	var top []string
+	for _, i := range from {
+		if len(top) == maxTopImporters {
+			break
+		}
+		top = append(top, i.repositoryID)
+	}
+	return len(from), top
+}
+
+// Ties are broken by name so that the top importers don't change from one
+// run to the next for no reason.
+func (g *importersGraph) sortImporters(from []importer, name func(importer) string) {
+	sort.Slice(from, func(i, j int) bool {
+		si, sj := g.stars[from[i].repositoryID], g.stars[from[j].repositoryID]
+		if si != sj {
+			return si > sj
+		}
+		return name(from[i]) < name(from[j])
+	})
+}
+
+// countImporters reads every repository and package in the index, works out
+// who imports what, and updates the documents whose counts have changed.
+// Repositories with no recent commits move between that status and Inactive
+// depending on whether anything imports them.
+func (idx *Indexer) countImporters() error {
+	idx.l.Infof("Counting the importers of every package")
+
+	g := newImportersGraph()
+	repos := make(map[string]*esmodels.Repository)
+	err := idx.scrollAll("repository", nil,
+		[]string{"refs.name", "refs.is_head", "stars", "status", "status_history", "imported_by", "top_importers", "importers_counted"},
+		func(id string, source []byte) error {
+			r := &esmodels.Repository{}
+			err := json.Unmarshal(source, r)
+			if err != nil {
+				return err
+			}
+			repos[id] = r
+			g.addRepository(id, r)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	type counted struct {
+		id           string
+		importPath   string
+		repositoryID string
+		importedBy   int
+		topImporters []string
+	}
+	var packages []counted
+	err = idx.scrollAll("package", nil,
+		[]string{"import_path", "repository_id", "ref", "is_vendored", "imports", "imported_by", "top_importers"},
+		func(id string, source []byte) error {
+			p := &esmodels.Package{}
+			err := json.Unmarshal(source, p)
+			if err != nil {
+				return err
+			}
+			g.addPackage(p)
+			packages = append(packages, counted{id, p.ImportPath, p.RepositoryID, p.ImportedBy, p.TopImporters})
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	updated := 0
+	for _, p := range packages {
+		n, top := g.packageImporters(p.importPath, p.repositoryID)
+		if n == p.importedBy && reflect.DeepEqual(top, p.topImporters) {
+			continue
+		}
+		updated++
+		if !idx.dryRun {
+			idx.writer.Update(esmodels.Index("package"), "package", p.id, map[string]interface{}{
+				"imported_by":   n,
+				"top_importers": top,
+			})
+		}
+	}
+
+	now := esmodels.FormatTime(time.Now())
+	inactive := 0
+	for id, r := range repos {
+		n, top := g.repositoryImporters(id)
+		if r.ImportersCounted && n == r.ImportedBy && reflect.DeepEqual(top, r.TopImporters) {
+			continue
+		}
+
+		r.ImportedBy = n
+		r.TopImporters = top
+		r.ImportersCounted = true
+		doc := map[string]interface{}{
+			"imported_by":       n,
+			"top_importers":     top,
+			"importers_counted": true,
+		}
+		if status := r.StatusWithImporters(); status != r.Status {
+			if status == esmodels.Inactive {
+				inactive++
+			}
+			doc["status"] = status
+			doc["status_history"] = append(r.StatusHistory, &esmodels.StatusTransition{
+				From: r.Status,
+				To:   status,
+				At:   now,
+			})
+		}
+
+		updated++
+		if !idx.dryRun {
+			idx.writer.Update(esmodels.Index("repository"), "repository", id, doc)
+		}
+	}
+
+	idx.l.Infof("Counted the importers of %d repositories and %d packages, updating %d documents, %d repositories became inactive",
+		len(repos), len(packages), updated, inactive)
+
+	return nil
+}
+
+// scrollAll calls f with the ID and source of every document of the given
+// type which matches the query, fetching only the listed fields. A nil query
+// matches every document.
+func (idx *Indexer) scrollAll(typ string, q elastic.Query, fields []string, f func(id string, source []byte) error) error {
+	scroll := idx.elastic.
+		Scroll(esmodels.Index(typ)).
+		Type(idx.elastic.SearchTypes(typ)...).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...)).
+		Size(1000)
+	if q != nil {
+		scroll = scroll.Query(q)
+	}
+
+	for !idx.isDone() {
+		result, err := scroll.Do(idx.ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			err := f(hit.Id, *hit.Source)
+			if err != nil {
+				return errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportersGraph(t *testing.T) {
+	g := newImportersGraph()
+	for id, stars := range map[string]int{"github.com/lib/lib": 1, "github.com/big/app": 100, "github.com/small/app": 5} {
+		g.addRepository(id, &esmodels.Repository{
+			Stars: stars,
+			Refs:  []*esmodels.Ref{{Name: "v1.0.0"}, {Name: "master", IsDefaultBranch: true}},
+		})
+	}
+
+	pkgs := []*esmodels.Package{
+		{ImportPath: "github.com/lib/lib", RepositoryID: "github.com/lib/lib", Ref: "master"},
+		{ImportPath: "github.com/lib/lib", RepositoryID: "github.com/lib/lib", Ref: "v1.0.0"},
+		{ImportPath: "github.com/lib/lib/util", RepositoryID: "github.com/lib/lib", Ref: "master", Imports: []string{"github.com/lib/lib"}},
+		{ImportPath: "github.com/small/app", RepositoryID: "github.com/small/app", Ref: "master", Imports: []string{"github.com/lib/lib", "fmt"}},
+		{ImportPath: "github.com/big/app", RepositoryID: "github.com/big/app", Ref: "master", Imports: []string{"github.com/lib/lib/util"}},
+		{ImportPath: "github.com/big/app/cmd", RepositoryID: "github.com/big/app", Ref: "master", Imports: []string{"github.com/lib/lib", "github.com/big/app"}},
+		// Neither of these count.
+		{ImportPath: "github.com/big/app", RepositoryID: "github.com/big/app", Ref: "v1.0.0", Imports: []string{"github.com/small/app"}},
+		{ImportPath: "github.com/big/app/vendor/github.com/small/app", RepositoryID: "github.com/big/app", Ref: "master", IsVendored: true, Imports: []string{"github.com/small/app"}},
+	}
+	for _, p := range pkgs {
+		g.addPackage(p)
+	}
+
+	n, top := g.packageImporters("github.com/lib/lib", "github.com/lib/lib")
+	assert.Equal(t, 2, n, "importers in the same repository aren't counted")
+	assert.Equal(t, []string{"github.com/big/app/cmd", "github.com/small/app"}, top)
+
+	n, top = g.packageImporters("github.com/small/app", "github.com/small/app")
+	assert.Equal(t, 0, n, "only the default branch and unvendored packages count")
+	assert.Empty(t, top)
+
+	n, top = g.packageImporters("github.com/big/app", "github.com/big/app")
+	assert.Equal(t, 0, n)
+	assert.Empty(t, top)
+
+	n, top = g.repositoryImporters("github.com/lib/lib")
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"github.com/big/app", "github.com/small/app"}, top, "most starred first")
+
+	n, _ = g.repositoryImporters("github.com/big/app")
+	assert.Equal(t, 0, n)
+}
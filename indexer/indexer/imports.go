@@ -0,0 +1,138 @@
+package indexer
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// How many repositories can be waiting for their imports to be discovered.
+// If discovery falls further behind than this then we skip some, and their
+// imports are discovered the next time they're crawled.
+const maxPendingImports = 1000
+
+// The imports of one repository, waiting to be discovered.
+type importsBatch struct {
+	l      *logger.Logger
+	repoID string
+	paths  []string
+}
+
+// queueImports hands the imports of a repository we've just indexed to
+// discoverLoop. Resolving vanity import paths means fetching them, which can
+// take a while, so we don't want to do it while holding up the pipeline.
+// Without the loop, when indexing a single repository, we do it right away.
+func (idx *Indexer) queueImports(l *logger.Logger, repoID string, model *esmodels.Repository) {
+	paths := importPaths(model)
+	if len(paths) == 0 {
+		return
+	}
+
+	if idx.imports == nil {
+		idx.discoverImports(idx.ctx, l, repoID, paths)
+		return
+	}
+
+	select {
+	case idx.imports <- &importsBatch{l: l, repoID: repoID, paths: paths}:
+	default:
+		l.Infof("Too many repositories are waiting for import discovery, skipping %s", repoID)
+	}
+}
+
+func (idx *Indexer) discoverLoop() {
+	for {
+		select {
+		case b := <-idx.imports:
+			idx.discoverImports(idx.ctx, b.l, b.repoID, b.paths)
+		case <-idx.done:
+			return
+		case <-idx.ctx.Done():
+			return
+		}
+	}
+}
+
+// importPaths returns every import path the repository's packages import,
+// in any ref, without the standard library or duplicates.
+func importPaths(model *esmodels.Repository) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, ref := range model.Refs {
+		for _, pkg := range ref.Packages {
+			for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+				for _, ip := range imports {
+					if seen[ip] || isStdlib(ip) {
+						continue
+					}
+					seen[ip] = true
+					paths = append(paths, ip)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// discoverImports adds the repositories for the given import paths to the
+// crawl queue. Repositories the queue already knows about are ignored, so
+// over time this lets the index grow to cover the whole dependency graph of
+// everything we've crawled.
+func (idx *Indexer) discoverImports(ctx context.Context, l *logger.Logger, repoID string, paths []string) {
+	seen := make(map[string]bool)
+	added := 0
+	for _, ip := range paths {
+		if idx.isDone() {
+			return
+		}
+
+		root, err := idx.resolver.Resolve(ctx, ip)
+		if err != nil {
+			l.Debugf("Could not resolve %s: %s", ip, err)
+			continue
+		}
+
+		u := repository.NormalizeURL(root.RepoURL)
+		id := repository.IDFromURL(u)
+		if seen[id] || id == repoID || !idx.allowed(id) {
+			continue
+		}
+		seen[id] = true
+
+		if idx.crawlerFor(u) == nil {
+			continue
+		}
+
+		ok, err := idx.queue.Add(id, u.String(), nil)
+		if err != nil {
+			l.Errorf("Could not add %s to the queue: %s", id, err)
+			continue
+		}
+		if ok {
+			added++
+		}
+
+		if root.IsVanity {
+			err = idx.queue.SetImportPrefix(id, root.ImportPrefix)
+			if err != nil {
+				l.Errorf("Could not update %s in the queue: %s", id, err)
+			}
+		}
+	}
+
+	if added > 0 {
+		l.Infof("Added %d imported repositories to the queue", added)
+	}
+}
+
+// Standard library import paths never have a dot in their first element,
+// while every remote import path does.
+func isStdlib(importPath string) bool {
+	first := strings.SplitN(importPath, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
@@ -0,0 +1,47 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportPaths(t *testing.T) {
+	model := &esmodels.Repository{
+		Refs: []*esmodels.Ref{
+			{Packages: []*esmodels.Package{
+				{Imports: []string{"fmt", "github.com/pkg/errors"}, TestImports: []string{"github.com/stretchr/testify/assert"}},
+				{Imports: []string{"github.com/pkg/errors"}, XTestImports: []string{"k8s.io/client-go/rest"}},
+			}},
+			{Packages: []*esmodels.Package{
+				{Imports: []string{"github.com/pkg/errors", "net/http"}},
+			}},
+		},
+	}
+	assert.Equal(
+		t,
+		[]string{"github.com/pkg/errors", "github.com/stretchr/testify/assert", "k8s.io/client-go/rest"},
+		importPaths(model),
+		"each import path once, without the standard library",
+	)
+}
+
+func TestQueueImports(t *testing.T) {
+	idx := testIndexer(t)
+	idx.imports = make(chan *importsBatch, 1)
+
+	model := &esmodels.Repository{
+		Refs: []*esmodels.Ref{{Packages: []*esmodels.Package{{Imports: []string{"github.com/pkg/errors"}}}}},
+	}
+	idx.queueImports(idx.l, "github.com/example/one", model)
+	idx.queueImports(idx.l, "github.com/example/two", model)
+	idx.queueImports(idx.l, "github.com/example/three", &esmodels.Repository{})
+
+	if assert.Len(t, idx.imports, 1, "imports are discovered later, and skipped when too many are waiting") {
+		b := <-idx.imports
+		assert.Equal(t, "github.com/example/one", b.repoID)
+		assert.Equal(t, []string{"github.com/pkg/errors"}, b.paths)
+	}
+}
@@ -2,15 +2,31 @@ package indexer
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/esmodels"
 	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/importpath"
+	"github.com/autarch/metagodoc/indexer/modgraph"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+	"github.com/autarch/metagodoc/indexer/repolist"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
 	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/scheduler"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+	"github.com/autarch/metagodoc/indexer/vulndb"
 	"github.com/autarch/metagodoc/logger"
 
 	"github.com/hako/durafmt"
@@ -23,30 +39,239 @@ type NewParams struct {
 	GitHubToken  string
 	CacheRoot    string
 	TraceElastic bool
+	// The Elasticsearch or OpenSearch nodes to connect to. See elc.NewParams
+	// for details.
+	ElasticURLs            []string
+	DisableElasticSniffing bool
+	// The prefix for every index name. See esmodels.SetIndexPrefix. This
+	// defaults to esmodels.DefaultIndexPrefix.
+	IndexPrefix string
+	// Keeps everything this indexer writes apart from other tenants sharing
+	// the cluster and cache root. See esmodels.SetTenant. The file queue and
+	// other crawl state in the cache root are per tenant too, but clones are
+	// shared.
+	Tenant string
+	// Either "file" or "elastic".
+	QueueBackend string
+	// The path to a YAML file listing repositories to skip. If this is empty
+	// then the default skip list is used.
+	SkipList string
+	// The path to a YAML file listing the only repositories which may be
+	// indexed, in the same format as the skip list. If this is empty then
+	// anything not skipped may be indexed.
+	AllowList string
+	// The default tag policy as a comma-separated list of key=value pairs,
+	// and the path to a YAML file with policies for particular repositories.
+	// See the tagpolicy package for details. If these are empty then the
+	// default policy is used for everything.
+	TagPolicy   string
+	TagPolicies string
+	// The path to a YAML file overriding which branches and packages are
+	// indexed for particular repositories. See the repopolicy package for
+	// details.
+	RepoPolicies string
+	// Per host rate limits as a comma-separated list of host=duration pairs.
+	// See ratelimit.Parse for details.
+	RateLimits string
+	// URLs or paths of curated lists, like awesome-go, used to seed the
+	// crawl queue.
+	SeedLists []string
+	// Limits on how much a single run may do. When any of these is reached
+	// IndexAll returns, leaving the remaining work in the queue. With more
+	// than one worker, the repositories already in progress are finished
+	// first, so the limits may be overshot a little. In daemon mode these
+	// apply to each round instead.
+	Budget Budget
+	// Keeps IndexAll running until the Context is cancelled. By default it
+	// returns once the budget runs out.
+	Daemon Daemon
+	// The number of workers for each stage of the pipeline. Defaults to 1.
+	Workers int
+	// Overrides Workers for particular stages, as a comma-separated list of
+	// stage=workers pairs, like "fetch=4,analyze=2". See ParseStages.
+	StageWorkers string
+	// The most disk space the clones under CacheRoot may use. See
+	// repository.Settings.CloneQuota. Zero means no limit.
+	MaxCloneCacheBytes int64
+	// How many commits of history to fetch for each ref. See
+	// repository.Settings.FetchDepth. Zero means all of it.
+	FetchDepth int
+	// Whether generated files are left out of package docs. See
+	// repository.Settings.ExcludeGenerated.
+	ExcludeGenerated bool
+	// Whether packages in testdata directories are indexed. See
+	// repository.Settings.IndexTestdata.
+	IndexTestdata bool
+	// Whether internal packages, and packages in vendor directories, are
+	// indexed. See repository.Settings.IndexInternal and
+	// repository.Settings.SummarizeVendor.
+	IndexInternal   bool
+	SummarizeVendor bool
+	// The Go vulnerability database which each ref's module requirements
+	// are checked against, like vulndb.DefaultURL. If this is empty refs
+	// aren't checked. See repository.Settings.VulnDB.
+	VulnDBURL string
+	// The Go module proxy used to follow each ref's dependencies to find
+	// how deep its dependency tree is, like modgraph.DefaultURL. If this is
+	// empty the depth isn't measured. See repository.Settings.ModuleProxy.
+	ModuleProxyURL string
+	// Limits on how many clones and fetches, and how many API calls, may be
+	// in progress at once across all of the workers. Zero means no limit
+	// beyond the per host rate limits. See ratelimit.Limiter.SetConcurrency.
+	MaxClones   int
+	MaxAPICalls int
+	// What to do about repositories which haven't been crawled for a long
+	// time. By default nothing is done.
+	Retention Retention
+	// How READMEs too big to keep in the repository document are stored.
+	About esmodels.AboutPolicy
+	// The number of documents sent to Elasticsearch in each bulk request, and
+	// how often pending documents are sent regardless. These default to
+	// esmodels.DefaultBulkSize and esmodels.DefaultBulkFlushInterval.
+	BulkSize          int
+	BulkFlushInterval time.Duration
+	// In dry run mode everything runs as usual except that nothing is written
+	// to Elasticsearch or the queue. Instead, a report of what would have
+	// been written is sent to DryRunReport as JSON lines.
+	DryRun       bool
+	DryRunReport io.Writer
+	// At the end of each run, or each round in daemon mode, a summary of
+	// what the crawl did is written to a file in CrawlReports. This defaults
+	// to the crawl-reports directory in the cache root. If
+	// CrawlReportsToElastic is true the summary is stored in the crawl_report
+	// index as well. See esmodels.CrawlReport.
+	CrawlReports          string
+	CrawlReportsToElastic bool
+	// Where to send alerts, if anywhere, and when. See Alerts.
+	Alerts Alerts
+	// Cancelling this stops the crawl right away. Repositories which are
+	// part way through stop at their next git command, directory, or write,
+	// and are retried on the next run. To let them finish first, call Stop
+	// before cancelling it. Defaults to context.Background().
+	Context context.Context
+	// How long indexing a single repository may take. Zero means no limit.
+	RepoTimeout time.Duration
+	// Repositories which fail this many crawls in a row are moved to the
+	// dead-letter list, and aren't crawled again until they're retried
+	// through the admin API. Zero means they're retried forever.
+	MaxFailures int
+	// Documents are written to this output instead of Elasticsearch if it's
+	// set. It's "ndjson:<dir>", "sqlite:<file>", or "sql:<file>", see
+	// esmodels.NewExportWriter for details. No cluster is needed in this
+	// mode, so every repository is treated as new and there's no
+	// rescheduling or reconciliation of previously indexed repositories.
+	Output string
 }
 
 type crawlers struct {
+	all       []crawler.Crawler
 	available []crawler.Crawler
 	sleeping  map[crawler.Crawler]time.Time
+	mu        sync.Mutex
 }
 
 type Indexer struct {
 	l           *logger.Logger
-	elastic     *elastic.Client
+	elastic     *elc.Client
+	writer      esmodels.DocumentWriter
 	cacheRoot   string
 	githubToken string
 	crawlers    crawlers
-	ctx         context.Context
-	err         error
+	queue       *queue.Queue
+	// These can be changed by Reload, so they're read through skipped,
+	// allowed, tagPolicy, and repoPolicy.
+	skipList     *repolist.List
+	allowList    *repolist.List
+	tagPolicies  *tagpolicy.Rules
+	repoPolicies *repopolicy.Rules
+	reloadMu     sync.RWMutex
+	resolver     *importpath.Resolver
+	imports      chan *importsBatch
+	limiter      *ratelimit.Limiter
+	seedLists    []string
+	budget       *budget
+	retention    Retention
+	daemon       Daemon
+	about        esmodels.AboutPolicy
+	stages       Stages
+	done         chan struct{}
+	doneOnce     sync.Once
+	pause        pause
+	dryRun       bool
+	reportOut    io.Writer
+	// Passed to every repository we crawl or index.
+	repoSettings repository.Settings
+	reportMu     sync.Mutex
+	ctx          context.Context
+	repoTimeout  time.Duration
+	err          error
+
+	// See crawlreport.go.
+	crawlReport           *crawlReport
+	crawlReportMu         sync.Mutex
+	crawlReports          string
+	crawlReportsToElastic bool
+
+	// See alerts.go.
+	alerts *alerter
+	// See throughput.go.
+	throughput throughput
 }
 
+// How often to reschedule every indexed repository based on what we know
+// about it.
+const scheduleInterval = 6 * time.Hour
+
+// How long to wait before recrawling a repository that was skipped or has
+// gone away.
+const skippedRecrawlInterval = 30 * 24 * time.Hour
+
+// How long to wait before retrying a repository that failed to index.
+const retryInterval = 6 * time.Hour
+
+// A repository which couldn't be written to Elasticsearch is retried sooner,
+// since that's usually the cluster having a bad moment rather than anything
+// wrong with the repository. The delay doubles with each failure in a row, up
+// to retryInterval.
+const writeRetryInterval = 5 * time.Minute
+
+// How long the worker sleeps when there is nothing in the queue that is due.
+const idleSleep = 30 * time.Second
+
 func New(p NewParams) *Indexer {
-	el, err := elc.NewClient(p.TraceElastic, p.Logger)
+	// We load the allow list before doing anything that touches the network,
+	// so that a broken allow list can never lead to us crawling things we
+	// shouldn't.
+	allowList, err := loadAllowList(p.AllowList)
+	if err != nil {
+		return &Indexer{err: err}
+	}
 
+	if p.IndexPrefix != "" {
+		err := esmodels.SetIndexPrefix(p.IndexPrefix)
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+	err = esmodels.SetTenant(p.Tenant)
 	if err != nil {
 		return &Indexer{err: err}
 	}
 
+	var el *elc.Client
+	if p.Output == "" {
+		var err error
+		el, err = elc.NewClient(elc.NewParams{
+			Logger:          p.Logger,
+			Trace:           p.TraceElastic,
+			URLs:            p.ElasticURLs,
+			DisableSniffing: p.DisableElasticSniffing,
+		})
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+
 	info, err := os.Stat(p.CacheRoot)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -61,26 +286,241 @@ func New(p NewParams) *Indexer {
 		return &Indexer{err: fmt.Errorf("The root that was passed, %s, is not a directory", p.CacheRoot)}
 	}
 
+	// The queue, index, and writer keep going after the crawl is cancelled,
+	// so that whatever was finished still gets recorded.
 	c := context.Background()
+	ctx := p.Context
+	if ctx == nil {
+		ctx = c
+	}
 	idx := &Indexer{
 		l:           p.Logger,
 		elastic:     el,
 		cacheRoot:   p.CacheRoot,
 		githubToken: p.GitHubToken,
-		ctx:         c,
+		seedLists:   p.SeedLists,
+		allowList:   allowList,
+		budget:      newBudget(p.Budget),
+		retention:   p.Retention,
+		daemon:      p.Daemon.withDefaults(),
+		about:       p.About,
+		done:        make(chan struct{}),
+		dryRun:      p.DryRun,
+		reportOut:   p.DryRunReport,
+		crawlers:    crawlers{sleeping: make(map[crawler.Crawler]time.Time)},
+		ctx:         ctx,
+		repoTimeout: p.RepoTimeout,
+
+		crawlReports:          p.CrawlReports,
+		crawlReportsToElastic: p.CrawlReportsToElastic,
+		alerts:                newAlerter(p.Alerts),
+	}
+	if idx.reportOut == nil {
+		idx.reportOut = os.Stdout
+	}
+
+	idx.stages, err = ParseStages(p.StageWorkers, p.Workers)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	err = p.Retention.Validate()
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	err = p.About.Validate()
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	err = p.Daemon.Validate()
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	err = p.Alerts.Validate()
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	limiter, err := ratelimit.Parse(p.RateLimits)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+	limiter.SetConcurrency(p.MaxClones, p.MaxAPICalls)
+	idx.repoSettings = repository.Settings{
+		DryRun:           p.DryRun,
+		CloneQuota:       p.MaxCloneCacheBytes,
+		FetchDepth:       p.FetchDepth,
+		ExcludeGenerated: p.ExcludeGenerated,
+		IndexTestdata:    p.IndexTestdata,
+		IndexInternal:    p.IndexInternal,
+		SummarizeVendor:  p.SummarizeVendor,
+	}
+	if p.VulnDBURL != "" {
+		idx.repoSettings.VulnDB, err = vulndb.New(p.VulnDBURL)
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+	if p.ModuleProxyURL != "" {
+		idx.repoSettings.ModuleProxy, err = modgraph.New(p.ModuleProxyURL)
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+	idx.limiter = limiter
+	idx.resolver = importpath.NewResolver(&http.Client{
+		Transport: limiter.Transport(nil),
+		Timeout:   30 * time.Second,
+	})
+
+	// Without this Elasticsearch would guess at the type of every field when
+	// we first write a document.
+	if !idx.dryRun && el != nil {
+		err = esmodels.NewIndexManager(esmodels.NewIndexManagerParams{
+			Logger:  p.Logger,
+			Elastic: el,
+			Context: c,
+		}).Migrate()
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+
+	if p.Output != "" {
+		idx.writer, err = esmodels.NewExportWriter(p.Output)
+	} else {
+		idx.writer, err = esmodels.NewBulkWriter(esmodels.NewBulkWriterParams{
+			Logger:        p.Logger,
+			Elastic:       el,
+			Context:       c,
+			BatchSize:     p.BulkSize,
+			FlushInterval: p.BulkFlushInterval,
+		})
+	}
+	if err != nil {
+		return &Indexer{err: err}
+	}
+	idx.writer = &countingWriter{DocumentWriter: idx.writer, report: idx.currentReport, throughput: &idx.throughput}
+
+	idx.setSkipList(p.SkipList)
+	if idx.err != nil {
+		return idx
+	}
+
+	idx.setTagPolicies(p.TagPolicy, p.TagPolicies)
+	if idx.err != nil {
+		return idx
+	}
+
+	idx.repoPolicies, idx.err = repopolicy.Load(p.RepoPolicies)
+	if idx.err != nil {
+		return idx
 	}
 
+	idx.setQueue(p.QueueBackend)
+	if idx.err != nil {
+		return idx
+	}
+	idx.queue.SetMaxFailures(p.MaxFailures)
+	idx.queue.SetKeyFunc(repository.DedupKey)
+
 	idx.setCrawlers()
 
 	return idx
 }
 
+// loadAllowList returns nil if there's no allow list, which allows
+// everything.
+func loadAllowList(path string) (*repolist.List, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	l, err := repolist.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Entries) == 0 {
+		return nil, fmt.Errorf("The allow list in %s is empty", path)
+	}
+	return l, nil
+}
+
+func loadSkipList(path string) (*repolist.List, error) {
+	if path == "" {
+		return repolist.DefaultSkipList(), nil
+	}
+	return repolist.Load(path)
+}
+
+func loadTagPolicies(def, path string) (*tagpolicy.Rules, error) {
+	p, err := tagpolicy.Parse(def)
+	if err != nil {
+		return nil, err
+	}
+	return tagpolicy.Load(path, p)
+}
+
+func (idx *Indexer) setSkipList(path string) {
+	idx.skipList, idx.err = loadSkipList(path)
+}
+
+func (idx *Indexer) setTagPolicies(def, path string) {
+	idx.tagPolicies, idx.err = loadTagPolicies(def, path)
+}
+
+// statePath returns the path of a file in the cache root which holds crawl
+// state, like the queue. Each tenant gets its own.
+func (idx *Indexer) statePath(name string) string {
+	if t := esmodels.Tenant(); t != "" {
+		return filepath.Join(idx.cacheRoot, "tenants", t, name)
+	}
+	return filepath.Join(idx.cacheRoot, name)
+}
+
+func (idx *Indexer) setQueue(backend string) {
+	var store queue.Store
+	switch backend {
+	case "", "file":
+		var err error
+		store, err = queue.NewFileStore(idx.statePath("queue.jsonl"))
+		if err != nil {
+			idx.err = err
+			return
+		}
+	case "elastic":
+		if idx.elastic == nil {
+			idx.err = errors.New("The elastic queue backend can't be used when exporting")
+			return
+		}
+		store = queue.NewElasticStore(idx.elastic, context.Background())
+	default:
+		idx.err = fmt.Errorf("Unknown queue backend: %s", backend)
+		return
+	}
+
+	if idx.dryRun {
+		store = queue.ReadOnly(store)
+	}
+
+	q, err := queue.New(store)
+	if err != nil {
+		idx.err = errwrap.Wrapf("Could not load the crawl queue: {{err}}", err)
+		return
+	}
+	idx.queue = q
+}
+
 func (idx *Indexer) setCrawlers() {
-	gh, err := crawler.NewGitHubCrawler(idx.l, idx.cacheRoot, idx.githubToken, idx.ctx)
+	gh, err := crawler.NewGitHubCrawler(idx.l, idx.cacheRoot, idx.githubToken, idx.limiter, idx.repoSettings, idx.ctx)
 	if err != nil {
 		idx.err = err
 		return
 	}
+	idx.crawlers.all = append(idx.crawlers.all, gh)
 	idx.crawlers.available = append(idx.crawlers.available, gh)
 }
 
@@ -88,54 +528,291 @@ func (idx *Indexer) IndexAll() error {
 	if idx.err != nil {
 		return idx.err
 	}
+	defer idx.queue.Close()
+	defer idx.closeWriter()
+	idx.swapReport(newCrawlReport())
 
+	// We never close this channel, since crawlers may still be sending to it
+	// when the budget runs out. Results sent after that are dropped.
 	ch := make(chan *crawler.Result)
-	defer close(ch)
-	for true {
+
+	// Crawlers only discover repositories and add them to the queue. The
+	// actual indexing happens in the pipeline, which takes repositories off
+	// the queue as they become due.
+	idx.imports = make(chan *importsBatch, maxPendingImports)
+	go idx.discoverLoop()
+	go idx.handleResults(ch)
+	finished := idx.startPipeline()
+	go idx.schedule()
+	go idx.seedLoop()
+	go idx.reconcileLoop()
+	go idx.retentionLoop()
+	go idx.importersLoop()
+	go idx.roundLoop()
+	go idx.alertLoop()
+
+	for !idx.isDone() {
 		idx.loop(ch)
 	}
 
+	// The pipeline may still be in the middle of some repositories.
+	for range finished {
+	}
+	idx.endReport(idx.swapReport(nil), "stopped")
+	idx.waitForAlerts()
+
 	return nil
 }
 
-func (idx *Indexer) loop(ch chan *crawler.Result) {
-	idx.maybeWakeCrawlers()
+// Anything still waiting to be written is flushed when the run ends.
+func (idx *Indexer) closeWriter() {
+	err := idx.writer.Close()
+	if err != nil {
+		idx.l.Errorf("Could not write everything: %s", err)
+	}
+}
+
+// Stop stops the crawl from starting anything new. The repositories already
+// in progress are finished and written as usual, after which IndexAll
+// returns. Cancelling the Context as well stops them early.
+func (idx *Indexer) Stop() {
+	if idx.done == nil {
+		return
+	}
+	idx.doneOnce.Do(func() { close(idx.done) })
+}
 
-	if len(idx.crawlers.available) == 0 {
-		until := idx.untilNextWake()
-		idx.l.Infof("Sleeping for %s", durafmt.Parse(until))
-		time.Sleep(until)
+func (idx *Indexer) isDone() bool {
+	select {
+	case <-idx.done:
+		return true
+	case <-idx.ctx.Done():
+		return true
+	default:
+		return false
 	}
+}
 
+func (idx *Indexer) loop(ch chan *crawler.Result) {
+	idx.maybeWakeCrawlers()
+
+	idx.crawlers.mu.Lock()
 	available := idx.crawlers.available
 	idx.crawlers.available = []crawler.Crawler{}
-	idx.l.Info("Starting all available crawlers")
+	idx.crawlers.mu.Unlock()
+
+	if len(available) > 0 {
+		idx.l.Info("Starting all available crawlers")
+	}
 	for _, c := range available {
 		idx.l.Infof("Starting %s crawler", c.Name())
 		go c.CrawlAll(ch)
 	}
 
-	// We want result handling in its own goroutine so we can wake up sleeping
-	// crawlers on time without waiting for a result from the channel.
-	go func() {
-		for r := range ch {
-			idx.l.Infof("Got a result from the %s crawler", r.Crawler.Name())
-			if r.Error != nil {
-				if r.Exhausted {
-					idx.putCrawlerToSleep(r.Crawler)
-				} else {
-					idx.l.Infof("%s crawler returned an error: %s", r.Crawler.Name(), r.Error)
-					idx.putCrawlerToSleep(r.Crawler)
-				}
-				continue
+	until := idx.untilNextWake()
+	idx.l.Infof("Sleeping for %s", durafmt.Parse(until))
+	select {
+	case <-time.After(until):
+	case <-idx.done:
+	}
+}
+
+// We want result handling in its own goroutine so we can wake up sleeping
+// crawlers on time without waiting for a result from the channel.
+func (idx *Indexer) handleResults(ch chan *crawler.Result) {
+	for r := range ch {
+		if idx.isDone() {
+			continue
+		}
+
+		if r.Error != nil {
+			idx.l.Infof("%s crawler returned an error: %s", r.Crawler.Name(), r.Error)
+			idx.putCrawlerToSleep(r.Crawler)
+			continue
+		}
+
+		if r.Exhausted {
+			idx.putCrawlerToSleep(r.Crawler)
+			continue
+		}
+
+		u := repository.NormalizeURL(r.URL)
+		id := repository.IDFromURL(u)
+		if !idx.allowed(id) {
+			continue
+		}
+
+		stats := &queue.Stats{Stars: r.Stars}
+		// Crawlers don't know about importers, but a repository which is
+		// already indexed, and somehow isn't in the queue, has them counted.
+		if idx.queue.Get(id) == nil {
+			prev, err := idx.getRepository(idx.ctx, id)
+			if err != nil {
+				idx.l.Errorf("Could not get the importers of %s: %s", id, err)
+			} else if prev != nil {
+				stats.ImportedBy = prev.ImportedBy
 			}
+		}
+
+		added, err := idx.queue.Add(id, u.String(), stats)
+		if err != nil {
+			idx.l.Errorf("Could not add %s to the queue: %s", id, err)
+			continue
+		}
+		if added {
+			idx.l.Infof("Added %s to the queue", id)
+		}
+	}
+}
+
+func (idx *Indexer) schedule() {
+	if idx.elastic == nil {
+		return
+	}
+
+	s := scheduler.New(scheduler.NewParams{
+		Logger:  idx.l,
+		Elastic: idx.elastic,
+		Queue:   idx.queue,
+		Context: idx.ctx,
+	})
+	for !idx.isDone() {
+		err := s.Schedule()
+		if err != nil {
+			idx.l.Errorf("Could not schedule recrawls: %s", err)
+		}
+
+		select {
+		case <-time.After(idx.daemon.ScheduleInterval):
+		case <-idx.done:
+			return
+		}
+	}
+}
+
+// canonicalize returns the ID the repository was actually indexed under. This
+// differs from the queue item's ID when the repository has been renamed or
+// moved, since the host redirects us to its new home. In that case the old ID
+// is marked as an alias of the new one, so that we don't keep indexing the
+// same repository twice, and any document left under the old ID is removed.
+func (idx *Indexer) canonicalize(l *logger.Logger, item *queue.Item, model *esmodels.Repository) string {
+	u, err := url.Parse(model.PrimaryURL)
+	if err != nil {
+		return item.ID
+	}
+
+	u = repository.NormalizeURL(u)
+	id := repository.IDFromURL(u)
+	if id == item.ID {
+		return id
+	}
+
+	l.Infof("%s is now %s", item.ID, id)
+
+	err = idx.queue.Schedule(id, u.String(), time.Now(), &item.Stats)
+	if err == nil {
+		err = idx.queue.Alias(item.ID, id, time.Now().Add(skippedRecrawlInterval))
+	}
+	if err != nil {
+		idx.l.Errorf("Could not update %s in the queue: %s", item.ID, err)
+	}
+
+	if idx.dryRun {
+		return id
+	}
+
+	idx.deleteRepository(item.ID)
+
+	return id
+}
 
-			go idx.indexRepo(r.Repository)
+// allowed returns true if the repository may be indexed at all. Without an
+// allow list everything is allowed.
+func (idx *Indexer) allowed(id string) bool {
+	idx.reloadMu.RLock()
+	defer idx.reloadMu.RUnlock()
+	return idx.allowList == nil || idx.allowList.Match(id) != nil
+}
+
+// skipped returns the skip list entry for the repository, or nil if it isn't
+// on the skip list.
+func (idx *Indexer) skipped(id string) *repolist.Entry {
+	idx.reloadMu.RLock()
+	defer idx.reloadMu.RUnlock()
+	return idx.skipList.Match(id)
+}
+
+func (idx *Indexer) tagPolicy(id string) *tagpolicy.Policy {
+	idx.reloadMu.RLock()
+	defer idx.reloadMu.RUnlock()
+	return idx.tagPolicies.For(id)
+}
+
+func (idx *Indexer) repoPolicy(id string) *repopolicy.Policy {
+	idx.reloadMu.RLock()
+	defer idx.reloadMu.RUnlock()
+	return idx.repoPolicies.For(id)
+}
+
+// skip records a tombstone for a repository on the skip list. We check the
+// repository again when the skip list entry expires, or after the usual
+// interval for skipped repositories if it never does.
+func (idx *Indexer) skip(item *queue.Item, e *repolist.Entry) {
+	idx.l.Infof("Skipping %s: %s", item.ID, e.Reason)
+	idx.currentReport().skipped()
+
+	idx.writeTombstone(item.ID, esmodels.TombstoneSkipped, e.Reason)
+
+	next := e.ExpiresAt()
+	if next.IsZero() {
+		next = time.Now().Add(skippedRecrawlInterval)
+	}
+	err := idx.queue.Done(item.ID, next, nil)
+	if err != nil {
+		idx.l.Errorf("Could not update %s in the queue: %s", item.ID, err)
+	}
+}
+
+func (idx *Indexer) writeTombstone(id, kind, reason string) {
+	if idx.dryRun {
+		idx.report(&reportEntry{ID: id, Action: "tombstone", Kind: kind, Reason: reason})
+		return
+	}
+
+	idx.writer.Index(
+		esmodels.Index("tombstone"),
+		"tombstone",
+		id,
+		&esmodels.Tombstone{
+			ID:      id,
+			Kind:    kind,
+			Reason:  reason,
+			Created: esmodels.FormatTime(time.Now()),
+			Tenant:  esmodels.Tenant(),
+		},
+	)
+}
+
+// removeTombstone deletes the tombstone for a repository which has been
+// indexed. Most repositories never had one, which is fine, since deleting a
+// document that isn't there isn't an error.
+func removeTombstone(w esmodels.DocumentWriter, id string) {
+	w.Delete(esmodels.Index("tombstone"), "tombstone", id)
+}
+
+func (idx *Indexer) crawlerFor(u *url.URL) crawler.Crawler {
+	for _, c := range idx.crawlers.all {
+		if c.Handles(u) {
+			return c
 		}
-	}()
+	}
+	return nil
 }
 
 func (idx *Indexer) maybeWakeCrawlers() {
+	idx.crawlers.mu.Lock()
+	defer idx.crawlers.mu.Unlock()
+
 	now := time.Now()
 	for c, t := range idx.crawlers.sleeping {
 		if t.After(now) {
@@ -148,6 +825,9 @@ func (idx *Indexer) maybeWakeCrawlers() {
 }
 
 func (idx *Indexer) untilNextWake() time.Duration {
+	idx.crawlers.mu.Lock()
+	defer idx.crawlers.mu.Unlock()
+
 	var durs []time.Duration
 	now := time.Now()
 	for _, t := range idx.crawlers.sleeping {
@@ -155,12 +835,15 @@ func (idx *Indexer) untilNextWake() time.Duration {
 	}
 
 	// If there are no crawlers sleeping that means all crawlers are currently
-	// available. We will sleep for a minute and then try again.
+	// running. We will sleep for a minute and then check again.
 	if len(durs) == 0 {
 		return time.Duration(1) * time.Minute
 	}
 
 	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	if durs[0] < 0 {
+		return 0
+	}
 	return durs[0]
 }
 
@@ -173,51 +856,115 @@ func (idx *Indexer) putCrawlerToSleep(c crawler.Crawler) {
 		wake.Format("2006-01-02 15:04:05"),
 	)
 
+	idx.crawlers.mu.Lock()
+	defer idx.crawlers.mu.Unlock()
+
+	idx.crawlers.sleeping[c] = wake
+
 	var available []crawler.Crawler
 	for _, a := range idx.crawlers.available {
-		if c == a {
-			idx.crawlers.sleeping[a] = wake
-			continue
+		if c != a {
+			available = append(available, a)
 		}
-		available = append(available, a)
 	}
-
 	idx.crawlers.available = available
 }
 
-func (idx *Indexer) indexRepo(repo repository.Repository) {
-	// Repo is being intentionally skipped.
-	if repo == nil {
-		return
+// unchanged returns true if the previously indexed document has the given
+// content hash. Categories come from the queue rather than the repository, so
+// they're compared separately.
+func unchanged(prev *esmodels.Repository, hash string, categories []string) bool {
+	if prev == nil || hash == "" || prev.ContentHash != hash || len(prev.Categories) != len(categories) {
+		return false
+	}
+	for i := range categories {
+		if prev.Categories[i] != categories[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// touch records that an unchanged repository was crawled, and returns the
+// previous document with the new crawl time and star and fork counts, which
+// aren't part of the content hash. Nothing else needs to be written.
+func (idx *Indexer) touch(l *logger.Logger, id string, prev *esmodels.Repository, stars, forks int) *esmodels.Repository {
+	l.Info("Content hash is unchanged, only updating the crawl time and counts")
+	prev.LastCrawled = esmodels.FormatTime(time.Now())
+	prev.Stale = false
+	prev.Stars = stars
+	prev.Forks = forks
+	prev.SetSuggest()
+
+	if idx.dryRun {
+		idx.report(&reportEntry{ID: id, Action: "touch", Status: prev.Status})
+		return prev
 	}
 
-	exists, err := idx.elastic.
-		Exists().
-		Index("metagodoc-repository").
-		Type("repository").
-		Id(repo.ID()).
-		Do(idx.ctx)
+	idx.writer.Update(
+		esmodels.Index("repository"),
+		"repository",
+		id,
+		map[string]interface{}{
+			"last_crawled": prev.LastCrawled,
+			"stale":        false,
+			"stars":        prev.Stars,
+			"forks":        prev.Forks,
+			"suggest":      prev.Suggest,
+		},
+	)
+	return prev
+}
+
+// getRepository returns the currently indexed document for the given
+// repository ID, or nil if it has not been indexed yet.
+func (idx *Indexer) getRepository(ctx context.Context, id string) (*esmodels.Repository, error) {
+	if idx.elastic == nil {
+		return nil, nil
+	}
+
+	result, err := idx.elastic.
+		Get().
+		Index(esmodels.Index("repository")).
+		Type(idx.elastic.Type("repository")).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		idx.l.Panicf("Exists: %s", err)
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not get the document for %s: {{err}}", id), err)
+	}
+	if !result.Found {
+		return nil, nil
 	}
 
-	elURI := fmt.Sprintf("http://localhost:9200/metagodoc-repository/repository/%s", url.PathEscape(repo.ID()))
-	if exists {
-		idx.l.Infof("  already exists at %s?pretty", elURI)
-	} else {
-		idx.l.Infof("  did not find any repo where the ID is %s", repo.ID())
+	esr := &esmodels.Repository{}
+	err = json.Unmarshal(*result.Source, esr)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the document for %s: {{err}}", id), err)
 	}
 
-	_, err = idx.elastic.
-		Index().
-		Index("metagodoc-repository").
-		Type("repository").
-		Id(repo.ID()).
-		BodyJson(repo.ESModel()).
-		Do(idx.ctx)
+	return esr, nil
+}
+
+// IndexLocal indexes the code in a directory on disk, without cloning
+// anything. If importRoot is empty then the module path from the directory's
+// go.mod file is used.
+func (idx *Indexer) IndexLocal(dir, importRoot string) (*esmodels.Repository, error) {
+	if idx.err != nil {
+		return nil, idx.err
+	}
+
+	repo, err := repository.NewLocalRepository(idx.l, dir, importRoot, idx.repoSettings)
 	if err != nil {
-		idx.l.Panicf("Index: %s", err)
+		return nil, err
+	}
+
+	model, err := idx.indexRepo(repo, nil)
+	if err != nil || idx.dryRun {
+		return model, err
 	}
 
-	idx.l.Infof("  made new repository record at %s?pretty", elURI)
+	return model, idx.writer.Flush()
 }
@@ -0,0 +1,68 @@
+package indexer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnchanged(t *testing.T) {
+	prev := &esmodels.Repository{ContentHash: "abc", Categories: []string{"web", "cli"}}
+
+	assert.True(t, unchanged(prev, "abc", []string{"web", "cli"}))
+	assert.False(t, unchanged(nil, "abc", nil), "nothing was indexed before")
+	assert.False(t, unchanged(prev, "", []string{"web", "cli"}), "the repository has no hash")
+	assert.False(t, unchanged(prev, "def", []string{"web", "cli"}), "the hash changed")
+	assert.False(t, unchanged(prev, "abc", []string{"web"}), "a category was removed")
+	assert.False(t, unchanged(prev, "abc", []string{"cli", "web"}), "the categories were reordered")
+}
+
+func TestTouch(t *testing.T) {
+	idx := testIndexer(t)
+
+	prev := &esmodels.Repository{
+		Name:        "bar",
+		LastCrawled: esmodels.FormatTime(time.Now().AddDate(-1, 0, 0)),
+		Stale:       true,
+	}
+	m := idx.touch(idx.l, "github.com/foo/bar", prev, 1200, 30)
+	assert.Equal(t, "bar", m.Name, "the previous document is returned")
+	assert.False(t, m.Stale)
+	assert.Equal(t, 1200, m.Stars, "the counts are updated")
+	assert.Equal(t, 30, m.Forks)
+	crawled, err := time.Parse(esmodels.DateTimeFormat, m.LastCrawled)
+	if assert.Nil(t, err) {
+		assert.WithinDuration(t, time.Now(), crawled, time.Minute)
+	}
+
+	if err := idx.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(idx.cacheRoot, "export", esmodels.Index("repository")+".ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 1, "only a partial update is written") {
+		var line struct {
+			ID     string                 `json:"id"`
+			Update map[string]interface{} `json:"update"`
+		}
+		if assert.Nil(t, json.Unmarshal([]byte(lines[0]), &line)) {
+			assert.Equal(t, "github.com/foo/bar", line.ID)
+			assert.Equal(t, m.LastCrawled, line.Update["last_crawled"])
+			assert.Equal(t, false, line.Update["stale"])
+			assert.Equal(t, float64(1200), line.Update["stars"])
+			assert.Equal(t, float64(30), line.Update["forks"])
+			assert.Contains(t, line.Update, "suggest", "the suggestion weight follows the stars")
+			assert.Len(t, line.Update, 5)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// A ListFilter picks the repositories returned by List. The zero value
+// matches every repository.
+type ListFilter struct {
+	Status esmodels.ActivityStatus
+	// Only repositories crawled at or after this time.
+	Since time.Time
+}
+
+var listStatuses = []esmodels.ActivityStatus{
+	esmodels.Active,
+	esmodels.DeadEndFork,
+	esmodels.QuickFork,
+	esmodels.NoRecentCommits,
+	esmodels.Empty,
+	esmodels.Inactive,
+}
+
+// ParseListFilter returns a filter from a status name and a time, either of
+// which may be empty. The time is either a date like "2024-06-01", an RFC
+// 3339 timestamp, or a duration like "720h", which means that long before
+// now.
+func ParseListFilter(status, since string, now time.Time) (ListFilter, error) {
+	var f ListFilter
+	if status != "" {
+		for _, s := range listStatuses {
+			if string(s) == status {
+				f.Status = s
+			}
+		}
+		if f.Status == "" {
+			return f, fmt.Errorf("Unknown status: %s", status)
+		}
+	}
+
+	if since == "" {
+		return f, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		f.Since = now.Add(-d)
+		return f, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, since); err == nil {
+			f.Since = t
+			return f, nil
+		}
+	}
+	return f, fmt.Errorf("Invalid time %q, expected a date like 2024-06-01, an RFC 3339 timestamp, or a duration like 720h", since)
+}
+
+func (f ListFilter) query() elastic.Query {
+	q := elastic.NewBoolQuery()
+	if f.Status != "" {
+		q.Filter(elastic.NewTermQuery("status", f.Status))
+	}
+	if !f.Since.IsZero() {
+		q.Filter(elastic.NewRangeQuery("last_crawled").Gte(esmodels.FormatTime(f.Since)))
+	}
+	return q
+}
+
+// A Listing is a repository returned by List.
+type Listing struct {
+	ID          string
+	Status      esmodels.ActivityStatus
+	LastCrawled string
+	Stale       bool
+	// Refs which have been removed upstream aren't counted.
+	Refs int
+}
+
+// NewLister returns an indexer which can only List. Listing is a read only
+// view of the index, so unlike New this doesn't migrate the indexes, open the
+// queue, or start a writer, and it's safe to run alongside another indexer
+// using the same cache root.
+func NewLister(p NewParams) *Indexer {
+	if p.IndexPrefix != "" {
+		err := esmodels.SetIndexPrefix(p.IndexPrefix)
+		if err != nil {
+			return &Indexer{err: err}
+		}
+	}
+	err := esmodels.SetTenant(p.Tenant)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	if p.Output != "" {
+		return &Indexer{err: errors.New("Listing repositories needs Elasticsearch, not an export")}
+	}
+	el, err := elc.NewClient(elc.NewParams{
+		Logger:          p.Logger,
+		Trace:           p.TraceElastic,
+		URLs:            p.ElasticURLs,
+		DisableSniffing: p.DisableElasticSniffing,
+	})
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Indexer{l: p.Logger, elastic: el, ctx: ctx}
+}
+
+// List returns the indexed repositories which match the filter, sorted by
+// ID. This needs a cluster, since it's the index being listed rather than
+// the queue. See NewLister.
+func (idx *Indexer) List(f ListFilter) ([]*Listing, error) {
+	if idx.err != nil {
+		return nil, idx.err
+	}
+
+	if idx.elastic == nil {
+		return nil, errors.New("Listing repositories needs Elasticsearch, not an export")
+	}
+
+	scroll := idx.elastic.
+		Scroll(esmodels.Index("repository")).
+		Type(idx.elastic.SearchTypes("repository")...).
+		Query(f.query()).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("status", "last_crawled", "stale", "refs.name", "refs.removed")).
+		Size(500)
+
+	var listings []*Listing
+	for {
+		result, err := scroll.Do(idx.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			r := &esmodels.Repository{}
+			err := json.Unmarshal(*hit.Source, r)
+			if err != nil {
+				return nil, errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+			listings = append(listings, &Listing{
+				ID:          hit.Id,
+				Status:      r.Status,
+				LastCrawled: r.LastCrawled,
+				Stale:       r.Stale,
+				Refs:        len(refNames(r)),
+			})
+		}
+	}
+
+	sort.Slice(listings, func(i, j int) bool { return listings[i].ID < listings[j].ID })
+	return listings, nil
+}
@@ -0,0 +1,38 @@
+package indexer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListFilter(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	f, err := ParseListFilter("", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, ListFilter{}, f)
+
+	f, err = ParseListFilter("no-recent-commits", "2024-06-01", now)
+	assert.NoError(t, err)
+	assert.Equal(t, ListFilter{Status: esmodels.NoRecentCommits, Since: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, f)
+
+	f, err = ParseListFilter("", "48h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-48*time.Hour), f.Since)
+
+	_, err = ParseListFilter("asleep", "", now)
+	assert.Error(t, err)
+	_, err = ParseListFilter("", "last week", now)
+	assert.Error(t, err)
+
+	src, err := ListFilter{Status: esmodels.Active, Since: now}.query().Source()
+	assert.NoError(t, err)
+	b, err := json.Marshal(src)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"bool":{"filter":[{"term":{"status":"active"}},{"range":{"last_crawled":{"from":"2024-06-30T12:00:00","include_lower":true,"include_upper":true,"to":null}}}]}}`, string(b))
+}
@@ -0,0 +1,105 @@
+package indexer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/repository"
+)
+
+// IndexOne indexes a single repository right away and waits for it to be
+// written. The target is either the repository's URL or an import path in
+// it, like "github.com/stretchr/testify/assert". Unlike a crawl, the
+// repository is indexed even if it hasn't changed since the last time.
+//
+// The repository goes through the same stages as anything taken off the
+// queue, so it's added to the queue if needed and rescheduled afterwards.
+func (idx *Indexer) IndexOne(target string) (*esmodels.Repository, error) {
+	if idx.err != nil {
+		return nil, idx.err
+	}
+	defer idx.queue.Close()
+	defer idx.closeWriter()
+
+	item, err := idx.enqueue(target)
+	if err != nil {
+		return nil, err
+	}
+	id := item.ID
+
+	j := idx.newJob(item, nil, item.Categories)
+	j.force = true
+	if idx.runJob("discover", j, idx.crawl) && idx.runJob("fetch", j, idx.fetch) && idx.runJob("analyze", j, idx.analyze) {
+		idx.runJob("write", j, idx.write)
+	}
+	if j.err != nil {
+		return nil, j.err
+	}
+	if j.model == nil {
+		return nil, fmt.Errorf("%s was skipped by its crawler", id)
+	}
+
+	if idx.dryRun {
+		return j.model, nil
+	}
+	return j.model, idx.writer.Flush()
+}
+
+// enqueue adds the repository for a target to the queue if it isn't there
+// already, and returns its item. The target is either the repository's URL or
+// an import path in it.
+func (idx *Indexer) enqueue(target string) (*queue.Item, error) {
+	u, prefix, err := idx.resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if idx.crawlerFor(u) == nil {
+		return nil, fmt.Errorf("No crawler knows how to handle %s", u)
+	}
+
+	id := repository.IDFromURL(u)
+	if !idx.allowed(id) {
+		return nil, fmt.Errorf("%s is not on the allow list", id)
+	}
+	if e := idx.skipped(id); e != nil {
+		return nil, fmt.Errorf("%s is on the skip list", id)
+	}
+
+	_, err = idx.queue.Add(id, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		err = idx.queue.SetImportPrefix(id, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return idx.queue.Get(id), nil
+}
+
+// resolveTarget returns the repository URL for a target passed to enqueue,
+// along with its vanity import prefix, if it has one.
+func (idx *Indexer) resolveTarget(target string) (*url.URL, string, error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, "", err
+		}
+		return repository.NormalizeURL(u), "", nil
+	}
+
+	root, err := idx.resolver.Resolve(idx.ctx, target)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := ""
+	if root.IsVanity {
+		prefix = root.ImportPrefix
+	}
+	return repository.NormalizeURL(root.RepoURL), prefix, nil
+}
@@ -0,0 +1,65 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/repolist"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexOne(t *testing.T) {
+	idx := testIndexer(t)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+
+	model, err := idx.IndexOne("https://www.github.com/example/thing/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "github.com/example/thing", model.Name)
+	}
+
+	item := idx.queue.Get("github.com/example/thing")
+	if assert.NotNil(t, item, "the repository is added to the queue") {
+		assert.Equal(t, queue.Done, item.State)
+	}
+
+	assert.Nil(t, idx.writer.Flush())
+	b, err := ioutil.ReadFile(filepath.Join(idx.cacheRoot, "export", esmodels.Index("tombstone")+".ndjson"))
+	if assert.Nil(t, err) {
+		assert.JSONEq(t, `{"id": "github.com/example/thing", "deleted": true}`, string(b), "an indexed repository's tombstone is deleted")
+	}
+
+	idx = testIndexer(t)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+	idx.skipList, err = repolist.New([]*repolist.Entry{{Pattern: "github.com/example/...", Reason: "testing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.IndexOne("https://github.com/example/thing")
+	assert.Error(t, err, "skipped repositories aren't indexed")
+}
+
+func TestIndexOneTenant(t *testing.T) {
+	err := esmodels.SetTenant("ghe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer esmodels.SetTenant("")
+
+	idx := testIndexer(t)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+	model, err := idx.IndexOne("https://github.com/example/thing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ghe", model.Tenant)
+	}
+	assert.Nil(t, idx.writer.Flush())
+	_, err = os.Stat(filepath.Join(idx.cacheRoot, "export", "metagodoc-ghe-repository.ndjson"))
+	assert.Nil(t, err, "the document is written to the tenant's index")
+
+	assert.Equal(t, filepath.Join(idx.cacheRoot, "tenants", "ghe", "queue.jsonl"), idx.statePath("queue.jsonl"))
+}
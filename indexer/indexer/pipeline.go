@@ -0,0 +1,642 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/scheduler"
+	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
+	"github.com/autarch/metagodoc/tracing"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Indexing happens in a pipeline of four stages connected by channels:
+//
+//   - discover takes repositories off the queue as they become due and asks
+//     their host about them, which is enough to tell whether they've changed
+//   - fetch clones or fetches the ones which have
+//   - analyze walks their refs and builds their documents
+//   - write queues the documents to be written and updates the queue
+//
+// Each stage has its own workers, so whichever one is slowest can be given
+// more of them. The channels are unbuffered, so a slow stage holds up the
+// ones before it rather than letting work pile up in memory.
+//
+// Every job has its own context, which is done when the crawl is cancelled
+// or the job runs out of time. Each stage checks it before starting, and the
+// repository checks it before each git command and directory it walks.
+
+// Stages is the number of workers for each stage of the pipeline.
+type Stages struct {
+	Discover int
+	Fetch    int
+	Analyze  int
+	Write    int
+}
+
+// ParseStages parses a comma-separated list of stage=workers pairs, like
+// "fetch=4,analyze=2". Stages which aren't listed get def workers.
+func ParseStages(s string, def int) (Stages, error) {
+	if def < 1 {
+		def = 1
+	}
+	st := Stages{Discover: def, Fetch: def, Analyze: def, Write: def}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return st, fmt.Errorf("Invalid stage workers %q, expected stage=workers", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 1 {
+			return st, fmt.Errorf("Invalid stage workers %q, the number of workers must be at least 1", pair)
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case "discover":
+			st.Discover = n
+		case "fetch":
+			st.Fetch = n
+		case "analyze":
+			st.Analyze = n
+		case "write":
+			st.Write = n
+		default:
+			return st, fmt.Errorf("Unknown stage in %q", pair)
+		}
+	}
+
+	return st, nil
+}
+
+// A job is one repository making its way through the pipeline.
+type job struct {
+	// This is nil when we're indexing something that isn't in the queue.
+	item       *queue.Item
+	repo       repository.Repository
+	categories []string
+	prev       *esmodels.Repository
+	hash       string
+	model      *esmodels.Repository
+	err        error
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// Logs with the repository and the current stage as fields. See runJob.
+	l *logger.Logger
+	// If this is true the repository is indexed even if it hasn't changed.
+	force bool
+	// The stage the job is in, which is what a failure is counted under.
+	stage string
+}
+
+// newJob returns a job with its own context, which is passed on to the
+// repository.
+func (idx *Indexer) newJob(item *queue.Item, repo repository.Repository, categories []string) *job {
+	j := &job{item: item, repo: repo, categories: categories, l: idx.l}
+	// A repository with refs to reindex has to be crawled even if nothing
+	// changed.
+	j.force = item != nil && len(item.Reindex) > 0
+	if idx.repoTimeout > 0 {
+		j.ctx, j.cancel = context.WithTimeout(idx.ctx, idx.repoTimeout)
+	} else {
+		j.ctx, j.cancel = context.WithCancel(idx.ctx)
+	}
+
+	// Each job is a trace, with a span for each stage. It ends when the
+	// job's context is cancelled, which is when we're done with it.
+	ctx, span := tracing.Start(j.ctx, "index repository", "repo", j.id())
+	cancel := j.cancel
+	j.ctx = ctx
+	j.cancel = func() {
+		span.SetError(j.err)
+		span.End()
+		cancel()
+	}
+
+	if repo != nil {
+		repo.SetContext(j.ctx)
+	}
+	return j
+}
+
+// startPipeline starts every stage. The returned channel is closed once the
+// last job has made it all the way through, which happens after the indexer
+// is done.
+func (idx *Indexer) startPipeline() <-chan *job {
+	fetch := make(chan *job)
+	analyze := make(chan *job)
+	write := make(chan *job)
+	finished := make(chan *job)
+
+	idx.startDiscovery(idx.stages.Discover, fetch)
+	idx.runStage("fetch", idx.stages.Fetch, fetch, analyze, idx.fetch)
+	idx.runStage("analyze", idx.stages.Analyze, analyze, write, idx.analyze)
+	idx.runStage("write", idx.stages.Write, write, finished, idx.write)
+
+	return finished
+}
+
+// runStage starts n workers which call f with every job from in, and closes
+// out once they've all finished. If f returns true the job is passed on to
+// out, otherwise f is done with it.
+func (idx *Indexer) runStage(stage string, n int, in <-chan *job, out chan<- *job, f func(*job) bool) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range in {
+				if idx.runJob(stage, j, f) {
+					out <- j
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// startDiscovery starts the first stage, which has no input channel since it
+// takes its work from the queue. The workers stop when the indexer is done,
+// at which point the rest of the pipeline drains.
+func (idx *Indexer) startDiscovery(n int, out chan<- *job) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !idx.isDone() {
+				if j := idx.discoverNext(); j != nil {
+					out <- j
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+func (idx *Indexer) discoverNext() *job {
+	idx.waitWhilePaused()
+	if idx.isDone() {
+		return nil
+	}
+
+	if reason := idx.budget.exhausted(); reason != "" {
+		if idx.daemon.Enabled {
+			idx.waitForRound(reason)
+			return nil
+		}
+		idx.l.Infof("Crawl budget exhausted after this run %s - stopping and leaving the rest of the queue for next time", reason)
+		idx.currentReport().stop("budget exhausted: " + reason)
+		idx.Stop()
+		return nil
+	}
+
+	item, err := idx.queue.Next()
+	if err != nil {
+		idx.l.Errorf("Could not get the next item from the queue: %s", err)
+		time.Sleep(idleSleep)
+		return nil
+	}
+	if item == nil {
+		time.Sleep(idleSleep)
+		return nil
+	}
+
+	return idx.discover(item)
+}
+
+// discover returns a job for the item if it needs to be fetched. Anything
+// else is finished here.
+func (idx *Indexer) discover(item *queue.Item) *job {
+	// The queue may have been filled before the allow list was set up.
+	if !idx.allowed(item.ID) {
+		idx.l.Infof("Not indexing %s since it is not on the allow list", item.ID)
+		idx.currentReport().skipped()
+		err := idx.queue.Done(item.ID, time.Now().Add(skippedRecrawlInterval), nil)
+		if err != nil {
+			idx.l.Errorf("Could not update %s in the queue: %s", item.ID, err)
+		}
+		return nil
+	}
+
+	if e := idx.skipped(item.ID); e != nil {
+		idx.skip(item, e)
+		return nil
+	}
+
+	j := idx.newJob(item, nil, item.Categories)
+	if !idx.runJob("discover", j, idx.crawl) {
+		return nil
+	}
+	return j
+}
+
+func (idx *Indexer) crawl(j *job) bool {
+	j.repo, j.err = idx.crawlItem(j.item)
+	if j.err != nil || j.repo == nil {
+		idx.finish(j)
+		return false
+	}
+	j.repo.SetContext(j.ctx)
+	if !idx.check(j) {
+		idx.finish(j)
+		return false
+	}
+	return true
+}
+
+// crawlItem asks the item's host about it. This returns nil if the crawler
+// decided to skip it.
+func (idx *Indexer) crawlItem(item *queue.Item) (repository.Repository, error) {
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := idx.crawlerFor(u)
+	if c == nil {
+		return nil, fmt.Errorf("No crawler knows how to handle %s", u)
+	}
+
+	repo, err := c.CrawlOne(u)
+	if g, ok := err.(*crawler.GoneError); ok {
+		return nil, g
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("%s crawler: {{err}}", c.Name()), err)
+	}
+	if repo == nil {
+		return nil, nil
+	}
+
+	if item.ImportPrefix != "" {
+		repo.SetImportPathRoot(item.ImportPrefix, item.ImportPrefixes...)
+	}
+	repo.SetTagPolicy(idx.tagPolicy(repo.ID()))
+	repo.SetPolicy(idx.repoPolicy(repo.ID()))
+
+	return repo, nil
+}
+
+// check returns false if the repository hasn't changed since it was last
+// indexed, in which case we only need to record that we looked at it, or if
+// we couldn't tell.
+func (idx *Indexer) check(j *job) bool {
+	metrics.ReposProcessed.Add(1)
+
+	id := j.repo.ID()
+	j.prev, j.err = idx.getRepository(j.ctx, id)
+	if j.err != nil {
+		return false
+	}
+
+	elURI := fmt.Sprintf("http://localhost:9200/%s/repository/%s", esmodels.Index("repository"), url.PathEscape(id))
+	if j.prev != nil {
+		j.l.Infow("Repository is already indexed", "url", elURI+"?pretty")
+	} else {
+		j.l.Info("Repository has not been indexed before")
+	}
+
+	var err error
+	j.hash, err = j.repo.ContentHash()
+	if err != nil {
+		j.l.Infof("Could not get content hash: %s", err)
+	}
+	if !j.force && unchanged(j.prev, j.hash, j.categories) {
+		stars, forks := j.repo.Counts()
+		j.model = idx.touch(j.l, id, j.prev, stars, forks)
+		return false
+	}
+
+	return true
+}
+
+func (idx *Indexer) fetch(j *job) bool {
+	j.repo.SetPrevious(j.prev)
+	start := time.Now()
+	j.err = j.repo.Fetch()
+	metrics.FetchSeconds.Observe(time.Since(start).Seconds())
+	// Repositories count against the budget whether or not they end up being
+	// indexed successfully, since the work was done either way.
+	idx.budget.spend(j.repo.FetchedBytes())
+	idx.currentReport().fetched(j.repo.FetchedBytes())
+	idx.throughput.count("clone_bytes", j.repo.FetchedBytes())
+	if j.err != nil {
+		idx.finish(j)
+		return false
+	}
+	return true
+}
+
+func (idx *Indexer) analyze(j *job) bool {
+	if j.item != nil {
+		j.repo.SetReindex(j.item.Reindex)
+	}
+	j.model, j.err = j.repo.ESModel()
+	if j.err != nil {
+		idx.finish(j)
+		return false
+	}
+	j.model.ContentHash = j.hash
+	j.model.Categories = j.categories
+	j.model.CarryImporters(j.prev)
+	j.model.RecordStatusTransition(j.prev)
+	j.model.RecordRemovedRefs(j.prev)
+	idx.diffAPIs(j)
+	j.model.SetTesting()
+	j.model.SetSuggest()
+	return true
+}
+
+func (idx *Indexer) write(j *job) bool {
+	idx.store(j)
+	idx.finish(j)
+	return false
+}
+
+// store queues the job's documents to be written.
+func (idx *Indexer) store(j *job) {
+	id := j.repo.ID()
+
+	if idx.dryRun {
+		idx.report(repositoryChanges(id, j.prev, j.model))
+		return
+	}
+
+	// This is after the dry run check since externalizing content writes it
+	// somewhere.
+	err := idx.about.Apply(j.ctx, j.model.About)
+	if err != nil {
+		j.l.Errorf("Could not store About content for %s: %s", id, err)
+		j.model.About = nil
+	}
+
+	j.model.Tenant = esmodels.Tenant()
+
+	// The job's writes go in a batch of their own, so that other jobs
+	// writing at the same time don't see its failures or it theirs. Anything
+	// recorded by the writer itself came from writes which aren't part of a
+	// job, like tombstones, so it isn't this repository's problem.
+	w := idx.writer.Batch()
+	if err := idx.writer.Err(); err != nil {
+		j.l.Errorf("An earlier write failed: %s", err)
+	}
+
+	// An invalid document fails the job before anything is written, rather
+	// than only showing up as the writer's error later on.
+	err = esmodels.Validate(esmodels.Index("repository"), id, j.model)
+	if err != nil {
+		j.err = err
+		return
+	}
+
+	// The checkpoint is kept if this fails, so that the next attempt doesn't
+	// have to walk every ref again.
+	err = esmodels.WritePackages(j.ctx, idx.elastic, w, id, j.prev, j.model)
+	if _, ok := err.(*esmodels.ValidationError); ok {
+		j.err = err
+		return
+	}
+	if err != nil {
+		j.err = errwrap.Wrapf(fmt.Sprintf("Could not write packages for %s: {{err}}", id), err)
+		return
+	}
+
+	elURI := fmt.Sprintf("http://localhost:9200/%s/repository/%s", esmodels.Index("repository"), url.PathEscape(id))
+
+	// There's no point in sending refs which haven't changed again, so
+	// unless this is the first crawl or a ref has been removed, only the
+	// changed refs are sent.
+	changed, partial := j.model.ChangedRefs(j.prev)
+	switch {
+	case partial && len(changed) == 0:
+		doc, err := j.model.WithoutRefs()
+		if err != nil {
+			j.err = errwrap.Wrapf(fmt.Sprintf("Could not encode %s without its refs: {{err}}", id), err)
+			return
+		}
+		w.Update(esmodels.Index("repository"), "repository", id, doc)
+		j.l.Infow("Refs are unchanged, queued partial update", "url", elURI+"?pretty")
+	case partial:
+		script, err := j.model.RefsUpdateScript(changed)
+		if err != nil {
+			j.err = errwrap.Wrapf(fmt.Sprintf("Could not encode %s without its refs: {{err}}", id), err)
+			return
+		}
+		w.UpdateWithScript(esmodels.Index("repository"), "repository", id, script)
+		j.l.Infow("Queued partial update of changed refs", "url", elURI+"?pretty", "refs", len(changed))
+	default:
+		w.Index(esmodels.Index("repository"), "repository", id, j.model)
+		j.l.Infow("Queued repository record", "url", elURI+"?pretty")
+	}
+
+	// A repository which was skipped or had gone away before is back, so
+	// its tombstone is out of date.
+	removeTombstone(w, id)
+
+	// Until everything has actually been written the repository isn't done,
+	// so if anything failed it goes back in the queue and keeps its
+	// checkpoint.
+	err = w.Flush()
+	if err != nil {
+		j.err = errwrap.Wrapf(fmt.Sprintf("Could not write %s: {{err}}", id), err)
+		return
+	}
+
+	err = j.repo.ClearCheckpoint()
+	if err != nil {
+		j.l.Errorf("Could not clear checkpoint for %s: %s", id, err)
+	}
+}
+
+// finish updates the queue once we're done with a job, whether or not it
+// succeeded.
+func (idx *Indexer) finish(j *job) {
+	timedOut := j.ctx.Err() == context.DeadlineExceeded
+	j.cancel()
+
+	item := j.item
+	if item == nil {
+		return
+	}
+
+	var err error
+	if g, ok := j.err.(*crawler.GoneError); ok {
+		metrics.RepoFailures.Add("gone", 1)
+		idx.currentReport().failed(item.ID, "gone", g)
+		idx.throughput.count("failed", 1)
+		idx.bury(item.ID, g)
+		err = idx.queue.Done(item.ID, time.Now().Add(skippedRecrawlInterval), nil)
+	} else if j.err != nil && idx.ctx.Err() != nil {
+		// The crawl was cancelled rather than the repository failing, so
+		// it goes back in the queue as if we'd never started on it.
+		j.l.Infof("Releasing %s since the crawl was stopped: %s", item.ID, j.err)
+		err = idx.queue.Release(item.ID)
+	} else if j.err != nil {
+		category := failureCategory(j, timedOut)
+		metrics.RepoFailures.Add(category, 1)
+		idx.currentReport().failed(item.ID, category, j.err)
+		idx.recordOutcome(true)
+		idx.throughput.count("failed", 1)
+		j.l.Infof("Could not index %s: %s", item.ID, j.err)
+		var dead bool
+		dead, err = idx.queue.Fail(item.ID, j.err, time.Now().Add(retryDelay(j, item)))
+		if dead {
+			metrics.DeadLettered.Add("", 1)
+			j.l.Warnf("Moved %s to the dead-letter list after %d failures in a row", item.ID, item.Attempts)
+		}
+	} else if j.model == nil {
+		idx.currentReport().skipped()
+		idx.recordOutcome(false)
+		idx.throughput.count("skipped", 1)
+		err = idx.queue.Done(item.ID, time.Now().Add(skippedRecrawlInterval), nil)
+	} else {
+		metrics.ReposIndexed.Add("", 1)
+		idx.currentReport().succeeded()
+		idx.recordOutcome(false)
+		idx.throughput.count("indexed", 1)
+		id := idx.canonicalize(j.l, item, j.model)
+		err = idx.queue.Done(id, scheduler.NextCrawl(j.model), &queue.Stats{Stars: j.model.Stars, ImportedBy: j.model.ImportedBy})
+		idx.queueImports(j.l, id, j.model)
+	}
+
+	if err != nil {
+		j.l.Errorf("Could not update %s in the queue: %s", item.ID, err)
+	}
+}
+
+// retryDelay returns how long to wait before trying a failed job's
+// repository again.
+func retryDelay(j *job, item *queue.Item) time.Duration {
+	if j.stage != "write" {
+		return retryInterval
+	}
+	// Trying again won't make the document any more valid.
+	if _, ok := j.err.(*esmodels.ValidationError); ok {
+		return retryInterval
+	}
+
+	d := writeRetryInterval
+	for i := 1; i < item.Attempts && d < retryInterval; i++ {
+		d *= 2
+	}
+	if d > retryInterval {
+		d = retryInterval
+	}
+	return d
+}
+
+func failureCategory(j *job, timedOut bool) string {
+	if _, ok := j.err.(*PanicError); ok {
+		return "panic"
+	}
+	if timedOut {
+		return "timeout"
+	}
+	return j.stage
+}
+
+// indexRepo runs a repository through every stage right away, rather than
+// waiting for the queue. The model is nil if the repository was skipped.
+func (idx *Indexer) indexRepo(repo repository.Repository, categories []string) (*esmodels.Repository, error) {
+	j := idx.newJob(nil, repo, categories)
+	defer j.cancel()
+	if idx.runJob("discover", j, idx.check) && idx.runJob("fetch", j, idx.fetch) && idx.runJob("analyze", j, idx.analyze) {
+		idx.runJob("write", j, idx.write)
+	}
+	return j.model, j.err
+}
+
+// A PanicError is a panic recovered while indexing a repository. One bad
+// repository shouldn't bring down the whole crawl, so instead the panic is
+// recorded in the queue like any other failure, along with its stack.
+type PanicError struct {
+	Stage string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in the %s stage: %v", e.Stage, e.Value)
+}
+
+func (e *PanicError) Failure() *queue.Failure {
+	return &queue.Failure{Stage: e.Stage, Panic: true, Stack: string(e.Stack)}
+}
+
+// id returns the ID of the job's repository, which may not be known yet if
+// it's a queue item that hasn't been crawled.
+func (j *job) id() string {
+	if j.item != nil {
+		return j.item.ID
+	}
+	if j.repo != nil {
+		return j.repo.ID()
+	}
+	return ""
+}
+
+// runJob calls f with the job, turning a panic into a failure of the job. If
+// the job's context is already done then f isn't called at all.
+func (idx *Indexer) runJob(stage string, j *job, f func(*job) bool) (ok bool) {
+	j.stage = stage
+	j.l = idx.l.With("repo", j.id(), "stage", stage)
+	if err := j.ctx.Err(); err != nil {
+		j.err = errwrap.Wrapf(fmt.Sprintf("Stopped before the %s stage: {{err}}", stage), err)
+		idx.finish(j)
+		return false
+	}
+
+	// The repository gets the stage's context, so that the spans it starts,
+	// like one for each ref, end up under the stage.
+	ctx, span := tracing.Start(j.ctx, stage, "repo", j.id())
+	if j.repo != nil {
+		j.repo.SetContext(ctx)
+	}
+	defer func() {
+		span.SetError(j.err)
+		span.End()
+	}()
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		err := &PanicError{Stage: stage, Value: r, Stack: debug.Stack()}
+		j.l.Errorw("Recovered from a panic", "panic", fmt.Sprint(r), "stack", string(err.Stack))
+		metrics.Panics.Add(1)
+
+		j.err = err
+		idx.finish(j)
+		ok = false
+	}()
+
+	return f(j)
+}
@@ -0,0 +1,349 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+	"github.com/autarch/metagodoc/indexer/repolist"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseStages(t *testing.T) {
+	s, err := ParseStages("", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, Stages{Discover: 1, Fetch: 1, Analyze: 1, Write: 1}, s, "defaults to one worker each")
+
+	s, err = ParseStages("fetch=4, analyze=2", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, Stages{Discover: 3, Fetch: 4, Analyze: 2, Write: 3}, s)
+
+	for _, bad := range []string{"fetch", "fetch=0", "fetch=many", "parse=2"} {
+		_, err = ParseStages(bad, 1)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	idx := testIndexer(t)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{panics: true}}
+
+	id := "github.com/example/thing"
+	_, err := idx.queue.Add(id, "https://"+id, nil)
+	assert.NoError(t, err)
+	item, err := idx.queue.Next()
+	assert.NoError(t, err)
+
+	j := idx.discover(item)
+	if !assert.NotNil(t, j) {
+		return
+	}
+	assert.False(t, idx.runJob("analyze", j, idx.analyze), "the job stops at the stage that panicked")
+
+	failed := idx.queue.Get(id)
+	assert.Equal(t, queue.Failed, failed.State)
+	assert.Equal(t, "panic in the analyze stage: boom", failed.LastError)
+	if assert.NotNil(t, failed.LastFailure) {
+		assert.Equal(t, "analyze", failed.LastFailure.Stage)
+		assert.True(t, failed.LastFailure.Panic)
+		assert.Contains(t, failed.LastFailure.Stack, "ESModel", "the stack shows where the panic happened")
+	}
+
+	// Indexing a repository directly turns a panic into an error too.
+	_, err = idx.indexRepo(&fakeRepository{id: id, panics: true}, nil)
+	assert.IsType(t, &PanicError{}, err)
+}
+
+func TestCancelledJob(t *testing.T) {
+	idx := testIndexer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.ctx = ctx
+	cancel()
+
+	// The repository would panic if it got as far as being analyzed.
+	_, err := idx.indexRepo(&fakeRepository{id: "github.com/example/thing", panics: true}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Stopped before the discover stage")
+		assert.Contains(t, err.Error(), context.Canceled.Error())
+	}
+	assert.True(t, idx.isDone(), "the crawl stops too")
+
+	idx = testIndexer(t)
+	idx.repoTimeout = time.Nanosecond
+	j := idx.newJob(nil, &fakeRepository{id: "github.com/example/thing"}, nil)
+	<-j.ctx.Done()
+	assert.False(t, idx.runJob("fetch", j, idx.fetch))
+	assert.Contains(t, j.err.Error(), context.DeadlineExceeded.Error())
+}
+
+// The benchmarks below run each stage on its own, so that a change which
+// slows one of them down shows up there rather than being lost in the noise
+// of a whole crawl. None of them touch the network.
+
+func BenchmarkDiscover(b *testing.B) {
+	idx := testIndexer(b)
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+	item := &queue.Item{ID: "github.com/example/thing", URL: "https://github.com/example/thing"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if idx.discover(item) == nil {
+			b.Fatal("discover did not return a job")
+		}
+	}
+}
+
+func BenchmarkFetch(b *testing.B) {
+	idx := testIndexer(b)
+	remote := benchModule(b, 20)
+	ghr := &github.Repository{
+		HTMLURL:       github.String("https://github.com/example/thing"),
+		CloneURL:      github.String("file://" + remote),
+		DefaultBranch: github.String("master"),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cacheRoot := filepath.Join(idx.cacheRoot, fmt.Sprintf("fetch-%d", i))
+		repo, err := repository.NewGitHubRepository(idx.l, ghr, nil, cacheRoot, idx.limiter, idx.repoSettings, context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		j := idx.newJob(nil, repo, nil)
+		if !idx.fetch(j) {
+			b.Fatal(j.err)
+		}
+	}
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	idx := testIndexer(b)
+	dir := benchModule(b, 20)
+	repo, err := repository.NewLocalRepository(idx.l, dir, "example.com/thing", idx.repoSettings)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.analyze(idx.newJob(nil, repo, nil))
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	idx := testIndexer(b)
+	dir := benchModule(b, 20)
+	repo, err := repository.NewLocalRepository(idx.l, dir, "example.com/thing", idx.repoSettings)
+	if err != nil {
+		b.Fatal(err)
+	}
+	j := idx.newJob(nil, repo, nil)
+	idx.analyze(j)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.store(j)
+	}
+	err = idx.writer.Flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// testIndexer returns an indexer which exports to a temporary directory
+// rather than needing a cluster. Logging is turned off since it would
+// swamp the benchmark output.
+func testIndexer(tb testing.TB) *Indexer {
+	root, err := ioutil.TempDir("", "metagodoc-pipeline")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(root) })
+
+	w, err := esmodels.NewExportWriter("ndjson:" + filepath.Join(root, "export"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	policies, err := tagpolicy.Load("", tagpolicy.Default())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	store, err := queue.NewFileStore(filepath.Join(root, "queue.jsonl"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	q, err := queue.New(store)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return &Indexer{
+		l:            &logger.Logger{SugaredLogger: zap.NewNop().Sugar()},
+		writer:       w,
+		cacheRoot:    root,
+		skipList:     repolist.DefaultSkipList(),
+		tagPolicies:  policies,
+		repoPolicies: &repopolicy.Rules{},
+		queue:        q,
+		limiter:      ratelimit.New(0, nil),
+		budget:       newBudget(Budget{}),
+		done:         make(chan struct{}),
+		ctx:          context.Background(),
+	}
+}
+
+// benchModule makes a git repository with a module of n packages.
+func benchModule(b *testing.B, n int) string {
+	dir, err := ioutil.TempDir("", "metagodoc-module")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	for i := 0; i < n; i++ {
+		pkg := fmt.Sprintf("pkg%d", i)
+		src := fmt.Sprintf("// Package %s is for benchmarking.\npackage %s\n\nimport \"strings\"\n\n// Upper upper cases s.\nfunc Upper(s string) string {\n\treturn strings.ToUpper(s)\n}\n", pkg, pkg)
+		err := os.MkdirAll(filepath.Join(dir, pkg), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, pkg, pkg+".go"), []byte(src), 0644)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"commit", "-q", "-m", "packages"},
+		{"tag", "v1.0.0"},
+	} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			b.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+
+	return dir
+}
+
+type fakeCrawler struct {
+	panics bool
+}
+
+func (c *fakeCrawler) Name() string                  { return "fake" }
+func (c *fakeCrawler) Handles(*url.URL) bool         { return true }
+func (c *fakeCrawler) SleepDuration() time.Duration  { return time.Minute }
+func (c *fakeCrawler) CrawlAll(chan *crawler.Result) {}
+func (c *fakeCrawler) Check(*url.URL) error          { return nil }
+func (c *fakeCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	return &fakeRepository{id: repository.IDFromURL(u), panics: c.panics}, nil
+}
+
+// fakeRepository is a repository which is always changed but has nothing in
+// it, unless it panics when asked what's in it.
+type fakeRepository struct {
+	id      string
+	panics  bool
+	cleared bool
+}
+
+func (r *fakeRepository) Fetch() error { return nil }
+func (r *fakeRepository) ESModel() (*esmodels.Repository, error) {
+	if r.panics {
+		panic("boom")
+	}
+	return &esmodels.Repository{
+		Name:        r.id,
+		PrimaryURL:  "https://" + r.id,
+		LastCrawled: esmodels.FormatTime(time.Now()),
+	}, nil
+}
+func (r *fakeRepository) ID() string                          { return r.id }
+func (r *fakeRepository) SetImportPathRoot(string, ...string) {}
+func (r *fakeRepository) SetContext(context.Context)          {}
+func (r *fakeRepository) SetTagPolicy(*tagpolicy.Policy)      {}
+func (r *fakeRepository) SetPolicy(*repopolicy.Policy)        {}
+func (r *fakeRepository) FetchedBytes() int64                 { return 0 }
+func (r *fakeRepository) ContentHash() (string, error)        { return "", nil }
+func (r *fakeRepository) Counts() (int, int)                  { return 0, 0 }
+func (r *fakeRepository) SetPrevious(*esmodels.Repository)    {}
+func (r *fakeRepository) SetReindex([]string)                 {}
+func (r *fakeRepository) ClearCheckpoint() error              { r.cleared = true; return nil }
+
+func TestStop(t *testing.T) {
+	idx := testIndexer(t)
+	id := "github.com/example/thing"
+	_, err := idx.queue.Add(id, "https://"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping lets the job in progress carry on.
+	j := idx.newJob(item, &fakeRepository{id: id}, nil)
+	idx.Stop()
+	assert.True(t, idx.isDone())
+	assert.Nil(t, j.ctx.Err())
+
+	// Once the crawl is cancelled the job is released rather than failed.
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.ctx = ctx
+	cancel()
+	j.ctx = ctx
+	assert.False(t, idx.runJob("fetch", j, idx.fetch))
+	released := idx.queue.Get(id)
+	assert.Equal(t, queue.Pending, released.State)
+	assert.Equal(t, 0, released.Attempts)
+}
+
+func TestRetryDelay(t *testing.T) {
+	write := &job{stage: "write"}
+	assert.Equal(t, writeRetryInterval, retryDelay(write, &queue.Item{Attempts: 1}))
+	assert.Equal(t, 4*writeRetryInterval, retryDelay(write, &queue.Item{Attempts: 3}))
+	assert.Equal(t, retryInterval, retryDelay(write, &queue.Item{Attempts: 20}), "the delay is capped")
+
+	analyze := &job{stage: "analyze"}
+	assert.Equal(t, retryInterval, retryDelay(analyze, &queue.Item{Attempts: 1}), "only write failures back off")
+}
+
+func TestStoreInvalid(t *testing.T) {
+	idx := testIndexer(t)
+	id := "github.com/example/thing"
+	repo := &fakeRepository{id: id}
+	j := idx.newJob(nil, repo, nil)
+	j.model = &esmodels.Repository{Name: id}
+
+	idx.store(j)
+	_, ok := j.err.(*esmodels.ValidationError)
+	assert.True(t, ok, "the job fails with the validation error")
+	assert.False(t, repo.cleared, "the checkpoint is kept")
+
+	_, err := os.Stat(filepath.Join(idx.cacheRoot, "export", esmodels.Index("repository")+".ndjson"))
+	assert.True(t, os.IsNotExist(err), "nothing is written")
+}
@@ -0,0 +1,37 @@
+package indexer
+
+import (
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repository"
+)
+
+// Purge deletes the repository with the given ID from every index, and
+// removes everything cached for it under the cache root. This is for
+// takedowns and corrupt clones.
+//
+// The repository stays in the queue, so it will be indexed again when it's
+// next due. For a takedown it should be added to the skip list as well.
+func (idx *Indexer) Purge(id string) error {
+	if idx.err != nil {
+		return idx.err
+	}
+	defer idx.queue.Close()
+	defer idx.closeWriter()
+
+	if idx.dryRun {
+		idx.report(&reportEntry{ID: id, Action: "purge"})
+		return nil
+	}
+
+	idx.l.Infof("Purging %s", id)
+	err := esmodels.DeleteRepository(idx.ctx, idx.elastic, idx.writer, id)
+	if err != nil {
+		return err
+	}
+	err = idx.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	return repository.RemoveClone(idx.cacheRoot, id)
+}
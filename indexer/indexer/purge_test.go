@@ -0,0 +1,30 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurge(t *testing.T) {
+	idx := testIndexer(t)
+	clone := filepath.Join(idx.cacheRoot, "repos", "github.com", "example", "thing")
+	err := os.MkdirAll(filepath.Join(clone, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, idx.Purge("github.com/example/thing"))
+	_, err = os.Stat(clone)
+	assert.True(t, os.IsNotExist(err), "the clone is removed")
+
+	b, err := ioutil.ReadFile(filepath.Join(idx.cacheRoot, "export", esmodels.Index("repository")+".ndjson"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `"deleted":true`, "the document is deleted")
+	}
+}
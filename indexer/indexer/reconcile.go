@@ -0,0 +1,194 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// How often to check every indexed repository against its upstream host.
+const reconcileInterval = 7 * 24 * time.Hour
+
+// A full pass makes an API call for every indexed repository, so we remember
+// when the last one finished rather than starting a new pass on every run.
+func (idx *Indexer) reconcileLoop() {
+	if idx.elastic == nil {
+		return
+	}
+
+	last := idx.lastReconciled()
+	for !idx.isDone() {
+		wait := last.Add(reconcileInterval).Sub(time.Now())
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-idx.done:
+				return
+			}
+		}
+
+		err := idx.reconcile()
+		if err != nil {
+			idx.l.Errorf("Could not reconcile the index: %s", err)
+			time.Sleep(retryInterval)
+			continue
+		}
+		// A pass cut short by the crawl budget doesn't count.
+		if idx.isDone() {
+			return
+		}
+		last = time.Now()
+		// A dry run doesn't write anything, including this, so the next
+		// real run still reconciles on schedule.
+		if idx.dryRun {
+			continue
+		}
+
+		path := idx.reconciledPath()
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(last.UTC().Format(time.RFC3339)), 0644)
+		}
+		if err != nil {
+			idx.l.Errorf("Could not record reconciliation time: %s", err)
+		}
+	}
+}
+
+func (idx *Indexer) reconciledPath() string {
+	return idx.statePath("last-reconcile")
+}
+
+// This returns the zero time if we've never reconciled.
+func (idx *Indexer) lastReconciled() time.Time {
+	b, err := ioutil.ReadFile(idx.reconciledPath())
+	if err != nil {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// reconcile checks that every indexed repository still exists upstream. Any
+// repository which has been deleted or taken down is removed from the index
+// and replaced with a tombstone.
+func (idx *Indexer) reconcile() error {
+	idx.l.Info("Reconciling indexed repositories with their upstream hosts")
+
+	// Checking is slow, since each check is an API call, so the URLs are all
+	// collected before any of them are checked. Otherwise the scroll could
+	// expire while we're checking one page of it.
+	repos, err := idx.indexedURLs()
+	if err != nil {
+		return err
+	}
+
+	checked, buried := 0, 0
+	for _, r := range repos {
+		if idx.isDone() {
+			break
+		}
+
+		c := idx.crawlerFor(r.url)
+		if c == nil {
+			continue
+		}
+
+		checked++
+		err = c.Check(r.url)
+		if g, ok := err.(*crawler.GoneError); ok {
+			idx.bury(r.id, g)
+			buried++
+		} else if err != nil {
+			idx.l.Infof("Could not check %s: %s", r.id, err)
+		}
+	}
+
+	idx.l.Infof("Checked %d repositories, %d of which are gone", checked, buried)
+
+	return nil
+}
+
+type indexedURL struct {
+	id  string
+	url *url.URL
+}
+
+// indexedURLs returns the ID and primary URL of every indexed repository.
+func (idx *Indexer) indexedURLs() ([]indexedURL, error) {
+	scroll := idx.elastic.
+		Scroll(esmodels.Index("repository")).
+		Type(idx.elastic.SearchTypes("repository")...).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("primary_url")).
+		Size(500)
+
+	var repos []indexedURL
+	for !idx.isDone() {
+		result, err := scroll.Do(idx.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			r := &esmodels.Repository{}
+			err := json.Unmarshal(*hit.Source, r)
+			if err != nil {
+				return nil, errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+
+			u, err := url.Parse(r.PrimaryURL)
+			if err != nil {
+				idx.l.Errorf("Invalid URL for %s: %s", hit.Id, r.PrimaryURL)
+				continue
+			}
+			repos = append(repos, indexedURL{id: hit.Id, url: u})
+		}
+	}
+	return repos, nil
+}
+
+// bury removes a repository which no longer exists upstream from the index
+// and writes a tombstone saying why.
+func (idx *Indexer) bury(id string, g *crawler.GoneError) {
+	idx.l.Infof("%s is gone: %s", id, g.Reason)
+
+	kind := esmodels.TombstoneNotFound
+	if g.StatusCode == http.StatusUnavailableForLegalReasons {
+		kind = esmodels.TombstoneUnavailable
+	}
+
+	idx.writeTombstone(id, kind, fmt.Sprintf("%d: %s", g.StatusCode, g.Reason))
+
+	if idx.dryRun {
+		return
+	}
+
+	idx.deleteRepository(id)
+}
+
+func (idx *Indexer) deleteRepository(id string) {
+	err := esmodels.DeleteRepository(idx.ctx, idx.elastic, idx.writer, id)
+	if err != nil {
+		idx.l.Errorf("Could not delete %s: %s", id, err)
+	}
+}
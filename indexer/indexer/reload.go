@@ -0,0 +1,63 @@
+package indexer
+
+import (
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+)
+
+// Reload applies the settings in p which can change while the crawl is
+// running: the skip and allow lists, the tag and repository policies, the
+// rate limits, and MaxClones and MaxAPICalls. Everything else in p is
+// ignored, since it only takes effect on a restart, though a warning is
+// logged if the number of workers has changed. If any of the new settings is
+// invalid then none of them are applied.
+//
+// Repositories already in progress carry on with the settings they started
+// with, so nothing in flight is lost.
+func (idx *Indexer) Reload(p NewParams) error {
+	if idx.err != nil {
+		return idx.err
+	}
+
+	allowList, err := loadAllowList(p.AllowList)
+	if err != nil {
+		return err
+	}
+	skipList, err := loadSkipList(p.SkipList)
+	if err != nil {
+		return err
+	}
+	tagPolicies, err := loadTagPolicies(p.TagPolicy, p.TagPolicies)
+	if err != nil {
+		return err
+	}
+	repoPolicies, err := repopolicy.Load(p.RepoPolicies)
+	if err != nil {
+		return err
+	}
+	limits, err := ratelimit.Parse(p.RateLimits)
+	if err != nil {
+		return err
+	}
+	stages, err := ParseStages(p.StageWorkers, p.Workers)
+	if err != nil {
+		return err
+	}
+
+	idx.reloadMu.Lock()
+	idx.allowList = allowList
+	idx.skipList = skipList
+	idx.tagPolicies = tagPolicies
+	idx.repoPolicies = repoPolicies
+	idx.reloadMu.Unlock()
+
+	idx.limiter.SetIntervals(limits)
+	idx.limiter.SetConcurrency(p.MaxClones, p.MaxAPICalls)
+
+	if stages != idx.stages {
+		idx.l.Warnf("The number of workers can't be changed without a restart, so %+v is still being used instead of %+v", idx.stages, stages)
+	}
+
+	idx.l.Info("Reloaded the skip list, allow list, tag and repository policies, and rate limits")
+	return nil
+}
@@ -0,0 +1,37 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	idx := testIndexer(t)
+	skipList := filepath.Join(idx.cacheRoot, "skip.yaml")
+	err := ioutil.WriteFile(skipList, []byte("- pattern: github.com/example/...\n  reason: testing\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := "github.com/example/thing"
+	assert.Nil(t, idx.skipped(id))
+	err = idx.Reload(NewParams{SkipList: skipList, RateLimits: "example.com=5s", MaxClones: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "testing", idx.skipped(id).Reason)
+		assert.Equal(t, 5*time.Second, idx.limiter.Interval("example.com"))
+	}
+
+	// A bad setting means nothing changes.
+	err = idx.Reload(NewParams{AllowList: filepath.Join(idx.cacheRoot, "missing.yaml")})
+	assert.Error(t, err)
+	assert.NotNil(t, idx.skipped(id), "the skip list is kept")
+	assert.True(t, idx.allowed(id))
+
+	err = idx.Reload(NewParams{TagPolicy: "bogus"})
+	assert.Error(t, err)
+	assert.Equal(t, 5*time.Second, idx.limiter.Interval("example.com"), "the rate limits are kept")
+}
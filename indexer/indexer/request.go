@@ -0,0 +1,161 @@
+package indexer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/indexer/repository"
+)
+
+type JobState string
+
+const (
+	JobPending    JobState = "pending"
+	JobInProgress JobState = "in-progress"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+)
+
+// A Job is a request for a repository to be indexed right away.
+type Job struct {
+	ID           string    `json:"id"`
+	RepositoryID string    `json:"repository_id"`
+	Requested    time.Time `json:"requested"`
+	State        JobState  `json:"state"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// RequestIndex asks for the repository containing the given import path to
+// be indexed as soon as possible. It returns a job ID which can be passed to
+// JobStatus to see how things are going.
+//
+// The job ID encodes the repository ID and the time of the request, so the
+// status can be worked out from the crawl queue alone and survives restarts.
+func (idx *Indexer) RequestIndex(importPath string) (string, error) {
+	if idx.err != nil {
+		return "", idx.err
+	}
+
+	root, err := idx.resolver.Resolve(idx.ctx, importPath)
+	if err != nil {
+		return "", err
+	}
+
+	u := repository.NormalizeURL(root.RepoURL)
+	if idx.crawlerFor(u) == nil {
+		return "", fmt.Errorf("No crawler knows how to handle %s", u)
+	}
+
+	id := repository.IDFromURL(u)
+	if !idx.allowed(id) {
+		return "", fmt.Errorf("%s is not on the allow list", id)
+	}
+
+	// The item may be under an ID which differs in case, see
+	// repository.DedupKey, and Schedule only finds exact IDs.
+	if item := idx.queue.Get(id); item != nil {
+		if item.State == queue.DeadLetter {
+			return "", fmt.Errorf("%s failed too many times in a row and has to be retried through the admin API", item.ID)
+		}
+		id = item.ID
+	}
+
+	// Any crawl which ends after this answers the request.
+	requested := time.Now().UTC()
+
+	// The zero time sorts before everything else in the queue, so this
+	// repository will be the next one picked up.
+	err = idx.queue.Schedule(id, u.String(), time.Time{}, nil)
+	if err != nil {
+		return "", err
+	}
+	err = idx.queue.RequestIndex(id, requested)
+	if err != nil {
+		return "", err
+	}
+	if root.IsVanity {
+		err = idx.queue.SetImportPrefix(id, root.ImportPrefix)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	idx.l.Infof("Indexing of %s requested", id)
+
+	return jobID(id, requested), nil
+}
+
+// JobStatus returns the current state of a job started with RequestIndex.
+func (idx *Indexer) JobStatus(jobID string) (*Job, error) {
+	if idx.err != nil {
+		return nil, idx.err
+	}
+
+	id, requested, err := parseJobID(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	item := idx.queue.Get(id)
+	if item == nil {
+		return nil, fmt.Errorf("Unknown job: %s", jobID)
+	}
+
+	job := &Job{
+		ID:           jobID,
+		RepositoryID: id,
+		Requested:    requested,
+	}
+	job.State, job.Error = jobState(item, requested)
+
+	return job, nil
+}
+
+func jobState(item *queue.Item, requested time.Time) (JobState, string) {
+	if item.State == queue.InProgress {
+		return JobInProgress, ""
+	}
+
+	// The item is touched for all sorts of reasons, so the only sign that
+	// the request was dealt with is a crawl which ended after it.
+	var failed time.Time
+	if len(item.Failures) > 0 {
+		failed = item.Failures[len(item.Failures)-1].At
+	}
+	switch {
+	case item.LastCrawled.After(requested) && !item.LastCrawled.Before(failed):
+		return JobDone, ""
+	case failed.After(requested):
+		return JobFailed, item.LastError
+	default:
+		return JobPending, ""
+	}
+}
+
+func jobID(repoID string, requested time.Time) string {
+	raw := fmt.Sprintf("%s@%d", repoID, requested.UnixNano())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseJobID(jobID string) (string, time.Time, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(jobID)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Invalid job ID: %s", jobID)
+	}
+
+	i := strings.LastIndex(string(raw), "@")
+	if i == -1 {
+		return "", time.Time{}, fmt.Errorf("Invalid job ID: %s", jobID)
+	}
+
+	nanos, err := strconv.ParseInt(string(raw[i+1:]), 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Invalid job ID: %s", jobID)
+	}
+
+	return string(raw[:i]), time.Unix(0, nanos).UTC(), nil
+}
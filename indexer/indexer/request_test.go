@@ -0,0 +1,116 @@
+package indexer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/importpath"
+	"github.com/autarch/metagodoc/indexer/queue"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIndex(t *testing.T) {
+	idx := testIndexer(t)
+	idx.resolver = importpath.NewResolver(nil)
+
+	_, err := idx.RequestIndex("github.com/example/thing")
+	assert.Error(t, err, "no crawler handles the repository")
+
+	idx.crawlers.all = []crawler.Crawler{&fakeCrawler{}}
+
+	id, err := idx.RequestIndex("github.com/example/thing/sub/pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item := idx.queue.Get("github.com/example/thing"); assert.NotNil(t, item) {
+		assert.False(t, item.IndexRequested.IsZero(), "the request is recorded on the item")
+	}
+
+	job, err := idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "github.com/example/thing", job.RepositoryID, "the job is for the whole repository")
+		assert.Equal(t, JobPending, job.State)
+	}
+
+	item, err := idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "github.com/example/thing", item.ID, "the requested repository is next in the queue")
+
+	job, err = idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JobInProgress, job.State)
+	}
+
+	err = idx.queue.Done(item.ID, time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JobDone, job.State)
+	}
+
+	// A second request for the same repository is pending again, even though
+	// the queue item says it's done.
+	id, err = idx.RequestIndex("github.com/example/thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JobPending, job.State)
+	}
+
+	// Other changes to the queue item don't finish the job.
+	err = idx.queue.Schedule("github.com/example/thing", "https://github.com/example/thing", time.Now(), &queue.Stats{Stars: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.queue.AddCategory("github.com/example/thing", "Utilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JobPending, job.State, "the job is pending until the repository is crawled")
+	}
+
+	item, err = idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.queue.Fail(item.ID, errors.New("boom"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = idx.JobStatus(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, JobFailed, job.State)
+		assert.Equal(t, "boom", job.Error)
+	}
+
+	_, err = idx.JobStatus("not a job")
+	assert.Error(t, err, "invalid job ID")
+	_, err = idx.JobStatus(jobID("github.com/example/unknown", time.Now()))
+	assert.Error(t, err, "unknown repository")
+}
+
+func TestParseJobID(t *testing.T) {
+	requested := time.Date(2018, 6, 1, 12, 30, 0, 42, time.UTC)
+	id, at, err := parseJobID(jobID("github.com/example/thing", requested))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "github.com/example/thing", id)
+		assert.Equal(t, requested, at)
+	}
+
+	for _, raw := range []string{"!!!", "Z2l0aHViLmNvbS9leGFtcGxl", "Z2l0aHViLmNvbS9leGFtcGxlQG5vdw"} {
+		_, _, err := parseJobID(raw)
+		assert.Error(t, err, raw)
+	}
+}
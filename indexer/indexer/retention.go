@@ -0,0 +1,194 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/queue"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// What the retention job does with a stale repository which can't be
+// recrawled.
+const (
+	RetentionFlag   = "flag"
+	RetentionDelete = "delete"
+)
+
+// A Retention policy deals with repositories which haven't been crawled for
+// a long time, usually because every recrawl fails. Without this they stay in
+// the index forever.
+type Retention struct {
+	// Repositories which were last crawled longer ago than this are stale.
+	// If this is zero then stale repositories are left alone.
+	Horizon time.Duration
+	// Either RetentionFlag, to mark stale repositories as stale, or
+	// RetentionDelete, to delete them. Defaults to RetentionFlag.
+	Action string
+}
+
+// Validate returns an error if the action isn't one we know about.
+func (r Retention) Validate() error {
+	switch r.Action {
+	case "", RetentionFlag, RetentionDelete:
+		return nil
+	default:
+		return fmt.Errorf("Unknown retention action: %s", r.Action)
+	}
+}
+
+// How often to look for stale repositories.
+const retentionInterval = 24 * time.Hour
+
+func (idx *Indexer) retentionLoop() {
+	if idx.elastic == nil || idx.retention.Horizon == 0 {
+		return
+	}
+
+	for !idx.isDone() {
+		err := idx.expire()
+		if err != nil {
+			idx.l.Errorf("Could not expire stale repositories: %s", err)
+		}
+
+		select {
+		case <-time.After(retentionInterval):
+		case <-idx.done:
+			return
+		}
+	}
+}
+
+// expire queues every stale repository to be recrawled. Those which the
+// queue has already tried and couldn't crawl are flagged or deleted,
+// depending on the retention policy. Repositories which have already been
+// flagged aren't tried again.
+func (idx *Indexer) expire() error {
+	cutoff := time.Now().Add(-idx.retention.Horizon)
+	idx.l.Infof("Looking for repositories which haven't been crawled since %s", esmodels.FormatTime(cutoff))
+
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewRangeQuery("last_crawled").Lt(esmodels.FormatTime(cutoff))).
+		MustNot(elastic.NewTermQuery("stale", true))
+	scroll := idx.elastic.
+		Scroll(esmodels.Index("repository")).
+		Type(idx.elastic.SearchTypes("repository")...).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("primary_url", "import_path_root", "categories", "last_crawled")).
+		Size(100)
+
+	stale, expired := 0, 0
+	for !idx.isDone() {
+		result, err := scroll.Do(idx.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			r := &esmodels.Repository{}
+			err := json.Unmarshal(*hit.Source, r)
+			if err != nil {
+				return errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+
+			stale++
+			err = idx.recrawl(hit.Id, r)
+			if err == nil {
+				continue
+			}
+			idx.l.Infof("Stale repository %s could not be recrawled: %s", hit.Id, err)
+			idx.expireRepository(hit.Id)
+			expired++
+		}
+	}
+
+	idx.l.Infof("Found %d stale repositories, %d of which could not be recrawled and the rest of which were queued", stale, expired)
+
+	return nil
+}
+
+// recrawl puts a stale repository at the front of the queue, so the pipeline
+// tries it again, and records that we asked for that. We only find out how it
+// went on a later pass. By then a repository which was crawled successfully
+// isn't stale any more, so if it still is, and the queue has failed to crawl
+// it or crawled it without indexing it since we asked, then this returns an
+// error. A failure from before we asked doesn't count, since the repository
+// may have been fixed since.
+func (idx *Indexer) recrawl(id string, r *esmodels.Repository) error {
+	if !idx.allowed(id) {
+		return fmt.Errorf("%s is not on the allow list", id)
+	}
+	if e := idx.skipped(id); e != nil {
+		return fmt.Errorf("%s is on the skip list", id)
+	}
+
+	// If the document was indexed after the last request then that request
+	// was for an earlier time it went stale.
+	indexed, _ := time.Parse(esmodels.DateTimeFormat, r.LastCrawled)
+	if i := idx.queue.Get(id); i != nil {
+		if i.State == queue.DeadLetter {
+			return fmt.Errorf("%s is on the dead-letter list: %s", id, i.LastError)
+		}
+
+		requested := i.RecrawlRequested
+		if !requested.IsZero() && requested.After(indexed) {
+			switch {
+			case i.LastError != "" && len(i.Failures) > 0 && i.Failures[len(i.Failures)-1].At.After(requested):
+				return fmt.Errorf("%s could not be crawled: %s", id, i.LastError)
+			case i.LastCrawled.After(requested):
+				return fmt.Errorf("%s was skipped by its crawler", id)
+			default:
+				// The queue hasn't got to it yet.
+				return nil
+			}
+		}
+	}
+
+	err := idx.queue.Schedule(id, r.PrimaryURL, time.Now(), nil)
+	if err != nil {
+		return err
+	}
+	err = idx.queue.RequestRecrawl(id, time.Now())
+	if err != nil {
+		return err
+	}
+	if r.ImportPathRoot != "" {
+		err = idx.queue.SetImportPrefix(id, r.ImportPathRoot)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range r.Categories {
+		err = idx.queue.AddCategory(id, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *Indexer) expireRepository(id string) {
+	action := idx.retention.Action
+	if action == "" {
+		action = RetentionFlag
+	}
+
+	if idx.dryRun {
+		idx.report(&reportEntry{ID: id, Action: "expire", Reason: action})
+		return
+	}
+
+	if action == RetentionDelete {
+		idx.deleteRepository(id)
+		return
+	}
+	idx.writer.Update(esmodels.Index("repository"), "repository", id, map[string]bool{"stale": true})
+}
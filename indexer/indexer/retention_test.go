@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecrawl(t *testing.T) {
+	idx := testIndexer(t)
+
+	const id = "github.com/foo/bar"
+	r := &esmodels.Repository{
+		PrimaryURL:  "https://github.com/foo/bar",
+		LastCrawled: esmodels.FormatTime(time.Now().AddDate(-1, 0, 0)),
+	}
+
+	// A failure from before it went stale doesn't count. The failures here
+	// are retried right away, since scheduling a recrawl doesn't cut a
+	// failed item's backoff short.
+	_, err := idx.queue.Add(id, r.PrimaryURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.queue.Fail(item.ID, errors.New("boom"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, idx.recrawl(id, r), "the first pass schedules a recrawl")
+	item = idx.queue.Get(id)
+	assert.False(t, item.RecrawlRequested.IsZero())
+	assert.True(t, item.NextCrawlAt.Before(time.Now()), "the recrawl is due now")
+
+	assert.Nil(t, idx.recrawl(id, r), "nothing happens until the queue gets to it")
+
+	item, err = idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.queue.Fail(item.ID, errors.New("still broken"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, idx.recrawl(id, r), "github.com/foo/bar could not be crawled: still broken")
+
+	// Once the repository is indexed again, the old request is for an
+	// earlier time it went stale.
+	err = idx.queue.RequestRecrawl(id, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.LastCrawled = esmodels.FormatTime(time.Now().Add(-time.Minute))
+	assert.Nil(t, idx.recrawl(id, r))
+
+	// A crawl that doesn't index the repository leaves it stale.
+	item, err = idx.queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.queue.Done(item.ID, time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, idx.recrawl(id, r), "github.com/foo/bar was skipped by its crawler")
+}
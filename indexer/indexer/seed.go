@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/seed"
+)
+
+// seed adds every repository from the curated lists to the queue, tagging
+// each one with the categories it was listed under. Repositories which are
+// already in the queue just get the category.
+func (idx *Indexer) seed() {
+	client := &http.Client{
+		Transport: idx.limiter.Transport(nil),
+		Timeout:   time.Minute,
+	}
+
+	for _, source := range idx.seedLists {
+		seeds, err := seed.Fetch(client, source)
+		if err != nil {
+			idx.l.Errorf("Could not read seed list: %s", err)
+			continue
+		}
+
+		added := 0
+		for _, s := range seeds {
+			u := repository.NormalizeURL(s.URL)
+			if idx.crawlerFor(u) == nil {
+				continue
+			}
+
+			id := repository.IDFromURL(u)
+			if !idx.allowed(id) {
+				continue
+			}
+
+			ok, err := idx.queue.Add(id, u.String(), nil)
+			if err != nil {
+				idx.l.Errorf("Could not add %s to the queue: %s", id, err)
+				continue
+			}
+			if ok {
+				added++
+			}
+
+			if s.Category != "" {
+				err = idx.queue.AddCategory(id, s.Category)
+				if err != nil {
+					idx.l.Errorf("Could not update %s in the queue: %s", id, err)
+				}
+			}
+		}
+
+		idx.l.Infof("Seeded the queue with %d new repositories from %s", added, source)
+	}
+}
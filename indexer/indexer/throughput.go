@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"sync"
+	"time"
+)
+
+// throughput counts what the pipeline got through in each of the last
+// throughputMinutes minutes, for the admin API. Unlike the crawl report this
+// is always kept, and only ever covers the recent past.
+type throughput struct {
+	buckets [throughputMinutes]throughputBucket
+	mu      sync.Mutex
+}
+
+const throughputMinutes = 60
+
+type throughputBucket struct {
+	minute int64
+	counts map[string]int64
+}
+
+// count adds n to a counter, like "indexed" or "documents", for the current
+// minute.
+func (t *throughput) count(name string, n int64) {
+	t.countAt(time.Now(), name, n)
+}
+
+func (t *throughput) countAt(now time.Time, name string, n int64) {
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[minute%throughputMinutes]
+	if b.minute != minute {
+		b.minute = minute
+		b.counts = make(map[string]int64)
+	}
+	b.counts[name] += n
+}
+
+// since returns the totals of every counter over the last few minutes,
+// including the current one.
+func (t *throughput) since(now time.Time, minutes int) map[string]int64 {
+	end := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := make(map[string]int64)
+	for _, b := range t.buckets {
+		if b.minute > end-int64(minutes) && b.minute <= end {
+			for name, n := range b.counts {
+				totals[name] += n
+			}
+		}
+	}
+	return totals
+}
@@ -0,0 +1,23 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughput(t *testing.T) {
+	var tp throughput
+	now := time.Date(2024, 6, 1, 12, 0, 30, 0, time.UTC)
+
+	tp.countAt(now.Add(-90*time.Minute), "indexed", 100)
+	tp.countAt(now.Add(-30*time.Minute), "indexed", 3)
+	tp.countAt(now.Add(-2*time.Minute), "indexed", 2)
+	tp.countAt(now.Add(-2*time.Minute), "failed", 1)
+	tp.countAt(now, "indexed", 1)
+
+	assert.Equal(t, map[string]int64{"indexed": 3, "failed": 1}, tp.since(now, 5))
+	assert.Equal(t, map[string]int64{"indexed": 6, "failed": 1}, tp.since(now, 60), "the count from more than an hour ago was replaced")
+	assert.Equal(t, map[string]int64{}, tp.since(now.Add(2*time.Hour), 60))
+}
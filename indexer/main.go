@@ -1,27 +1,156 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/autarch/metagodoc/env"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/config"
 	"github.com/autarch/metagodoc/indexer/indexer"
 	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
+	"github.com/autarch/metagodoc/tracing"
 )
 
 func main() {
-	l, err := logger.New(logger.NewParams{IsProd: env.IsProd()})
+	// Passing "index <repository URL or import path>" indexes just that
+	// repository and prints a summary, "purge <repository ID>" removes a
+	// repository from the index and the cache, and "ls" lists the indexed
+	// repositories. Otherwise we crawl everything.
+	var command, arg string
+	var filter indexer.ListFilter
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "":
+	case "index", "purge":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		arg = os.Args[2]
+	case "ls":
+		filter = listFilter(os.Args[2:])
+	default:
+		usage()
+	}
+
+	// We don't have a logger until we know whether we're in production.
+	cfg, err := config.Load(env.ConfigFile())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := logger.New(logger.NewParams{
+		IsProd: cfg.Production,
+		Level:  cfg.LogLevel,
+		Format: cfg.LogFormat,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer l.Sync()
 
-	err = indexer.New(indexer.NewParams{
-		Logger:       l,
-		GitHubToken:  env.GitHubToken(),
-		CacheRoot:    env.Root(),
-		TraceElastic: env.TraceElastic(),
-	}).IndexAll()
+	if cfg.DebugAddr != "" {
+		err = metrics.Serve(l, cfg.DebugAddr)
+		if err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	var exporter *tracing.Exporter
+	if cfg.OTLPEndpoint != "" {
+		exporter, err = tracing.New(tracing.NewParams{Logger: l, Endpoint: cfg.OTLPEndpoint})
+		if err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := cfg.Params()
+	p.Logger = l
+	p.Context = ctx
+	var idx *indexer.Indexer
+	if command == "ls" {
+		idx = indexer.NewLister(p)
+	} else {
+		idx = indexer.New(p)
+	}
+
+	// The first signal stops the crawl from starting anything new, and gives
+	// the repositories in progress a while to finish. A second signal, or
+	// running out of time, cancels them, leaving them to be retried next
+	// time. A third one kills us the usual way.
+	timeout := cfg.ShutdownTimeout
+	if timeout == 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Infof("Stopping the crawl once the repositories in progress are done, or in %s", timeout)
+		idx.Stop()
+
+		select {
+		case <-sigs:
+		case <-time.After(timeout):
+		}
+		signal.Stop(sigs)
+		l.Info("Cancelling the repositories in progress")
+		cancel()
+	}()
+
+	// SIGHUP reloads the config file, and applies whatever can change without
+	// a restart. See indexer.Reload.
+	hups := make(chan os.Signal, 1)
+	if command != "ls" {
+		signal.Notify(hups, syscall.SIGHUP)
+	}
+	go func() {
+		for range hups {
+			reload(l, idx)
+		}
+	}()
+
+	switch command {
+	case "index":
+		var model *esmodels.Repository
+		model, err = idx.IndexOne(arg)
+		if err == nil {
+			printSummary(os.Stdout, model)
+		}
+	case "purge":
+		err = idx.Purge(arg)
+	case "ls":
+		var listings []*indexer.Listing
+		listings, err = idx.List(filter)
+		if err == nil {
+			printListings(os.Stdout, listings)
+		}
+	default:
+		if cfg.AdminAddr != "" {
+			err = idx.ServeAdmin(cfg.AdminAddr, cfg.AdminToken)
+			if err != nil {
+				l.Fatal(err)
+			}
+		}
+		err = idx.IndexAll()
+	}
+
+	// Exiting skips deferred calls, so the last spans are sent here.
+	if exporter != nil {
+		exporter.Close()
+	}
 
 	if err != nil {
 		l.Fatalf("Error creating indexer: %s", err)
@@ -29,3 +158,62 @@ func main() {
 
 	os.Exit(0)
 }
+
+func reload(l *logger.Logger, idx *indexer.Indexer) {
+	l.Info("Reloading the config")
+	cfg, err := config.Load(env.ConfigFile())
+	if err == nil {
+		err = idx.Reload(cfg.Params())
+	}
+	if err != nil {
+		l.Errorf("Could not reload the config, so the current settings are kept: %s", err)
+	}
+}
+
+func usage() {
+	log.Fatalf("Usage: %s [index <repository URL or import path> | purge <repository ID> | ls [--status=<status>] [--since=<date or duration>]]", os.Args[0])
+}
+
+func listFilter(args []string) indexer.ListFilter {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	status := fs.String("status", "", "only list repositories with this status, like no-recent-commits")
+	since := fs.String("since", "", "only list repositories crawled since this date, like 2024-06-01, or this long ago, like 720h")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usage()
+	}
+
+	f, err := indexer.ParseListFilter(*status, *since, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func printListings(w io.Writer, listings []*indexer.Listing) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tSTATUS\tLAST CRAWLED\tREFS")
+	for _, l := range listings {
+		status := string(l.Status)
+		if l.Stale {
+			status += " (stale)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", l.ID, status, l.LastCrawled, l.Refs)
+	}
+	tw.Flush()
+}
+
+func printSummary(w io.Writer, r *esmodels.Repository) {
+	fmt.Fprintf(w, "%s (%s)\n", r.Name, r.PrimaryURL)
+	fmt.Fprintf(w, "  status: %s\n", r.Status)
+	for _, ref := range r.Refs {
+		if ref.Removed != "" {
+			continue
+		}
+		errors := 0
+		for _, p := range ref.Packages {
+			errors += len(p.Errors)
+		}
+		fmt.Fprintf(w, "  %s %s: %d packages, %d errors, %d warnings\n", ref.RefType, ref.Name, len(ref.Packages), errors, len(ref.Warnings))
+	}
+}
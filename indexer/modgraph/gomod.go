@@ -0,0 +1,79 @@
+package modgraph
+
+import (
+	"strings"
+)
+
+// A Require is a module required by a go.mod file.
+type Require struct {
+	Path    string
+	Version string
+	// Marked with an "// indirect" comment, meaning none of the module's
+	// packages import it.
+	Indirect bool
+}
+
+// ParseGoMod returns the module path and requirements in a go.mod file.
+// Unlike vulndb.Requirements this keeps the indirect requirements separate,
+// and doesn't apply replacements, since those don't change how many modules
+// there are.
+func ParseGoMod(goMod []byte) (string, []Require) {
+	var module string
+	var requires []Require
+
+	block := ""
+	for _, line := range strings.Split(string(goMod), "\n") {
+		comment := ""
+		if i := strings.Index(line, "//"); i >= 0 {
+			line, comment = line[:i], line[i+2:]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		for i := range f {
+			f[i] = strings.Trim(f[i], `"`)
+		}
+
+		directive := block
+		switch {
+		case block != "" && f[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(f) == 2 && f[1] == "(":
+			block = f[0]
+			continue
+		case block == "":
+			directive, f = f[0], f[1:]
+		}
+
+		switch {
+		case directive == "module" && len(f) == 1:
+			module = f[0]
+		case directive == "require" && len(f) >= 2:
+			requires = append(requires, Require{
+				Path:     f[0],
+				Version:  f[1],
+				Indirect: strings.HasPrefix(strings.TrimSpace(comment), "indirect"),
+			})
+		}
+	}
+	return module, requires
+}
+
+// SumModules returns the path of every module in a go.sum file whose code was
+// downloaded. Modules which only have a hash for their go.mod file were
+// looked at while resolving versions, but aren't part of the build.
+func SumModules(goSum []byte) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, line := range strings.Split(string(goSum), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 || strings.HasSuffix(f[1], "/go.mod") || seen[f[0]] {
+			continue
+		}
+		seen[f[0]] = true
+		paths = append(paths, f[0])
+	}
+	return paths
+}
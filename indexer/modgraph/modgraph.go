@@ -0,0 +1,177 @@
+// Package modgraph works out how deep a module's dependency tree is, by
+// following the go.mod files of its dependencies from a Go module proxy. See
+// https://go.dev/ref/mod#goproxy-protocol for the API.
+//
+// This doesn't run minimal version selection. Each module is followed at the
+// version the main module's go.mod selects, if it lists it, and otherwise at
+// the version whatever required it asked for. Since Go 1.17 the main module
+// lists every module in its build, so that's usually right.
+package modgraph
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// The public Go module proxy.
+const DefaultURL = "https://proxy.golang.org"
+
+// We stop following dependencies after fetching this many go.mod files for
+// one module. A tree this big is deep enough that the exact depth doesn't
+// matter much.
+const maxFetches = 500
+
+// A module version's go.mod never changes, so the cache only has to be
+// bounded. When it gets this big it's emptied.
+const maxCached = 50000
+
+// A Client caches the go.mod files it fetches, so one should be shared by
+// everything that measures dependencies.
+type Client struct {
+	url    string
+	client *http.Client
+
+	// The direct requirements of each module version, keyed by
+	// "path@version".
+	cache map[string][]Require
+	mu    sync.Mutex
+}
+
+// New returns a client for the proxy at the given URL.
+func New(proxyURL string) (*Client, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid module proxy URL %q, expected an http or https URL", proxyURL)
+	}
+	return &Client{
+		url:    strings.TrimSuffix(proxyURL, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  make(map[string][]Require),
+	}, nil
+}
+
+// Depth returns the length of the longest chain of requirements from a
+// module to one of its dependencies, given the requirements in its go.mod
+// file. A module whose dependencies have none of their own has a depth of
+// one. Each module counts at its shortest distance from the main module.
+func (c *Client) Depth(ctx context.Context, requires []Require) (int, error) {
+	selected := make(map[string]string)
+	var level []Require
+	for _, r := range requires {
+		selected[r.Path] = r.Version
+		if !r.Indirect {
+			level = append(level, r)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range level {
+		seen[r.Path] = true
+	}
+	depth, fetches := 0, 0
+	for len(level) > 0 && fetches < maxFetches {
+		depth++
+		var next []Require
+		for _, r := range level {
+			if fetches == maxFetches {
+				break
+			}
+			fetches++
+			deps, err := c.requires(ctx, r.Path, r.Version)
+			if err != nil {
+				return 0, err
+			}
+			for _, d := range deps {
+				if seen[d.Path] {
+					continue
+				}
+				seen[d.Path] = true
+				if v, ok := selected[d.Path]; ok {
+					d.Version = v
+				}
+				next = append(next, d)
+			}
+		}
+		level = next
+	}
+	return depth, nil
+}
+
+// requires returns the direct requirements of a module version. A module
+// which the proxy doesn't have, because it was never published or has been
+// taken down, is treated as having no requirements.
+func (c *Client) requires(ctx context.Context, path, version string) ([]Require, error) {
+	key := path + "@" + version
+	c.mu.Lock()
+	deps, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		return deps, nil
+	}
+
+	goMod, err := c.get(ctx, "/"+escape(path)+"/@v/"+escape(version)+".mod")
+	if err != nil {
+		return nil, err
+	}
+	_, all := ParseGoMod(goMod)
+	for _, r := range all {
+		if !r.Indirect {
+			deps = append(deps, r)
+		}
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= maxCached {
+		c.cache = make(map[string][]Require)
+	}
+	c.cache[key] = deps
+	c.mu.Unlock()
+	return deps, nil
+}
+
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not get %s from the module proxy: {{err}}", path), err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Could not get %s from the module proxy: got a %d response", path, resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s from the module proxy: {{err}}", path), err)
+	}
+	return b, nil
+}
+
+// escape encodes a module path or version the way the proxy protocol wants,
+// with each capital letter replaced by "!" and the lower case letter, since
+// not every filesystem is case sensitive.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package modgraph
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMods = map[string]string{
+	"/example.com/!big/@v/v2.0.0.mod": "module example.com/Big\n\nrequire example.com/a v1.0.0\n",
+	"/example.com/a/@v/v1.0.0.mod":    "module example.com/a\n\nrequire example.com/b v1.0.0\n",
+	// The main module selects v1.1.0 of b, which needs c.
+	"/example.com/b/@v/v1.1.0.mod": "module example.com/b\n\nrequire (\n\texample.com/c v1.0.0\n\texample.com/z v1.0.0 // indirect\n)\n",
+	"/example.com/b/@v/v1.0.0.mod": "module example.com/b\n",
+	"/example.com/c/@v/v1.0.0.mod": "module example.com/c\n",
+}
+
+func TestDepth(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if mod, ok := testMods[r.URL.Path]; ok {
+			w.Write([]byte(mod))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	assert.Nil(t, err)
+
+	requires := []Require{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/Big", Version: "v2.0.0"},
+		{Path: "example.com/b", Version: "v1.1.0", Indirect: true},
+		{Path: "example.com/gone", Version: "v0.1.0"},
+	}
+	depth, err := c.Depth(context.Background(), requires)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, depth, "a, then b, then c")
+
+	_, err = c.Depth(context.Background(), requires)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, requests, "go.mod files are cached")
+
+	depth, err = c.Depth(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, depth)
+
+	_, err = New("proxy.golang.org")
+	assert.Error(t, err)
+}
+
+func TestParseGoMod(t *testing.T) {
+	module, requires := ParseGoMod([]byte(`module "example.com/app"
+
+go 1.20
+
+require example.com/a v1.0.0 // indirect
+
+require (
+	example.com/b v1.2.3
+	example.com/c v0.1.0 //indirect; needed by b
+)
+
+replace example.com/b => ../b
+`))
+	assert.Equal(t, "example.com/app", module)
+	assert.Equal(
+		t,
+		[]Require{
+			{Path: "example.com/a", Version: "v1.0.0", Indirect: true},
+			{Path: "example.com/b", Version: "v1.2.3"},
+			{Path: "example.com/c", Version: "v0.1.0", Indirect: true},
+		},
+		requires,
+	)
+
+	assert.Equal(
+		t,
+		[]string{"example.com/a", "example.com/b"},
+		SumModules([]byte(`example.com/a v1.0.0 h1:abc=
+example.com/a v1.0.0/go.mod h1:def=
+example.com/b v1.2.3 h1:ghi=
+example.com/b v1.2.2 h1:jkl=
+example.com/c v0.1.0/go.mod h1:mno=
+`)),
+	)
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const elasticType = "item"
+
+// elasticStore keeps the queue in its own Elasticsearch index, which is handy
+// when several indexers share a cluster but not a filesystem.
+type elasticStore struct {
+	client *elc.Client
+	ctx    context.Context
+}
+
+func NewElasticStore(client *elc.Client, ctx context.Context) Store {
+	return &elasticStore{client: client, ctx: ctx}
+}
+
+func (es *elasticStore) Load() ([]*Item, error) {
+	exists, err := es.client.IndexExists(esmodels.Index("queue")).Do(es.ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("IndexExists: {{err}}", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	var items []*Item
+	scroll := es.client.Scroll(esmodels.Index("queue")).Type(es.client.SearchTypes(elasticType)...).Size(500)
+	for {
+		result, err := scroll.Do(es.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			i := &Item{}
+			err := json.Unmarshal(*hit.Source, i)
+			if err != nil {
+				return nil, errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+			items = append(items, i)
+		}
+	}
+
+	return items, nil
+}
+
+func (es *elasticStore) Save(i *Item) error {
+	_, err := es.client.
+		Index().
+		Index(esmodels.Index("queue")).
+		Type(es.client.Type(elasticType)).
+		Id(i.ID).
+		BodyJson(i).
+		Do(es.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Index: {{err}}", err)
+	}
+
+	return nil
+}
+
+func (es *elasticStore) Close() error {
+	return nil
+}
@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/autarch/metagodoc/indexer/filelock"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// fileStore keeps the queue in a file with one JSON-encoded item per line.
+// Every save appends a line, and the last line for an ID wins. The file is
+// compacted each time it is loaded, and whenever it gets too far ahead of
+// the items in it. See compactAfter.
+//
+// Compacting replaces the file, so a second process writing to it would
+// carry on appending to the old one and lose everything it saved. Loading the
+// store for writing takes a lock on the file, which fails if another process
+// holds it. Loading it read only doesn't, since that never writes.
+type fileStore struct {
+	path string
+	f    *os.File
+	lock *os.File
+	// Every item we've loaded or saved, in the order we first saw them, and
+	// how many lines the file has.
+	items map[string]*Item
+	order []string
+	lines int
+}
+
+// The file is compacted once it has this many lines per item. A daemon
+// saves every item several times a day, so without this the file would grow
+// until the next restart.
+const compactAfter = 10
+
+func NewFileStore(path string) (Store, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not create directory for %s: {{err}}", path), err)
+	}
+
+	return &fileStore{path: path}, nil
+}
+
+func (fs *fileStore) Load() ([]*Item, error) {
+	lock, err := filelock.Lock(fs.path + ".lock")
+	if e, ok := err.(*filelock.LockedError); ok {
+		return nil, fmt.Errorf("The queue in %s is in use by %s. Is another indexer using the same cache root?", fs.path, e.Owner())
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.lock = lock
+
+	items, err := fs.read()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.items = make(map[string]*Item)
+	for _, i := range items {
+		fs.items[i.ID] = i
+		fs.order = append(fs.order, i.ID)
+	}
+
+	err = fs.compact(items)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// LoadReadOnly reads the items without compacting the file or opening it for
+// appending, so that another process using the same file isn't disturbed.
+// The store can't save anything after this.
+func (fs *fileStore) LoadReadOnly() ([]*Item, error) {
+	return fs.read()
+}
+
+func (fs *fileStore) open() error {
+	f, err := os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not open %s: {{err}}", fs.path), err)
+	}
+	fs.f = f
+	return nil
+}
+
+func (fs *fileStore) read() ([]*Item, error) {
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not open %s: {{err}}", fs.path), err)
+	}
+	defer f.Close()
+
+	byID := make(map[string]*Item)
+	var order []string
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		i := &Item{}
+		err := json.Unmarshal(s.Bytes(), i)
+		if err != nil {
+			// A crash in the middle of a write can leave a partial last
+			// line, which we can safely ignore.
+			continue
+		}
+		if _, ok := byID[i.ID]; !ok {
+			order = append(order, i.ID)
+		}
+		byID[i.ID] = i
+	}
+	if err := s.Err(); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s: {{err}}", fs.path), err)
+	}
+
+	var items []*Item
+	for _, id := range order {
+		items = append(items, byID[id])
+	}
+
+	return items, nil
+}
+
+// compact rewrites the file with one line per item and opens it for
+// appending.
+func (fs *fileStore) compact(items []*Item) error {
+	if fs.f != nil {
+		fs.f.Close()
+		fs.f = nil
+	}
+
+	tmp := fs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not create %s: {{err}}", tmp), err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, i := range items {
+		if err := enc.Encode(i); err != nil {
+			f.Close()
+			return errwrap.Wrapf(fmt.Sprintf("Could not write to %s: {{err}}", tmp), err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errwrap.Wrapf(fmt.Sprintf("Could not write to %s: {{err}}", tmp), err)
+	}
+	if err := f.Close(); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not close %s: {{err}}", tmp), err)
+	}
+
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not rename %s: {{err}}", tmp), err)
+	}
+	fs.lines = len(items)
+
+	return fs.open()
+}
+
+// The queue saves items while holding its lock, and it saves the same items
+// it loaded or saved before, so compacting here writes the current state of
+// every item.
+func (fs *fileStore) Save(i *Item) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	_, err = fs.f.Write(append(b, '\n'))
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not write to %s: {{err}}", fs.path), err)
+	}
+	fs.lines++
+
+	if _, ok := fs.items[i.ID]; !ok {
+		fs.order = append(fs.order, i.ID)
+	}
+	fs.items[i.ID] = i
+
+	if fs.lines <= compactAfter*len(fs.items) {
+		return nil
+	}
+
+	items := make([]*Item, len(fs.order))
+	for n, id := range fs.order {
+		items[n] = fs.items[id]
+	}
+	return fs.compact(items)
+}
+
+func (fs *fileStore) Close() error {
+	if fs.lock != nil {
+		defer func() {
+			filelock.Unlock(fs.lock)
+			fs.lock = nil
+		}()
+	}
+	if fs.f == nil {
+		return nil
+	}
+	err := fs.f.Close()
+	fs.f = nil
+	return err
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"math"
+	"time"
+)
+
+// Stats are the things we know about a repository which affect how urgently
+// it should be crawled.
+type Stats struct {
+	Stars      int `json:"stars"`
+	ImportedBy int `json:"imported_by"`
+}
+
+// Weights control how much each factor contributes to an item's priority.
+// Stars and importers are counted on a log scale, since the difference
+// between 10 and 100 stars matters much more than the difference between
+// 10,000 and 10,090. Staleness is counted per week since the repository was
+// last crawled, or since it was added if it has never been crawled.
+type Weights struct {
+	Stars      float64
+	ImportedBy float64
+	Staleness  float64
+}
+
+var DefaultWeights = Weights{
+	Stars:      1,
+	ImportedBy: 1.5,
+	Staleness:  0.5,
+}
+
+const week = 7 * 24 * time.Hour
+
+// Priority returns the item's priority. Higher numbers are crawled first.
+// Items which were explicitly requested, which is indicated by a zero
+// NextCrawlAt, always come first.
+func (i *Item) Priority(w Weights, now time.Time) float64 {
+	if i.NextCrawlAt.IsZero() {
+		return math.Inf(1)
+	}
+
+	since := i.LastCrawled
+	if since.IsZero() {
+		since = i.Added
+	}
+	stale := float64(now.Sub(since)) / float64(week)
+	if stale < 0 {
+		stale = 0
+	}
+
+	return w.Stars*math.Log10(1+float64(i.Stars)) +
+		w.ImportedBy*math.Log10(1+float64(i.ImportedBy)) +
+		w.Staleness*stale
+}
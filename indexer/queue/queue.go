@@ -0,0 +1,563 @@
+// Package queue implements a durable queue of repositories to index. The
+// queue remembers the state of every repository it has seen, so work survives
+// restarts and each repository knows when it should next be crawled.
+package queue
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	Pending    State = "pending"
+	InProgress State = "in-progress"
+	Done       State = "done"
+	Failed     State = "failed"
+	// Items which failed too many times in a row. These aren't crawled
+	// again until someone calls Retry.
+	DeadLetter State = "dead-letter"
+)
+
+// How many past failures an item remembers.
+const maxFailureHistory = 10
+
+func (s State) String() string {
+	return string(s)
+}
+
+type Item struct {
+	// The repository ID, which is its URL without the scheme.
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	State     State  `json:"state"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	// More about the last error, if it came with more than a message.
+	LastFailure *Failure  `json:"last_failure,omitempty"`
+	Added       time.Time `json:"added"`
+	Updated     time.Time `json:"updated"`
+	LastCrawled time.Time `json:"last_crawled"`
+	NextCrawlAt time.Time `json:"next_crawl_at"`
+
+	// For repositories found through a vanity import path, like
+	// "gopkg.in/yaml.v2", this is that path. It's empty otherwise.
+	ImportPrefix string `json:"import_prefix,omitempty"`
+	// gopkg.in serves each major version of a repository under its own
+	// path, so a repository found as "gopkg.in/yaml.v2" may also be
+	// imported as "gopkg.in/yaml.v3". This has the paths other than
+	// ImportPrefix. See SetImportPrefix.
+	ImportPrefixes []string `json:"import_prefixes,omitempty"`
+	// The categories the repository is listed under in curated lists.
+	Categories []string `json:"categories,omitempty"`
+	// If the repository turned out to be another name for a repository we
+	// already know about, this is the ID of that repository.
+	CanonicalID string `json:"canonical_id,omitempty"`
+	// Refs to walk again on the next crawl even if they haven't changed.
+	// This is cleared once the item is done.
+	Reindex []string `json:"reindex,omitempty"`
+	// The most recent failures since the item was last done, oldest first.
+	Failures []*PastFailure `json:"failures,omitempty"`
+	// When the indexer last asked for this item to be recrawled because its
+	// document had gone stale. If it has been crawled or has failed since
+	// then, that attempt is how the indexer finds out whether the
+	// repository can still be crawled at all.
+	RecrawlRequested time.Time `json:"recrawl_requested"`
+	// When someone last asked for this item to be indexed right away. Any
+	// crawl which finishes or fails after this is the answer to that
+	// request.
+	IndexRequested time.Time `json:"index_requested"`
+
+	Stats
+}
+
+// A Failure records how the last attempt to index an item went wrong, beyond
+// the error message. An error passed to Fail can provide one by implementing
+// Failer.
+type Failure struct {
+	// The pipeline stage the error happened in.
+	Stage string `json:"stage"`
+	// Set if the error was a panic, along with where it happened.
+	Panic bool   `json:"panic,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// A PastFailure is an entry in an item's failure history.
+type PastFailure struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+	Stage string    `json:"stage,omitempty"`
+}
+
+type Failer interface {
+	Failure() *Failure
+}
+
+// A Store persists queue items. Save is called every time an item changes,
+// and Load is called once when the queue is created.
+type Store interface {
+	Load() ([]*Item, error)
+	Save(*Item) error
+	Close() error
+}
+
+type Queue struct {
+	store   Store
+	items   map[string]*Item
+	weights Weights
+	// The IDs of items by their dedup key. See SetKeyFunc.
+	keys    map[string]string
+	keyFunc func(string) string
+	// Zero means items are never dead-lettered.
+	maxFailures int
+	mu          sync.Mutex
+}
+
+// New returns a queue backed by the given store. Any items which were in
+// progress when the queue was last used are put back into the pending state,
+// since whatever was working on them is gone.
+func New(s Store) (*Queue, error) {
+	items, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		store:   s,
+		items:   make(map[string]*Item),
+		weights: DefaultWeights,
+		keys:    make(map[string]string),
+		keyFunc: func(id string) string { return id },
+	}
+	for _, i := range items {
+		q.items[i.ID] = i
+		q.addKey(i)
+		if i.State == InProgress {
+			i.State = Pending
+			if err := q.store.Save(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// SetWeights changes how items are prioritized.
+func (q *Queue) SetWeights(w Weights) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.weights = w
+}
+
+// SetMaxFailures sets how many times in a row an item can fail before it's
+// moved to the dead-letter state. Zero means it never is.
+func (q *Queue) SetMaxFailures(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxFailures = n
+}
+
+// SetKeyFunc sets the function which gives the dedup key for an ID. Items
+// with different IDs but the same key are the same repository, so Add won't
+// add a second one, and Get and the other methods which take an existing
+// item's ID find it by either ID. The default key is the ID itself.
+func (q *Queue) SetKeyFunc(f func(string) string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.keyFunc = f
+	q.keys = make(map[string]string)
+	for _, i := range q.items {
+		q.addKey(i)
+	}
+}
+
+// An alias shares its key with the item it's an alias of, and the key should
+// lead to the latter.
+func (q *Queue) addKey(i *Item) {
+	k := q.keyFunc(i.ID)
+	if id, ok := q.keys[k]; ok && q.items[id].CanonicalID == "" && i.CanonicalID != "" {
+		return
+	}
+	q.keys[k] = i.ID
+}
+
+// find returns the item with the ID, or failing that the item with the same
+// key.
+func (q *Queue) find(id string) (*Item, bool) {
+	if i, ok := q.items[id]; ok {
+		return i, true
+	}
+	i, ok := q.items[q.keys[q.keyFunc(id)]]
+	return i, ok
+}
+
+// Add puts a repository in the queue. If the queue already knows about the
+// repository this does nothing and returns false. The stats may be nil if
+// nothing is known about the repository yet.
+func (q *Queue) Add(id, url string, stats *Stats) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.find(id); ok {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	i := &Item{
+		ID:          id,
+		URL:         url,
+		State:       Pending,
+		Added:       now,
+		Updated:     now,
+		NextCrawlAt: now,
+	}
+	if stats != nil {
+		i.Stats = *stats
+	}
+	q.items[id] = i
+	q.addKey(i)
+
+	return true, q.store.Save(i)
+}
+
+// Schedule sets the time at which a repository should next be crawled,
+// adding it to the queue if needed. Items which are currently in progress are
+// left alone, since they will be rescheduled when they finish, and so are
+// dead-lettered items, apart from their stats. An item which is already due
+// keeps its time if that's earlier, so that a request for a crawl isn't put
+// off, and a failed item keeps its time if that's later, so that it still
+// backs off before being retried. The stats may be nil, in which
+// case the item's existing stats are kept. Unlike the other methods, this
+// only looks for an item with exactly this ID, so that a repository's
+// canonical ID can be scheduled before its old ID is made an alias of it.
+func (q *Queue) Schedule(id, url string, at time.Time, stats *Stats) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UTC()
+	i, ok := q.items[id]
+	if !ok {
+		i = &Item{
+			ID:    id,
+			URL:   url,
+			State: Pending,
+			Added: now,
+		}
+		q.items[id] = i
+		q.addKey(i)
+	} else if i.State == InProgress {
+		return nil
+	} else if i.State == DeadLetter {
+		if stats == nil || *stats == i.Stats {
+			return nil
+		}
+		at = i.NextCrawlAt
+	} else {
+		if i.State == Failed && i.NextCrawlAt.After(at) {
+			at = i.NextCrawlAt
+		} else if !i.NextCrawlAt.After(now) && i.NextCrawlAt.Before(at) {
+			at = i.NextCrawlAt
+		}
+		if i.NextCrawlAt.Equal(at.UTC()) && (stats == nil || *stats == i.Stats) {
+			return nil
+		}
+	}
+
+	i.NextCrawlAt = at.UTC()
+	i.Updated = now
+	if stats != nil {
+		i.Stats = *stats
+	}
+
+	return q.store.Save(i)
+}
+
+// Next claims the due item with the highest priority and marks it as in
+// progress. Ties are broken in favor of the item which has been due the
+// longest. It returns nil if no items are due.
+func (q *Queue) Next() (*Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var next *Item
+	var nextPriority float64
+	for _, i := range q.items {
+		if i.State == InProgress || i.State == DeadLetter || i.NextCrawlAt.After(now) {
+			continue
+		}
+		p := i.Priority(q.weights, now)
+		if next == nil || p > nextPriority || (p == nextPriority && i.NextCrawlAt.Before(next.NextCrawlAt)) {
+			next = i
+			nextPriority = p
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	next.State = InProgress
+	next.Attempts++
+	next.Updated = now.UTC()
+	if err := q.store.Save(next); err != nil {
+		return nil, err
+	}
+
+	c := *next
+	return &c, nil
+}
+
+// Done marks an item as successfully crawled and schedules its next crawl.
+// The stats may be nil, in which case the item's existing stats are kept.
+func (q *Queue) Done(id string, next time.Time, stats *Stats) error {
+	return q.update(id, func(i *Item) {
+		i.State = Done
+		i.Attempts = 0
+		i.LastError = ""
+		i.LastFailure = nil
+		i.Failures = nil
+		i.Reindex = nil
+		i.LastCrawled = time.Now().UTC()
+		i.NextCrawlAt = next.UTC()
+		if stats != nil {
+			i.Stats = *stats
+		}
+	})
+}
+
+// SetImportPrefix records the vanity import path for an item. A new path
+// replaces the old one, unless they're both gopkg.in paths, which are for
+// different major versions of the same repository, in which case the new one
+// is added to ImportPrefixes. This does nothing if the item is not in the
+// queue.
+func (q *Queue) SetImportPrefix(id, prefix string) error {
+	return q.updateIf(id, func(i *Item) bool {
+		if i.ImportPrefix == prefix || containsString(i.ImportPrefixes, prefix) {
+			return false
+		}
+		if isGopkgIn(i.ImportPrefix) && isGopkgIn(prefix) {
+			i.ImportPrefixes = append(i.ImportPrefixes, prefix)
+			return true
+		}
+		i.ImportPrefix = prefix
+		i.ImportPrefixes = nil
+		return true
+	})
+}
+
+func isGopkgIn(prefix string) bool {
+	return strings.HasPrefix(prefix, "gopkg.in/")
+}
+
+// Alias marks an item as being another name for the repository with the
+// canonical ID. The item is kept so that discovering the old name again
+// doesn't put it back in the queue, but we do check it again at the given
+// time in case the name is reused.
+func (q *Queue) Alias(id, canonicalID string, next time.Time) error {
+	return q.update(id, func(i *Item) {
+		i.State = Done
+		i.Attempts = 0
+		i.LastError = ""
+		i.Failures = nil
+		i.CanonicalID = canonicalID
+		i.LastCrawled = time.Now().UTC()
+		i.NextCrawlAt = next.UTC()
+		if c, ok := q.items[canonicalID]; ok {
+			q.addKey(c)
+		}
+	})
+}
+
+// AddCategory records a curated list category for an item. This does nothing
+// if the item is not in the queue or already has the category.
+func (q *Queue) AddCategory(id, category string) error {
+	q.mu.Lock()
+	i, ok := q.find(id)
+	if ok {
+		for _, c := range i.Categories {
+			if c == category {
+				ok = false
+				break
+			}
+		}
+	}
+	q.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return q.update(id, func(i *Item) {
+		i.Categories = append(i.Categories, category)
+	})
+}
+
+// Fail marks an item as failed, recording the error, and schedules it to be
+// retried. If the item has now failed too many times in a row it's moved to
+// the dead-letter state instead, and Fail returns true.
+func (q *Queue) Fail(id string, err error, retry time.Time) (bool, error) {
+	dead := false
+	uerr := q.update(id, func(i *Item) {
+		i.State = Failed
+		i.LastError = err.Error()
+		i.LastFailure = nil
+		if f, ok := err.(Failer); ok {
+			i.LastFailure = f.Failure()
+		}
+		i.NextCrawlAt = retry.UTC()
+
+		pf := &PastFailure{At: time.Now().UTC(), Error: i.LastError}
+		if i.LastFailure != nil {
+			pf.Stage = i.LastFailure.Stage
+		}
+		i.Failures = append(i.Failures, pf)
+		if len(i.Failures) > maxFailureHistory {
+			i.Failures = i.Failures[len(i.Failures)-maxFailureHistory:]
+		}
+
+		// Attempts only goes back to zero once the item is done, so it's
+		// how many times in a row it has failed, this time included.
+		if q.maxFailures > 0 && i.Attempts >= q.maxFailures {
+			i.State = DeadLetter
+			dead = true
+		}
+	})
+	return dead, uerr
+}
+
+// RequestRecrawl records when a recrawl was asked for, see
+// Item.RecrawlRequested. It doesn't schedule the item, since Schedule does
+// that.
+func (q *Queue) RequestRecrawl(id string, at time.Time) error {
+	return q.update(id, func(i *Item) {
+		i.RecrawlRequested = at.UTC()
+	})
+}
+
+// RequestIndex records when someone asked for an item to be indexed right
+// away, see Item.IndexRequested. Like RequestRecrawl, it doesn't schedule the
+// item.
+func (q *Queue) RequestIndex(id string, at time.Time) error {
+	return q.update(id, func(i *Item) {
+		i.IndexRequested = at.UTC()
+	})
+}
+
+// Retry takes an item out of the dead-letter state and makes it due right
+// away. It gets the full number of attempts again, but keeps its failure
+// history until it's done. This returns false if the item isn't dead-lettered.
+func (q *Queue) Retry(id string) (bool, error) {
+	retried := false
+	err := q.update(id, func(i *Item) {
+		if i.State != DeadLetter {
+			return
+		}
+		i.State = Pending
+		i.Attempts = 0
+		i.NextCrawlAt = time.Now().UTC()
+		retried = true
+	})
+	return retried, err
+}
+
+// Reindex asks for the given refs of an item to be walked again, and makes
+// it due right away unless it's in progress. A dead-lettered item stays that
+// way until it's retried. This does nothing if the item is not in the queue.
+func (q *Queue) Reindex(id string, refs []string) error {
+	return q.update(id, func(i *Item) {
+		for _, r := range refs {
+			if !containsString(i.Reindex, r) {
+				i.Reindex = append(i.Reindex, r)
+			}
+		}
+		if i.State != InProgress {
+			i.NextCrawlAt = time.Now().UTC()
+		}
+	})
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Release puts an item which is in progress back into the pending state
+// without counting the attempt, for when the crawl is stopped part way
+// through it. It's due again right away.
+func (q *Queue) Release(id string) error {
+	return q.update(id, func(i *Item) {
+		if i.State != InProgress {
+			return
+		}
+		i.State = Pending
+		if i.Attempts > 0 {
+			i.Attempts--
+		}
+	})
+}
+
+func (q *Queue) update(id string, f func(*Item)) error {
+	return q.updateIf(id, func(i *Item) bool {
+		f(i)
+		return true
+	})
+}
+
+// updateIf is like update, but the item is only saved if f returns true.
+func (q *Queue) updateIf(id string, f func(*Item) bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i, ok := q.find(id)
+	if !ok || !f(i) {
+		return nil
+	}
+
+	i.Updated = time.Now().UTC()
+	return q.store.Save(i)
+}
+
+// Get returns a copy of the item with the given ID, or nil if it is not in
+// the queue.
+func (q *Queue) Get(id string) *Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i, ok := q.find(id)
+	if !ok {
+		return nil
+	}
+
+	c := *i
+	return &c
+}
+
+// Items returns copies of every item in the queue, sorted by ID.
+func (q *Queue) Items() []*Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var items []*Item
+	for _, i := range q.items {
+		c := *i
+		items = append(items, &c)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+	return items
+}
+
+func (q *Queue) Close() error {
+	return q.store.Close()
+}
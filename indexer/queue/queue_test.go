@@ -0,0 +1,375 @@
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newFileQueue(t *testing.T, dir string) *Queue {
+	s, err := NewFileStore(filepath.Join(dir, "queue.jsonl"))
+	must(t, err)
+	q, err := New(s)
+	must(t, err)
+	return q
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+
+	added, err := q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+	assert.True(t, added, "new item is added")
+
+	added, err = q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+	assert.False(t, added, "existing item is not added twice")
+
+	_, err = q.Add("github.com/foo/baz", "https://github.com/foo/baz", nil)
+	must(t, err)
+
+	first, err := q.Next()
+	must(t, err)
+	if !assert.NotNil(t, first) {
+		return
+	}
+	assert.Equal(t, "github.com/foo/bar", first.ID, "oldest item comes first")
+	assert.Equal(t, InProgress, first.State)
+	assert.Equal(t, 1, first.Attempts)
+
+	second, err := q.Next()
+	must(t, err)
+	if !assert.NotNil(t, second) {
+		return
+	}
+	assert.Equal(t, "github.com/foo/baz", second.ID)
+
+	none, err := q.Next()
+	must(t, err)
+	assert.Nil(t, none, "nothing is due while both items are in progress")
+
+	must(t, q.Done(first.ID, time.Now().Add(time.Hour), nil))
+	dead, err := q.Fail(second.ID, errors.New("boom"), time.Now().Add(-time.Second))
+	must(t, err)
+	assert.False(t, dead, "nothing is dead-lettered without a limit")
+
+	retry, err := q.Next()
+	must(t, err)
+	if !assert.NotNil(t, retry) {
+		return
+	}
+	assert.Equal(t, second.ID, retry.ID, "failed item is retried once due")
+	assert.Equal(t, "boom", retry.LastError)
+	assert.Equal(t, 2, retry.Attempts)
+
+	// A released item is due again without the attempt counting.
+	must(t, q.Release(retry.ID))
+	released, err := q.Next()
+	must(t, err)
+	if !assert.NotNil(t, released) {
+		return
+	}
+	assert.Equal(t, retry.ID, released.ID)
+	assert.Equal(t, 2, released.Attempts)
+
+	must(t, q.Close())
+
+	// The in-progress item should go back to pending when the queue is
+	// reloaded.
+	q = newFileQueue(t, dir)
+	defer q.Close()
+
+	items := q.Items()
+	if !assert.Len(t, items, 2) {
+		return
+	}
+	assert.Equal(t, Done, items[0].State)
+	assert.Equal(t, Pending, items[1].State)
+	assert.Equal(t, "boom", items[1].LastError)
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+	q.SetMaxFailures(2)
+
+	_, err = q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+
+	fail := func(msg string) bool {
+		i, err := q.Next()
+		must(t, err)
+		if !assert.NotNil(t, i) {
+			t.FailNow()
+		}
+		dead, err := q.Fail(i.ID, errors.New(msg), time.Now().Add(-time.Second))
+		must(t, err)
+		return dead
+	}
+
+	assert.False(t, fail("first"))
+	assert.True(t, fail("second"), "the second failure in a row dead-letters the item")
+
+	i := q.Get("github.com/foo/bar")
+	assert.Equal(t, DeadLetter, i.State)
+	if assert.Len(t, i.Failures, 2) {
+		assert.Equal(t, "first", i.Failures[0].Error)
+		assert.Equal(t, "second", i.Failures[1].Error)
+	}
+
+	none, err := q.Next()
+	must(t, err)
+	assert.Nil(t, none, "dead-lettered items are not crawled even when due")
+
+	must(t, q.Schedule(i.ID, i.URL, time.Now().Add(-time.Hour), nil))
+	must(t, q.Reindex(i.ID, []string{"master"}))
+	assert.Equal(t, DeadLetter, q.Get(i.ID).State, "scheduling does not bring an item back")
+
+	retried, err := q.Retry(i.ID)
+	must(t, err)
+	assert.True(t, retried)
+	retried, err = q.Retry(i.ID)
+	must(t, err)
+	assert.False(t, retried, "only dead-lettered items can be retried")
+
+	assert.False(t, fail("third"), "a retried item gets the full number of attempts again")
+	assert.Len(t, q.Get(i.ID).Failures, 3, "the history is kept across retries")
+
+	next, err := q.Next()
+	must(t, err)
+	must(t, q.Done(next.ID, time.Now().Add(time.Hour), nil))
+	assert.Empty(t, q.Get(i.ID).Failures, "the history is cleared once the item is done")
+}
+
+func TestQueueScheduleKeepsRequestsAndBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+
+	later := time.Now().Add(24 * time.Hour)
+
+	failed := "github.com/foo/failed"
+	_, err = q.Add(failed, "https://"+failed, nil)
+	must(t, err)
+	i, err := q.Next()
+	must(t, err)
+	retry := time.Now().Add(time.Hour).UTC()
+	_, err = q.Fail(i.ID, errors.New("boom"), retry)
+	must(t, err)
+	must(t, q.Schedule(failed, "https://"+failed, time.Now().Add(-time.Hour), nil))
+	assert.True(t, q.Get(failed).NextCrawlAt.Equal(retry), "a failed item keeps backing off")
+
+	must(t, q.Schedule(failed, "https://"+failed, later, nil))
+	assert.True(t, q.Get(failed).NextCrawlAt.Equal(later.UTC()), "a failed item can be put off further")
+
+	done := "github.com/foo/done"
+	_, err = q.Add(done, "https://"+done, nil)
+	must(t, err)
+	i, err = q.Next()
+	must(t, err)
+	must(t, q.Done(i.ID, time.Now().Add(time.Hour), nil))
+	must(t, q.Schedule(done, "https://"+done, later, nil))
+	assert.True(t, q.Get(done).NextCrawlAt.Equal(later.UTC()), "an item which isn't due yet is rescheduled")
+
+	requested := "github.com/foo/requested"
+	must(t, q.Schedule(requested, "https://"+requested, time.Time{}, nil))
+	must(t, q.Schedule(requested, "https://"+requested, later, nil))
+	assert.True(t, q.Get(requested).NextCrawlAt.IsZero(), "a requested crawl is not put off")
+}
+
+func TestQueuePriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+
+	_, err = q.Add("github.com/foo/obscure", "https://github.com/foo/obscure", &Stats{Stars: 1})
+	must(t, err)
+	_, err = q.Add("github.com/foo/popular", "https://github.com/foo/popular", &Stats{Stars: 5000})
+	must(t, err)
+	_, err = q.Add("github.com/foo/imported", "https://github.com/foo/imported", &Stats{Stars: 10, ImportedBy: 2000})
+	must(t, err)
+	must(t, q.Schedule("github.com/foo/requested", "https://github.com/foo/requested", time.Time{}, nil))
+
+	var order []string
+	for {
+		i, err := q.Next()
+		must(t, err)
+		if i == nil {
+			break
+		}
+		order = append(order, i.ID)
+	}
+
+	assert.Equal(
+		t,
+		[]string{
+			"github.com/foo/requested",
+			"github.com/foo/imported",
+			"github.com/foo/popular",
+			"github.com/foo/obscure",
+		},
+		order,
+		"items come off the queue in priority order",
+	)
+}
+
+func TestQueueImportPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+
+	id := "github.com/go-yaml/yaml"
+	_, err = q.Add(id, "https://"+id, nil)
+	must(t, err)
+	must(t, q.SetImportPrefix(id, "gopkg.in/yaml.v2"))
+	must(t, q.SetImportPrefix(id, "gopkg.in/yaml.v3"))
+	must(t, q.SetImportPrefix(id, "gopkg.in/yaml.v3"))
+	i := q.Get(id)
+	assert.Equal(t, "gopkg.in/yaml.v2", i.ImportPrefix)
+	assert.Equal(t, []string{"gopkg.in/yaml.v3"}, i.ImportPrefixes, "each major version's path is kept")
+
+	must(t, q.SetImportPrefix(id, "yaml.example.com"))
+	i = q.Get(id)
+	assert.Equal(t, "yaml.example.com", i.ImportPrefix)
+	assert.Empty(t, i.ImportPrefixes, "any other path replaces them all")
+}
+
+func TestQueueKeyFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+	q.SetKeyFunc(strings.ToLower)
+
+	added, err := q.Add("github.com/BurntSushi/toml", "https://github.com/BurntSushi/toml", nil)
+	must(t, err)
+	assert.True(t, added)
+	added, err = q.Add("github.com/burntsushi/toml", "https://github.com/burntsushi/toml", nil)
+	must(t, err)
+	assert.False(t, added, "an ID with the same key is the same item")
+
+	i := q.Get("github.com/burntsushi/toml")
+	if assert.NotNil(t, i) {
+		assert.Equal(t, "github.com/BurntSushi/toml", i.ID, "the item keeps its own ID")
+	}
+	must(t, q.AddCategory("github.com/burntsushi/toml", "Configuration"))
+	assert.Equal(t, []string{"Configuration"}, q.Get("github.com/BurntSushi/toml").Categories)
+
+	// A repository found under the wrong case first is aliased to its
+	// canonical ID once we know it, and the key leads to the canonical item.
+	_, err = q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+	must(t, q.Schedule("github.com/Foo/Bar", "https://github.com/Foo/Bar", time.Now(), nil))
+	must(t, q.Alias("github.com/foo/bar", "github.com/Foo/Bar", time.Now().Add(time.Hour)))
+	assert.Equal(t, "github.com/Foo/Bar", q.Get("github.com/FOO/bar").ID)
+	assert.Equal(t, "github.com/foo/bar", q.Get("github.com/foo/bar").ID, "an exact ID still finds its own item")
+	assert.Len(t, q.Items(), 3)
+}
+
+func TestFileStoreCompacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	_, err = q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+	_, err = q.Add("github.com/foo/baz", "https://github.com/foo/baz", nil)
+	must(t, err)
+
+	for n := 0; n < 50; n++ {
+		i, err := q.Next()
+		must(t, err)
+		must(t, q.Done(i.ID, time.Now(), nil))
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "queue.jsonl"))
+	must(t, err)
+	lines := strings.Count(string(b), "\n")
+	assert.True(t, lines <= compactAfter*2, "the file is compacted as items are saved (%d lines)", lines)
+
+	must(t, q.Close())
+	q = newFileQueue(t, dir)
+	items := q.Items()
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, "github.com/foo/bar", items[0].ID)
+		assert.Equal(t, "github.com/foo/baz", items[1].ID)
+		assert.Equal(t, Done, items[0].State)
+	}
+}
+
+func TestReadOnlyFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-queue")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newFileQueue(t, dir)
+	defer q.Close()
+	_, err = q.Add("github.com/foo/bar", "https://github.com/foo/bar", nil)
+	must(t, err)
+	_, err = q.Next()
+	must(t, err)
+
+	path := filepath.Join(dir, "queue.jsonl")
+	before, err := os.Stat(path)
+	must(t, err)
+
+	s, err := NewFileStore(path)
+	must(t, err)
+	ro, err := New(ReadOnly(s))
+	must(t, err)
+	defer ro.Close()
+	assert.Equal(t, Pending, ro.Get("github.com/foo/bar").State)
+
+	after, err := os.Stat(path)
+	must(t, err)
+	assert.True(t, os.SameFile(before, after), "the file isn't replaced")
+	assert.Equal(t, before.Size(), after.Size(), "nothing is written to the file")
+
+	// The queue which owns the file can still write to it, and nothing else
+	// can until it's closed.
+	i := q.Get("github.com/foo/bar")
+	must(t, q.Done(i.ID, time.Now(), nil))
+	s, err = NewFileStore(path)
+	must(t, err)
+	_, err = New(s)
+	if assert.Error(t, err, "the file is locked") {
+		assert.Contains(t, err.Error(), "Is another indexer using the same cache root?")
+	}
+
+	must(t, q.Close())
+	reloaded := newFileQueue(t, dir)
+	defer reloaded.Close()
+	assert.Equal(t, Done, reloaded.Get("github.com/foo/bar").State)
+}
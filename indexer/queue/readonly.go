@@ -0,0 +1,30 @@
+package queue
+
+// ReadOnly wraps a store so that the queue starts with everything in it but
+// never writes anything back. Changes only live as long as the queue does.
+// If the store has its own way of loading without writing anything, such as
+// the file store compacting its file, that's used instead of Load.
+func ReadOnly(s Store) Store {
+	return &readOnlyStore{s}
+}
+
+type readOnlyStore struct {
+	Store
+}
+
+// A readOnlyLoader is a store which normally writes something when it's
+// loaded.
+type readOnlyLoader interface {
+	LoadReadOnly() ([]*Item, error)
+}
+
+func (s *readOnlyStore) Load() ([]*Item, error) {
+	if l, ok := s.Store.(readOnlyLoader); ok {
+		return l.LoadReadOnly()
+	}
+	return s.Store.Load()
+}
+
+func (s *readOnlyStore) Save(*Item) error {
+	return nil
+}
@@ -0,0 +1,233 @@
+// Package ratelimit spaces out requests to each host we crawl. Every host
+// gets a minimum interval between requests, which applies to API calls as
+// well as clones and fetches. Big hosts like GitHub can take a lot more than
+// someone's self-hosted server, so the interval can be set per host.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// The interval used for hosts with no specific setting.
+const DefaultInterval = 2 * time.Second
+
+// DefaultIntervals are the per host intervals used unless they're overridden.
+// GitHub enforces its own API rate limits, which the crawler already respects,
+// so we only need to keep from hammering it.
+var DefaultIntervals = map[string]time.Duration{
+	"github.com":     250 * time.Millisecond,
+	"api.github.com": 250 * time.Millisecond,
+}
+
+type Limiter struct {
+	def       time.Duration
+	intervals map[string]time.Duration
+	// The earliest time at which the next request to each host may be made.
+	next map[string]time.Time
+	mu   sync.Mutex
+
+	// Slots for clones and API calls in progress, across every host. These
+	// are nil when there's no limit. See SetConcurrency.
+	clones chan struct{}
+	calls  chan struct{}
+}
+
+// New returns a limiter using the given intervals for each host, falling back
+// to def for hosts which are not listed.
+func New(def time.Duration, intervals map[string]time.Duration) *Limiter {
+	l := &Limiter{
+		def:       def,
+		intervals: make(map[string]time.Duration),
+		next:      make(map[string]time.Time),
+	}
+	for h, i := range intervals {
+		l.intervals[strings.ToLower(h)] = i
+	}
+	return l
+}
+
+// Parse builds a limiter from a comma-separated list of host=duration pairs,
+// like "github.com=100ms,git.example.com=10s". A pair with the host "*" sets
+// the default interval. Anything not set in the string uses the package
+// defaults.
+func Parse(s string) (*Limiter, error) {
+	def := DefaultInterval
+	intervals := make(map[string]time.Duration)
+	for h, i := range DefaultIntervals {
+		intervals[h] = i
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid rate limit %q, expected host=duration", pair)
+		}
+
+		i, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid rate limit %q: {{err}}", pair), err)
+		}
+
+		host := strings.TrimSpace(kv[0])
+		if host == "*" {
+			def = i
+		} else {
+			intervals[host] = i
+		}
+	}
+
+	return New(def, intervals), nil
+}
+
+// Interval returns the minimum interval between requests to the host.
+func (l *Limiter) Interval(host string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.interval(host)
+}
+
+func (l *Limiter) interval(host string) time.Duration {
+	if i, ok := l.intervals[strings.ToLower(host)]; ok {
+		return i
+	}
+	return l.def
+}
+
+// Wait blocks until a request may be made to the host, or the context is
+// done. Each call claims a slot, so concurrent callers are spaced out rather
+// than all being woken at once.
+func (l *Limiter) Wait(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.interval(host))
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetIntervals replaces the limiter's intervals with the ones from other,
+// like when the rate limits are reloaded. Requests which are already waiting
+// keep the time they were given.
+func (l *Limiter) SetIntervals(other *Limiter) {
+	other.mu.Lock()
+	def, intervals := other.def, other.intervals
+	other.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def = def
+	l.intervals = intervals
+}
+
+// SetConcurrency limits how many clones and API calls may be in progress at
+// once, across every host, when several repositories are indexed at the same
+// time. A limit of 0 means there's no limit. This can be called again while
+// the limiter is in use, in which case clones and calls already in progress
+// count against the old limits until they're done.
+func (l *Limiter) SetConcurrency(clones, calls int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clones, l.calls = nil, nil
+	if clones > 0 {
+		l.clones = make(chan struct{}, clones)
+	}
+	if calls > 0 {
+		l.calls = make(chan struct{}, calls)
+	}
+}
+
+func (l *Limiter) slots() (clones, calls chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clones, l.calls
+}
+
+// InUse returns how many clones and API calls are in progress, and the limits
+// on them. This is only known when there's a limit, so otherwise everything
+// is 0.
+func (l *Limiter) InUse() (clones, maxClones, calls, maxCalls int) {
+	c, a := l.slots()
+	return len(c), cap(c), len(a), cap(a)
+}
+
+// StartClone blocks until a clone or fetch may start, or the context is
+// done. The returned function must be called when the clone is finished.
+func (l *Limiter) StartClone(ctx context.Context) (func(), error) {
+	clones, _ := l.slots()
+	return acquire(ctx, clones)
+}
+
+func acquire(ctx context.Context, slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Transport returns an http.RoundTripper which waits for the limiter before
+// passing each request on to base. If base is nil then
+// http.DefaultTransport is used.
+func (l *Limiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{l: l, base: base}
+}
+
+type transport struct {
+	l    *Limiter
+	base http.RoundTripper
+}
+
+// The API call's slot is released once the response headers arrive, rather
+// than when the body is read, which is close enough for API responses.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, calls := t.l.slots()
+	done, err := acquire(req.Context(), calls)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := t.l.Wait(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	l, err := Parse("*=5s, git.example.com=10s,github.com=1s")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 5*time.Second, l.Interval("example.org"), "default interval")
+	assert.Equal(t, 10*time.Second, l.Interval("Git.Example.com"), "hosts are case insensitive")
+	assert.Equal(t, time.Second, l.Interval("github.com"), "overrides package default")
+	assert.Equal(t, DefaultIntervals["api.github.com"], l.Interval("api.github.com"), "package default")
+
+	_, err = Parse("github.com")
+	assert.Error(t, err, "missing duration")
+
+	_, err = Parse("github.com=soon")
+	assert.Error(t, err, "invalid duration")
+}
+
+func TestWait(t *testing.T) {
+	l := New(50*time.Millisecond, map[string]time.Duration{"fast.example.com": 0})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.Wait(ctx, "slow.example.com"))
+	}
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "third request waits for two intervals")
+
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.Wait(ctx, "fast.example.com"))
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "hosts are limited independently")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	l.Wait(ctx, "other.example.com")
+	assert.Error(t, l.Wait(ctx, "other.example.com"), "cancelled context stops the wait")
+}
+
+func TestStartClone(t *testing.T) {
+	l := New(0, nil)
+	done, err := l.StartClone(context.Background())
+	assert.NoError(t, err)
+	done()
+
+	l.SetConcurrency(1, 0)
+	done, err = l.StartClone(context.Background())
+	assert.NoError(t, err)
+	clones, maxClones, calls, maxCalls := l.InUse()
+	assert.Equal(t, []int{1, 1, 0, 0}, []int{clones, maxClones, calls, maxCalls})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.StartClone(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "only one clone at a time")
+
+	done()
+	done, err = l.StartClone(context.Background())
+	assert.NoError(t, err, "the slot is free once the first clone is done")
+	done()
+}
+
+func TestReconfigure(t *testing.T) {
+	l := New(time.Second, nil)
+	l.SetConcurrency(1, 0)
+	held, err := l.StartClone(context.Background())
+	assert.NoError(t, err)
+
+	// The clone in progress counts against the old limit, not the new one.
+	l.SetConcurrency(0, 0)
+	done, err := l.StartClone(context.Background())
+	assert.NoError(t, err, "no limit after reconfiguring")
+	done()
+	held()
+
+	other, err := Parse("*=5s,example.com=1ms")
+	assert.NoError(t, err)
+	l.SetIntervals(other)
+	assert.Equal(t, 5*time.Second, l.Interval("example.org"))
+	assert.Equal(t, time.Millisecond, l.Interval("example.com"))
+}
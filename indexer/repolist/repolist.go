@@ -0,0 +1,149 @@
+// Package repolist implements lists of repository ID patterns, such as the
+// list of repositories the indexer should skip.
+//
+// A list is loaded from a YAML file containing a sequence of entries:
+//
+//   - pattern: github.com/*/awesome-*
+//     reason: Lists of links, not code
+//   - pattern: /^github\.com/[^/]+/.+-slides$/
+//     reason: Slide decks
+//     expires: 2019-06-01
+//
+// Patterns are matched against the repository ID, which is its URL without
+// the scheme. A pattern wrapped in slashes is a regular expression and
+// anything else is a glob as understood by path.Match. A glob ending in "/..."
+// matches everything beneath the rest of the glob, but not what the rest
+// matches itself, so "git.example.com/team/..." matches any repository under
+// that path but not git.example.com/team. An entry with an expiry date stops matching
+// once that date has passed.
+package repolist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const dateFormat = "2006-01-02"
+
+type Entry struct {
+	Pattern string `yaml:"pattern"`
+	Reason  string `yaml:"reason"`
+	// In YYYY-MM-DD format.
+	Expires string `yaml:"expires,omitempty"`
+
+	re      *regexp.Regexp
+	expires time.Time
+}
+
+type List struct {
+	Entries []*Entry
+}
+
+// Load reads a list from the YAML file at the given path.
+func Load(path string) (*List, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s: {{err}}", path), err)
+	}
+
+	l, err := Parse(b)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Invalid list in %s: {{err}}", path), err)
+	}
+
+	return l, nil
+}
+
+// Parse parses a list from YAML.
+func Parse(b []byte) (*List, error) {
+	var entries []*Entry
+	err := yaml.UnmarshalStrict(b, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(entries)
+}
+
+// New returns a list containing the given entries, checking that each
+// pattern and expiry date is valid.
+func New(entries []*Entry) (*List, error) {
+	for _, e := range entries {
+		if e.Pattern == "" {
+			return nil, fmt.Errorf("Entry has no pattern (reason: %q)", e.Reason)
+		}
+
+		if len(e.Pattern) > 2 && strings.HasPrefix(e.Pattern, "/") && strings.HasSuffix(e.Pattern, "/") {
+			re, err := regexp.Compile(e.Pattern[1 : len(e.Pattern)-1])
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("Invalid regexp %s: {{err}}", e.Pattern), err)
+			}
+			e.re = re
+		} else if _, err := path.Match(e.Pattern, ""); err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid glob %s: {{err}}", e.Pattern), err)
+		}
+
+		if e.Expires != "" {
+			t, err := time.Parse(dateFormat, e.Expires)
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("Invalid expiry date for %s: {{err}}", e.Pattern), err)
+			}
+			e.expires = t
+		}
+	}
+
+	return &List{Entries: entries}, nil
+}
+
+// Match returns the first unexpired entry which matches the given repository
+// ID, or nil if none match.
+func (l *List) Match(id string) *Entry {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for _, e := range l.Entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			continue
+		}
+		if e.matches(id) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// ExpiresAt returns the time at which the entry stops matching. This is the
+// zero time for entries that never expire.
+func (e *Entry) ExpiresAt() time.Time {
+	return e.expires
+}
+
+func (e *Entry) matches(id string) bool {
+	if e.re != nil {
+		return e.re.MatchString(id)
+	}
+
+	if prefix := strings.TrimSuffix(e.Pattern, "/..."); prefix != e.Pattern {
+		// Try the prefix against each leading part of the ID.
+		parts := strings.Split(id, "/")
+		for i := 1; i < len(parts); i++ {
+			if m, _ := path.Match(prefix, strings.Join(parts[:i], "/")); m {
+				return true
+			}
+		}
+		return false
+	}
+
+	m, _ := path.Match(e.Pattern, id)
+	return m
+}
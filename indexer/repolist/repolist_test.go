@@ -0,0 +1,53 @@
+package repolist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testList = `
+- pattern: github.com/*/awesome-*
+  reason: Lists of links
+- pattern: /^github\.com/[^/]+/.+-slides$/
+  reason: Slide decks
+- pattern: github.com/foo/old
+  reason: Expired
+  expires: 2001-01-01
+- pattern: git.example.com/*/team/...
+  reason: Everything under a path
+`
+
+func TestMatch(t *testing.T) {
+	l, err := Parse([]byte(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := l.Match("github.com/avelino/awesome-go"); assert.NotNil(t, e, "glob matches") {
+		assert.Equal(t, "Lists of links", e.Reason)
+	}
+	if e := l.Match("github.com/someone/gophercon-slides"); assert.NotNil(t, e, "regexp matches") {
+		assert.Equal(t, "Slide decks", e.Reason)
+	}
+	assert.Nil(t, l.Match("github.com/avelino/awesome-go/sub"), "glob does not match across slashes")
+	assert.Nil(t, l.Match("github.com/foo/old"), "expired entry does not match")
+	assert.Nil(t, l.Match("github.com/stretchr/testify"), "unlisted repository does not match")
+	assert.NotNil(t, l.Match("git.example.com/corp/team/a/b"), "prefix matches everything beneath it")
+	assert.Nil(t, l.Match("git.example.com/corp/team"), "prefix does not match itself")
+	assert.Nil(t, l.Match("git.example.com/corp/teams/a"), "prefix only matches whole path elements")
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte(`- reason: no pattern`))
+	assert.Error(t, err, "entry without a pattern")
+
+	_, err = Parse([]byte(`- pattern: /(/`))
+	assert.Error(t, err, "invalid regexp")
+
+	_, err = Parse([]byte("- pattern: foo\n  expires: tomorrow"))
+	assert.Error(t, err, "invalid expiry date")
+
+	_, err = Parse([]byte("- pattern: foo\n  colour: blue"))
+	assert.Error(t, err, "unknown field")
+}
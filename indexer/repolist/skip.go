@@ -0,0 +1,15 @@
+package repolist
+
+// DefaultSkipList is used when no skip list file is configured.
+func DefaultSkipList() *List {
+	l, err := New([]*Entry{
+		{Pattern: "github.com/GoesToEleven/GolangTraining", Reason: "A slide deck"},
+		{Pattern: "github.com/qiniu/gobook", Reason: "Contains an invalid .go file with no package"},
+		{Pattern: "github.com/adonovan/gopl.io", Reason: "A book"},
+		{Pattern: "github.com/aws/aws-sdk-go", Reason: "Too large to index"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
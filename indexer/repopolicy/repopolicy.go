@@ -0,0 +1,195 @@
+// Package repopolicy overrides how particular repositories are indexed. The
+// usual settings suit most repositories, but not giant monorepos, which are
+// better off with only some of their packages indexed. Overrides are set with
+// a YAML file containing a sequence of rules:
+//
+//   - pattern: github.com/kubernetes/kubernetes
+//     include: [staging/src/k8s.io/...]
+//     branches: [release-1.30]
+//   - pattern: github.com/example/...
+//     exclude: [examples, examples/..., hack]
+//     inactive_after: 8760h
+//     index_internal: true
+//
+// Patterns work just like those in a repolist, and the first matching rule
+// wins. The include and exclude patterns work the same way, except that
+// they're matched against a directory's path in the repository, like
+// "staging/src/k8s.io/api", which is empty for the top of the repository.
+// Since "x/..." only matches what's beneath x, x itself needs an entry of its
+// own, as with examples above. Anything a rule leaves out uses the indexer's
+// usual settings. Which tags are indexed is up to the tag policies instead,
+// see the tagpolicy package.
+package repopolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/repolist"
+
+	"github.com/hashicorp/errwrap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type Policy struct {
+	// Branches to index as well as the default branch, if they exist.
+	Branches []string `yaml:"branches,omitempty"`
+	// If this is set then only packages in matching directories are
+	// indexed.
+	Include []string `yaml:"include,omitempty"`
+	// Matching directories aren't walked at all, so nothing beneath them is
+	// indexed either.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// How long the default branch can go without a commit before the
+	// repository counts as having no recent commits. Zero means the usual two
+	// years.
+	InactiveAfter time.Duration `yaml:"inactive_after,omitempty"`
+	// These override the indexer's IndexInternal, IndexTestdata, and
+	// SummarizeVendor settings. See repository.Settings.
+	IndexInternal   *bool `yaml:"index_internal,omitempty"`
+	IndexTestdata   *bool `yaml:"index_testdata,omitempty"`
+	SummarizeVendor *bool `yaml:"summarize_vendor,omitempty"`
+
+	include *repolist.List
+	exclude *repolist.List
+}
+
+// Default returns the policy for repositories which no rule matches, which
+// changes nothing.
+func Default() *Policy {
+	return &Policy{}
+}
+
+func (p *Policy) compile() error {
+	if p.InactiveAfter < 0 {
+		return fmt.Errorf("inactive_after cannot be negative")
+	}
+	for _, b := range p.Branches {
+		if b == "" || strings.HasPrefix(b, "-") || strings.Contains(b, "..") {
+			return fmt.Errorf("Invalid branch name %q", b)
+		}
+	}
+
+	var err error
+	p.include, err = dirList(p.Include)
+	if err != nil {
+		return errwrap.Wrapf("Invalid include pattern: {{err}}", err)
+	}
+	p.exclude, err = dirList(p.Exclude)
+	if err != nil {
+		return errwrap.Wrapf("Invalid exclude pattern: {{err}}", err)
+	}
+	return nil
+}
+
+func dirList(patterns []string) (*repolist.List, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var entries []*repolist.Entry
+	for _, p := range patterns {
+		entries = append(entries, &repolist.Entry{Pattern: p})
+	}
+	return repolist.New(entries)
+}
+
+// Includes returns true if the package in dir should be indexed. The
+// directory is relative to the top of the repository, with or without a
+// leading slash. Like the other methods, this is fine to call on a nil
+// policy, which is the same as the default.
+func (p *Policy) Includes(dir string) bool {
+	if p == nil || p.include == nil {
+		return true
+	}
+	return p.include.Match(strings.TrimPrefix(dir, "/")) != nil
+}
+
+// Excludes returns true if dir shouldn't be walked at all.
+func (p *Policy) Excludes(dir string) bool {
+	if p == nil {
+		return false
+	}
+	return p.exclude.Match(strings.TrimPrefix(dir, "/")) != nil
+}
+
+// String returns a description of the policy which changes whenever the
+// policy does, for the repository's content hash.
+func (p *Policy) String() string {
+	if p == nil {
+		p = Default()
+	}
+	b, err := yaml.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+type rule struct {
+	Pattern string `yaml:"pattern"`
+	Policy  `yaml:",inline"`
+}
+
+// Rules picks the policy for each repository.
+type Rules struct {
+	list     *repolist.List
+	policies map[*repolist.Entry]*Policy
+}
+
+// Load reads rules from the YAML file at the given path. If the path is empty
+// then every repository gets the default policy.
+func Load(path string) (*Rules, error) {
+	if path == "" {
+		return &Rules{}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s: {{err}}", path), err)
+	}
+
+	r, err := ParseRules(b)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Invalid repository policies in %s: {{err}}", path), err)
+	}
+	return r, nil
+}
+
+// ParseRules parses rules from YAML.
+func ParseRules(b []byte) (*Rules, error) {
+	var rules []*rule
+	err := yaml.UnmarshalStrict(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rules{policies: make(map[*repolist.Entry]*Policy)}
+	var entries []*repolist.Entry
+	for _, ru := range rules {
+		p := ru.Policy
+		err := p.compile()
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid policy for %s: {{err}}", ru.Pattern), err)
+		}
+
+		e := &repolist.Entry{Pattern: ru.Pattern}
+		entries = append(entries, e)
+		r.policies[e] = &p
+	}
+
+	r.list, err = repolist.New(entries)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// For returns the policy for the repository with the given ID.
+func (r *Rules) For(id string) *Policy {
+	if e := r.list.Match(id); e != nil {
+		return r.policies[e]
+	}
+	return Default()
+}
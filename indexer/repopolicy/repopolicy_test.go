@@ -0,0 +1,62 @@
+package repopolicy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `
+- pattern: github.com/kubernetes/kubernetes
+  include: [staging/src/k8s.io/...]
+  exclude: [staging/src/k8s.io/kubectl/...]
+  branches: [release-1.30]
+- pattern: github.com/example/...
+  inactive_after: 8760h
+  index_internal: true
+`
+
+func TestRules(t *testing.T) {
+	r, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k8s := r.For("github.com/kubernetes/kubernetes")
+	assert.Equal(t, []string{"release-1.30"}, k8s.Branches)
+	assert.True(t, k8s.Includes("/staging/src/k8s.io/api/core"))
+	assert.False(t, k8s.Includes("pkg/kubelet"))
+	assert.False(t, k8s.Includes(""), "the top of the repository isn't included")
+	assert.True(t, k8s.Excludes("staging/src/k8s.io/kubectl/pkg"))
+	assert.False(t, k8s.Excludes("staging/src/k8s.io/api"))
+	assert.False(t, k8s.Excludes("staging/src/k8s.io/kubectl"), "x/... doesn't match x")
+
+	ex := r.For("github.com/example/thing")
+	assert.Equal(t, 365*24*time.Hour, ex.InactiveAfter)
+	if assert.NotNil(t, ex.IndexInternal) {
+		assert.True(t, *ex.IndexInternal)
+	}
+	assert.Nil(t, ex.IndexTestdata)
+	assert.True(t, ex.Includes("anything"), "everything is included without include patterns")
+	assert.NotEqual(t, k8s.String(), ex.String())
+
+	def := r.For("github.com/foo/bar")
+	assert.Equal(t, Default(), def)
+	assert.False(t, def.Excludes("vendor"))
+
+	empty, err := Load("")
+	if assert.Nil(t, err) {
+		assert.Equal(t, Default(), empty.For("github.com/foo/bar"))
+	}
+
+	for _, bad := range []string{
+		"- pattern: github.com/foo/bar\n  inactive_after: -1h\n",
+		"- pattern: github.com/foo/bar\n  branches: [--upload-pack=evil]\n",
+		"- pattern: github.com/foo/bar\n  include: ['/[/']\n",
+		"- pattern: github.com/foo/bar\n  tags: [v1.0.0]\n",
+	} {
+		_, err = ParseRules([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
@@ -7,6 +7,7 @@ const (
 	DeadEndFork                    = "dead-end-fork"     // Forks with no commits
 	QuickFork                      = "quick-fork"        // Forks with less than 3 commits, all within a week from creation
 	NoRecentCommits                = "no-recent-commits" // No commits for ExpiresAfter
+	Empty                          = "empty"             // No commits on the default branch, so nothing to index
 
 	// No commits for ExpiresAfter and no imports.
 	// This is a status derived from NoRecentCommits and the imports count information in the db.
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Any file at least this big counts as a binary artifact, whatever it is.
+const largeFileBytes = 10 << 20
+
+// We only keep this many of the paths of a repository's binary artifacts.
+const maxBinaryArtifacts = 50
+
+// A repository which had binary artifacts when it was last crawled is
+// fetched with no more than this many commits of history, since its full
+// history has every version of every binary that was ever committed. See
+// Settings.FetchDepth.
+const binaryArtifactsFetchDepth = 100
+
+// The first bytes of executables, object files, and archives: ELF, Mach-O
+// (both byte orders and sizes, and universal binaries, which share their
+// magic number with Java class files), PE, WebAssembly, and ar.
+var binaryMagic = [][]byte{
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+	{0xca, 0xfe, 0xba, 0xbe},
+	[]byte("MZ"),
+	[]byte("\x00asm"),
+	[]byte("!<arch>\n"),
+}
+
+// binaryArtifacts returns the paths of the compiled binaries and very large
+// files checked out under root, relative to it and sorted, with at most
+// maxBinaryArtifacts of them. Binaries in testdata directories are usually
+// there on purpose, for tests of code which reads them, so only their size
+// counts against them.
+func binaryArtifacts(root string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.Size() >= largeFileBytes {
+			paths = append(paths, rel)
+			return nil
+		}
+		if strings.HasPrefix(rel, "testdata/") || strings.Contains(rel, "/testdata/") {
+			return nil
+		}
+		binary, err := isBinary(path)
+		if err != nil {
+			return err
+		}
+		if binary {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	if len(paths) > maxBinaryArtifacts {
+		paths = paths[:maxBinaryArtifacts]
+	}
+	return paths, nil
+}
+
+func isBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 8)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	for _, m := range binaryMagic {
+		if bytes.HasPrefix(head[:n], m) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// A checkpoint records the refs we have finished indexing for a repository.
+// If the indexer dies part way through a repository then the next attempt can
+// pick up the completed refs from the checkpoint instead of checking out and
+// walking each one again. The checkpoint is removed once the repository has
+// been written to Elasticsearch.
+//
+// A checkpoint is a directory with a file for each completed ref, so saving a
+// ref only writes that ref, however many refs the repository has.
+type checkpoint struct {
+	l   *logger.Logger
+	dir string
+	// If this is set then the checkpoint is read but never written or
+	// removed. See Settings.DryRun.
+	dryRun bool
+	// Keyed by ref name.
+	Refs map[string]*checkpointRef
+
+	// Refs are walked concurrently, see newTagRefs.
+	mu sync.Mutex
+}
+
+// A ref's packages aren't included when it's encoded as JSON, so we store
+// them alongside it.
+type checkpointRef struct {
+	*esmodels.Ref
+	Packages []*esmodels.Package `json:"packages"`
+}
+
+// checkpointPath returns the checkpoint directory for a repository. Clones
+// are shared by every tenant using the cache root, but what each tenant has
+// indexed isn't, so each tenant has its own checkpoints.
+func checkpointPath(cacheRoot, id string) string {
+	if t := esmodels.Tenant(); t != "" {
+		return filepath.Join(cacheRoot, "tenants", t, "checkpoints", id)
+	}
+	return filepath.Join(cacheRoot, "checkpoints", id)
+}
+
+// loadCheckpoint reads the checkpoint in the given directory. A missing
+// checkpoint just means we start from scratch, and a corrupt ref file means
+// that ref is walked again.
+func loadCheckpoint(l *logger.Logger, dir string, dryRun bool) *checkpoint {
+	cp := &checkpoint{
+		l:      l,
+		dir:    dir,
+		dryRun: dryRun,
+		Refs:   make(map[string]*checkpointRef),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.Infof("Could not read checkpoint at %s: %s", dir, err)
+		}
+		return cp
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			l.Infof("Could not read checkpoint at %s: %s", path, err)
+			continue
+		}
+		r := &checkpointRef{}
+		err = json.Unmarshal(b, r)
+		if err != nil || r.Ref == nil {
+			l.Infof("Ignoring corrupt checkpoint at %s", path)
+			continue
+		}
+		cp.Refs[r.Name] = r
+	}
+
+	if len(cp.Refs) > 0 {
+		l.Infof("Resuming from checkpoint with %d completed refs", len(cp.Refs))
+	}
+	return cp
+}
+
+// ref returns the checkpointed ref with the given name if it was indexed at
+// the given commit.
+func (cp *checkpoint) ref(name, commit string) *esmodels.Ref {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	r, ok := cp.Refs[name]
+	if !ok || r.Ref == nil || r.LastSeenCommit != commit {
+		return nil
+	}
+	r.Ref.Packages = r.Packages
+	return r.Ref
+}
+
+// save records a completed ref and writes it to its file in the checkpoint.
+// The write goes to a temp file first so that a crash never leaves a partial
+// file. Ref names can contain slashes, so they're escaped in file names.
+func (cp *checkpoint) save(r *esmodels.Ref) {
+	cp.mu.Lock()
+	cr := &checkpointRef{Ref: r, Packages: r.Packages}
+	cp.Refs[r.Name] = cr
+	cp.mu.Unlock()
+	if cp.dryRun {
+		return
+	}
+
+	b, err := json.Marshal(cr)
+	if err != nil {
+		cp.l.Infof("Could not encode checkpoint: %s", err)
+		return
+	}
+
+	err = os.MkdirAll(cp.dir, 0755)
+	if err != nil {
+		cp.l.Infof("Could not create checkpoint directory: %s", err)
+		return
+	}
+
+	path := filepath.Join(cp.dir, url.PathEscape(r.Name)+".json")
+	tmp, err := ioutil.TempFile(cp.dir, "tmp")
+	if err != nil {
+		cp.l.Infof("Could not write checkpoint to %s: %s", path, err)
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		cp.l.Infof("Could not write checkpoint to %s: %s", path, err)
+	}
+}
+
+func (cp *checkpoint) remove() error {
+	if cp.dryRun {
+		return nil
+	}
+	return os.RemoveAll(cp.dir)
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-checkpoint")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	dir := checkpointPath(root, "github.com/example/thing")
+	cp := loadCheckpoint(l, dir, false)
+	cp.save(&esmodels.Ref{Name: "v1.0.0", LastSeenCommit: "abc"})
+	cp.save(&esmodels.Ref{
+		Name:           "feature/x",
+		LastSeenCommit: "def",
+		Packages:       []*esmodels.Package{{ImportPath: "github.com/example/thing"}},
+	})
+
+	files, err := ioutil.ReadDir(dir)
+	must(t, err)
+	assert.Len(t, files, 2, "each ref has its own file")
+
+	cp = loadCheckpoint(l, dir, false)
+	assert.NotNil(t, cp.ref("v1.0.0", "abc"))
+	assert.Nil(t, cp.ref("v1.0.0", "123"), "a ref at another commit isn't resumed")
+	if r := cp.ref("feature/x", "def"); assert.NotNil(t, r) {
+		assert.Len(t, r.Packages, 1, "packages are kept with the ref")
+	}
+
+	must(t, cp.remove())
+	assert.False(t, pathExists(dir))
+
+	cp = loadCheckpoint(l, dir, true)
+	cp.save(&esmodels.Ref{Name: "v1.0.0", LastSeenCommit: "abc"})
+	assert.NotNil(t, cp.ref("v1.0.0", "abc"))
+	assert.False(t, pathExists(dir), "a dry run doesn't write checkpoints")
+
+	must(t, esmodels.SetTenant("ghe"))
+	defer esmodels.SetTenant("")
+	assert.NotEqual(t, dir, checkpointPath(root, "github.com/example/thing"), "each tenant has its own checkpoints")
+	assert.Equal(
+		t,
+		filepath.Join(root, "tenants", "ghe", "checkpoints", "github.com/example/thing"),
+		checkpointPath(root, "github.com/example/thing"),
+	)
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+)
+
+// Each clone has a file in its .git directory recording its size. The file's
+// modification time is when the clone was last used.
+const usageFile = "metagodoc-usage"
+
+// The clones being indexed right now, which are never evicted. Clones are
+// shared by every repository with the same cache root, so this is global. We
+// hold the lock for each clone in use, see clonelock.go.
+//
+// A clone which is being evicted is in evicting until it's gone, and anyone
+// who wants it waits for the channel to be closed and then clones it again.
+// Deleting a clone can take a long time, so it's done without holding mu.
+var clones = struct {
+	inUse    map[string]int
+	locks    map[string]*os.File
+	evicting map[string]chan struct{}
+	// Only one eviction runs at a time, since they'd all pick victims from
+	// the same total. This is set while one is running.
+	evictRunning bool
+	mu           sync.Mutex
+}{inUse: make(map[string]int), locks: make(map[string]*os.File), evicting: make(map[string]chan struct{})}
+
+// useClone marks the clone at dir as in use, which fails if another process
+// is using it. The returned function must be called once the clone isn't
+// needed any more. It records the clone's size and last use, and then evicts
+// other clones if we're over the quota, which is unlimited if it's 0. See
+// Settings.CloneQuota.
+func useClone(l *logger.Logger, reposRoot, dir string, cloneQuota int64) (func(), error) {
+	clones.mu.Lock()
+	for clones.evicting[dir] != nil {
+		evicted := clones.evicting[dir]
+		clones.mu.Unlock()
+		<-evicted
+		clones.mu.Lock()
+	}
+	if clones.inUse[dir] == 0 {
+		f, err := lockClone(dir)
+		if err != nil {
+			clones.mu.Unlock()
+			return nil, err
+		}
+		clones.locks[dir] = f
+	}
+	clones.inUse[dir]++
+	clones.mu.Unlock()
+
+	return func() {
+		recordUsage(l, dir)
+
+		clones.mu.Lock()
+		clones.inUse[dir]--
+		if clones.inUse[dir] == 0 {
+			delete(clones.inUse, dir)
+			unlockClone(clones.locks[dir])
+			delete(clones.locks, dir)
+		}
+		clones.mu.Unlock()
+
+		if cloneQuota > 0 {
+			evictClones(l, reposRoot, cloneQuota)
+		}
+	}, nil
+}
+
+// removeStaleLocks deletes the lock files left in the clone at dir by git
+// commands which were killed part way through, like when a crawl is
+// cancelled or a repository times out. Every later command in the clone fails
+// until they're gone. This is only safe if nothing else is using the clone,
+// so nothing is removed if it's in use more than once.
+func removeStaleLocks(l *logger.Logger, dir string) {
+	clones.mu.Lock()
+	defer clones.mu.Unlock()
+	if clones.inUse[dir] > 1 {
+		return
+	}
+
+	gitDir := filepath.Join(dir, ".git")
+	filepath.Walk(gitDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// There are a lot of objects, and git never locks them.
+		if info.IsDir() && path == filepath.Join(gitDir, "objects") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		l.Infof("Removing %s, which was left by an interrupted git command", path)
+		err = os.Remove(path)
+		if err != nil {
+			l.Warnf("Could not remove %s: %s", path, err)
+		}
+		return nil
+	})
+}
+
+func recordUsage(l *logger.Logger, dir string) {
+	if !pathExists(filepath.Join(dir, ".git")) {
+		return
+	}
+
+	size := strconv.FormatInt(dirBytes(dir), 10)
+	err := ioutil.WriteFile(filepath.Join(dir, ".git", usageFile), []byte(size), 0644)
+	if err != nil {
+		l.Infof("Could not record clone usage for %s: %s", dir, err)
+	}
+}
+
+type cachedClone struct {
+	dir      string
+	bytes    int64
+	lastUsed time.Time
+	// The clone's lock, which is held while it's deleted.
+	lock *os.File
+}
+
+// evictClones deletes the least recently used clones under root, except for
+// those in use by this process or any other, until the total size is no more
+// than the quota. The victims are picked and locked while holding clones.mu,
+// and then deleted without it, so other workers can carry on using their
+// clones in the meantime. If another eviction is already running this does
+// nothing, since that one will get us under the quota.
+func evictClones(l *logger.Logger, root string, quota int64) {
+	clones.mu.Lock()
+	running := clones.evictRunning
+	clones.evictRunning = true
+	clones.mu.Unlock()
+	if running {
+		return
+	}
+	defer func() {
+		clones.mu.Lock()
+		clones.evictRunning = false
+		clones.mu.Unlock()
+	}()
+
+	var all []*cachedClone
+	var total int64
+	for _, dir := range findClones(root) {
+		c := &cachedClone{dir: dir}
+		info, err := os.Stat(filepath.Join(dir, ".git", usageFile))
+		if err == nil {
+			c.lastUsed = info.ModTime()
+			b, _ := ioutil.ReadFile(filepath.Join(dir, ".git", usageFile))
+			c.bytes, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		}
+		// Clones made before we tracked usage count as the oldest.
+		if c.bytes == 0 {
+			c.bytes = dirBytes(dir)
+		}
+		total += c.bytes
+		all = append(all, c)
+	}
+	if total <= quota {
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].lastUsed.Before(all[j].lastUsed) })
+	var victims []*cachedClone
+	clones.mu.Lock()
+	for _, c := range all {
+		if total <= quota {
+			break
+		}
+		if clones.inUse[c.dir] > 0 {
+			continue
+		}
+		f, err := lockClone(c.dir)
+		if err != nil {
+			continue
+		}
+		c.lock = f
+		clones.evicting[c.dir] = make(chan struct{})
+		victims = append(victims, c)
+		total -= c.bytes
+	}
+	clones.mu.Unlock()
+
+	for _, c := range victims {
+		l.Infof("Evicting the clone at %s to stay under the clone cache quota", c.dir)
+		err := os.RemoveAll(c.dir)
+		if err == nil {
+			os.RemoveAll(c.dir + ".worktrees")
+		} else {
+			l.Errorf("Could not remove %s: %s", c.dir, err)
+		}
+		unlockClone(c.lock)
+
+		clones.mu.Lock()
+		close(clones.evicting[c.dir])
+		delete(clones.evicting, c.dir)
+		clones.mu.Unlock()
+	}
+}
+
+// RemoveClone deletes everything in the cache for the repository with the
+// given ID, which is its clone, worktrees, exported trees, and checkpoint.
+// It's not an error if there's nothing there. A clone which is in use, by this
+// process or another one, can't be removed.
+func RemoveClone(cacheRoot, id string) error {
+	if id == "" || filepath.IsAbs(id) || strings.Contains("/"+filepath.ToSlash(id)+"/", "/../") {
+		return fmt.Errorf("Invalid repository ID: %s", id)
+	}
+	dir := filepath.Join(cacheRoot, "repos", id)
+
+	clones.mu.Lock()
+	defer clones.mu.Unlock()
+
+	if clones.inUse[dir] > 0 {
+		return fmt.Errorf("The clone of %s is in use", id)
+	}
+	f, err := lockClone(dir)
+	if err != nil {
+		return err
+	}
+	defer unlockClone(f)
+
+	for _, path := range []string{dir, dir + ".worktrees", dir + ".export", checkpointPath(cacheRoot, id)} {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findClones returns every directory under root with a .git directory in it.
+// A clone's worktrees and exported trees are next to it, and never contain
+// clones themselves.
+func findClones(root string) []string {
+	var dirs []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".worktrees") || strings.HasSuffix(path, ".export") {
+			return filepath.SkipDir
+		}
+		if pathExists(filepath.Join(path, ".git")) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs
+}
+
+func dirBytes(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
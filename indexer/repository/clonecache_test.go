@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvictClones(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-clones")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	// Each clone is 100 bytes, and a is the least recently used.
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c", "d"} {
+		dir := filepath.Join(root, "github.com", "example", name)
+		write(t, filepath.Join(dir, "file"), strings.Repeat("x", 100))
+		must(t, os.MkdirAll(filepath.Join(dir, ".git"), 0755))
+		usage := filepath.Join(dir, ".git", usageFile)
+		write(t, usage, "100")
+		used := now.Add(time.Duration(i) * time.Hour)
+		must(t, os.Chtimes(usage, used, used))
+	}
+
+	// An exported tree isn't a clone, even if it has a .git in it.
+	write(t, filepath.Join(root, "github.com", "example", "d.export", ".git", "HEAD"), "ref: refs/heads/master\n")
+	assert.Len(t, findClones(root), 4)
+
+	done := mustUseClone(t, l, root, filepath.Join(root, "github.com", "example", "b"))
+
+	evictClones(l, root, 200)
+
+	assert.False(t, pathExists(filepath.Join(root, "github.com", "example", "a")), "least recently used clone is evicted")
+	assert.True(t, pathExists(filepath.Join(root, "github.com", "example", "b")), "clone in use is kept")
+	assert.False(t, pathExists(filepath.Join(root, "github.com", "example", "c")), "next least recently used clone is evicted")
+	assert.True(t, pathExists(filepath.Join(root, "github.com", "example", "d")))
+
+	done()
+	assert.Empty(t, clones.inUse)
+}
+
+func TestRemoveClone(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-clones")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "repos", "github.com", "example", "thing")
+	write(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/master\n")
+	write(t, filepath.Join(dir+".worktrees", "0", "a.go"), "package a\n")
+	write(t, filepath.Join(dir+".export", "a.go"), "package a\n")
+	write(t, filepath.Join(checkpointPath(root, "github.com/example/thing"), "master.json"), "{}")
+	other := filepath.Join(root, "repos", "github.com", "example", "thing2")
+	write(t, filepath.Join(other, ".git", "HEAD"), "ref: refs/heads/master\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	done := mustUseClone(t, l, filepath.Join(root, "repos"), dir)
+	assert.Error(t, RemoveClone(root, "github.com/example/thing"), "a clone in use is kept")
+	done()
+
+	must(t, RemoveClone(root, "github.com/example/thing"))
+	for _, path := range []string{dir, dir + ".worktrees", dir + ".export", checkpointPath(root, "github.com/example/thing")} {
+		assert.False(t, pathExists(path), path)
+	}
+	assert.True(t, pathExists(other), "other clones are left alone")
+
+	must(t, RemoveClone(root, "github.com/example/gone"))
+	assert.Error(t, RemoveClone(root, "github.com/../../etc"))
+}
+
+func TestRemoveStaleLocks(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-clones")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "github.com", "example", "thing")
+	locks := []string{
+		filepath.Join(dir, ".git", "index.lock"),
+		filepath.Join(dir, ".git", "refs", "remotes", "origin", "master.lock"),
+	}
+	for _, path := range locks {
+		write(t, path, "")
+	}
+	write(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/master\n")
+	pack := filepath.Join(dir, ".git", "objects", "pack", "tmp.lock")
+	write(t, pack, "")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	// Another user of the clone may be running git right now.
+	done := mustUseClone(t, l, root, dir)
+	other := mustUseClone(t, l, root, dir)
+	removeStaleLocks(l, dir)
+	assert.True(t, pathExists(locks[0]), "locks are kept while the clone is in use elsewhere")
+	other()
+
+	removeStaleLocks(l, dir)
+	done()
+	for _, path := range locks {
+		assert.False(t, pathExists(path), path)
+	}
+	assert.True(t, pathExists(filepath.Join(dir, ".git", "HEAD")))
+	assert.True(t, pathExists(pack), "objects are left alone")
+}
+
+func mustUseClone(t *testing.T, l *logger.Logger, reposRoot, dir string) func() {
+	done, err := useClone(l, reposRoot, dir, 0)
+	must(t, err)
+	return done
+}
+
+func TestCloneLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-clones")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	dir := filepath.Join(root, "github.com", "example", "thing")
+	write(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/master\n")
+
+	// Opening the lock file again stands in for another process.
+	f, err := lockClone(dir)
+	must(t, err)
+	_, err = useClone(l, root, dir, 0)
+	if assert.IsType(t, &CloneLockedError{}, err) {
+		assert.Equal(t, os.Getpid(), err.(*CloneLockedError).PID)
+		assert.Contains(t, err.Error(), "same cache root")
+	}
+	assert.Empty(t, clones.inUse, "a clone we couldn't lock isn't in use")
+
+	evictClones(l, root, 1)
+	assert.True(t, pathExists(dir), "a clone locked by another process isn't evicted")
+	unlockClone(f)
+
+	done := mustUseClone(t, l, root, dir)
+	again := mustUseClone(t, l, root, dir)
+	_, err = lockClone(dir)
+	assert.Error(t, err, "the lock is held while the clone is in use")
+	again()
+	_, err = lockClone(dir)
+	assert.Error(t, err, "until every user is done with it")
+	done()
+
+	f, err = lockClone(dir)
+	must(t, err)
+	unlockClone(f)
+}
+
+func TestUseCloneWaitsForEviction(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-clones")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	dir := filepath.Join(root, "github.com", "example", "thing")
+	evicted := make(chan struct{})
+	clones.mu.Lock()
+	clones.evicting[dir] = evicted
+	clones.mu.Unlock()
+
+	used := make(chan func())
+	go func() {
+		done, err := useClone(l, root, dir, 0)
+		assert.Nil(t, err)
+		used <- done
+	}()
+
+	select {
+	case <-used:
+		t.Fatal("a clone being evicted was used")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clones.mu.Lock()
+	close(evicted)
+	delete(clones.evicting, dir)
+	clones.mu.Unlock()
+
+	done := <-used
+	done()
+	assert.Empty(t, clones.inUse)
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/autarch/metagodoc/indexer/filelock"
+)
+
+// Clones are shared by every indexer with the same cache root, not just the
+// workers in one process, and two processes fetching into or checking out the
+// same clone at once leave it corrupted. So while a process is using a clone
+// it holds an advisory lock on a file next to it, and any other process which
+// wants the clone gets a CloneLockedError instead. See filelock.
+type CloneLockedError struct {
+	Dir string
+	// The process holding the lock, if we could tell.
+	PID int
+}
+
+func (e *CloneLockedError) Error() string {
+	owner := (&filelock.LockedError{PID: e.PID}).Owner()
+	return fmt.Sprintf("The clone at %s is locked by %s. Is another indexer using the same cache root?", e.Dir, owner)
+}
+
+func lockPath(dir string) string {
+	return dir + ".lock"
+}
+
+// lockClone takes the lock for the clone at dir without waiting for it.
+func lockClone(dir string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := filelock.Lock(lockPath(dir))
+	if e, ok := err.(*filelock.LockedError); ok {
+		return nil, &CloneLockedError{Dir: dir, PID: e.PID}
+	}
+	return f, err
+}
+
+func unlockClone(f *os.File) {
+	filelock.Unlock(f)
+}
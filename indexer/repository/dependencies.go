@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/modgraph"
+)
+
+// dependencies counts the dependencies of every module the walker found. If
+// the proxy can't be reached we just log it and leave out the depth.
+func (w *walker) dependencies() *esmodels.Dependencies {
+	if len(w.goMods) == 0 {
+		return nil
+	}
+
+	own := make(map[string]bool)
+	var requires [][]modgraph.Require
+	var sums [][]string
+	for _, path := range w.goMods {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			w.l.Warnf("Could not read %s: %s", path, err)
+			continue
+		}
+		module, reqs := modgraph.ParseGoMod(b)
+		own[module] = true
+		requires = append(requires, reqs)
+
+		sumPath := filepath.Join(filepath.Dir(path), "go.sum")
+		b, err = ioutil.ReadFile(sumPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				w.l.Warnf("Could not read %s: %s", sumPath, err)
+			}
+			continue
+		}
+		sums = append(sums, modgraph.SumModules(b))
+	}
+
+	direct := make(map[string]bool)
+	total := make(map[string]bool)
+	for _, reqs := range requires {
+		for _, r := range reqs {
+			if own[r.Path] {
+				continue
+			}
+			total[r.Path] = true
+			if !r.Indirect {
+				direct[r.Path] = true
+			}
+		}
+	}
+	for _, paths := range sums {
+		for _, p := range paths {
+			if !own[p] {
+				total[p] = true
+			}
+		}
+	}
+
+	deps := &esmodels.Dependencies{Direct: len(direct), Total: len(total)}
+	moduleProxy := w.settings.ModuleProxy
+	if moduleProxy == nil {
+		return deps
+	}
+	for _, reqs := range requires {
+		var external []modgraph.Require
+		for _, r := range reqs {
+			if !own[r.Path] {
+				external = append(external, r)
+			}
+		}
+		depth, err := moduleProxy.Depth(w.ctx, external)
+		if err != nil {
+			w.l.Warnf("Could not follow dependencies: %s", err)
+			deps.MaxDepth = 0
+			break
+		}
+		if depth > deps.MaxDepth {
+			deps.MaxDepth = depth
+		}
+	}
+	return deps
+}
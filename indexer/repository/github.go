@@ -3,22 +3,35 @@ package repository
 import (
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/autarch/metagodoc/doc"
 	"github.com/autarch/metagodoc/esmodels"
-	"github.com/autarch/metagodoc/indexer/directory"
+	"github.com/autarch/metagodoc/indexer/importpath"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
 	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
+	"github.com/autarch/metagodoc/tracing"
 
 	"code.gitea.io/git"
-	"github.com/golang/gddo/gosrc"
 	"github.com/google/go-github/github"
+	"github.com/hashicorp/errwrap"
 	version "github.com/hashicorp/go-version"
 )
 
@@ -27,9 +40,57 @@ type githubRepository struct {
 	githubRepo   *github.Repository
 	githubClient *github.Client
 	clone        *git.Repository
+	limiter      *ratelimit.Limiter
 	ctx          context.Context
 	isGoCore     bool
+	reposRoot    string
 	cloneRoot    string
+	checkpoint   *checkpoint
+	packages     *packageCache
+	settings     Settings
+
+	// True for the Go repository itself and the golang.org/x repositories.
+	isGoProject bool
+
+	// The refs from the last crawl, keyed by name.
+	previousRefs map[string]*esmodels.Ref
+	// Refs which are walked again whether or not they've changed. See
+	// SetReindex.
+	reindex map[string]bool
+
+	// Which version tags are indexed.
+	tagPolicy *tagpolicy.Policy
+	// Overrides for which branches and packages are indexed. See SetPolicy.
+	policy *repopolicy.Policy
+
+	// The creation dates of every version tag, gathered by getRefs.
+	releaseDates []time.Time
+	// The newest version tags, also found by getRefs. See latestVersions.
+	latestVersion       string
+	latestStableVersion string
+
+	// How much the clone grew when we cloned or fetched it.
+	fetchedBytes int64
+	// Whether the repository had binary artifacts when it was last
+	// crawled. See fetchDepth.
+	hadBinaryArtifacts bool
+
+	// Releases the clone once ESModel is done with it. See Fetch.
+	releaseClone func()
+
+	// The output of ls-remote. See lsRemote.
+	remoteRefs string
+
+	// True if the default branch has no commits, which is the case for a
+	// newly created repository. There's nothing to clone then.
+	empty bool
+
+	// The branch we treat as the default. See resolveDefaultBranch.
+	defaultBranch string
+
+	// Adding and pruning worktrees rewrite the clone's worktree list, so
+	// only one worker may do either at a time.
+	worktreeMu sync.Mutex
 
 	// A unique ID for the repository based on its URL without the scheme. So
 	// for a GitHub repo like "https://github.com/stretchr/testify" this would
@@ -37,74 +98,241 @@ type githubRepository struct {
 	// for individual packages.
 	id string
 
+	// The import path of the root package. This is the same as the ID unless
+	// the repository is imported through a vanity path like
+	// "gopkg.in/yaml.v2".
+	importRoot string
+	// The gopkg.in paths for the repository's other major versions. See
+	// importRootFor.
+	versionedRoots []string
+
 	// Version control system: git, hg, bzr, ...
 	VCS esmodels.VCSType
 }
 
-var skipList map[string]bool = map[string]bool{
-	// A slide deck?
-	"github.com/GoesToEleven/GolangTraining": true,
-	"github.com/golang/go":                   true,
-	// Contains invalid .go file (no package).
-	"github.com/qiniu/gobook": true,
-	// // A book.
-	"github.com/adonovan/gopl.io": true,
-	"github.com/aws/aws-sdk-go":   true,
-}
-
 func NewGitHubRepository(
 	l *logger.Logger,
 	ghr *github.Repository,
 	github *github.Client,
 	cacheRoot string,
+	limiter *ratelimit.Limiter,
+	settings Settings,
 	ctx context.Context,
 ) (*githubRepository, error) {
 
-	id := regexp.MustCompile(`^https?://`).ReplaceAllString(ghr.GetHTMLURL(), "")
+	u, err := url.Parse(ghr.GetHTMLURL())
+	if err != nil {
+		return nil, err
+	}
+	id := IDFromURL(u)
 
+	l = l.With("repo", id)
 	l.Infof("Indexing %s", id)
 
-	if skipList[id] {
-		l.Info("  is on the skip list")
-		return nil, nil
-	}
-
 	isGoCore := id == "github.com/golang/go"
 	repo := &githubRepository{
 		l:            l,
 		githubRepo:   ghr,
 		githubClient: github,
+		limiter:      limiter,
 		ctx:          ctx,
 		isGoCore:     isGoCore,
+		reposRoot:    filepath.Join(cacheRoot, "repos"),
 		cloneRoot:    filepath.Join(cacheRoot, "repos", id),
+		checkpoint:   loadCheckpoint(l, checkpointPath(cacheRoot, id), settings.DryRun),
+		packages:     newPackageCache(l, cacheRoot),
+		settings:     settings,
+		tagPolicy:    tagpolicy.Default(),
+		policy:       repopolicy.Default(),
 		id:           id,
+		importRoot:   id,
+		isGoProject:  isGoCore,
 		VCS:          esmodels.Git,
 	}
-	repo.clone = repo.getGitRepo()
+
+	// The golang.org/x repositories are imported through their canonical
+	// paths, never through the GitHub mirror.
+	if prefix, ok := importpath.GoXImportPrefix(id); ok {
+		repo.importRoot = prefix
+		repo.isGoProject = true
+	}
 
 	return repo, nil
 }
 
-func (repo *githubRepository) ESModel() *esmodels.Repository {
-	issues, prs := repo.getIssuesAndPullRequests()
+// ContentHash hashes the commit at the head of every branch and every tag,
+// which we get with ls-remote rather than by cloning, along with the metadata
+// we already have from the API. We index every branch, not just the default,
+// so they're all included. So are the tag and repository policies, since
+// changing them changes what we index, and the time buckets, since some of
+// what we index changes as time passes even if the repository doesn't.
+//
+// The star, fork, and open issue counts are left out, since for a popular
+// repository they change between almost every crawl. The stars and forks are
+// updated without a crawl, see Counts, while the issue counts are only
+// updated when something else changes.
+func (repo *githubRepository) ContentHash() (string, error) {
+	refs, err := repo.lsRemote()
+	if err != nil {
+		return "", err
+	}
+
+	ghr := repo.githubRepo
+	meta, err := json.Marshal([]interface{}{
+		repo.importRoot,
+		repo.versionedRoots,
+		repo.timeBuckets(time.Now()),
+		repo.tagPolicy.String(),
+		repo.policy.String(),
+		ghr.GetDescription(),
+		ghr.GetHomepage(),
+		ghr.GetDefaultBranch(),
+		ghr.GetArchived(),
+		ghr.GetFork(),
+		esmodels.FormatTime(ghr.GetPushedAt().Time),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(refs))
+	h.Write(meta)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (repo *githubRepository) Counts() (int, int) {
+	return repo.githubRepo.GetStargazersCount(), repo.githubRepo.GetForksCount()
+}
+
+// timeBuckets returns which side of each age cutoff the repository is on,
+// for the parts of its status that depend on the current time: whether it's
+// gone too long without commits, and whether it's too new to be a quick fork.
+// We don't have the head commit before cloning, so this uses when it was
+// last pushed to instead, which is never earlier. Numbers like the days since
+// the last release also drift, but those are only updated when something
+// else changes.
+func (repo *githubRepository) timeBuckets(now time.Time) []bool {
+	ghr := repo.githubRepo
+	return []bool{
+		now.Sub(ghr.GetPushedAt().Time) > repo.inactiveAfter(),
+		ghr.GetCreatedAt().Add(oneWeek).After(now),
+	}
+}
+
+// Fetch clones or updates the repository. We don't do this until we know we
+// need to, since ContentHash may tell us we don't.
+func (repo *githubRepository) Fetch() error {
+	if repo.clone != nil || repo.empty {
+		return nil
+	}
+
+	branch, err := repo.resolveDefaultBranch()
+	if err != nil {
+		return err
+	}
+	if branch == "" {
+		repo.l.Infof("%s has no commits - not cloning", repo.id)
+		repo.empty = true
+		return nil
+	}
+	repo.defaultBranch = branch
+
+	// The clone may be evicted from the cache once ESModel is done with it,
+	// but not before.
+	repo.releaseClone, err = useClone(repo.l, repo.reposRoot, repo.cloneRoot, repo.settings.CloneQuota)
+	if err != nil {
+		return err
+	}
+
+	c, err := repo.getGitRepo()
+	if err != nil {
+		repo.doneWithClone()
+		return err
+	}
+	repo.clone = c
+	return nil
+}
+
+func (repo *githubRepository) doneWithClone() {
+	if repo.releaseClone != nil {
+		repo.releaseClone()
+		repo.releaseClone = nil
+	}
+}
+
+func (repo *githubRepository) ESModel() (*esmodels.Repository, error) {
+	err := repo.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	if repo.empty {
+		m := repo.metadata()
+		m.Status = esmodels.Empty
+		return m, nil
+	}
+	defer repo.doneWithClone()
+
+	issues, prs, err := repo.getIssuesAndPullRequests()
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not get issues: {{err}}", err)
+	}
+	// The release cadence is calculated from the tags we find in getRefs, so
+	// that needs to be called first.
+	refs, err := repo.getRefs()
+	if err != nil {
+		return nil, err
+	}
+	status, err := repo.getStatus()
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not get activity status: {{err}}", err)
+	}
+	about, err := readme(repo.clone.Path)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not read README: {{err}}", err)
+	}
+	binaries, err := binaryArtifacts(repo.clone.Path)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not look for binary artifacts: {{err}}", err)
+	}
+	contributors, err := repo.getContributors()
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not get contributors: {{err}}", err)
+	}
+
+	m := repo.metadata()
+	m.Issues = issues
+	m.PullRequests = prs
+	m.Status = status
+	m.About = about
+	m.ReleaseCadence = releaseCadence(repo.releaseDates, time.Now())
+	m.LatestVersion = repo.latestVersion
+	m.LatestStableVersion = repo.latestStableVersion
+	m.Contributors = contributors
+	m.HasBinaryArtifacts = len(binaries) > 0
+	m.BinaryArtifacts = binaries
+	m.Refs = refs
+	return m, nil
+}
+
+// metadata returns a document with just what we already know from the API,
+// without looking at the clone.
+func (repo *githubRepository) metadata() *esmodels.Repository {
 	return &esmodels.Repository{
-		Name:         repo.githubRepo.GetName(),
-		FullName:     repo.githubRepo.GetFullName(),
-		VCS:          string(repo.VCS),
-		Description:  repo.githubRepo.GetDescription(),
-		PrimaryURL:   repo.githubRepo.GetHTMLURL(),
-		Issues:       issues,
-		PullRequests: prs,
-		Owner:        repo.githubRepo.GetOwner().GetLogin(),
-		Created:      repo.githubRepo.GetCreatedAt().UTC().Format(esmodels.DateTimeFormat),
-		LastUpdated:  repo.githubRepo.GetPushedAt().Format(esmodels.DateTimeFormat),
-		LastCrawled:  time.Now().UTC().Format(esmodels.DateTimeFormat),
-		Stars:        repo.githubRepo.GetStargazersCount(),
-		Forks:        repo.githubRepo.GetForksCount(),
-		Status:       repo.getStatus(),
-		About:        repo.getReadme(),
-		IsFork:       repo.githubRepo.GetFork(),
-		Refs:         repo.getRefs(),
+		Name:           repo.githubRepo.GetName(),
+		FullName:       repo.githubRepo.GetFullName(),
+		VCS:            string(repo.VCS),
+		Description:    repo.githubRepo.GetDescription(),
+		PrimaryURL:     repo.githubRepo.GetHTMLURL(),
+		Owner:          repo.githubRepo.GetOwner().GetLogin(),
+		Created:        esmodels.FormatTime(repo.githubRepo.GetCreatedAt().Time),
+		LastUpdated:    esmodels.FormatTime(repo.githubRepo.GetPushedAt().Time),
+		LastCrawled:    esmodels.FormatTime(time.Now()),
+		Stars:          repo.githubRepo.GetStargazersCount(),
+		Forks:          repo.githubRepo.GetForksCount(),
+		IsFork:         repo.githubRepo.GetFork(),
+		ImportPathRoot: repo.importRoot,
+		IsGoProject:    repo.isGoProject,
 	}
 }
 
@@ -112,69 +340,567 @@ func (repo *githubRepository) ID() string {
 	return repo.id
 }
 
-func (repo *githubRepository) getGitRepo() *git.Repository {
-	var c *git.Repository
+func (repo *githubRepository) FetchedBytes() int64 {
+	return repo.fetchedBytes
+}
+
+func (repo *githubRepository) SetImportPathRoot(root string, versioned ...string) {
+	repo.importRoot = root
+	repo.versionedRoots = versioned
+}
+
+var majorVersionRE = regexp.MustCompile(`^v(\d+)(?:\.|$)`)
+
+// importRootFor returns the import path of the root package at a ref.
+// gopkg.in serves major version N from the branch or tags named vN or
+// vN.x.y, so if one of the repository's gopkg.in paths ends in ".vN" that's
+// the path for those refs. Every other ref has the repository's path.
+func (repo *githubRepository) importRootFor(ref string) string {
+	m := majorVersionRE.FindStringSubmatch(ref)
+	if m == nil || len(repo.versionedRoots) == 0 {
+		return repo.importRoot
+	}
+	for _, root := range append([]string{repo.importRoot}, repo.versionedRoots...) {
+		if strings.HasSuffix(root, ".v"+m[1]) {
+			return root
+		}
+	}
+	return repo.importRoot
+}
+
+func (repo *githubRepository) SetContext(ctx context.Context) {
+	repo.ctx = ctx
+}
+
+func (repo *githubRepository) SetTagPolicy(p *tagpolicy.Policy) {
+	repo.tagPolicy = p
+}
+
+func (repo *githubRepository) SetPolicy(p *repopolicy.Policy) {
+	repo.policy = p
+}
+
+// The previous refs are useless if the import path changed, since every
+// package in them has the old import path.
+func (repo *githubRepository) SetPrevious(prev *esmodels.Repository) {
+	if prev == nil {
+		return
+	}
+	repo.hadBinaryArtifacts = prev.HasBinaryArtifacts
+	if prev.ImportPathRoot != repo.importRoot {
+		return
+	}
+
+	repo.previousRefs = make(map[string]*esmodels.Ref)
+	for _, r := range prev.Refs {
+		if r.Removed == "" {
+			repo.previousRefs[r.Name] = r
+		}
+	}
+}
+
+func (repo *githubRepository) SetReindex(refs []string) {
+	repo.reindex = make(map[string]bool)
+	for _, r := range refs {
+		repo.reindex[r] = true
+	}
+}
+
+func (repo *githubRepository) ClearCheckpoint() error {
+	return repo.checkpoint.remove()
+}
+
+// lsRemote returns the output of ls-remote for every branch and tag. We only
+// ask once, since ContentHash needs this too.
+func (repo *githubRepository) lsRemote() (string, error) {
+	if repo.remoteRefs != "" {
+		return repo.remoteRefs, nil
+	}
+
+	err := repo.waitForHost()
+	if err != nil {
+		return "", err
+	}
+	refs, err := runGit(repo.ctx, "", "ls-remote", "--heads", "--tags", repo.githubRepo.GetCloneURL())
+	if err != nil {
+		return "", errwrap.Wrapf("ls-remote: {{err}}", err)
+	}
+	repo.remoteRefs = refs
+	return refs, nil
+}
+
+// resolveDefaultBranch returns the branch to treat as the default. That's
+// usually the one the API tells us about, but the API can be out of date, for
+// example just after the branch is renamed, so if the remote doesn't have it
+// we go by the remote's HEAD instead. This returns an empty string if there's
+// no branch we can use, which means the repository is empty.
+func (repo *githubRepository) resolveDefaultBranch() (string, error) {
+	refs, err := repo.lsRemote()
+	if err != nil {
+		return "", err
+	}
+
+	branches := make(map[string]bool)
+	for _, line := range strings.Split(refs, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && strings.HasPrefix(f[1], "refs/heads/") {
+			branches[strings.TrimPrefix(f[1], "refs/heads/")] = true
+		}
+	}
+	if len(branches) == 0 {
+		return "", nil
+	}
+
+	want := repo.githubRepo.GetDefaultBranch()
+	if branches[want] {
+		return want, nil
+	}
+
+	head, err := repo.remoteHead()
+	if err != nil {
+		return "", err
+	}
+	if branches[head] {
+		repo.l.Warnf("%s has no %s branch even though GitHub says it's the default - using %s, which HEAD points to", repo.id, want, head)
+		return head, nil
+	}
+
+	// HEAD may be detached or point at a branch which is gone.
+	for _, b := range []string{"main", "master"} {
+		if branches[b] {
+			repo.l.Warnf("%s has no %s branch even though GitHub says it's the default, and HEAD doesn't point to a branch - using %s", repo.id, want, b)
+			return b, nil
+		}
+	}
+
+	repo.l.Warnf("%s has no %s branch even though GitHub says it's the default, and nothing else to use instead", repo.id, want)
+	return "", nil
+}
+
+// remoteHead returns the branch the remote's HEAD points to, or an empty
+// string if it's detached.
+func (repo *githubRepository) remoteHead() (string, error) {
+	err := repo.waitForHost()
+	if err != nil {
+		return "", err
+	}
+	out, err := runGit(repo.ctx, "", "ls-remote", "--symref", repo.githubRepo.GetCloneURL(), "HEAD")
+	if err != nil {
+		return "", errwrap.Wrapf("ls-remote: {{err}}", err)
+	}
+
+	// The symref looks like "ref: refs/heads/main\tHEAD".
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == "ref:" && f[2] == "HEAD" {
+			return strings.TrimPrefix(f[1], "refs/heads/"), nil
+		}
+	}
+	return "", nil
+}
 
-	exists := pathExists(repo.cloneRoot)
-	if !exists {
-		repo.l.Infof("  %s does not exist at %s - cloning", repo.id, repo.cloneRoot)
-		err := git.Clone(repo.githubRepo.GetCloneURL(), repo.cloneRoot, git.CloneRepoOptions{})
+// getGitRepo creates the clone if needed and fetches the refs we might
+// index. Rather than cloning everything we start with an empty repository
+// and fetch into it, so a new clone gets the same refs as an existing one.
+func (repo *githubRepository) getGitRepo() (*git.Repository, error) {
+	if !pathExists(repo.cloneRoot) {
+		repo.l.Infof("%s does not exist at %s - cloning", repo.id, repo.cloneRoot)
+		err := repo.initClone()
 		if err != nil {
-			repo.l.Panic(err)
+			os.RemoveAll(repo.cloneRoot)
+			return nil, err
 		}
+	} else {
+		repo.l.Infof("%s exists at %s - fetching", repo.id, repo.cloneRoot)
+		removeStaleLocks(repo.l, repo.cloneRoot)
 	}
 
-	var err error
-	c, err = git.OpenRepository(repo.cloneRoot)
+	c, err := git.OpenRepository(repo.cloneRoot)
 	if err != nil {
-		repo.l.Panic(err)
+		return nil, err
 	}
 
-	if exists {
-		repo.l.Infof("  %s exists at %s - fetching", repo.id, repo.cloneRoot)
-		_, err = git.NewCommand("fetch", "--tags").RunInDir(c.Path)
+	before := objectBytes(repo.ctx, c.Path)
+	err = repo.fetch(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	// A fetch can trigger an automatic gc, which may leave the object store
+	// smaller than it was.
+	if after := objectBytes(repo.ctx, c.Path); after > before {
+		repo.fetchedBytes = after - before
+	}
+
+	err = repo.pruneRefs(c.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The README is read from the clone's own checkout, which should be the
+	// default branch even if we don't walk it.
+	branch := repo.defaultBranch
+	_, err = runGit(repo.ctx, c.Path, "checkout", "--force", "--detach", "origin/"+branch)
+	if err != nil {
+		return nil, errwrap.Wrapf("git checkout: {{err}}", err)
+	}
+
+	return c, nil
+}
+
+// fetch runs the fetch from fetchArgs. If a ref is deleted between ls-remote
+// and the fetch then git refuses to fetch anything, so in that case we ask
+// for the list of refs again and have one more go. A new clone is just a
+// fetch into an empty repository, so this is where we wait for a clone slot.
+func (repo *githubRepository) fetch(dir string) error {
+	done, err := repo.limiter.StartClone(repo.ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for retried := false; ; retried = true {
+		args, err := repo.fetchArgs()
+		if err != nil {
+			return err
+		}
+		err = repo.waitForHost()
 		if err != nil {
-			repo.l.Panic(err)
+			return err
+		}
+
+		_, err = runGit(repo.ctx, dir, args...)
+		if err == nil {
+			return nil
 		}
+		if retried || !strings.Contains(err.Error(), "couldn't find remote ref") {
+			return errwrap.Wrapf("git fetch: {{err}}", err)
+		}
+		repo.l.Infof("A ref was deleted while we were fetching %s - trying again", repo.id)
+		repo.remoteRefs = ""
 	}
+}
 
-	return c
+// pruneRefs deletes the tags and remote branches in the clone which are no
+// longer on the remote. Fetching refs by name never deletes anything, so
+// without this a deleted tag would go on being indexed forever.
+func (repo *githubRepository) pruneRefs(dir string) error {
+	refs, err := repo.lsRemote()
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]bool)
+	for _, line := range strings.Split(refs, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		if strings.HasPrefix(f[1], "refs/heads/") {
+			remote["refs/remotes/origin/"+strings.TrimPrefix(f[1], "refs/heads/")] = true
+		} else if !strings.HasSuffix(f[1], "^{}") {
+			remote[f[1]] = true
+		}
+	}
+
+	local, err := runGit(repo.ctx, dir, "for-each-ref", "--format=%(refname)", "refs/tags/", "refs/remotes/origin/")
+	if err != nil {
+		return errwrap.Wrapf("Could not list refs: {{err}}", err)
+	}
+	for _, ref := range strings.Fields(local) {
+		if remote[ref] || ref == "refs/remotes/origin/HEAD" {
+			continue
+		}
+		repo.l.Infof("%s was deleted upstream - pruning it", ref)
+		_, err = runGit(repo.ctx, dir, "update-ref", "-d", ref)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Could not delete %s: {{err}}", ref), err)
+		}
+	}
+
+	return nil
+}
+
+func (repo *githubRepository) initClone() error {
+	err := os.MkdirAll(repo.cloneRoot, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = runGit(repo.ctx, repo.cloneRoot, "init", "--quiet")
+	if err != nil {
+		return errwrap.Wrapf("git init: {{err}}", err)
+	}
+	_, err = runGit(repo.ctx, repo.cloneRoot, "remote", "add", "origin", repo.githubRepo.GetCloneURL())
+	if err != nil {
+		return errwrap.Wrapf("git remote add: {{err}}", err)
+	}
+	return nil
+}
+
+// fetchDepth returns how many commits of history to fetch, or 0 for all of
+// it. See Settings.FetchDepth.
+func (repo *githubRepository) fetchDepth() int {
+	fetchDepth := repo.settings.FetchDepth
+	if repo.hadBinaryArtifacts && (fetchDepth == 0 || fetchDepth > binaryArtifactsFetchDepth) {
+		return binaryArtifactsFetchDepth
+	}
+	return fetchDepth
+}
+
+// fetchArgs returns the arguments for a single fetch of the default branch,
+// any other branches the repository's policy names, and every version tag,
+// which are the only refs we might index. We get the list from ls-remote so
+// we can ask for them by name.
+func (repo *githubRepository) fetchArgs() ([]string, error) {
+	refs, err := repo.lsRemote()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"fetch", "--no-tags"}
+	if depth := repo.fetchDepth(); depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(depth))
+	}
+
+	args = append(args, "origin")
+	branches, err := repo.policyBranches()
+	if err != nil {
+		return nil, err
+	}
+	for _, branch := range append([]string{repo.defaultBranch}, branches...) {
+		args = append(args, fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch))
+	}
+
+	// Each line looks like "<commit>\trefs/tags/v1.0.0". Annotated tags
+	// have a second line for the commit they point at, ending in "^{}".
+	for _, line := range strings.Split(refs, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.HasPrefix(f[1], "refs/tags/") || strings.HasSuffix(f[1], "^{}") {
+			continue
+		}
+		if _, ok := repo.tagVersion(strings.TrimPrefix(f[1], "refs/tags/")); ok {
+			args = append(args, "+"+f[1]+":"+f[1])
+		}
+	}
+
+	return args, nil
+}
+
+// policyBranches returns the branches besides the default which the
+// repository's policy asks for. Any the remote doesn't have are left out, since
+// branches come and go.
+func (repo *githubRepository) policyBranches() ([]string, error) {
+	if repo.policy == nil || len(repo.policy.Branches) == 0 {
+		return nil, nil
+	}
+	refs, err := repo.lsRemote()
+	if err != nil {
+		return nil, err
+	}
+
+	remote := make(map[string]bool)
+	for _, line := range strings.Split(refs, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && strings.HasPrefix(f[1], "refs/heads/") {
+			remote[strings.TrimPrefix(f[1], "refs/heads/")] = true
+		}
+	}
+
+	var branches []string
+	for _, b := range repo.policy.Branches {
+		if b != repo.defaultBranch && remote[b] {
+			branches = append(branches, b)
+		}
+	}
+	return branches, nil
+}
+
+// objectBytes returns the size of the repository's object store, which is a
+// decent approximation of how much we had to download to get it.
+func objectBytes(ctx context.Context, path string) int64 {
+	out, err := runGit(ctx, path, "count-objects", "-v")
+	if err != nil {
+		return 0
+	}
+
+	var kib int64
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || (f[0] != "size:" && f[0] != "size-pack:") {
+			continue
+		}
+		n, err := strconv.ParseInt(f[1], 10, 64)
+		if err == nil {
+			kib += n
+		}
+	}
+
+	return kib * 1024
+}
+
+// Clones and fetches count against the same per host limit as API calls.
+func (repo *githubRepository) waitForHost() error {
+	u, err := url.Parse(repo.githubRepo.GetCloneURL())
+	if err != nil {
+		return err
+	}
+
+	return repo.limiter.Wait(repo.ctx, u.Hostname())
 }
 
 // A repository with no commits within the last 2 years will be considered
-// inactive. But if another active repo imports this one then we will consider
-// this one active.
+// inactive, unless its policy says otherwise. But if another active repo
+// imports this one then we will consider this one active.
 const twoYears = 2 * 365 * 24 * time.Hour
 
-func (repo *githubRepository) getStatus() esmodels.ActivityStatus {
-	head, err := repo.clone.GetBranchCommit(repo.githubRepo.GetDefaultBranch())
+func (repo *githubRepository) getStatus() (esmodels.ActivityStatus, error) {
+	// We only fetch the default branch as a remote branch, so there's no
+	// local branch to ask for.
+	commitID, err := repo.revParse("origin/" + repo.defaultBranch)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.getCommit(commitID)
 	if err != nil {
-		repo.l.Panic(err)
+		return "", err
 	}
 
-	if time.Now().Sub(head.Author.When) > twoYears {
-		return esmodels.NoRecentCommits
+	if time.Now().Sub(head.Author.When) > repo.inactiveAfter() {
+		return esmodels.NoRecentCommits, nil
 	}
 
 	commits, err := head.CommitsBeforeLimit(2)
 	if err != nil {
-		repo.l.Panic(err)
+		return "", err
 	}
 	commits.PushFront(head)
 
 	if repo.githubRepo.GetFork() {
-		if repo.githubRepo.GetPushedAt().Before(repo.githubRepo.GetCreatedAt().Time) {
-			return esmodels.DeadEndFork
+		// Comparing against the parent is much more accurate, since it tells
+		// us which commits are unique to the fork. But if the parent is gone
+		// or the comparison fails we fall back to looking at the fork alone.
+		unique, ok := repo.commitsAheadOfParent()
+		if ok {
+			if len(unique) == 0 {
+				return esmodels.DeadEndFork, nil
+			} else if repo.isQuickForkOfParent(unique) {
+				return esmodels.QuickFork, nil
+			}
+		} else if repo.githubRepo.GetPushedAt().Before(repo.githubRepo.GetCreatedAt().Time) {
+			return esmodels.DeadEndFork, nil
 		} else if repo.isQuickFork(commits) {
-			return esmodels.QuickFork
+			return esmodels.QuickFork, nil
+		}
+	}
+
+	return esmodels.Active, nil
+}
+
+func (repo *githubRepository) inactiveAfter() time.Duration {
+	if repo.policy != nil && repo.policy.InactiveAfter > 0 {
+		return repo.policy.InactiveAfter
+	}
+	return twoYears
+}
+
+// commitsAheadOfParent uses the GitHub compare API to find the commits on the
+// fork's default branch which are not in its parent's default branch. The
+// second return value is false if the comparison could not be made.
+func (repo *githubRepository) commitsAheadOfParent() ([]github.RepositoryCommit, bool) {
+	// Repositories returned by the search API do not include the parent, so
+	// we need to fetch the full repository first.
+	parent := repo.githubRepo.GetParent()
+	if parent == nil {
+		full, _, err := repo.githubClient.Repositories.Get(
+			repo.ctx,
+			repo.githubRepo.GetOwner().GetLogin(),
+			repo.githubRepo.GetName(),
+		)
+		if err != nil {
+			repo.l.Infof("Could not get full repository to find parent: %s", err)
+			return nil, false
 		}
+		parent = full.GetParent()
+	}
+	if parent == nil {
+		repo.l.Info("Fork has no parent")
+		return nil, false
+	}
+
+	cmp, _, err := repo.githubClient.Repositories.CompareCommits(
+		repo.ctx,
+		parent.GetOwner().GetLogin(),
+		parent.GetName(),
+		parent.GetDefaultBranch(),
+		fmt.Sprintf("%s:%s", repo.githubRepo.GetOwner().GetLogin(), repo.defaultBranch),
+	)
+	if err != nil {
+		repo.l.Infof("Could not compare fork with %s: %s", parent.GetFullName(), err)
+		return nil, false
 	}
 
-	return esmodels.Active
+	return cmp.Commits, true
 }
 
 const oneWeek = 7 * 24 * time.Hour
 
+const oneYear = 365 * 24 * time.Hour
+
+// If the top contributor made at least this share of the commits in the last
+// year then we consider the repository to have a single maintainer.
+const singleMaintainerShare = 0.9
+
+// getContributors looks at the commits on the default branch over the last
+// year and works out how concentrated they are. Authors are identified by
+// their email address, since names are much less consistent.
+func (repo *githubRepository) getContributors() (*esmodels.Contributors, error) {
+	since := time.Now().Add(-oneYear).Format(time.RFC3339)
+	stdout, err := runGit(
+		repo.ctx,
+		repo.clone.Path,
+		"log",
+		"--since="+since,
+		"--format=%aE",
+		"origin/"+repo.defaultBranch,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	total := 0
+	for _, email := range strings.Split(stdout, "\n") {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" {
+			continue
+		}
+		counts[email]++
+		total++
+	}
+
+	return contributors(counts, total), nil
+}
+
+func contributors(counts map[string]int, total int) *esmodels.Contributors {
+	c := &esmodels.Contributors{
+		Commits:      total,
+		Contributors: len(counts),
+	}
+	if total == 0 {
+		return c
+	}
+
+	top := 0
+	for _, n := range counts {
+		if n > top {
+			top = n
+		}
+	}
+	c.TopContributorShare = float64(top) / float64(total)
+	c.IsSingleMaintainer = c.TopContributorShare >= singleMaintainerShare
+
+	return c
+}
+
 // isQuickFork reports whether the repository is a "quick fork": it has fewer
 // than 3 commits, all within a week of the repo creation, createdAt.  Commits
 // must be in reverse chronological order by Commit.Committer.Date.
@@ -195,8 +921,28 @@ func (repo *githubRepository) isQuickFork(firstThree *list.List) bool {
 	return true
 }
 
-func (repo *githubRepository) getIssuesAndPullRequests() (*esmodels.Tickets, *esmodels.Tickets) {
-	repo.l.Info("  getting issues")
+// isQuickForkOfParent reports whether the commits that are unique to a fork
+// make it a "quick fork": fewer than 3 commits, all within a week of the
+// fork's creation.
+func (repo *githubRepository) isQuickForkOfParent(unique []github.RepositoryCommit) bool {
+	if len(unique) >= 3 {
+		return false
+	}
+
+	oneWeekOld := repo.githubRepo.GetCreatedAt().Add(oneWeek)
+	if oneWeekOld.After(time.Now()) {
+		return false // a newborn baby of a repository
+	}
+	for _, c := range unique {
+		if c.GetCommit().GetAuthor().GetDate().After(oneWeekOld) {
+			return false
+		}
+	}
+	return true
+}
+
+func (repo *githubRepository) getIssuesAndPullRequests() (*esmodels.Tickets, *esmodels.Tickets, error) {
+	repo.l.Info("Getting issues")
 
 	issues := &esmodels.Tickets{
 		URL: fmt.Sprintf("%s/issues", repo.githubRepo.GetHTMLURL()),
@@ -214,7 +960,7 @@ func (repo *githubRepository) getIssuesAndPullRequests() (*esmodels.Tickets, *es
 			opts,
 		)
 		if err != nil {
-			repo.l.Panic(err)
+			return nil, nil, err
 		}
 
 		for _, i := range issuesList {
@@ -238,97 +984,205 @@ func (repo *githubRepository) getIssuesAndPullRequests() (*esmodels.Tickets, *es
 		opts.Page = resp.NextPage
 	}
 
-	return issues, prs
+	return issues, prs, nil
+}
+
+// The Go repository's release tags look like "go1.10.3". We skip its betas
+// and release candidates.
+var goCoreTagRE = regexp.MustCompile(`^go[0-9]+(?:\.[0-9]+)*$`)
+
+// tagVersion returns the version for a tag, or false if it's not one of the
+// tags we index. Other than for Go itself, the tag policy decides this.
+func (repo *githubRepository) tagVersion(tag string) (*version.Version, bool) {
+	if !repo.isGoCore {
+		return repo.tagPolicy.Version(tag)
+	}
+	if !goCoreTagRE.MatchString(tag) {
+		return nil, false
+	}
+
+	// The version package doesn't like the go core repo's tag names like
+	// "go1.0.1".
+	v, err := version.NewVersion(strings.TrimPrefix(tag, "go"))
+	if err != nil {
+		return nil, false
+	}
+	return v, true
 }
 
-func (repo *githubRepository) getReadme() *esmodels.About {
-	files, err := ioutil.ReadDir(repo.clone.Path)
+func (repo *githubRepository) getRefs() ([]*esmodels.Ref, error) {
+	def, err := repo.newRef(repo.defaultBranch, true)
+	if err != nil {
+		return nil, err
+	}
+	branchRefs, err := repo.newBranchRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := repo.clone.GetTags()
 	if err != nil {
-		repo.l.Panic(err)
+		return nil, errwrap.Wrapf("Could not list tags: {{err}}", err)
 	}
 
-	for _, f := range files {
-		m := regexp.MustCompile(`(?i)^readme(?:\.(.+))`).FindStringSubmatch(f.Name())
-		if m == nil {
+	dates, err := repo.tagDates()
+	if err != nil {
+		return nil, err
+	}
+	repo.releaseDates = nil
+
+	var versionTags []tagpolicy.Tag
+	for _, tag := range tags {
+		v, ok := repo.tagVersion(tag)
+		if !ok {
 			continue
 		}
-
-		contentType := "text/plain"
-		if m[1] == "md" {
-			contentType = "text/markdown"
+		versionTags = append(versionTags, tagpolicy.Tag{
+			Name:    tag,
+			Version: v,
+			Created: dates[tag],
+		})
+
+		if d, ok := dates[tag]; ok {
+			repo.releaseDates = append(repo.releaseDates, d)
 		}
+	}
 
-		c, err := ioutil.ReadFile(filepath.Join(repo.clone.Path, f.Name()))
-		if err != nil {
-			repo.l.Panic(err)
-		}
+	repo.latestVersion, repo.latestStableVersion = latestVersions(versionTags, repo.retractions(versionTags))
 
-		return &esmodels.About{Content: string(c), ContentType: contentType}
+	// Go has been at major version 1 forever, so for Go itself the policy
+	// picks from the newest patch release of each minor version instead.
+	if repo.isGoCore {
+		versionTags = newestPerMinor(versionTags)
 	}
 
-	return nil
+	// The policy gives us the tags in version order. This should reduce
+	// churn in each worktree as checking out versions that are close to each
+	// other should require fewer changes to the files. This should speed up
+	// the overall indexing process.
+	names := repo.tagPolicy.Select(versionTags)
+	refs, err := repo.newTagRefs(names)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]*esmodels.Ref{def}, branchRefs...), refs...), nil
 }
 
-func (repo *githubRepository) getRefs() []*esmodels.Ref {
-	refs := []*esmodels.Ref{repo.newRef(repo.githubRepo.GetDefaultBranch(), true)}
+// newBranchRefs walks the branches the repository's policy asks for. The
+// default branch is checked out again afterwards, since that's where the
+// README comes from.
+func (repo *githubRepository) newBranchRefs() ([]*esmodels.Ref, error) {
+	branches, err := repo.policyBranches()
+	if err != nil || len(branches) == 0 {
+		return nil, err
+	}
 
-	tags, err := repo.clone.GetTags()
-	if err != nil {
-		repo.l.Panic(err)
+	var refs []*esmodels.Ref
+	for _, b := range branches {
+		r, err := repo.newRef(b, true)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, r)
 	}
 
-	var re *regexp.Regexp
-	if repo.isGoCore {
-		re = regexp.MustCompile(`^go[0-9]+(?:\.[0-9]+)*$`)
-	} else {
-		re = regexp.MustCompile(`^v?[0-9]+(?:\.[0-9]+)*$`)
+	_, err = runGit(repo.ctx, repo.clone.Path, "checkout", "origin/"+repo.defaultBranch)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not check out %s: {{err}}", repo.defaultBranch), err)
 	}
+	return refs, nil
+}
 
-	// We want to go through the refs in sorted order. This should reduce
-	// churn in the worktree as checking out versions that are close to each
-	// other should require fewer changes to the files. This should speed up
-	// the overall indexing process.
-	var versions version.Collection
-	versionTags := make(map[*version.Version]string)
-	for _, tag := range tags {
-		if !re.MatchString(tag) {
-			// repo.l.Infof("  %s does not match", ref.Name().Short())
+// newestPerMinor returns the tag with the newest patch version for each
+// minor version, so go1.10.8 stands in for go1.10 through go1.10.7.
+func newestPerMinor(tags []tagpolicy.Tag) []tagpolicy.Tag {
+	newest := make(map[[2]int64]int)
+	var minors []tagpolicy.Tag
+	for _, t := range tags {
+		s := t.Version.Segments64()
+		minor := [2]int64{s[0], s[1]}
+		i, ok := newest[minor]
+		if !ok {
+			newest[minor] = len(minors)
+			minors = append(minors, t)
 			continue
 		}
-
-		name := tag
-		if repo.isGoCore {
-			// The version package doesn't like the go core repo's tag names
-			// like "go1.0.1".
-			name = strings.Replace(name, "go", "", 1)
+		if minors[i].Version.LessThan(t.Version) {
+			minors[i] = t
 		}
-		v := version.Must(version.NewVersion(name))
-		versions = append(versions, v)
-		versionTags[v] = tag
 	}
+	return minors
+}
 
-	sort.Sort(versions)
-	i := 0
-	for _, v := range versions {
-		// XXX - temporarily only index 3 tags
-		if i >= 3 {
-			break
+// tagDates returns the creation date for every tag in the clone. For
+// annotated tags this is the date the tag was made and for lightweight tags it
+// is the date of the commit the tag points to.
+func (repo *githubRepository) tagDates() (map[string]time.Time, error) {
+	stdout, err := runGit(
+		repo.ctx,
+		repo.clone.Path,
+		"for-each-ref",
+		"--format=%(refname:short) %(creatordate:unix)",
+		"refs/tags",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	dates := make(map[string]time.Time)
+	for _, line := range strings.Split(stdout, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, err
 		}
-		i++
-		// repo.l.Infof("  %s matches", ref.Name().Short())
-		refs = append(refs, repo.newRef(versionTags[v], false))
+		dates[f[0]] = time.Unix(sec, 0)
+	}
+
+	return dates, nil
+}
+
+// releaseCadence calculates the average time between releases and the time
+// since the last release. If there are no releases at all then it returns
+// nil.
+func releaseCadence(dates []time.Time, now time.Time) *esmodels.ReleaseCadence {
+	if len(dates) == 0 {
+		return nil
+	}
+
+	sorted := make([]time.Time, len(dates))
+	copy(sorted, dates)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	first := sorted[0]
+	last := sorted[len(sorted)-1]
+	c := &esmodels.ReleaseCadence{
+		Releases:             len(sorted),
+		FirstRelease:         esmodels.FormatTime(first),
+		LastRelease:          esmodels.FormatTime(last),
+		DaysSinceLastRelease: days(now.Sub(last)),
+	}
+	if len(sorted) > 1 {
+		c.AverageDaysBetween = days(last.Sub(first)) / float64(len(sorted)-1)
 	}
 
-	return refs
+	return c
+}
+
+func days(d time.Duration) float64 {
+	return d.Hours() / 24
 }
 
 // Mostly copied from git.Repository.GetBranches, but altered to get remote
 // branches rather than local.
-func (repo *githubRepository) allBranches() []string {
+func (repo *githubRepository) allBranches() ([]string, error) {
 	prefix := "refs/remotes/origin/"
-	stdout, err := git.NewCommand("for-each-ref", "--format=%(refname)", prefix).RunInDir(repo.clone.Path)
+	stdout, err := runGit(repo.ctx, repo.clone.Path, "for-each-ref", "--format=%(refname)", prefix)
 	if err != nil {
-		repo.l.Panic(err)
+		return nil, err
 	}
 
 	refs := strings.Split(stdout, "\n")
@@ -343,33 +1197,43 @@ func (repo *githubRepository) allBranches() []string {
 		branches = append(branches, b)
 	}
 
-	return branches
+	return branches, nil
 }
 
-func (repo *githubRepository) newRef(name string, isBranch bool) *esmodels.Ref {
-	repo.l.Infof("   ref = %s", name)
-
-	if isBranch {
-		_, err := git.NewCommand("fetch", "origin", name).RunInDir(repo.clone.Path)
-		if err != nil {
-			repo.l.Panic(err)
-		}
-	}
+func (repo *githubRepository) newRef(name string, isBranch bool) (*esmodels.Ref, error) {
+	repo.l.Infow("Indexing ref", "ref", name)
 
+	// The ref was fetched by getGitRepo.
 	coName := name
 	if isBranch {
 		coName = "origin/" + name
 	}
-	// Despite the reference to Branch this works with any name that git can
-	// resolve to a commit.
-	err := git.Checkout(repo.clone.Path, git.CheckoutOptions{Branch: coName})
+
+	commitID, err := repo.revParse(coName)
 	if err != nil {
-		repo.l.Panic(err)
+		return nil, err
+	}
+	if r := repo.reusableRef(name, commitID); r != nil {
+		return r, nil
+	}
+	if isBranch && repo.wasForcePushed(name, commitID) {
+		repo.l.Infof("%s was force-pushed since the last crawl at %s", name, repo.previousRefs[name].LastSeenCommit)
 	}
 
-	c, err := repo.clone.GetCommit("HEAD")
+	entries, unusable, warnings, err := repo.checkPaths(name, commitID)
 	if err != nil {
-		repo.l.Panic(err)
+		return nil, err
+	}
+	dir := repo.clone.Path
+	if unusable != nil {
+		dir = repo.cloneRoot + ".export"
+		defer os.RemoveAll(dir)
+		err = repo.exportTree(dir, entries, unusable)
+	} else {
+		_, err = runGit(repo.ctx, repo.clone.Path, "checkout", coName)
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not check out %s: {{err}}", name), err)
 	}
 
 	t := "tag"
@@ -377,118 +1241,343 @@ func (repo *githubRepository) newRef(name string, isBranch bool) *esmodels.Ref {
 		t = "branch"
 	}
 
-	return &esmodels.Ref{
-		Name:            name,
-		IsDefaultBranch: name == repo.githubRepo.GetDefaultBranch(),
-		RefType:         t,
-		LastSeenCommit:  c.ID.String(),
-		LastUpdated:     c.Author.When.Format(esmodels.DateTimeFormat),
-		Packages:        repo.getPackages(name),
+	c, err := repo.getCommit(commitID)
+	if err != nil {
+		return nil, err
 	}
+	return repo.walkRef(name, t, c, dir, warnings)
 }
 
-func (repo *githubRepository) getPackages(name string) []*esmodels.Package {
-	return repo.walkTreeForPackages(repo.cloneRoot, name)
-}
+// How many tags are walked at once. Each worker gets its own worktree, so
+// they don't fight over the clone's checkout.
+const refWorkers = 4
+
+// newTagRefs is newRef for tags, except that the tags are walked by a pool of
+// workers. The default branch stays checked out in the clone itself, since
+// that's where the README comes from.
+func (repo *githubRepository) newTagRefs(names []string) ([]*esmodels.Ref, error) {
+	refs := make([]*esmodels.Ref, len(names))
+	commits := make([]*git.Commit, len(names))
+	exports := make([]*tagExport, len(names))
+
+	// Everything that touches the clone's object store happens here, so the
+	// workers only have to read their own worktrees.
+	var todo []int
+	for i, name := range names {
+		repo.l.Infow("Indexing ref", "ref", name)
+		// A tag we can't resolve is left out rather than failing the whole
+		// repository, since it's most likely been deleted or moved upstream
+		// while we were looking at it.
+		commitID, err := repo.revParse(name)
+		if err != nil {
+			repo.l.With("ref", name).Warnf("Skipping the ref: %s", err)
+			continue
+		}
+		if r := repo.reusableRef(name, commitID); r != nil {
+			refs[i] = r
+			continue
+		}
+		commits[i], err = repo.getCommit(commitID)
+		if err != nil {
+			return nil, err
+		}
+		entries, unusable, warnings, err := repo.checkPaths(name, commitID)
+		if err != nil {
+			return nil, err
+		}
+		exports[i] = &tagExport{entries: entries, unusable: unusable, warnings: warnings}
+		todo = append(todo, i)
+	}
+	if len(todo) == 0 {
+		return compactRefs(refs), nil
+	}
 
-func (repo *githubRepository) walkTreeForPackages(dir, refName string) []*esmodels.Package {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		repo.l.Panic(err)
+	workers := refWorkers
+	if len(todo) < workers {
+		workers = len(todo)
 	}
 
-	var p *esmodels.Package = nil
-	var pkgs []*esmodels.Package
+	// Once a worker fails the rest of the tags are skipped, since we won't
+	// use any of them.
+	var firstErr error
+	var errMu sync.Mutex
+	failed := func(err error) bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return firstErr != nil
+	}
 
-	for _, f := range files {
-		name := f.Name()
-		path := filepath.Join(dir, name)
-		if f.IsDir() {
-			// There are no packages to index outside of the src/ part of go
-			// core repo.
-			if repo.isGoCore && strings.Index(path, "/src") == -1 {
-				continue
-			}
-			// The core has testdata directories containing go code that
-			// should be ignored.
-			if repo.isGoCore && name == "testdata" {
-				continue
-			}
-			if name == "." || name == "internal" || name == "vendor" || name == ".git" {
-				continue
+	// A panic in a worker would take down the whole indexer, since nothing
+	// further up the stack can recover it, so it's turned into an error for
+	// the tag.
+	walk := func(dir string, i int) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
 			}
-			pkgs = append(pkgs, repo.walkTreeForPackages(path, refName)...)
+			repo.l.Errorw("Recovered from a panic", "tag", names[i], "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			err = fmt.Errorf("Panic while walking %s: %v", names[i], r)
+		}()
+
+		if e := exports[i]; e.unusable != nil {
+			refs[i], err = repo.walkExport(names[i], commits[i], dir+".export", e)
+			return err
+		}
+		err = repo.checkoutWorktree(dir, commits[i].ID.String())
+		if err != nil {
+			return err
 		}
+		refs[i], err = repo.walkRef(names[i], "tag", commits[i], dir, nil)
+		return err
+	}
 
-		// If we've already seen a .go file in this directory then we've made
-		// the package for the directory.
-		if p != nil {
-			continue
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			defer repo.removeWorktree(dir)
+			for i := range jobs {
+				if failed(nil) {
+					continue
+				}
+				failed(walk(dir, i))
+			}
+		}(filepath.Join(repo.cloneRoot+".worktrees", strconv.Itoa(w)))
+	}
+
+	for _, i := range todo {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return compactRefs(refs), nil
+}
+
+// A tagExport is what we need to walk a tag whose paths can't all be
+// checked out. See checkPaths.
+type tagExport struct {
+	entries  []treeEntry
+	unusable map[string]bool
+	warnings []*esmodels.Warning
+}
+
+func (repo *githubRepository) walkExport(name string, c *git.Commit, dir string, e *tagExport) (*esmodels.Ref, error) {
+	defer os.RemoveAll(dir)
+	err := repo.exportTree(dir, e.entries, e.unusable)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not export %s: {{err}}", name), err)
+	}
+	return repo.walkRef(name, "tag", c, dir, e.warnings)
+}
+
+// compactRefs removes the nils left by refs which were skipped.
+func compactRefs(refs []*esmodels.Ref) []*esmodels.Ref {
+	var out []*esmodels.Ref
+	for _, r := range refs {
+		if r != nil {
+			out = append(out, r)
 		}
+	}
+	return out
+}
 
-		if regexp.MustCompile(`\.go$`).MatchString(name) {
-			p = repo.packageForDir(dir, refName)
+// checkoutWorktree checks out a commit in the worktree at dir, creating the
+// worktree if needed. A worktree left behind by an earlier run that died is
+// thrown away and created again, since we can't trust its state.
+func (repo *githubRepository) checkoutWorktree(dir, commitID string) error {
+	if pathExists(dir) {
+		_, err := runGit(repo.ctx, dir, "checkout", "--force", "--detach", commitID)
+		if err == nil {
+			return nil
 		}
+		repo.removeWorktree(dir)
 	}
 
-	if p != nil {
-		repo.l.Infof("      package = %s", p.ImportPath)
-		return append(pkgs, p)
+	repo.worktreeMu.Lock()
+	_, err := runGit(repo.ctx, repo.clone.Path, "worktree", "add", "--force", "--detach", dir, commitID)
+	repo.worktreeMu.Unlock()
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not add a worktree for %s: {{err}}", commitID), err)
 	}
-	return pkgs
+	return nil
 }
 
-// There are paths that contain go code in the golang/go repo that are not
-// organized in valid manner, for example
-// https://github.com/golang/go/tree/master/doc/progs, which contains a bunch
-// of example programs, each with its own package.
-func (repo *githubRepository) isGoCorePackage(path string) bool {
-	importPath := strings.Replace(path, repo.cloneRoot+"/src", "", 1)
-	return pathFlags[importPath]&packagePath != 0
+func (repo *githubRepository) removeWorktree(dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		repo.l.Infof("Could not remove worktree at %s: %s", dir, err)
+	}
+
+	repo.worktreeMu.Lock()
+	defer repo.worktreeMu.Unlock()
+	_, err = runGit(repo.ctx, repo.clone.Path, "worktree", "prune")
+	if err != nil {
+		repo.l.Infof("Could not prune worktrees: %s", err)
+	}
 }
 
-func (repo *githubRepository) packageForDir(d, refName string) *esmodels.Package {
-	// For some reason bpkg.ImportPath is always giving me ".". But what I'm
-	// doing here is really gross. There's got to be a proper way to get this
-	// working.
-	var importPath string
-	if repo.isGoCore {
-		importPath = regexp.MustCompile(`^.+?/src/pkg/`).ReplaceAllLiteralString(d, "")
-	} else {
-		importPath = regexp.MustCompile(`^.+?/`+repo.id).ReplaceAllLiteralString(d, repo.id)
+func (repo *githubRepository) revParse(name string) (string, error) {
+	commitID, err := runGit(repo.ctx, repo.clone.Path, "rev-parse", name+"^{commit}")
+	if err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("Could not find the commit for %s: {{err}}", name), err)
 	}
+	return strings.TrimSpace(commitID), nil
+}
 
-	pathInRepo := regexp.MustCompile(`^.+?/`+repo.id).ReplaceAllLiteralString(d, "")
-	browseURL := fmt.Sprintf("%s/tree/%s%s", repo.githubRepo.GetHTMLURL(), refName, pathInRepo)
-	dir := directory.New(d, importPath, browseURL)
-	pkg, err := doc.NewPackage(dir)
+func (repo *githubRepository) getCommit(commitID string) (*git.Commit, error) {
+	c, err := repo.clone.GetCommit(commitID)
 	if err != nil {
-		// If this is true it means that this packages lives at a different
-		// canonical URL. This can happen when a package has a GitHub repo but
-		// you should import it via gopkg.in or some other host.
-		if _, ok := err.(gosrc.NotFoundError); ok {
-			return nil
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not get commit %s: {{err}}", commitID), err)
+	}
+	return c, nil
+}
+
+// reusableRef returns the ref with the given name if it was already indexed
+// at the given commit, either earlier in this run or in the last crawl. In
+// either case nothing needs to be checked out or walked. A ref from the last
+// crawl has no packages, since those live in their own index, but that's
+// fine because WritePackages leaves the packages of unchanged refs alone.
+func (repo *githubRepository) reusableRef(name, commitID string) *esmodels.Ref {
+	if repo.reindex[name] {
+		repo.l.With("ref", name).Info("Reindexing the ref as requested")
+		return nil
+	}
+	// A ref whose import path has changed has to be walked again, since
+	// every package in it has the old path.
+	root := repo.importRootFor(name)
+	if root == repo.importRoot {
+		root = ""
+	}
+	if r := repo.checkpoint.ref(name, commitID); r != nil && r.ImportPathRoot == root {
+		repo.l.With("ref", name).Infof("Already indexed at %s", r.LastSeenCommit)
+		return r
+	}
+	if r, ok := repo.previousRefs[name]; ok && r.LastSeenCommit == commitID && r.ImportPathRoot == root {
+		repo.l.With("ref", name).Infof("Unchanged since the last crawl at %s", r.LastSeenCommit)
+		// The default branch may have changed even if this ref didn't.
+		r.IsDefaultBranch = name == repo.defaultBranch
+		return r
+	}
+	return nil
+}
+
+// wasForcePushed returns true if the branch was indexed at a commit which
+// isn't in its history any more. With a shallow fetch we may not have the
+// old commit even if it is, so we can't tell.
+func (repo *githubRepository) wasForcePushed(name, commitID string) bool {
+	prev, ok := repo.previousRefs[name]
+	if !ok || prev.LastSeenCommit == "" || prev.LastSeenCommit == commitID || repo.fetchDepth() > 0 {
+		return false
+	}
+	_, err := runGit(repo.ctx, repo.clone.Path, "merge-base", "--is-ancestor", prev.LastSeenCommit, commitID)
+	return err != nil
+}
+
+// walkRef finds the packages in dir, which must have the ref checked out.
+func (repo *githubRepository) walkRef(name, refType string, c *git.Commit, dir string, warnings []*esmodels.Warning) (*esmodels.Ref, error) {
+	_, span := tracing.Start(repo.ctx, "analyze ref", "ref", name, "ref_type", refType)
+	defer span.End()
+
+	ref := &esmodels.Ref{
+		Name:            name,
+		IsDefaultBranch: name == repo.defaultBranch,
+		RefType:         refType,
+		LastSeenCommit:  c.ID.String(),
+		LastUpdated:     esmodels.FormatTime(c.Author.When),
+		Warnings:        warnings,
+	}
+	if root := repo.importRootFor(name); root != repo.importRoot {
+		ref.ImportPathRoot = root
+	}
+	err := repo.getPackages(ref, dir)
+	if err != nil {
+		span.SetError(err)
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not get the packages in %s: {{err}}", name), err)
+	}
+	span.SetAttributes("packages", len(ref.Packages))
+
+	ref.CountStats()
+	repo.checkpoint.save(ref)
+	metrics.RefsProcessed.Add(1)
+	metrics.PackagesPerRef.Observe(float64(len(ref.Packages)))
+
+	return ref, nil
+}
+
+// getPackages walks dir to find the ref's packages, along with everything
+// else which comes from its files, like vulnerabilities and dependencies.
+func (repo *githubRepository) getPackages(ref *esmodels.Ref, dir string) error {
+	name := ref.Name
+	cache := repo.packages
+	if repo.reindex[name] {
+		cache = nil
+	}
+	w := &walker{
+		l:          repo.l.With("ref", name),
+		ctx:        repo.ctx,
+		root:       dir,
+		importRoot: repo.importRootFor(name),
+		isGoCore:   repo.isGoCore,
+		browseURL: func(pathInRepo string) string {
+			return fmt.Sprintf("%s/tree/%s%s", repo.githubRepo.GetHTMLURL(), name, pathInRepo)
+		},
+		cache:     cache,
+		dirHashes: repo.dirHashes(ref.LastSeenCommit),
+		policy:    repo.policy,
+		settings:  repo.settings,
+	}
+	pkgs, err := w.packages()
+	if err != nil {
+		return err
+	}
+	ref.Packages = pkgs
+	ref.Vulnerabilities = w.vulnerabilities()
+	ref.Dependencies = w.dependencies()
+	return nil
+}
+
+// dirHashes returns a hash of the files directly in each directory in the
+// commit, keyed by its path in the repository, which is either empty or
+// starts with a slash. This is like the directory's git tree hash, except
+// that it ignores subdirectories, which don't change the package in the
+// directory itself. If git fails we just won't use the package cache.
+func (repo *githubRepository) dirHashes(commitID string) map[string]string {
+	entries, err := repo.treeEntries(commitID)
+	if err != nil {
+		repo.l.Infof("Could not hash directories, so the package cache won't be used: %s", err)
+		return nil
+	}
+
+	// git lists the entries in order, so each directory's hash is always
+	// built up the same way.
+	hashes := make(map[string]hash.Hash)
+	for _, e := range entries {
+		dir, name := path.Split(e.path)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir != "" {
+			dir = "/" + dir
 		}
-		repo.l.Panic(err)
-	}
-
-	return &esmodels.Package{
-		Name:         pkg.Name,
-		ImportPath:   importPath,
-		Doc:          pkg.Doc,
-		Synopsis:     pkg.Synopsis,
-		Errors:       pkg.Errors,
-		IsCommand:    pkg.IsCmd,
-		Files:        pkg.Files,
-		TestFiles:    pkg.TestFiles,
-		Imports:      pkg.Imports,
-		TestImports:  pkg.TestImports,
-		XTestImports: pkg.XTestImports,
-		Consts:       pkg.Consts,
-		Funcs:        pkg.Funcs,
-		Types:        pkg.Types,
-		Vars:         pkg.Vars,
-		Examples:     pkg.Examples,
-		Notes:        pkg.Notes,
+		h, ok := hashes[dir]
+		if !ok {
+			h = sha256.New()
+			hashes[dir] = h
+		}
+		fmt.Fprintf(h, "%s %s %s\n", e.mode, e.hash, name)
+	}
+
+	dirs := make(map[string]string, len(hashes))
+	for dir, h := range hashes {
+		dirs[dir] = hex.EncodeToString(h.Sum(nil))
 	}
+	return dirs
 }
@@ -0,0 +1,498 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+	"github.com/google/go-github/github"
+	version "github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTagRefs(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-github")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "repos", "github.com", "example", "thing")
+	write(t, filepath.Join(dir, "thing.go"), "// Package thing does things.\npackage thing\n")
+	gitRun(t, dir, "init", "-q")
+	gitRun(t, dir, "add", ".")
+	gitRun(t, dir, "commit", "-q", "-m", "one")
+	gitRun(t, dir, "tag", "v1.0.0")
+	write(t, filepath.Join(dir, "sub", "sub.go"), "// Package sub is new in v1.1.0.\npackage sub\n")
+	gitRun(t, dir, "add", ".")
+	gitRun(t, dir, "commit", "-q", "-m", "two")
+	gitRun(t, dir, "tag", "v1.1.0")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	clone, err := git.OpenRepository(dir)
+	must(t, err)
+
+	repo := &githubRepository{
+		l:          l,
+		ctx:        context.Background(),
+		githubRepo: &github.Repository{DefaultBranch: github.String("master")},
+		clone:      clone,
+		cloneRoot:  dir,
+		checkpoint: loadCheckpoint(l, filepath.Join(root, "checkpoint"), false),
+		packages:   newPackageCache(l, root),
+		importRoot: "github.com/example/thing",
+	}
+
+	refs, err := repo.newTagRefs([]string{"v1.0.0", "v1.1.0"})
+	must(t, err)
+	if assert.Len(t, refs, 2) {
+		assert.Equal(t, []string{"github.com/example/thing"}, importPaths(refs[0]), "v1.0.0")
+		assert.ElementsMatch(t, []string{"github.com/example/thing", "github.com/example/thing/sub"}, importPaths(refs[1]), "v1.1.0")
+		assert.Equal(t, "tag", refs[1].RefType)
+	}
+
+	worktrees, _ := ioutil.ReadDir(dir + ".worktrees")
+	assert.Empty(t, worktrees, "worktrees are removed")
+	assert.Len(t, repo.checkpoint.Refs, 2, "refs are checkpointed")
+
+	cached, _ := filepath.Glob(filepath.Join(root, "packages", "*", "*.json"))
+	assert.Len(t, cached, 2, "the root package is the same in both tags, so it's only cached once")
+
+	// A ref from the last crawl at the same commit is reused as is, while a
+	// ref whose tag has moved is walked again.
+	prev := &esmodels.Ref{Name: "v1.0.0", RefType: "tag", LastSeenCommit: refs[0].LastSeenCommit}
+	moved := &esmodels.Ref{Name: "v1.1.0", RefType: "tag", LastSeenCommit: refs[0].LastSeenCommit}
+	repo.checkpoint = loadCheckpoint(l, filepath.Join(root, "other"), false)
+	repo.previousRefs = map[string]*esmodels.Ref{"v1.0.0": prev, "v1.1.0": moved}
+
+	refs, err = repo.newTagRefs([]string{"v1.0.0", "v1.1.0"})
+	must(t, err)
+	if assert.Len(t, refs, 2) {
+		assert.True(t, refs[0] == prev, "unchanged ref is reused")
+		assert.Len(t, refs[1].Packages, 2, "moved ref is walked")
+		for _, p := range refs[1].Packages {
+			if assert.Len(t, p.Files, 1) {
+				assert.Contains(t, p.Files[0].URL, "/tree/v1.1.0/", "cached packages get URLs for their ref")
+			}
+		}
+	}
+	assert.Len(t, repo.checkpoint.Refs, 1, "only the walked ref is checkpointed")
+
+	refs, err = repo.newTagRefs([]string{"v1.0.0", "v9.9.9"})
+	must(t, err)
+	if assert.Len(t, refs, 1, "a missing tag is skipped") {
+		assert.Equal(t, "v1.0.0", refs[0].Name)
+	}
+}
+
+func TestGetGitRepo(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-github")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	remote := filepath.Join(root, "remote")
+	write(t, filepath.Join(remote, "README.md"), "# Thing\n")
+	gitRun(t, remote, "init", "-q")
+	gitRun(t, remote, "add", ".")
+	gitRun(t, remote, "commit", "-q", "-m", "one")
+	gitRun(t, remote, "tag", "-a", "-m", "first", "v1.0.0")
+	gitRun(t, remote, "tag", "not-a-version")
+	gitRun(t, remote, "branch", "other")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	repo := &githubRepository{
+		l:   l,
+		ctx: context.Background(),
+		githubRepo: &github.Repository{
+			CloneURL:      github.String("file://" + remote),
+			DefaultBranch: github.String("master"),
+		},
+		limiter:       ratelimit.New(0, nil),
+		tagPolicy:     tagpolicy.Default(),
+		cloneRoot:     filepath.Join(root, "repos", "thing"),
+		defaultBranch: "master",
+	}
+
+	clone, err := repo.getGitRepo()
+	must(t, err)
+	assert.True(t, repo.fetchedBytes > 0, "new clone is fetched")
+	assert.True(t, pathExists(filepath.Join(clone.Path, "README.md")), "default branch is checked out")
+
+	tags, err := clone.GetTags()
+	must(t, err)
+	assert.Equal(t, []string{"v1.0.0"}, tags, "only version tags are fetched")
+	assert.False(t, clone.IsBranchExist("other"), "other branches are not fetched")
+
+	repo.clone = clone
+	status, err := repo.getStatus()
+	must(t, err)
+	assert.Equal(t, esmodels.Active, status, "status comes from the remote default branch")
+
+	// Fetching again only gets what's new.
+	write(t, filepath.Join(remote, "thing.go"), "package thing\n")
+	gitRun(t, remote, "add", ".")
+	gitRun(t, remote, "commit", "-q", "-m", "two")
+	gitRun(t, remote, "tag", "v1.1.0")
+
+	repo.remoteRefs = ""
+	clone, err = repo.getGitRepo()
+	must(t, err)
+	assert.True(t, pathExists(filepath.Join(clone.Path, "thing.go")), "default branch is updated")
+	tags, err = clone.GetTags()
+	must(t, err)
+	assert.ElementsMatch(t, []string{"v1.0.0", "v1.1.0"}, tags)
+
+	// Deleted tags are pruned, and a force-pushed branch is fetched anyway.
+	repo.clone = clone
+	repo.previousRefs = map[string]*esmodels.Ref{"master": {Name: "master", LastSeenCommit: revParse(t, remote, "master")}}
+	gitRun(t, remote, "tag", "-d", "v1.0.0")
+	gitRun(t, remote, "commit", "-q", "--amend", "-m", "rewritten")
+
+	repo.remoteRefs = ""
+	clone, err = repo.getGitRepo()
+	must(t, err)
+	tags, err = clone.GetTags()
+	must(t, err)
+	assert.Equal(t, []string{"v1.1.0"}, tags)
+	commitID, err := repo.revParse("origin/master")
+	must(t, err)
+	assert.Equal(t, revParse(t, remote, "master"), commitID)
+	assert.True(t, repo.wasForcePushed("master", commitID))
+}
+
+func revParse(t *testing.T, dir, name string) string {
+	cmd := exec.Command("git", "rev-parse", name)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	must(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func TestDefaultBranch(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-github")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	// GitHub says the default branch is master, but it's been renamed.
+	remote := filepath.Join(root, "remote")
+	write(t, filepath.Join(remote, "README.md"), "# Thing\n")
+	gitRun(t, remote, "init", "-q")
+	gitRun(t, remote, "symbolic-ref", "HEAD", "refs/heads/trunk")
+	gitRun(t, remote, "add", ".")
+	gitRun(t, remote, "commit", "-q", "-m", "one")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	newRepo := func(name string) *githubRepository {
+		return &githubRepository{
+			l:   l,
+			ctx: context.Background(),
+			githubRepo: &github.Repository{
+				CloneURL:      github.String("file://" + remote),
+				DefaultBranch: github.String("master"),
+			},
+			limiter:   ratelimit.New(0, nil),
+			tagPolicy: tagpolicy.Default(),
+			cloneRoot: filepath.Join(root, "repos", name),
+		}
+	}
+
+	repo := newRepo("renamed")
+	must(t, repo.Fetch())
+	assert.Equal(t, "trunk", repo.defaultBranch, "HEAD is used when the API's default branch is missing")
+	assert.True(t, pathExists(filepath.Join(repo.clone.Path, "README.md")))
+
+	// With HEAD detached we fall back to a conventional name.
+	gitRun(t, remote, "branch", "main")
+	gitRun(t, remote, "checkout", "-q", "--detach")
+	repo = newRepo("detached")
+	must(t, repo.Fetch())
+	assert.Equal(t, "main", repo.defaultBranch)
+	assert.False(t, repo.empty)
+}
+
+func TestEmptyRepository(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-github")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	remote := filepath.Join(root, "remote")
+	must(t, os.MkdirAll(remote, 0755))
+	gitRun(t, remote, "init", "-q", "--bare")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	repo := &githubRepository{
+		l:   l,
+		ctx: context.Background(),
+		githubRepo: &github.Repository{
+			Name:          github.String("thing"),
+			HTMLURL:       github.String("https://github.com/example/thing"),
+			CloneURL:      github.String("file://" + remote),
+			DefaultBranch: github.String("master"),
+		},
+		limiter:   ratelimit.New(0, nil),
+		tagPolicy: tagpolicy.Default(),
+		cloneRoot: filepath.Join(root, "repos", "thing"),
+	}
+
+	model, err := repo.ESModel()
+	must(t, err)
+	assert.Equal(t, esmodels.ActivityStatus(esmodels.Empty), model.Status)
+	assert.Equal(t, "thing", model.Name)
+	assert.Empty(t, model.Refs)
+	assert.False(t, pathExists(repo.cloneRoot), "nothing is cloned")
+	assert.NoError(t, esmodels.Validate(esmodels.Index("repository"), "github.com/example/thing", model))
+}
+
+func gitRun(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %s: %s", args, err, out)
+	}
+}
+
+func importPaths(r *esmodels.Ref) []string {
+	var paths []string
+	for _, p := range r.Packages {
+		paths = append(paths, p.ImportPath)
+	}
+	return paths
+}
+
+func TestNewestPerMinor(t *testing.T) {
+	var tags []tagpolicy.Tag
+	for _, n := range []string{"1.10", "1.10.8", "1.10.2", "1.11", "1.9.7"} {
+		tags = append(tags, tagpolicy.Tag{Name: "go" + n, Version: version.Must(version.NewVersion(n))})
+	}
+
+	var names []string
+	for _, t := range newestPerMinor(tags) {
+		names = append(names, t.Name)
+	}
+	assert.Equal(t, []string{"go1.10.8", "go1.11", "go1.9.7"}, names)
+}
+
+func TestLatestVersions(t *testing.T) {
+	var tags []tagpolicy.Tag
+	for _, n := range []string{"v1.0.0", "v1.2.0", "v1.3.0", "v1.3.1", "v2.0.0-rc.1", "v1.1.0"} {
+		tags = append(tags, tagpolicy.Tag{Name: n, Version: version.Must(version.NewVersion(n))})
+	}
+
+	latest, stable := latestVersions(tags, nil)
+	assert.Equal(t, "v2.0.0-rc.1", latest)
+	assert.Equal(t, "v1.3.1", stable)
+
+	rs := retractions([]byte(`module example.com/m
+
+retract v1.3.1 // Oops.
+retract (
+	[v1.2.0, v1.3.0] // Broken.
+	v2.0.0-rc.1
+	not-a-version
+)
+
+require example.com/other v1.3.1
+`))
+	if assert.Len(t, rs, 3) {
+		assert.Equal(t, "1.2.0", rs[1].low.String())
+		assert.Equal(t, "1.3.0", rs[1].high.String())
+	}
+	latest, stable = latestVersions(tags, rs)
+	assert.Equal(t, "v1.1.0", latest)
+	assert.Equal(t, "v1.1.0", stable)
+
+	latest, stable = latestVersions(tags[4:5], nil)
+	assert.Equal(t, "v2.0.0-rc.1", latest)
+	assert.Equal(t, "", stable, "there's no stable version")
+}
+
+func TestImportRootFor(t *testing.T) {
+	repo := &githubRepository{importRoot: "github.com/go-yaml/yaml"}
+	assert.Equal(t, "github.com/go-yaml/yaml", repo.importRootFor("v2"))
+
+	repo.SetImportPathRoot("gopkg.in/yaml.v2", "gopkg.in/yaml.v3")
+	for ref, root := range map[string]string{
+		"v2":      "gopkg.in/yaml.v2",
+		"v2.4.0":  "gopkg.in/yaml.v2",
+		"v3":      "gopkg.in/yaml.v3",
+		"v3.0.1":  "gopkg.in/yaml.v3",
+		"v1.0.0":  "gopkg.in/yaml.v2",
+		"master":  "gopkg.in/yaml.v2",
+		"v30.0.0": "gopkg.in/yaml.v2",
+	} {
+		assert.Equal(t, root, repo.importRootFor(ref), ref)
+	}
+}
+
+func TestPathHazards(t *testing.T) {
+	root, err := ioutil.TempDir("", "metagodoc-github")
+	must(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "repos", "github.com", "example", "thing")
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "a", "Thing.go"), "package a\n\nfunc Upper() {}\n")
+	write(t, filepath.Join(dir, "a", "thing.go"), "package a\n\nfunc Lower() {}\n")
+	write(t, filepath.Join(dir, "bad\xff.go"), "package thing\n")
+	gitRun(t, dir, "init", "-q")
+	gitRun(t, dir, "add", ".")
+	gitRun(t, dir, "commit", "-q", "-m", "one")
+	gitRun(t, dir, "tag", "v1.0.0")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	clone, err := git.OpenRepository(dir)
+	must(t, err)
+
+	repo := &githubRepository{
+		l:          l,
+		ctx:        context.Background(),
+		githubRepo: &github.Repository{DefaultBranch: github.String("master")},
+		clone:      clone,
+		cloneRoot:  dir,
+		checkpoint: loadCheckpoint(l, filepath.Join(root, "checkpoint"), false),
+		packages:   newPackageCache(l, root),
+		importRoot: "github.com/example/thing",
+	}
+
+	refs, err := repo.newTagRefs([]string{"v1.0.0"})
+	must(t, err)
+	if !assert.Len(t, refs, 1) {
+		return
+	}
+
+	var kinds []string
+	for _, w := range refs[0].Warnings {
+		kinds = append(kinds, w.Kind)
+		if w.Kind == esmodels.CaseCollision {
+			assert.Equal(t, []string{"a/Thing.go", "a/thing.go"}, w.Paths)
+		}
+	}
+	assert.Equal(t, []string{esmodels.CaseCollision, esmodels.InvalidPathName}, kinds)
+
+	assert.ElementsMatch(t, []string{"github.com/example/thing", "github.com/example/thing/a"}, importPaths(refs[0]), "the tree is read from the object database")
+	for _, p := range refs[0].Packages {
+		assert.Len(t, p.Files, 1, "only one of the colliding files is used")
+	}
+	assert.False(t, pathExists(dir+".worktrees/0.export"), "the export is removed")
+}
+
+func TestBinaryArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-binaries")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "main.go"), "package main\n")
+	write(t, filepath.Join(dir, "build.sh"), "#!/bin/sh\ngo build\n")
+	write(t, filepath.Join(dir, "bin", "tool"), "\x7fELF\x02\x01\x01")
+	write(t, filepath.Join(dir, "tool.exe"), "MZ\x90\x00")
+	write(t, filepath.Join(dir, "elf", "testdata", "hello"), "\x7fELF\x02\x01\x01")
+	write(t, filepath.Join(dir, ".git", "objects", "pack"), "\x7fELF")
+	must(t, os.Chmod(filepath.Join(dir, "build.sh"), 0755))
+	write(t, filepath.Join(dir, "testdata", "huge.json"), "")
+	must(t, os.Truncate(filepath.Join(dir, "testdata", "huge.json"), largeFileBytes))
+
+	paths, err := binaryArtifacts(dir)
+	must(t, err)
+	assert.Equal(t, []string{"bin/tool", "testdata/huge.json", "tool.exe"}, paths)
+
+	repo := &githubRepository{}
+	repo.SetPrevious(&esmodels.Repository{HasBinaryArtifacts: true})
+	assert.Equal(t, binaryArtifactsFetchDepth, repo.fetchDepth())
+	repo.SetPrevious(&esmodels.Repository{})
+	assert.Equal(t, 0, repo.fetchDepth())
+}
+
+func TestForkOfParent(t *testing.T) {
+	created := time.Now().Add(-30 * 24 * time.Hour)
+	var compared []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/someone/thing", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"parent": {"name": "thing", "full_name": "upstream/thing", "owner": {"login": "upstream"}, "default_branch": "master"}}`)
+	})
+	mux.HandleFunc("/repos/upstream/thing/compare/", func(w http.ResponseWriter, r *http.Request) {
+		compared = append(compared, strings.TrimPrefix(r.URL.Path, "/repos/upstream/thing/compare/"))
+		fmt.Fprintf(w, `{"commits": [{"commit": {"author": {"date": %q}}}]}`, created.Add(time.Hour).Format(time.RFC3339))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	repo := &githubRepository{
+		l:            l,
+		ctx:          context.Background(),
+		githubClient: client,
+		githubRepo: &github.Repository{
+			Name:      github.String("thing"),
+			Owner:     &github.User{Login: github.String("someone")},
+			Fork:      github.Bool(true),
+			CreatedAt: &github.Timestamp{Time: created},
+		},
+		defaultBranch: "main",
+	}
+
+	unique, ok := repo.commitsAheadOfParent()
+	assert.True(t, ok, "the parent is found through the full repository")
+	assert.Len(t, unique, 1)
+	assert.Equal(t, []string{"master...someone:main"}, compared, "the fork's default branch is compared with the parent's")
+	assert.True(t, repo.isQuickForkOfParent(unique), "one commit in the fork's first week")
+
+	lateDate := created.Add(2 * oneWeek)
+	late := github.RepositoryCommit{Commit: &github.Commit{Author: &github.CommitAuthor{Date: &lateDate}}}
+	assert.False(t, repo.isQuickForkOfParent(append(unique, late)), "a commit after the first week")
+	assert.False(t, repo.isQuickForkOfParent([]github.RepositoryCommit{unique[0], unique[0], unique[0]}), "three commits")
+
+	repo.githubRepo.CreatedAt = &github.Timestamp{Time: time.Now()}
+	assert.False(t, repo.isQuickForkOfParent(unique), "a fork less than a week old")
+
+	repo.githubRepo.Owner.Login = github.String("orphan")
+	_, ok = repo.commitsAheadOfParent()
+	assert.False(t, ok, "the comparison can't be made without a parent")
+}
+
+func TestTimeBuckets(t *testing.T) {
+	now := time.Now()
+	repo := &githubRepository{
+		githubRepo: &github.Repository{
+			CreatedAt: &github.Timestamp{Time: now.Add(-3 * 365 * 24 * time.Hour)},
+			PushedAt:  &github.Timestamp{Time: now.Add(-365 * 24 * time.Hour)},
+		},
+	}
+
+	buckets := repo.timeBuckets(now)
+	assert.Equal(t, buckets, repo.timeBuckets(now.AddDate(0, 1, 0)), "a month passing changes nothing by itself")
+	assert.Equal(t, []bool{false, false}, buckets)
+	assert.Equal(t, []bool{true, false}, repo.timeBuckets(now.AddDate(1, 1, 0)), "no pushes for over two years")
+
+	repo.policy = &repopolicy.Policy{InactiveAfter: 180 * 24 * time.Hour}
+	assert.Equal(t, []bool{true, false}, repo.timeBuckets(now), "the policy sets when it goes inactive")
+
+	repo.githubRepo.CreatedAt = &github.Timestamp{Time: now.Add(-time.Hour)}
+	assert.Equal(t, []bool{true, true}, repo.timeBuckets(now), "created less than a week ago")
+}
@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Some trees can't be checked out faithfully everywhere. Paths which differ
+// only by case collide on case-insensitive filesystems, so one file silently
+// replaces the other, and names which aren't UTF-8 can't be represented on
+// some filesystems at all. For a commit with either of these we read the
+// files we need straight from the object database instead of checking it
+// out.
+
+// A treeEntry is a file in a commit, from git ls-tree.
+type treeEntry struct {
+	mode string
+	hash string
+	path string
+}
+
+func (repo *githubRepository) treeEntries(commitID string) ([]treeEntry, error) {
+	out, err := runGit(repo.ctx, repo.clone.Path, "ls-tree", "-r", "-z", commitID)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not list the files in %s: {{err}}", commitID), err)
+	}
+
+	// Each entry looks like "100644 blob <hash>\t<path>". With -z the path
+	// is never quoted.
+	var entries []treeEntry
+	for _, entry := range strings.Split(out, "\x00") {
+		tab := strings.Index(entry, "\t")
+		if tab == -1 {
+			continue
+		}
+		f := strings.Fields(entry[:tab])
+		if len(f) != 3 || f[1] != "blob" {
+			continue
+		}
+		entries = append(entries, treeEntry{mode: f[0], hash: f[2], path: entry[tab+1:]})
+	}
+	return entries, nil
+}
+
+// pathHazards returns a warning for each group of paths which collide when
+// case is ignored, and one for all of the paths which aren't UTF-8. It also
+// returns the paths which can't be used, which is every path but the first of
+// each colliding group, plus the ones which aren't UTF-8.
+func pathHazards(entries []treeEntry) ([]*esmodels.Warning, map[string]bool) {
+	unusable := make(map[string]bool)
+	var invalid []string
+	// Keyed by folded path, with the actual paths which fold to it. A
+	// directory can collide too, so every prefix of each path is checked.
+	first := make(map[string]string)
+	collisions := make(map[string]map[string]bool)
+	for _, e := range entries {
+		if !utf8.ValidString(e.path) {
+			invalid = append(invalid, validUTF8(e.path))
+			unusable[e.path] = true
+			continue
+		}
+
+		parts := strings.Split(e.path, "/")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/")
+			folded := strings.ToLower(prefix)
+			other, ok := first[folded]
+			if !ok {
+				first[folded] = prefix
+				continue
+			}
+			if other != prefix {
+				if collisions[folded] == nil {
+					collisions[folded] = map[string]bool{other: true}
+				}
+				collisions[folded][prefix] = true
+				unusable[e.path] = true
+				break
+			}
+		}
+	}
+
+	var warnings []*esmodels.Warning
+	var folded []string
+	for f := range collisions {
+		folded = append(folded, f)
+	}
+	sort.Strings(folded)
+	for _, f := range folded {
+		var paths []string
+		for p := range collisions[f] {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		warnings = append(warnings, &esmodels.Warning{
+			Kind:    esmodels.CaseCollision,
+			Paths:   paths,
+			Message: fmt.Sprintf("%d paths differ only by case, so only %s was indexed", len(paths), first[f]),
+		})
+	}
+	if len(invalid) > 0 {
+		warnings = append(warnings, &esmodels.Warning{
+			Kind:    esmodels.InvalidPathName,
+			Paths:   invalid,
+			Message: fmt.Sprintf("%d paths are not valid UTF-8, so they were not indexed", len(invalid)),
+		})
+	}
+	return warnings, unusable
+}
+
+// validUTF8 returns s with each invalid byte replaced by the Unicode
+// replacement character, so it can be shown in a warning.
+func validUTF8(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// checkPaths returns the commit's files and the paths which can't be used if
+// there's anything wrong with its paths, along with warnings about it.
+// Otherwise the commit can be checked out and this returns nothing.
+func (repo *githubRepository) checkPaths(name, commitID string) ([]treeEntry, map[string]bool, []*esmodels.Warning, error) {
+	entries, err := repo.treeEntries(commitID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	warnings, unusable := pathHazards(entries)
+	if len(warnings) == 0 {
+		return nil, nil, nil, nil
+	}
+	for _, w := range warnings {
+		repo.l.With("ref", name).Warn(w.Message)
+	}
+	return entries, unusable, warnings, nil
+}
+
+// exportTree writes the files the walker needs from the entries to dir,
+// reading them from the object database. Only Go files and go.mod files are
+// written, since nothing else is read when walking, and the unusable paths
+// are left out.
+func (repo *githubRepository) exportTree(dir string, entries []treeEntry, unusable map[string]bool) error {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var want []treeEntry
+	for _, e := range entries {
+		// Symlinks and submodules aren't followed when walking either.
+		if e.mode != "100644" && e.mode != "100755" {
+			continue
+		}
+		name := path.Base(e.path)
+		if unusable[e.path] || (!strings.HasSuffix(name, ".go") && name != "go.mod") {
+			continue
+		}
+		want = append(want, e)
+	}
+	if len(want) == 0 {
+		return nil
+	}
+
+	var input strings.Builder
+	for _, e := range want {
+		input.WriteString(e.hash + "\n")
+	}
+	out, err := runGitInput(repo.ctx, repo.clone.Path, input.String(), "cat-file", "--batch")
+	if err != nil {
+		return errwrap.Wrapf("Could not read files from the object database: {{err}}", err)
+	}
+
+	// Each object is a "<hash> blob <size>" line followed by the contents
+	// and a newline, in the order we asked for them.
+	for _, e := range want {
+		nl := strings.IndexByte(out, '\n')
+		if nl == -1 {
+			return fmt.Errorf("Missing object %s for %s", e.hash, e.path)
+		}
+		f := strings.Fields(out[:nl])
+		if len(f) != 3 || f[0] != e.hash {
+			return fmt.Errorf("Unexpected object header for %s: %s", e.path, out[:nl])
+		}
+		size, err := strconv.Atoi(f[2])
+		if err != nil || nl+1+size > len(out) {
+			return fmt.Errorf("Bad object size for %s: %s", e.path, f[2])
+		}
+		contents := out[nl+1 : nl+1+size]
+		out = out[nl+1+size:]
+		out = strings.TrimPrefix(out, "\n")
+
+		file := filepath.Join(dir, filepath.FromSlash(e.path))
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(contents), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"strings"
+
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// A retraction is a version, or an inclusive range of versions, which a
+// retract directive in go.mod says shouldn't be used.
+type retraction struct {
+	low, high *version.Version
+}
+
+// retractions returns the retract directives in a go.mod file. Like the go
+// command, we only look at the go.mod file of the newest version, which is
+// where retractions are meant to be added.
+func retractions(goMod []byte) []retraction {
+	var rs []retraction
+	inBlock := false
+	for _, line := range strings.Split(string(goMod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case !inBlock && strings.HasPrefix(line, "retract"):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "retract"))
+			if line == "(" {
+				inBlock = true
+				continue
+			}
+		case !inBlock:
+			continue
+		}
+
+		// Either "v1.0.0" or "[v1.0.0, v1.0.5]".
+		bounds := []string{line}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			bounds = strings.Split(strings.Trim(line, "[]"), ",")
+		}
+		if len(bounds) > 2 {
+			continue
+		}
+		low, err := version.NewVersion(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			continue
+		}
+		high, err := version.NewVersion(strings.TrimSpace(bounds[len(bounds)-1]))
+		if err != nil {
+			continue
+		}
+		rs = append(rs, retraction{low, high})
+	}
+	return rs
+}
+
+func retracted(t tagpolicy.Tag, rs []retraction) bool {
+	// Retractions are module versions, which only tags like "v1.2.3" are.
+	if !strings.HasPrefix(t.Name, "v") {
+		return false
+	}
+	for _, r := range rs {
+		if !t.Version.LessThan(r.low) && !t.Version.GreaterThan(r.high) {
+			return true
+		}
+	}
+	return false
+}
+
+// latestVersions returns the names of the newest version tag and the newest
+// which isn't a prerelease, leaving out retracted versions. Either is empty if
+// there's no such tag. The stable one is what "go get" picks for @latest if
+// there is one.
+func latestVersions(tags []tagpolicy.Tag, rs []retraction) (string, string) {
+	var latest, stable *tagpolicy.Tag
+	for i := range tags {
+		t := &tags[i]
+		if retracted(*t, rs) {
+			continue
+		}
+		if latest == nil || t.Version.GreaterThan(latest.Version) {
+			latest = t
+		}
+		if t.Version.Prerelease() == "" && (stable == nil || t.Version.GreaterThan(stable.Version)) {
+			stable = t
+		}
+	}
+
+	var latestName, stableName string
+	if latest != nil {
+		latestName = latest.Name
+	}
+	if stable != nil {
+		stableName = stable.Name
+	}
+	return latestName, stableName
+}
+
+// retractions returns the retractions in the go.mod file of the version "go
+// get" would pick before taking any retractions into account. A version can
+// retract itself, so this may well be one of the versions retracted.
+func (repo *githubRepository) retractions(tags []tagpolicy.Tag) []retraction {
+	if repo.isGoCore {
+		return nil
+	}
+	latest, stable := latestVersions(tags, nil)
+	if stable != "" {
+		latest = stable
+	}
+	if latest == "" {
+		return nil
+	}
+
+	// Plenty of tags predate modules, so there's often no go.mod at all.
+	goMod, err := runGit(repo.ctx, repo.clone.Path, "show", latest+":go.mod")
+	if err != nil {
+		return nil
+	}
+	return retractions([]byte(goMod))
+}
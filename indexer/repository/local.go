@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// A localRepository is a directory on disk. There's no remote and no history
+// to look at, so we index whatever is in the directory right now as a single
+// ref. This is handy for testing the indexer offline and for indexing code
+// that hasn't been published anywhere yet.
+type localRepository struct {
+	l   *logger.Logger
+	dir string
+	// For a local directory the ID is the import path of the root package,
+	// since there's no URL.
+	importRoot string
+	ctx        context.Context
+	policy     *repopolicy.Policy
+	settings   Settings
+}
+
+// NewLocalRepository returns a repository for the directory. If importRoot is
+// empty then the module path from the directory's go.mod file is used.
+func NewLocalRepository(l *logger.Logger, dir, importRoot string, settings Settings) (*localRepository, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not stat %s: {{err}}", abs), err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", abs)
+	}
+
+	if importRoot == "" {
+		importRoot, err = modulePath(abs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l = l.With("repo", importRoot)
+	l.Infof("Indexing %s as %s", abs, importRoot)
+
+	return &localRepository{
+		l:          l,
+		dir:        abs,
+		importRoot: importRoot,
+		ctx:        context.Background(),
+		settings:   settings,
+	}, nil
+}
+
+// modulePath returns the module path declared in the go.mod file in the
+// directory.
+func modulePath(dir string) (string, error) {
+	path := filepath.Join(dir, "go.mod")
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("No import path was given and could not read %s: {{err}}", path), err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) >= 2 && f[0] == "module" {
+			return strings.Trim(f[1], `"`), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("No module line found in %s", path)
+}
+
+// Fetch does nothing, since the code is already on disk.
+func (repo *localRepository) Fetch() error {
+	return nil
+}
+
+func (repo *localRepository) ESModel() (*esmodels.Repository, error) {
+	now := esmodels.FormatTime(time.Now())
+
+	w := &walker{
+		l:          repo.l,
+		ctx:        repo.ctx,
+		root:       repo.dir,
+		importRoot: repo.importRoot,
+		browseURL: func(pathInRepo string) string {
+			return "file://" + repo.dir + pathInRepo
+		},
+		policy:   repo.policy,
+		settings: repo.settings,
+	}
+	pkgs, err := w.packages()
+	if err != nil {
+		return nil, err
+	}
+	about, err := readme(repo.dir)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not read README: {{err}}", err)
+	}
+	binaries, err := binaryArtifacts(repo.dir)
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not look for binary artifacts: {{err}}", err)
+	}
+
+	ref := &esmodels.Ref{
+		Name:            "local",
+		IsDefaultBranch: true,
+		RefType:         "directory",
+		LastUpdated:     now,
+		Vulnerabilities: w.vulnerabilities(),
+		Dependencies:    w.dependencies(),
+		Packages:        pkgs,
+	}
+	ref.CountStats()
+
+	return &esmodels.Repository{
+		Name:           filepath.Base(repo.dir),
+		FullName:       repo.importRoot,
+		PrimaryURL:     "file://" + repo.dir,
+		LastUpdated:    now,
+		LastCrawled:    now,
+		Status:         esmodels.Active,
+		About:          about,
+		ImportPathRoot: repo.importRoot,
+		Refs:           []*esmodels.Ref{ref},
+
+		HasBinaryArtifacts: len(binaries) > 0,
+		BinaryArtifacts:    binaries,
+	}, nil
+}
+
+func (repo *localRepository) ID() string {
+	return repo.importRoot
+}
+
+// A local repository only has the one import path.
+func (repo *localRepository) SetImportPathRoot(root string, versioned ...string) {
+	repo.importRoot = root
+}
+
+func (repo *localRepository) SetContext(ctx context.Context) {
+	repo.ctx = ctx
+}
+
+func (repo *localRepository) FetchedBytes() int64 {
+	return 0
+}
+
+// We have no way to tell whether anything changed, so there's no hash.
+// A directory has no tags.
+func (repo *localRepository) SetTagPolicy(p *tagpolicy.Policy) {
+}
+
+func (repo *localRepository) SetPolicy(p *repopolicy.Policy) {
+	repo.policy = p
+}
+
+func (repo *localRepository) ContentHash() (string, error) {
+	return "", nil
+}
+
+// A directory has no stars or forks.
+func (repo *localRepository) Counts() (int, int) {
+	return 0, 0
+}
+
+// We have no way to tell whether anything changed, since the directory isn't
+// necessarily a git checkout.
+func (repo *localRepository) SetPrevious(prev *esmodels.Repository) {
+}
+
+// The directory is always walked from scratch anyway.
+func (repo *localRepository) SetReindex(refs []string) {
+}
+
+// There's nothing to resume, since there's only one ref.
+func (repo *localRepository) ClearCheckpoint() error {
+	return nil
+}
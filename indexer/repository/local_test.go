@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-local")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "go.mod"), "module example.com/thing\n")
+	write(t, filepath.Join(dir, "README.md"), "# Thing\n")
+	write(t, filepath.Join(dir, "thing.go"), "// Package thing does things.\npackage thing\n\nfunc Do() {}\n")
+	write(t, filepath.Join(dir, "sub", "sub.go"), "// Package sub is below thing.\npackage sub\n")
+	write(t, filepath.Join(dir, "vendor", "v", "v.go"), "package v\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+
+	repo, err := NewLocalRepository(l, dir, "", Settings{})
+	must(t, err)
+	assert.Equal(t, "example.com/thing", repo.ID(), "import path comes from go.mod")
+
+	model, err := repo.ESModel()
+	must(t, err)
+	if assert.Len(t, model.Refs, 1) {
+		var paths []string
+		for _, p := range model.Refs[0].Packages {
+			paths = append(paths, p.ImportPath)
+		}
+		assert.ElementsMatch(t, []string{"example.com/thing", "example.com/thing/sub"}, paths)
+	}
+	if assert.NotNil(t, model.About) {
+		assert.Equal(t, "text/markdown", model.About.ContentType)
+	}
+
+	_, err = NewLocalRepository(l, filepath.Join(dir, "sub"), "", Settings{})
+	assert.Error(t, err, "no import path and no go.mod")
+}
+
+func write(t *testing.T, path, content string) {
+	must(t, os.MkdirAll(filepath.Dir(path), 0755))
+	must(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// Bump this whenever the doc package changes what it extracts, so that old
+// entries are ignored.
+const packageCacheVersion = 11
+
+// A packageCache stores the package found in a directory on disk, keyed by a
+// hash of the directory's files and everything else which changes the
+// package, see walker.cacheKey. Most directories are the
+// same in most tags, so this saves parsing them again for every ref, and
+// again on every crawl.
+type packageCache struct {
+	l   *logger.Logger
+	dir string
+}
+
+func newPackageCache(l *logger.Logger, cacheRoot string) *packageCache {
+	return &packageCache{
+		l:   l,
+		dir: filepath.Join(cacheRoot, "packages"),
+	}
+}
+
+func (pc *packageCache) path(key string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", packageCacheVersion, key)))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(pc.dir, name[:2], name+".json")
+}
+
+// get returns the cached package and true if there is one. The package may be
+// nil, which means the directory has no package we can index.
+func (pc *packageCache) get(key string) (*esmodels.Package, bool) {
+	b, err := ioutil.ReadFile(pc.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var p *esmodels.Package
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// put saves a package. Failing to save it isn't worth stopping for, since the
+// directory is just parsed again next time.
+func (pc *packageCache) put(key string, p *esmodels.Package) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		pc.l.Infof("Could not encode package for the cache: %s", err)
+		return
+	}
+
+	path := pc.path(key)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		pc.l.Infof("Could not create package cache directory: %s", err)
+		return
+	}
+
+	// Several workers may be writing the same entry at once, so each writes
+	// its own temp file.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		pc.l.Infof("Could not write to the package cache: %s", err)
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		pc.l.Infof("Could not write to the package cache: %s", err)
+	}
+}
@@ -1,8 +1,61 @@
 package repository
 
-import "github.com/autarch/metagodoc/esmodels"
+import (
+	"context"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/indexer/tagpolicy"
+)
 
 type Repository interface {
-	ESModel() *esmodels.Repository
+	// Fetch gets a copy of the repository to analyze, if that needs doing.
+	// ESModel calls this itself, but the indexer calls it first so that
+	// fetching and analyzing can happen in separate stages.
+	Fetch() error
+	// ESModel builds the repository's document. An error means the
+	// repository couldn't be indexed this time, and it's up to the caller
+	// whether to retry it.
+	ESModel() (*esmodels.Repository, error)
 	ID() string
+	// SetContext sets the context for everything the repository does from
+	// then on, including git commands and walking its files. Once it's done
+	// those return its error.
+	SetContext(context.Context)
+	// SetImportPathRoot sets the import path of the repository's root
+	// package, for repositories which are imported through a vanity path
+	// rather than their URL. For gopkg.in, which has a path for each major
+	// version, the paths for the other versions can be passed as well, and
+	// each ref gets the path for its version.
+	SetImportPathRoot(root string, versioned ...string)
+	// SetTagPolicy sets which tags are indexed. This must be called before
+	// ContentHash.
+	SetTagPolicy(*tagpolicy.Policy)
+	// SetPolicy overrides which branches and packages are indexed, and when
+	// the repository counts as inactive. This must be called before
+	// ContentHash.
+	SetPolicy(*repopolicy.Policy)
+	// FetchedBytes returns roughly how much data was downloaded to clone or
+	// update the repository. This is only known once Fetch has been called.
+	FetchedBytes() int64
+	// ContentHash returns a hash which changes whenever anything we index
+	// about the repository might have changed, without doing the expensive
+	// parts of crawling it. An empty hash means the repository always has to
+	// be crawled.
+	ContentHash() (string, error)
+	// Counts returns the star and fork counts we have for the repository
+	// without crawling it. They change too often to be part of ContentHash,
+	// so they're written on their own when nothing else has changed.
+	Counts() (stars, forks int)
+	// SetPrevious gives the repository the document from its last crawl, if
+	// it has one. Refs which are still at the same commit are copied from
+	// it rather than being checked out and walked again. This is called
+	// before Fetch, since the last crawl can change how much is fetched.
+	SetPrevious(*esmodels.Repository)
+	// SetReindex names refs which are checked out and walked again even if
+	// they haven't changed, without using any cached packages.
+	SetReindex([]string)
+	// ClearCheckpoint should be called once the repository's model has been
+	// stored, so that the next crawl starts from scratch.
+	ClearCheckpoint() error
 }
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"github.com/autarch/metagodoc/indexer/modgraph"
+	"github.com/autarch/metagodoc/indexer/vulndb"
+)
+
+// Settings change how every repository an indexer crawls is cloned, walked,
+// and checked. Each repository gets its own copy, so indexers with different
+// settings can run in the same process. The zero value is the default for
+// each of them.
+type Settings struct {
+	// If this is set then checkpoints are read but never written or
+	// removed. A dry run still resumes from any checkpoint an earlier run
+	// left behind, but leaves it as it was, since the repository won't
+	// actually be written.
+	DryRun bool
+
+	// Limits the total size of the clones kept under the cache root, or
+	// unlimited if it's 0. When a repository has been indexed and the clones
+	// are over the quota, the least recently used clones are deleted until
+	// they fit. A deleted clone is cloned again the next time its repository
+	// is indexed.
+	CloneQuota int64
+
+	// Limits fetches to this many commits of history from each ref, or no
+	// limit if it's 0. This saves a lot of network traffic for repositories
+	// with long histories, but the contributor counts and activity status
+	// are based on the history we have, so they'll be less accurate.
+	FetchDepth int
+
+	// Whether generated files are left out of a package's documentation and
+	// source size. See directory.Directory.
+	ExcludeGenerated bool
+
+	// Whether packages in testdata directories are indexed. The go tool
+	// ignores these directories, so by default we do too, since they're
+	// mostly full of fixtures which aren't real packages. The Go
+	// repository's testdata is never indexed.
+	IndexTestdata bool
+
+	// Whether internal packages are indexed. They're marked with
+	// IsInternal, since they can only be imported from inside the tree
+	// they're in.
+	IndexInternal bool
+
+	// Whether packages in vendor directories are indexed. They're marked
+	// with IsVendored, and only get enough of their docs to say what they
+	// are, since the full docs belong with the package's own repository.
+	// Their import paths include the vendor directory, so they don't clash
+	// with the real thing.
+	SummarizeVendor bool
+
+	// The database which each ref's module requirements are checked against
+	// for known vulnerabilities. If this is nil refs aren't checked.
+	VulnDB *vulndb.Client
+
+	// The proxy used to find how deep each ref's dependency tree is. If this
+	// is nil only the dependencies listed in the ref's own go.mod and go.sum
+	// files are counted.
+	ModuleProxy *modgraph.Client
+}
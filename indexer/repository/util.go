@@ -1,15 +1,145 @@
 package repository
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/metrics"
+
+	"code.gitea.io/git"
 )
 
+// runGit runs a git command in dir, or in the current directory if dir is
+// empty, and records how long it took. The git package can't be cancelled,
+// so this runs the command itself, with the same arguments and timeout the
+// git package would use, and kills it if ctx is done first.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	return runGitInput(ctx, dir, "", args...)
+}
+
+// runGitInput is runGit with the given input on stdin.
+func runGitInput(ctx context.Context, dir, input string, args ...string) (string, error) {
+	defer metrics.TimeGit(args[0], time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, git.DefaultCommandExecutionTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", append(git.GlobalCommandArgs, args...)...)
+	cmd.Dir = dir
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		if stderr.Len() > 0 {
+			return "", fmt.Errorf("%v - %s", err, stderr.String())
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// pathExists returns false only if the path definitely doesn't exist. If we
+// can't stat it for some other reason then whatever we do with it next will
+// fail and tell us why.
 func pathExists(path string) bool {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return false
-	} else if err != nil {
-		log.Panic(err)
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// Hosts whose repository paths aren't case sensitive. Other hosts may serve
+// different repositories at paths which only differ in case.
+var caseInsensitiveHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// IDFromURL returns the repository ID for a repository URL, which is the
+// normalized URL without its scheme.
+func IDFromURL(u *url.URL) string {
+	n := NormalizeURL(u)
+	return n.Host + n.Path
+}
+
+// NormalizeURL returns the canonical form of a repository URL. The same
+// repository can be found as "http://www.github.com/foo/bar.git/" and
+// "https://github.com/foo/bar", and we want both to end up as the latter.
+// This doesn't catch repositories which have been renamed. For those we rely
+// on the crawler following the host's redirects.
+//
+// The case of the path is left alone, since it's part of every import path
+// in the repository. See DedupKey for comparing IDs which differ only in
+// case.
+func NormalizeURL(u *url.URL) *url.URL {
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	host = strings.TrimSuffix(host, ":443")
+
+	p := strings.TrimRight(u.Path, "/")
+	p = strings.TrimSuffix(p, ".git")
+	p = strings.TrimRight(p, "/")
+
+	return &url.URL{Scheme: "https", Host: host, Path: p}
+}
+
+// DedupKey returns the key under which two repository IDs are the same
+// repository. The hosts in caseInsensitiveHosts ignore case in paths, so
+// "github.com/BurntSushi/toml" and "github.com/burntsushi/toml" have the
+// same key. This is only for finding duplicates, the ID itself keeps the
+// case the host gave us.
+func DedupKey(id string) string {
+	i := strings.Index(id, "/")
+	if i == -1 || !caseInsensitiveHosts[id[:i]] {
+		return id
+	}
+	return strings.ToLower(id)
+}
+
+var readmeRE = regexp.MustCompile(`(?i)^readme(?:\.(.+))`)
+
+// readme returns the contents of the first README file in the directory, or
+// nil if there isn't one.
+func readme(dir string) (*esmodels.About, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		m := readmeRE.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+
+		contentType := "text/plain"
+		if m[1] == "md" {
+			contentType = "text/markdown"
+		}
+
+		c, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		return &esmodels.About{Content: string(c), ContentType: contentType}, nil
 	}
-	return true
+
+	return nil, nil
 }
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/foo/bar":          "https://github.com/foo/bar",
+		"http://github.com/foo/bar":           "https://github.com/foo/bar",
+		"https://www.GitHub.com/foo/bar/":     "https://github.com/foo/bar",
+		"https://github.com/foo/bar.git":      "https://github.com/foo/bar",
+		"https://github.com:443/foo/bar.git/": "https://github.com/foo/bar",
+		"https://github.com/foo/bar?tab=repo": "https://github.com/foo/bar",
+		"https://user@github.com/foo/bar#x":   "https://github.com/foo/bar",
+		"https://GitHub.com/Foo/Bar":          "https://github.com/Foo/Bar",
+		"https://GitLab.com/Foo/Bar.git":      "https://gitlab.com/Foo/Bar",
+	}
+
+	for in, expect := range tests {
+		u, err := url.Parse(in)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, expect, NormalizeURL(u).String(), in)
+	}
+
+	u, _ := url.Parse("http://www.github.com/foo/bar.git")
+	assert.Equal(t, "github.com/foo/bar", IDFromURL(u))
+
+	u, _ = url.Parse("https://github.com/BurntSushi/toml")
+	assert.Equal(t, "github.com/BurntSushi/toml", IDFromURL(u), "the ID keeps the case of the path")
+}
+
+func TestDedupKey(t *testing.T) {
+	assert.Equal(t, "github.com/burntsushi/toml", DedupKey("github.com/BurntSushi/toml"))
+	assert.Equal(t, DedupKey("gitlab.com/Foo/Bar"), DedupKey("gitlab.com/foo/bar"))
+	assert.Equal(t, DedupKey("bitbucket.org/Foo/Bar"), DedupKey("bitbucket.org/foo/bar"))
+	assert.Equal(t, "git.example.com/Foo/Bar", DedupKey("git.example.com/Foo/Bar"), "other hosts may be case sensitive")
+	assert.Equal(t, "github.com", DedupKey("github.com"))
+}
+
+func TestRunGit(t *testing.T) {
+	out, err := runGit(context.Background(), "", "--version")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "git version")
+
+	_, err = runGit(context.Background(), "", "no-such-command")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = runGit(ctx, "", "--version")
+	assert.Equal(t, context.Canceled, err, "nothing runs once the context is done")
+}
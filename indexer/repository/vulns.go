@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"io/ioutil"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/vulndb"
+)
+
+// vulnerabilities checks the requirements of every module the walker found.
+// A monorepo's modules are built separately, so each is checked on its own.
+// If the database can't be reached we just log it, since it's better to index
+// the ref without vulnerabilities than not at all.
+func (w *walker) vulnerabilities() []*esmodels.Vulnerability {
+	vulnDB := w.settings.VulnDB
+	if vulnDB == nil {
+		return nil
+	}
+
+	type key struct{ id, module, version string }
+	seen := make(map[key]bool)
+	var vulns []*esmodels.Vulnerability
+	for _, path := range w.goMods {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			w.l.Warnf("Could not read %s: %s", path, err)
+			continue
+		}
+		found, err := vulnDB.Check(w.ctx, vulndb.Requirements(b))
+		if err != nil {
+			w.l.Warnf("Could not check for vulnerabilities: %s", err)
+			return nil
+		}
+		for _, v := range found {
+			k := key{v.ID, v.Module, v.Version}
+			if !seen[k] {
+				seen[k] = true
+				vulns = append(vulns, v)
+			}
+		}
+	}
+	return vulns
+}
@@ -0,0 +1,373 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/autarch/metagodoc/doc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/directory"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/logger"
+	"github.com/autarch/metagodoc/metrics"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// A walker finds every package in a checked out tree and extracts its docs.
+// It doesn't care where the tree came from, so it's shared by all repository
+// types.
+type walker struct {
+	l *logger.Logger
+	// Walking stops with the context's error once it's done.
+	ctx context.Context
+	// The top of the tree.
+	root string
+	// The import path of the package at the top of the tree, unless the tree
+	// has a go.mod file saying otherwise.
+	importRoot string
+	isGoCore   bool
+	// Returns the URL for browsing a directory, given its path relative to
+	// the root, which is either empty or starts with a slash.
+	browseURL func(pathInRepo string) string
+
+	// If these are set then packages are cached by a hash of the files in
+	// their directory. The hashes are keyed by path relative to the root,
+	// like browseURL.
+	cache     *packageCache
+	dirHashes map[string]string
+
+	// The repository's policy, which may override which directories are
+	// walked and which packages are indexed. This can be nil.
+	policy *repopolicy.Policy
+	// The indexer's settings, which the policy overrides.
+	settings Settings
+
+	// The real path of every directory we've walked, so a tree that reaches
+	// the same directory twice (via a bind mount, say) can't send us around
+	// in circles.
+	visited map[string]bool
+	// Every go.mod file we've found outside of testdata, for
+	// vulnerabilities.
+	goMods []string
+}
+
+// Nothing real nests packages this deep, so a tree that does is either
+// broken or hostile.
+const maxWalkDepth = 64
+
+// A module is the closest directory at or above the one being walked which
+// has a go.mod file. Trees without one are treated as a single module rooted
+// at the top, which is how GOPATH-style import paths work.
+type module struct {
+	path string
+	dir  string
+	// False for the stand in module we use when there's no go.mod.
+	hasGoMod bool
+}
+
+// These return the indexer's settings unless the repository's policy
+// overrides them.
+func (w *walker) indexTestdata() bool {
+	if w.policy != nil && w.policy.IndexTestdata != nil {
+		return *w.policy.IndexTestdata
+	}
+	return w.settings.IndexTestdata
+}
+
+func (w *walker) indexInternal() bool {
+	if w.policy != nil && w.policy.IndexInternal != nil {
+		return *w.policy.IndexInternal
+	}
+	return w.settings.IndexInternal
+}
+
+func (w *walker) summarizeVendor() bool {
+	if w.policy != nil && w.policy.SummarizeVendor != nil {
+		return *w.policy.SummarizeVendor
+	}
+	return w.settings.SummarizeVendor
+}
+
+func (w *walker) packages() ([]*esmodels.Package, error) {
+	if w.ctx == nil {
+		w.ctx = context.Background()
+	}
+	w.visited = make(map[string]bool)
+	return w.walk(w.root, 0, module{path: w.importRoot, dir: w.root})
+}
+
+func (w *walker) walk(dir string, depth int, mod module) ([]*esmodels.Package, error) {
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if depth > maxWalkDepth {
+		w.l.Warnf("Not walking into %s, it is more than %d directories deep", dir, maxWalkDepth)
+		return nil, nil
+	}
+
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	if w.visited[real] {
+		w.l.Warnf("Not walking into %s, we have already been to %s", dir, real)
+		return nil, nil
+	}
+	w.visited[real] = true
+
+	mod = w.moduleFor(dir, mod)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var p *esmodels.Package = nil
+	var pkgs []*esmodels.Package
+
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(dir, name)
+		// A symlink can point anywhere, including outside the clone or back
+		// up the tree, so we never follow them.
+		if f.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if f.IsDir() {
+			// There are no packages to index outside of the src/ part of go
+			// core repo. The rest is tests, docs, and example programs.
+			rel := filepath.ToSlash(strings.TrimPrefix(path, w.root))
+			if w.isGoCore && rel != "/src" && !strings.HasPrefix(rel, "/src/") {
+				continue
+			}
+			if name == "testdata" && (w.isGoCore || !w.indexTestdata()) {
+				continue
+			}
+			if name == "." || name == ".git" {
+				continue
+			}
+			if (name == "internal" && !w.indexInternal()) || (name == "vendor" && !w.summarizeVendor()) {
+				continue
+			}
+			if w.policy.Excludes(rel) {
+				continue
+			}
+			sub, err := w.walk(path, depth+1, mod)
+			if err != nil {
+				return nil, err
+			}
+			pkgs = append(pkgs, sub...)
+		}
+
+		// If we've already seen a .go file in this directory then we've made
+		// the package for the directory.
+		if p != nil {
+			continue
+		}
+
+		if f.Mode().IsRegular() && strings.HasSuffix(name, ".go") {
+			if !w.policy.Includes(filepath.ToSlash(strings.TrimPrefix(dir, w.root))) {
+				continue
+			}
+			p, err = w.packageForDir(dir, mod)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p != nil {
+		w.l.Infow("Indexed package", "package", p.ImportPath)
+		return append(pkgs, p), nil
+	}
+	return pkgs, nil
+}
+
+// moduleFor returns the module which dir belongs to. A go.mod file in the
+// directory starts a new module, otherwise it's in the same module as its
+// parent.
+func (w *walker) moduleFor(dir string, parent module) module {
+	// The Go repository's go.mod files name pseudo-modules like "std", which
+	// aren't part of any import path.
+	if w.isGoCore {
+		return parent
+	}
+
+	fi, err := os.Lstat(filepath.Join(dir, "go.mod"))
+	if err != nil || !fi.Mode().IsRegular() {
+		return parent
+	}
+	path, err := modulePath(dir)
+	if err != nil {
+		w.l.Warnf("Ignoring the go.mod file in %s: %s", dir, err)
+		return parent
+	}
+	if !hasPathElement(filepath.ToSlash(strings.TrimPrefix(dir, w.root)), "testdata") {
+		w.goMods = append(w.goMods, filepath.Join(dir, "go.mod"))
+	}
+	return module{path: path, dir: dir, hasGoMod: true}
+}
+
+func (w *walker) packageForDir(d string, mod module) (*esmodels.Package, error) {
+	pathInRepo := filepath.ToSlash(strings.TrimPrefix(d, w.root))
+	importPath := w.importPath(d, pathInRepo, mod)
+	p, err := w.cachedPackage(d, pathInRepo, importPath, mod)
+	if p == nil || err != nil {
+		return p, err
+	}
+
+	// A package whose go.mod or import comment names some other path, like
+	// a GitHub repository for a k8s.io module, has to be imported with that
+	// path rather than the one its repository would suggest.
+	if w.isGoCore {
+		p.IsStdlib = isStdlib(importPath)
+	} else {
+		p.ImportPathMismatch = p.CanonicalImportPath != w.importRoot+pathInRepo
+	}
+	p.IsInternal = hasPathElement(importPath, "internal")
+	if hasPathElement(pathInRepo, "vendor") {
+		p.IsVendored = true
+		summarize(p)
+	}
+	return p, nil
+}
+
+func (w *walker) cachedPackage(d, pathInRepo, importPath string, mod module) (*esmodels.Package, error) {
+	dirHash := w.dirHashes[pathInRepo]
+	if w.cache == nil || dirHash == "" {
+		return w.parsePackage(d, pathInRepo, importPath, mod)
+	}
+
+	key := w.cacheKey(dirHash, importPath, mod)
+	if p, ok := w.cache.get(key); ok {
+		// The same files may be in another ref, which has different URLs.
+		if p != nil {
+			url := w.browseURL(pathInRepo)
+			for _, files := range [][]*doc.File{p.Files, p.TestFiles, p.IgnoredFiles} {
+				for _, f := range files {
+					f.URL = url + "/" + f.Name
+				}
+			}
+		}
+		return p, nil
+	}
+
+	p, err := w.parsePackage(d, pathInRepo, importPath, mod)
+	if err != nil {
+		return nil, err
+	}
+	w.cache.put(key, p)
+	return p, nil
+}
+
+// cacheKey returns the package cache key for a directory. The hash only
+// covers the directory's own files, so everything else which goes into
+// parsing it is part of the key too: its import path, the module it's in,
+// since a go.mod sets the package's module even if the path stays the same,
+// the repository's policy, and whether generated files are excluded.
+func (w *walker) cacheKey(dirHash, importPath string, mod module) string {
+	return fmt.Sprintf("%s\x00%s\x00%t\x00%s\x00%s\x00%t", dirHash, importPath, mod.hasGoMod, mod.path, w.policy.String(), w.settings.ExcludeGenerated)
+}
+
+// isStdlib returns true for packages in the Go repository which are part of
+// the standard library, as opposed to the go command and the other tools
+// under cmd/.
+func isStdlib(importPath string) bool {
+	return importPath != "cmd" && !strings.HasPrefix(importPath, "cmd/")
+}
+
+func hasPathElement(path, elem string) bool {
+	for _, e := range strings.Split(path, "/") {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// summarize removes everything but the package's synopsis, files, and
+// imports.
+func summarize(p *esmodels.Package) {
+	p.Doc = ""
+	p.Consts = nil
+	p.Funcs = nil
+	p.Types = nil
+	p.Vars = nil
+	p.Examples = nil
+	p.Notes = nil
+}
+
+// importPath is the module path plus the directory's path within the
+// module. We can't ask go/build for this, since it only knows about GOPATH
+// and we're looking at a bare checkout.
+func (w *walker) importPath(d, pathInRepo string, mod module) string {
+	if w.isGoCore {
+		// Packages in the Go repository live under src/, or src/pkg/ in
+		// older releases, and are imported relative to that.
+		p := strings.TrimPrefix(pathInRepo, "/src/")
+		return strings.TrimPrefix(p, "pkg/")
+	}
+
+	rel := filepath.ToSlash(strings.TrimPrefix(d, mod.dir))
+	return mod.path + rel
+}
+
+func (w *walker) parsePackage(d, pathInRepo, importPath string, mod module) (*esmodels.Package, error) {
+	dir := directory.New(d, importPath, w.browseURL(pathInRepo))
+	if mod.hasGoMod {
+		dir.Module = mod.path
+	}
+	dir.ExcludeGenerated = w.settings.ExcludeGenerated
+	pkg, err := doc.NewPackage(dir)
+	metrics.PackagesParsed.Add(1)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse the package in %s: {{err}}", d), err)
+	}
+
+	canonical := importPath
+	if pkg.CanonicalImportPath != "" {
+		canonical = pkg.CanonicalImportPath
+	}
+
+	return &esmodels.Package{
+		Name:                pkg.Name,
+		ImportPath:          importPath,
+		CanonicalImportPath: canonical,
+		Doc:                 pkg.Doc,
+		Synopsis:            pkg.Synopsis,
+		Errors:              pkg.Errors,
+		IsCommand:           pkg.IsCmd,
+		Files:               pkg.Files,
+		TestFiles:           pkg.TestFiles,
+		IgnoredFiles:        pkg.IgnoredFiles,
+		GeneratedFiles:      pkg.GeneratedFiles,
+		HandWrittenFiles:    pkg.HandWrittenFiles,
+		EmbedPatterns:       pkg.EmbedPatterns,
+		Imports:             pkg.Imports,
+		TestImports:         pkg.TestImports,
+		XTestImports:        pkg.XTestImports,
+		Consts:              pkg.Consts,
+		Funcs:               pkg.Funcs,
+		Types:               pkg.Types,
+		Vars:                pkg.Vars,
+		Examples:            pkg.Examples,
+		Notes:               pkg.Notes,
+		Complexity:          pkg.Complexity,
+		Quality:             pkg.Quality,
+		Platforms:           pkg.Platforms,
+		Testing:             esmodels.NewTestSignals(len(pkg.Files), len(pkg.TestFiles), pkg.TableTests, pkg.TestHelpers),
+		Stats: &esmodels.CodeStats{
+			GoFiles:          len(pkg.Files),
+			TestFiles:        len(pkg.TestFiles),
+			Lines:            pkg.Lines,
+			CommentLines:     pkg.CommentLines,
+			TestLines:        pkg.TestLines,
+			TestCommentLines: pkg.TestCommentLines,
+		},
+	}, nil
+}
@@ -0,0 +1,564 @@
+package repository
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/autarch/metagodoc/doc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/directory"
+	"github.com/autarch/metagodoc/indexer/repopolicy"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkerSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "metagodoc-outside")
+	must(t, err)
+	defer os.RemoveAll(outside)
+
+	write(t, filepath.Join(outside, "secret.go"), "// Package secret is not in the repo.\npackage secret\n")
+	write(t, filepath.Join(dir, "a", "a.go"), "// Package a is in the repo.\npackage a\n")
+	must(t, os.Symlink("..", filepath.Join(dir, "a", "loop")))
+	must(t, os.Symlink(outside, filepath.Join(dir, "outside")))
+	must(t, os.Symlink(filepath.Join(outside, "secret.go"), filepath.Join(dir, "a", "stolen.go")))
+	must(t, os.Mkdir(filepath.Join(dir, "b"), 0755))
+	must(t, os.Symlink(filepath.Join(outside, "secret.go"), filepath.Join(dir, "b", "b.go")))
+
+	deep := filepath.Join(append([]string{dir, "deep"}, strings.Split(strings.Repeat("d", maxWalkDepth+1), "")...)...)
+	write(t, filepath.Join(deep, "deep.go"), "package deep\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "example.com/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	if assert.Len(t, pkgs, 1, "only a is found") {
+		assert.Equal(t, "example.com/thing/a", pkgs[0].ImportPath)
+		var files []string
+		for _, f := range pkgs[0].Files {
+			files = append(files, f.Name)
+		}
+		assert.Equal(t, []string{"a.go"}, files, "symlinked files are not read")
+	}
+}
+
+func TestWalkerSkipsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "a", "a.go"), "// Package a is in the repo.\npackage a\n")
+	write(t, filepath.Join(dir, "a", "big.go"), "package a\n\n//"+strings.Repeat("x", directory.MaxFileSize)+"\n")
+	write(t, filepath.Join(dir, "a", "binary.go"), "\x7fELF\x02\x01\x01\x00")
+
+	// Each file is under the limit, but not all of them fit in one package.
+	chunk := "package b\n\n//" + strings.Repeat("x", directory.MaxFileSize/2) + "\n"
+	for i := 0; i*len(chunk) <= directory.MaxPackageSize; i++ {
+		write(t, filepath.Join(dir, "b", fmt.Sprintf("b%02d.go", i)), chunk)
+	}
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "example.com/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	byPath := map[string]*esmodels.Package{}
+	for _, p := range pkgs {
+		byPath[p.ImportPath] = p
+	}
+	if a := byPath["example.com/thing/a"]; assert.NotNil(t, a) {
+		assert.Len(t, a.Files, 1)
+		if assert.Len(t, a.Errors, 2) {
+			assert.Equal(t, doc.SizeError, a.Errors[0].Category)
+			assert.Equal(t, "big.go", a.Errors[0].File)
+			assert.Equal(t, doc.BinaryError, a.Errors[1].Category)
+			assert.Equal(t, "binary.go", a.Errors[1].File)
+		}
+	}
+	if b := byPath["example.com/thing/b"]; assert.NotNil(t, b) {
+		assert.Len(t, b.Files, directory.MaxPackageSize/len(chunk))
+		if assert.Len(t, b.Errors, 1) {
+			assert.Equal(t, doc.SizeError, b.Errors[0].Category)
+			assert.Contains(t, b.Errors[0].Message, "more than the limit")
+		}
+	}
+}
+
+func TestWalkerImportPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "go.mod"), "module example.com/thing/v2\n")
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "sub", "sub.go"), "package sub\n")
+	write(t, filepath.Join(dir, "tools", "go.mod"), "module example.com/tools\n")
+	write(t, filepath.Join(dir, "tools", "gen", "gen.go"), "package main\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+	assert.ElementsMatch(
+		t,
+		[]string{"example.com/thing/v2", "example.com/thing/v2/sub", "example.com/tools/gen"},
+		packageImportPaths(pkgs),
+		"paths come from the closest go.mod",
+	)
+
+	must(t, os.Remove(filepath.Join(dir, "go.mod")))
+	pkgs, err = w.packages()
+	must(t, err)
+	assert.ElementsMatch(
+		t,
+		[]string{"github.com/example/thing", "github.com/example/thing/sub", "example.com/tools/gen"},
+		packageImportPaths(pkgs),
+		"without a go.mod the paths are relative to the import root",
+	)
+
+	core := &walker{isGoCore: true}
+	assert.Equal(t, "cmd/go", core.importPath("", "/src/cmd/go", module{}))
+	assert.Equal(t, "net/http", core.importPath("", "/src/pkg/net/http", module{}), "old releases kept packages in src/pkg")
+}
+
+func TestWalkerCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "sub", "sub.go"), "package sub // import \"example.com/elsewhere\"\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+		cache:      newPackageCache(l, dir),
+		// A go.mod in the root doesn't change the files in sub.
+		dirHashes: map[string]string{"/sub": "abc"},
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+	if assert.Len(t, pkgs, 1) {
+		assert.Equal(t, "example.com/elsewhere", pkgs[0].CanonicalImportPath, "the import comment counts without a go.mod")
+	}
+
+	write(t, filepath.Join(dir, "go.mod"), "module github.com/example/thing\n")
+	pkgs, err = w.packages()
+	must(t, err)
+	if assert.Len(t, pkgs, 1) {
+		assert.Equal(t, "github.com/example/thing/sub", pkgs[0].CanonicalImportPath, "the package isn't taken from the cache once there's a go.mod")
+	}
+}
+
+func TestWalkerPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "staging", "api", "api.go"), "package api\n")
+	write(t, filepath.Join(dir, "staging", "api", "internal", "util", "util.go"), "package util\n")
+	write(t, filepath.Join(dir, "staging", "kubectl", "kubectl.go"), "package kubectl\n")
+	write(t, filepath.Join(dir, "pkg", "kubelet", "kubelet.go"), "package kubelet\n")
+
+	rules, err := repopolicy.ParseRules([]byte(`
+- pattern: github.com/example/thing
+  include: [staging/...]
+  exclude: [staging/kubectl]
+  index_internal: true
+`))
+	must(t, err)
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+		policy:     rules.For("github.com/example/thing"),
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	assert.ElementsMatch(
+		t,
+		[]string{"github.com/example/thing/staging/api", "github.com/example/thing/staging/api/internal/util"},
+		packageImportPaths(pkgs),
+	)
+}
+
+func packageImportPaths(pkgs []*esmodels.Package) []string {
+	var paths []string
+	for _, p := range pkgs {
+		paths = append(paths, p.ImportPath)
+	}
+	return paths
+}
+
+func TestWalkerBuildConstraints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "go.mod"), "module example.com/thing\n")
+	write(t, filepath.Join(dir, "thing.go"), "package thing // import \"github.com/example/thing\"\n\nimport _ \"embed\"\n\n//go:embed thing.txt\nvar Text string\n")
+	write(t, filepath.Join(dir, "thing.txt"), "thing\n")
+	write(t, filepath.Join(dir, "thing_plan9.go"), "package thing\n")
+	write(t, filepath.Join(dir, "gen.go"), "//go:build ignore\n\npackage main\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	if assert.Len(t, pkgs, 1, "the import comment is ignored when there's a go.mod") {
+		p := pkgs[0]
+		assert.Equal(t, "example.com/thing", p.ImportPath)
+		var ignored []string
+		for _, f := range p.IgnoredFiles {
+			ignored = append(ignored, f.Name)
+		}
+		assert.ElementsMatch(t, []string{"gen.go", "thing_plan9.go"}, ignored)
+		assert.Equal(t, []string{"thing.txt"}, p.EmbedPatterns)
+	}
+}
+
+func TestWalkerErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n\nimport _ \"example.com/other/vendor/dep\"\n")
+	write(t, filepath.Join(dir, "example_test.go"), "package thing\n\nfunc Example() {\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "example.com/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	if assert.Len(t, pkgs, 1) {
+		var categories []string
+		for _, e := range pkgs[0].Errors {
+			categories = append(categories, e.Category)
+			if e.Category == doc.ParseError {
+				assert.Equal(t, "example_test.go", e.File)
+				assert.NotZero(t, e.Line)
+			}
+		}
+		assert.ElementsMatch(t, []string{doc.ParseError, doc.VendorError}, categories)
+	}
+}
+
+func TestWalkerGeneratedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "go.mod"), "module example.com/thing\n")
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n\nfunc Thing() {}\n")
+	write(t, filepath.Join(dir, "thing.pb.go"), "// Code generated by protoc-gen-go. DO NOT EDIT.\n\n// Package thing is generated.\npackage thing\n\ntype Message struct{}\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+
+	pkgs, err := w.packages()
+	must(t, err)
+	if assert.Len(t, pkgs, 1) {
+		p := pkgs[0]
+		assert.Equal(t, 1, p.GeneratedFiles)
+		assert.Equal(t, 1, p.HandWrittenFiles)
+		for _, f := range p.Files {
+			assert.Equal(t, f.Name == "thing.pb.go", f.Generated, f.Name)
+		}
+		assert.Equal(t, "Package thing is generated.", p.Synopsis)
+	}
+
+	w.settings.ExcludeGenerated = true
+	pkgs, err = w.packages()
+	must(t, err)
+	if assert.Len(t, pkgs, 1) {
+		p := pkgs[0]
+		assert.Equal(t, "", p.Synopsis, "the generated package comment is ignored")
+		assert.Len(t, p.Types, 1, "generated declarations are still documented")
+	}
+}
+
+func TestWalkerStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "// Package thing does things.\npackage thing\n\n/*\nThing does a thing.\n*/\nfunc Thing() {} // Really.")
+	write(t, filepath.Join(dir, "thing_test.go"), "package thing\n\n// Nothing to see here.\n")
+	write(t, filepath.Join(dir, "sub", "sub.go"), "package sub\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+
+	pkgs, err := w.packages()
+	must(t, err)
+	stats := make(map[string]*esmodels.CodeStats)
+	for _, p := range pkgs {
+		stats[p.ImportPath] = p.Stats
+	}
+	assert.Equal(
+		t,
+		&esmodels.CodeStats{GoFiles: 1, TestFiles: 1, Lines: 7, CommentLines: 5, TestLines: 3, TestCommentLines: 1},
+		stats["github.com/example/thing"],
+	)
+
+	ref := &esmodels.Ref{Packages: pkgs}
+	ref.CountStats()
+	assert.Equal(t, &esmodels.CodeStats{GoFiles: 2, TestFiles: 1, Lines: 8, CommentLines: 5, TestLines: 3, TestCommentLines: 1}, ref.Stats)
+	assert.Equal(t, &esmodels.TestSignals{TestRatio: 0.5, TestedPackages: 0.5}, ref.Testing)
+
+	r := &esmodels.Repository{Refs: []*esmodels.Ref{{Name: "v1"}, {Name: "master", IsDefaultBranch: true, Testing: ref.Testing}}}
+	r.SetTesting()
+	assert.Equal(t, ref.Testing, r.Testing, "the default branch's")
+}
+
+func TestWalkerTestdata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "testdata", "fixture", "fixture.go"), "package fixture\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+	assert.Equal(t, []string{"github.com/example/thing"}, packageImportPaths(pkgs), "testdata is skipped")
+
+	w.settings.IndexTestdata = true
+	pkgs, err = w.packages()
+	must(t, err)
+	assert.ElementsMatch(
+		t,
+		[]string{"github.com/example/thing", "github.com/example/thing/testdata/fixture"},
+		packageImportPaths(pkgs),
+		"testdata is walked when asked for",
+	)
+}
+
+func TestWalkerInternalAndVendor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "internal", "util", "util.go"), "package util\n")
+	write(t, filepath.Join(dir, "vendor", "example.com", "dep", "dep.go"), "// Package dep is a dependency.\npackage dep\n\n// Dep does things.\nfunc Dep() {}\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+	assert.Equal(t, []string{"github.com/example/thing"}, packageImportPaths(pkgs), "internal and vendor are skipped")
+
+	w.settings.IndexInternal = true
+	w.settings.SummarizeVendor = true
+	pkgs, err = w.packages()
+	must(t, err)
+
+	byPath := make(map[string]*esmodels.Package)
+	for _, p := range pkgs {
+		byPath[p.ImportPath] = p
+	}
+	assert.Len(t, byPath, 3)
+	assert.False(t, byPath["github.com/example/thing"].IsInternal)
+	if p := byPath["github.com/example/thing/internal/util"]; assert.NotNil(t, p) {
+		assert.True(t, p.IsInternal)
+		assert.False(t, p.IsVendored)
+	}
+	if p := byPath["github.com/example/thing/vendor/example.com/dep"]; assert.NotNil(t, p) {
+		assert.True(t, p.IsVendored)
+		assert.Equal(t, "Package dep is a dependency.", p.Synopsis)
+		assert.Empty(t, p.Funcs, "vendored packages are only summarized")
+	}
+}
+
+func TestWalkerConflictingPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "a.go"), "package thing\n\n// A is a thing.\nfunc A() {}\n")
+	write(t, filepath.Join(dir, "b.go"), "package thing\n\n// B is a thing.\nfunc B() {}\n")
+	write(t, filepath.Join(dir, "c.go"), "package other\n\nfunc C() {}\n")
+	write(t, filepath.Join(dir, "d.go"), "package thing\n\nimport \"fmt\n")
+	write(t, filepath.Join(dir, "thing_test.go"), "package thing_test\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "example.com/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	if assert.Len(t, pkgs, 1) {
+		p := pkgs[0]
+		assert.Equal(t, "thing", p.Name, "the package most files are in is indexed")
+		var funcs []string
+		for _, f := range p.Funcs {
+			funcs = append(funcs, f.Name)
+		}
+		assert.Equal(t, []string{"A", "B"}, funcs)
+
+		bad := make(map[string]string)
+		for _, e := range p.Errors {
+			bad[e.File] = e.Category
+		}
+		assert.Equal(t, map[string]string{"c.go": doc.ConflictError, "d.go": doc.ParseError}, bad)
+	}
+}
+
+func TestWalkerCanonicalImportPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "thing.go"), "package thing\n")
+	write(t, filepath.Join(dir, "yaml", "yaml.go"), "package yaml // import \"gopkg.in/yaml.v2\"\n")
+	write(t, filepath.Join(dir, "bad", "bad.go"), "package bad // import \"not a path\"\n")
+	write(t, filepath.Join(dir, "api", "go.mod"), "module k8s.io/api\n")
+	write(t, filepath.Join(dir, "api", "api.go"), "package api\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/example/thing",
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	byPath := make(map[string]*esmodels.Package)
+	for _, p := range pkgs {
+		byPath[p.ImportPath] = p
+	}
+	if p := byPath["github.com/example/thing"]; assert.NotNil(t, p) {
+		assert.Equal(t, "github.com/example/thing", p.CanonicalImportPath)
+		assert.False(t, p.ImportPathMismatch)
+	}
+	if p := byPath["github.com/example/thing/yaml"]; assert.NotNil(t, p, "packages with an import comment are still indexed") {
+		assert.Equal(t, "gopkg.in/yaml.v2", p.CanonicalImportPath)
+		assert.True(t, p.ImportPathMismatch)
+	}
+	if p := byPath["github.com/example/thing/bad"]; assert.NotNil(t, p) {
+		assert.Equal(t, "github.com/example/thing/bad", p.CanonicalImportPath, "an invalid import comment is ignored")
+		if assert.Len(t, p.Errors, 1) {
+			assert.Equal(t, doc.BuildError, p.Errors[0].Category)
+		}
+	}
+	if p := byPath["k8s.io/api"]; assert.NotNil(t, p) {
+		assert.Equal(t, "k8s.io/api", p.CanonicalImportPath)
+		assert.True(t, p.ImportPathMismatch)
+	}
+}
+
+func TestWalkerGoCore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metagodoc-walker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	write(t, filepath.Join(dir, "src", "go.mod"), "module std\n")
+	write(t, filepath.Join(dir, "src", "net", "http", "http.go"), "package http\n")
+	write(t, filepath.Join(dir, "src", "net", "http", "testdata", "x.go"), "package x\n")
+	write(t, filepath.Join(dir, "src", "cmd", "go", "main.go"), "package main\n")
+	write(t, filepath.Join(dir, "misc", "cgo", "test.go"), "package cgotest\n")
+	write(t, filepath.Join(dir, "test", "bug.go"), "package main\n")
+
+	l, err := logger.New(logger.NewParams{})
+	must(t, err)
+	w := &walker{
+		l:          l,
+		root:       dir,
+		importRoot: "github.com/golang/go",
+		isGoCore:   true,
+		browseURL:  func(string) string { return "" },
+	}
+	pkgs, err := w.packages()
+	must(t, err)
+
+	stdlib := make(map[string]bool)
+	for _, p := range pkgs {
+		stdlib[p.ImportPath] = p.IsStdlib
+		assert.False(t, p.ImportPathMismatch, p.ImportPath)
+	}
+	assert.Equal(t, map[string]bool{"net/http": true, "cmd/go": false}, stdlib, "only packages under src are indexed")
+}
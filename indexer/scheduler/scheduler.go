@@ -0,0 +1,123 @@
+// Package scheduler decides when repositories should be recrawled. Active,
+// popular repositories change often and people care about them, so they are
+// crawled frequently, while repositories that have gone quiet are only
+// checked occasionally.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/queue"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+const day = 24 * time.Hour
+
+// Interval returns how long to wait between crawls of a repository with the
+// given status and number of stars.
+func Interval(status esmodels.ActivityStatus, stars int) time.Duration {
+	switch status {
+	case esmodels.Active:
+		switch {
+		case stars >= 1000:
+			return day
+		case stars >= 100:
+			return 3 * day
+		default:
+			return 7 * day
+		}
+	case esmodels.QuickFork, esmodels.DeadEndFork:
+		return 60 * day
+	// New repositories are often empty for a little while before their
+	// first push.
+	case esmodels.Empty:
+		return 7 * day
+	default:
+		return 30 * day
+	}
+}
+
+// NextCrawl returns the time at which a repository should next be crawled,
+// based on when it was last crawled. If the last crawl time cannot be parsed
+// then the repository is due now.
+func NextCrawl(r *esmodels.Repository) time.Time {
+	last, err := time.Parse(esmodels.DateTimeFormat, r.LastCrawled)
+	if err != nil {
+		return time.Now()
+	}
+	return last.Add(Interval(r.Status, r.Stars))
+}
+
+type NewParams struct {
+	Logger  *logger.Logger
+	Elastic *elc.Client
+	Queue   *queue.Queue
+	Context context.Context
+}
+
+type Scheduler struct {
+	l       *logger.Logger
+	elastic *elc.Client
+	queue   *queue.Queue
+	ctx     context.Context
+}
+
+func New(p NewParams) *Scheduler {
+	return &Scheduler{
+		l:       p.Logger,
+		elastic: p.Elastic,
+		queue:   p.Queue,
+		ctx:     p.Context,
+	}
+}
+
+// Schedule reads every indexed repository and makes sure the crawl queue has
+// it scheduled for the right time.
+func (s *Scheduler) Schedule() error {
+	s.l.Info("Scheduling recrawls of indexed repositories")
+
+	scroll := s.elastic.
+		Scroll(esmodels.Index("repository")).
+		Type(s.elastic.SearchTypes("repository")...).
+		FetchSourceContext(
+			elastic.NewFetchSourceContext(true).Include("primary_url", "status", "stars", "imported_by", "last_crawled"),
+		).
+		Size(500)
+
+	n := 0
+	for {
+		result, err := scroll.Do(s.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errwrap.Wrapf("Scroll: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			r := &esmodels.Repository{}
+			err := json.Unmarshal(*hit.Source, r)
+			if err != nil {
+				return errwrap.Wrapf("Unmarshal: {{err}}", err)
+			}
+
+			err = s.queue.Schedule(hit.Id, r.PrimaryURL, NextCrawl(r), &queue.Stats{Stars: r.Stars, ImportedBy: r.ImportedBy})
+			if err != nil {
+				return err
+			}
+			n++
+		}
+	}
+
+	s.l.Infof("Scheduled %d repositories", n)
+
+	return nil
+}
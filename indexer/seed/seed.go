@@ -0,0 +1,137 @@
+// Package seed reads curated lists of Go projects, like awesome-go, so that
+// the crawl can start from repositories people have already vouched for
+// rather than whatever GitHub search turns up first.
+package seed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// A Seed is a repository found in a curated list.
+type Seed struct {
+	URL *url.URL
+	// The heading the repository was listed under, like "Database Drivers".
+	Category string
+}
+
+var (
+	headingRE = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*#*\s*$`)
+	itemRE    = regexp.MustCompile(`^\s*[-*+]\s+\[[^\]]*\]\(([^)\s]+)\)`)
+)
+
+// Headings whose links point elsewhere in the list rather than at projects.
+var skipHeadings = map[string]bool{
+	"contents":          true,
+	"table of contents": true,
+}
+
+// Parse returns the repositories listed in a Markdown document, in the order
+// they appear. Only the first link in each list item is used, since that's
+// the project itself in every list we care about. Links that don't look like
+// a repository, like the websites in awesome-go's resources section, are
+// ignored.
+func Parse(r io.Reader) ([]*Seed, error) {
+	var seeds []*Seed
+	category := ""
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+
+		if m := headingRE.FindStringSubmatch(line); m != nil {
+			category = m[1]
+			continue
+		}
+
+		if skipHeadings[strings.ToLower(category)] {
+			continue
+		}
+
+		m := itemRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		u := repositoryURL(m[1])
+		if u == nil {
+			continue
+		}
+
+		seeds = append(seeds, &Seed{URL: u, Category: category})
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return seeds, nil
+}
+
+// Repositories on the well known hosts are always owner/name, and links often
+// go deeper into the repository than that. For other hosts we can't know
+// where the repository ends, so we take the link as is and let the crawlers
+// decide whether they can do anything with it.
+var knownHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+func repositoryURL(link string) *url.URL {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	if knownHosts[host] {
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil
+		}
+		parts = parts[:2]
+	} else if parts[0] == "" {
+		return nil
+	}
+
+	return &url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "/" + strings.TrimSuffix(strings.Join(parts, "/"), ".git"),
+	}
+}
+
+// Fetch reads and parses a list from a URL or a local file.
+func Fetch(client *http.Client, source string) ([]*Seed, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Could not open %s: {{err}}", source), err)
+		}
+		defer f.Close()
+
+		return Parse(f)
+	}
+
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not fetch %s: {{err}}", source), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch %s: %s", source, resp.Status)
+	}
+
+	return Parse(resp.Body)
+}
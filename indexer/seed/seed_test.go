@@ -0,0 +1,59 @@
+package seed
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const readme = `# Awesome Go
+
+## Contents
+
+- [Awesome Go](#awesome-go)
+    - [Audio and Music](#audio-and-music)
+
+## Audio and Music
+
+*Libraries for manipulating audio.*
+
+* [beep](https://github.com/faiface/beep) - A simple library for playback and audio manipulation.
+* [flac](https://github.com/mewkiz/flac/tree/master/cmd) - Native Go FLAC encoder/decoder.
+
+### Database Drivers
+
+- [go-sql-driver](https://github.com/go-sql-driver/mysql.git) - MySQL driver.
+- [gitlab thing](https://gitlab.com/foo/bar/-/tree/main) - Hosted on GitLab.
+- [vanity](https://go.example.org/pkg/) - On a custom domain.
+- [broken](ftp://example.org/pkg) - Not a web link.
+
+## Websites
+
+- [Go Blog](https://blog.golang.org) - The official Go blog.
+- Not a link at all.
+`
+
+func TestParse(t *testing.T) {
+	seeds, err := Parse(strings.NewReader(readme))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var got [][2]string
+	for _, s := range seeds {
+		got = append(got, [2]string{s.URL.String(), s.Category})
+	}
+
+	assert.Equal(
+		t,
+		[][2]string{
+			{"https://github.com/faiface/beep", "Audio and Music"},
+			{"https://github.com/mewkiz/flac", "Audio and Music"},
+			{"https://github.com/go-sql-driver/mysql", "Database Drivers"},
+			{"https://gitlab.com/foo/bar", "Database Drivers"},
+			{"https://go.example.org/pkg", "Database Drivers"},
+		},
+		got,
+	)
+}
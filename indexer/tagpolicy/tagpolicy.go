@@ -0,0 +1,390 @@
+// Package tagpolicy decides which of a repository's version tags are indexed.
+// Indexing every tag of a repository with hundreds of releases costs a lot
+// and isn't very useful, so by default we only index the newest few tags of
+// each major version.
+//
+// The default policy can be changed with a string like
+// "per_major=5,since=2018-01-01", and the policy for particular repositories
+// can be set with a YAML file containing a sequence of rules:
+//
+//   - pattern: github.com/golang/go
+//     per_major: 0
+//     since: 2017-01-01
+//   - pattern: github.com/stretchr/...
+//     tags: [v1.1.4, v1.2.2]
+//   - pattern: github.com/example/calver
+//     scheme: date
+//     prefix: release-
+//
+// The scheme says what the version tags look like. The default, "semver",
+// matches tags like "v1.2.3" and "v1.2.3-rc.1", while "date" matches tags like
+// "2024.06.01" and orders them by date. If a prefix is set then only tags
+// starting with it are versions, so "release-1.2" is version 1.2.
+//
+// Patterns work just like those in a repolist. The first matching rule wins
+// and anything it leaves out comes from the default policy.
+package tagpolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/repolist"
+
+	"github.com/hashicorp/errwrap"
+	version "github.com/hashicorp/go-version"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const dateFormat = "2006-01-02"
+
+// DefaultPerMajor is how many tags of each major version are indexed unless a
+// policy says otherwise.
+const DefaultPerMajor = 3
+
+// The tag schemes we know about.
+const (
+	SemVer = "semver"
+	Date   = "date"
+)
+
+var (
+	semVerRE = regexp.MustCompile(`^v?[0-9]+(?:\.[0-9]+)*(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?$`)
+	dateRE   = regexp.MustCompile(`^v?([0-9]{4})[.-]?([0-9]{2})[.-]?([0-9]{2})(?:[.-]([0-9]+))?$`)
+)
+
+type Policy struct {
+	// The newest this many tags of each major version are indexed. Zero
+	// means all of them.
+	PerMajor *int `yaml:"per_major,omitempty"`
+	// Only tags created on or after this date, in YYYY-MM-DD format, are
+	// indexed.
+	Since string `yaml:"since,omitempty"`
+	// If this is set then exactly these tags are indexed, as long as they
+	// exist, and the other settings are ignored.
+	Tags []string `yaml:"tags,omitempty"`
+	// What the version tags look like, either "semver" or "date". For date
+	// tags the year counts as the major version.
+	Scheme string `yaml:"scheme,omitempty"`
+	// Only tags starting with this are versions, and it's removed before
+	// the rest is parsed.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Whether to index prerelease tags like "v1.2.3-rc.1". They are by
+	// default, until there's a release of the same version.
+	Prereleases *bool `yaml:"prereleases,omitempty"`
+
+	since time.Time
+}
+
+// A Tag is a version tag in a repository.
+type Tag struct {
+	Name    string
+	Version *version.Version
+	Created time.Time
+}
+
+// Default returns the policy used when nothing else is configured.
+func Default() *Policy {
+	n := DefaultPerMajor
+	return &Policy{PerMajor: &n}
+}
+
+// Parse parses a policy from a comma-separated list of key=value pairs. The
+// keys are "per_major", "since", "scheme", "prefix", and "prereleases".
+// Anything not set comes from Default.
+func Parse(s string) (*Policy, error) {
+	p := Default()
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid tag policy setting %q, expected key=value", pair)
+		}
+
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch k {
+		case "per_major":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid per_major value: %s", v)
+			}
+			p.PerMajor = &n
+		case "since":
+			p.Since = v
+		case "scheme":
+			p.Scheme = v
+		case "prefix":
+			p.Prefix = v
+		case "prereleases":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid prereleases value: %s", v)
+			}
+			p.Prereleases = &b
+		default:
+			return nil, fmt.Errorf("Unknown tag policy setting: %s", k)
+		}
+	}
+
+	return p, p.validate()
+}
+
+func (p *Policy) validate() error {
+	if p.PerMajor != nil && *p.PerMajor < 0 {
+		return fmt.Errorf("per_major cannot be negative")
+	}
+	switch p.Scheme {
+	case "", SemVer, Date:
+	default:
+		return fmt.Errorf("Unknown tag scheme: %s", p.Scheme)
+	}
+	if p.Since != "" {
+		t, err := time.Parse(dateFormat, p.Since)
+		if err != nil {
+			return errwrap.Wrapf("Invalid since date: {{err}}", err)
+		}
+		p.since = t
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the policy with any unset fields taken from
+// def.
+func (p *Policy) withDefaults(def *Policy) *Policy {
+	c := *p
+	if c.PerMajor == nil {
+		c.PerMajor = def.PerMajor
+	}
+	if c.Since == "" {
+		c.Since = def.Since
+		c.since = def.since
+	}
+	if c.Scheme == "" {
+		c.Scheme = def.Scheme
+	}
+	if c.Prefix == "" {
+		c.Prefix = def.Prefix
+	}
+	if c.Prereleases == nil {
+		c.Prereleases = def.Prereleases
+	}
+	return &c
+}
+
+// String describes the policy. This is included in a repository's content
+// hash, so that changing the policy means the repository is indexed again.
+func (p *Policy) String() string {
+	if len(p.Tags) > 0 {
+		return "tags=" + strings.Join(p.Tags, "|")
+	}
+
+	perMajor := 0
+	if p.PerMajor != nil {
+		perMajor = *p.PerMajor
+	}
+	s := fmt.Sprintf("per_major=%d,since=%s", perMajor, p.Since)
+
+	// These are only included when they're set so that adding them didn't
+	// change the hash of every repository.
+	if p.Scheme != "" && p.Scheme != SemVer {
+		s += ",scheme=" + p.Scheme
+	}
+	if p.Prefix != "" {
+		s += ",prefix=" + p.Prefix
+	}
+	if p.Prereleases != nil && !*p.Prereleases {
+		s += ",prereleases=false"
+	}
+	return s
+}
+
+// Version returns the version for a tag name, or false if the tag isn't a
+// version according to the policy's scheme.
+func (p *Policy) Version(name string) (*version.Version, bool) {
+	if !strings.HasPrefix(name, p.Prefix) {
+		return nil, false
+	}
+	name = strings.TrimPrefix(name, p.Prefix)
+
+	if p.Scheme == Date {
+		return dateVersion(name)
+	}
+
+	if !semVerRE.MatchString(name) {
+		return nil, false
+	}
+	v, err := version.NewVersion(name)
+	if err != nil {
+		return nil, false
+	}
+	if v.Prerelease() != "" && p.Prereleases != nil && !*p.Prereleases {
+		return nil, false
+	}
+	return v, true
+}
+
+// dateVersion turns a tag like "2024.06.01" or "20240601.2" into version
+// 2024.6.1 or 2024.6.1.2, so that dates sort in order.
+func dateVersion(name string) (*version.Version, bool) {
+	m := dateRE.FindStringSubmatch(name)
+	if m == nil {
+		return nil, false
+	}
+	if _, err := time.Parse("20060102", m[1]+m[2]+m[3]); err != nil {
+		return nil, false
+	}
+
+	s := m[1] + "." + m[2] + "." + m[3]
+	if m[4] != "" {
+		s += "." + m[4]
+	}
+	v, err := version.NewVersion(s)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Select returns the names of the tags to index, oldest version first.
+func (p *Policy) Select(tags []Tag) []string {
+	sorted := make([]Tag, len(tags))
+	copy(sorted, tags)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Version.LessThan(sorted[j].Version) })
+
+	if len(p.Tags) > 0 {
+		want := make(map[string]bool)
+		for _, t := range p.Tags {
+			want[t] = true
+		}
+
+		var names []string
+		for _, t := range sorted {
+			if want[t.Name] {
+				names = append(names, t.Name)
+			}
+		}
+		return names
+	}
+
+	perMajor := 0
+	if p.PerMajor != nil {
+		perMajor = *p.PerMajor
+	}
+
+	// A prerelease isn't worth indexing once the version it leads up to has
+	// been released.
+	released := make(map[string]bool)
+	for _, t := range sorted {
+		if t.Version.Prerelease() == "" {
+			released[core(t.Version)] = true
+		}
+	}
+
+	// We go from newest to oldest so we can count the tags for each major
+	// version as we see them.
+	var names []string
+	seen := make(map[int64]int)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		t := sorted[i]
+		if !p.since.IsZero() && t.Created.Before(p.since) {
+			continue
+		}
+		if t.Version.Prerelease() != "" && released[core(t.Version)] {
+			continue
+		}
+
+		major := t.Version.Segments64()[0]
+		if perMajor > 0 && seen[major] >= perMajor {
+			continue
+		}
+		seen[major]++
+		names = append([]string{t.Name}, names...)
+	}
+	return names
+}
+
+// core returns a version without any prerelease or metadata.
+func core(v *version.Version) string {
+	return fmt.Sprint(v.Segments64())
+}
+
+// Rules are the policies for particular repositories.
+type Rules struct {
+	def      *Policy
+	list     *repolist.List
+	policies map[*repolist.Entry]*Policy
+}
+
+type rule struct {
+	Pattern string `yaml:"pattern"`
+	Policy  `yaml:",inline"`
+}
+
+// Load reads rules from the YAML file at the given path. Repositories which
+// don't match any rule use def. If the path is empty then every repository
+// uses def.
+func Load(path string, def *Policy) (*Rules, error) {
+	if path == "" {
+		return &Rules{def: def}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s: {{err}}", path), err)
+	}
+
+	r, err := ParseRules(b, def)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Invalid tag policies in %s: {{err}}", path), err)
+	}
+	return r, nil
+}
+
+// ParseRules parses rules from YAML.
+func ParseRules(b []byte, def *Policy) (*Rules, error) {
+	var rules []*rule
+	err := yaml.UnmarshalStrict(b, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rules{
+		def:      def,
+		policies: make(map[*repolist.Entry]*Policy),
+	}
+	var entries []*repolist.Entry
+	for _, ru := range rules {
+		err := ru.Policy.validate()
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Invalid policy for %s: {{err}}", ru.Pattern), err)
+		}
+
+		e := &repolist.Entry{Pattern: ru.Pattern}
+		entries = append(entries, e)
+		p := ru.Policy
+		r.policies[e] = &p
+	}
+
+	r.list, err = repolist.New(entries)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// For returns the policy for the repository with the given ID.
+func (r *Rules) For(id string) *Policy {
+	if e := r.list.Match(id); e != nil {
+		return r.policies[e].withDefaults(r.def)
+	}
+	return r.def
+}
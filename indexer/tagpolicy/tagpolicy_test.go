@@ -0,0 +1,167 @@
+package tagpolicy
+
+import (
+	"testing"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+func tags(names ...string) []Tag {
+	var ts []Tag
+	for i, n := range names {
+		ts = append(ts, Tag{
+			Name:    n,
+			Version: version.Must(version.NewVersion(n)),
+			// Each tag is a month newer than the one before it.
+			Created: time.Date(2018, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return ts
+}
+
+func TestSelect(t *testing.T) {
+	all := tags("v1.0.0", "v1.1.0", "v1.2.0", "v1.3.0", "v2.0.0", "v2.1.0")
+
+	assert.Equal(
+		t,
+		[]string{"v1.1.0", "v1.2.0", "v1.3.0", "v2.0.0", "v2.1.0"},
+		Default().Select(all),
+		"newest 3 of each major version",
+	)
+
+	p, err := Parse("per_major=0, since=2018-04-01")
+	must(t, err)
+	assert.Equal(t, []string{"v1.3.0", "v2.0.0", "v2.1.0"}, p.Select(all), "everything since a date")
+
+	p, err = Parse("per_major=1")
+	must(t, err)
+	assert.Equal(t, []string{"v1.3.0", "v2.1.0"}, p.Select(all), "newest of each major version")
+
+	p = &Policy{Tags: []string{"v2.0.0", "v1.0.0", "v9.9.9"}}
+	assert.Equal(t, []string{"v1.0.0", "v2.0.0"}, p.Select(all), "explicit list")
+
+	_, err = Parse("per_major=lots")
+	assert.Error(t, err)
+	_, err = Parse("newest=1")
+	assert.Error(t, err)
+	_, err = Parse("since=last year")
+	assert.Error(t, err)
+}
+
+func TestSchemes(t *testing.T) {
+	p := Default()
+	for name, want := range map[string]string{
+		"v1.2.3":       "1.2.3",
+		"1.2":          "1.2.0",
+		"v1.2.3-rc.1":  "1.2.3-rc.1",
+		"v1.2.3+build": "1.2.3+build",
+		"release-1.2":  "",
+		"latest":       "",
+	} {
+		v, ok := p.Version(name)
+		if want == "" {
+			assert.False(t, ok, name)
+			continue
+		}
+		if assert.True(t, ok, name) {
+			assert.Equal(t, want, v.String(), name)
+		}
+	}
+
+	p, err := Parse("scheme=date")
+	must(t, err)
+	for name, want := range map[string]string{
+		"2024.06.01":    "2024.6.1",
+		"2024-06-01":    "2024.6.1",
+		"20240601":      "2024.6.1",
+		"v2024.06.01.2": "2024.6.1.2",
+		"2024.13.01":    "",
+		"v1.2.3":        "",
+	} {
+		v, ok := p.Version(name)
+		if want == "" {
+			assert.False(t, ok, name)
+			continue
+		}
+		if assert.True(t, ok, name) {
+			assert.Equal(t, want, v.String(), name)
+		}
+	}
+	assert.Contains(t, p.String(), "scheme=date")
+	assert.Equal(t, "per_major=3,since=", Default().String(), "defaults don't change the string")
+
+	p, err = Parse("prefix=release-, prereleases=false")
+	must(t, err)
+	_, ok := p.Version("release-1.2")
+	assert.True(t, ok, "prefix is removed")
+	_, ok = p.Version("1.2")
+	assert.False(t, ok, "tags without the prefix are not versions")
+	_, ok = p.Version("release-1.3-beta1")
+	assert.False(t, ok, "prereleases are skipped")
+
+	_, err = Parse("scheme=calver")
+	assert.Error(t, err)
+	_, err = Parse("prereleases=maybe")
+	assert.Error(t, err)
+}
+
+func TestSelectPrereleases(t *testing.T) {
+	all := tags("v1.0.0", "v1.1.0-rc.1", "v1.1.0-rc.2", "v1.1.0", "v1.2.0-beta.1")
+	assert.Equal(
+		t,
+		[]string{"v1.0.0", "v1.1.0", "v1.2.0-beta.1"},
+		Default().Select(all),
+		"prereleases are dropped once there's a release",
+	)
+
+	dates := []Tag{}
+	p, err := Parse("scheme=date, per_major=1")
+	must(t, err)
+	for _, n := range []string{"2023.12.01", "2024.01.15", "2023.02.01", "2024.06.01"} {
+		v, ok := p.Version(n)
+		if !assert.True(t, ok, n) {
+			return
+		}
+		dates = append(dates, Tag{Name: n, Version: v})
+	}
+	assert.Equal(t, []string{"2023.12.01", "2024.06.01"}, p.Select(dates), "newest tag of each year")
+}
+
+const testRules = `
+- pattern: github.com/golang/go
+  per_major: 0
+- pattern: github.com/stretchr/...
+  tags: [v1.0.0]
+- pattern: github.com/example/...
+  scheme: date
+`
+
+func TestRules(t *testing.T) {
+	def, err := Parse("since=2018-02-01")
+	must(t, err)
+	r, err := ParseRules([]byte(testRules), def)
+	must(t, err)
+
+	all := tags("v1.0.0", "v1.1.0", "v1.2.0", "v1.3.0", "v1.4.0")
+	assert.Equal(t, []string{"v1.2.0", "v1.3.0", "v1.4.0"}, r.For("github.com/foo/bar").Select(all), "default policy")
+	assert.Equal(
+		t,
+		[]string{"v1.1.0", "v1.2.0", "v1.3.0", "v1.4.0"},
+		r.For("github.com/golang/go").Select(all),
+		"rule with the default since date",
+	)
+	assert.Equal(t, []string{"v1.0.0"}, r.For("github.com/stretchr/testify").Select(all), "explicit list")
+	assert.NotEqual(t, r.For("github.com/foo/bar").String(), r.For("github.com/golang/go").String())
+	assert.Equal(t, Date, r.For("github.com/example/thing").Scheme)
+
+	_, err = ParseRules([]byte("- pattern: github.com/foo/bar\n  per_major: -1\n"), def)
+	assert.Error(t, err)
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+package vulndb
+
+import (
+	"strings"
+)
+
+// Requirements returns the version of every module required by a go.mod
+// file, keyed by module path, with any replacements applied. Modules replaced
+// by a local directory are left out, since their code isn't any published
+// version.
+//
+// We don't look at go.sum, which also has the versions which were considered
+// but not selected, so it would turn up vulnerabilities in versions that are
+// never built. Since Go 1.17 go.mod lists every module in the build anyway.
+func Requirements(goMod []byte) map[string]string {
+	type replacement struct{ from, fromVersion, to, toVersion string }
+	requires := make(map[string]string)
+	var replaces []replacement
+
+	block := ""
+	for _, line := range strings.Split(string(goMod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		for i := range f {
+			f[i] = strings.Trim(f[i], `"`)
+		}
+
+		directive := block
+		switch {
+		case block != "" && f[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(f) == 2 && f[1] == "(":
+			block = f[0]
+			continue
+		case block == "":
+			directive, f = f[0], f[1:]
+		}
+
+		switch directive {
+		case "require":
+			if len(f) >= 2 {
+				requires[f[0]] = f[1]
+			}
+		case "replace":
+			// Either "old => new", "old v => new", "old => new v" or
+			// "old v => new v".
+			arrow := 0
+			for i, s := range f {
+				if s == "=>" {
+					arrow = i
+				}
+			}
+			if arrow < 1 || arrow > 2 || len(f) <= arrow+1 {
+				continue
+			}
+			r := replacement{from: f[0], to: f[arrow+1]}
+			if arrow == 2 {
+				r.fromVersion = f[1]
+			}
+			if len(f) > arrow+2 {
+				r.toVersion = f[arrow+2]
+			}
+			replaces = append(replaces, r)
+		}
+	}
+
+	for _, r := range replaces {
+		v, ok := requires[r.from]
+		if !ok || (r.fromVersion != "" && r.fromVersion != v) {
+			continue
+		}
+		delete(requires, r.from)
+		if r.toVersion != "" {
+			requires[r.to] = r.toVersion
+		}
+	}
+	return requires
+}
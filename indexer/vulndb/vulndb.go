@@ -0,0 +1,282 @@
+// Package vulndb looks up known vulnerabilities in a module's dependencies
+// using the Go vulnerability database, or anything else which serves the same
+// API. See https://go.dev/security/vuln/database for the API.
+//
+// This only matches versions, like govulncheck does when it's run in module
+// mode. It doesn't try to work out whether the vulnerable code is actually
+// reachable.
+package vulndb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+
+	"github.com/hashicorp/errwrap"
+	version "github.com/hashicorp/go-version"
+)
+
+// The public Go vulnerability database.
+const DefaultURL = "https://vuln.go.dev"
+
+// How long we use the list of vulnerable modules before fetching it again.
+// Entries are only fetched again when the list says they've been modified.
+const indexTTL = time.Hour
+
+// A Client caches what it fetches, so one should be shared by everything that
+// checks for vulnerabilities.
+type Client struct {
+	url    string
+	client *http.Client
+
+	// The vulnerabilities in each module, from the database's index.
+	modules map[string][]indexVuln
+	fetched time.Time
+	entries map[string]*entry
+	mu      sync.Mutex
+}
+
+// New returns a client for the database at the given URL.
+func New(dbURL string) (*Client, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid vulnerability database URL %q, expected an http or https URL", dbURL)
+	}
+	return &Client{
+		url:     strings.TrimSuffix(dbURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		entries: make(map[string]*entry),
+	}, nil
+}
+
+type indexModule struct {
+	Path  string      `json:"path"`
+	Vulns []indexVuln `json:"vulns"`
+}
+
+type indexVuln struct {
+	ID       string `json:"id"`
+	Modified string `json:"modified"`
+}
+
+// An entry is the part of an OSV entry that we use.
+type entry struct {
+	ID       string   `json:"id"`
+	Modified string   `json:"modified"`
+	Summary  string   `json:"summary"`
+	Aliases  []string `json:"aliases"`
+	Affected []struct {
+		Package struct {
+			Name string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []struct {
+				Introduced string `json:"introduced"`
+				Fixed      string `json:"fixed"`
+			} `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+	Severity []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// Check returns the known vulnerabilities affecting the given module
+// versions, which are keyed by module path, sorted by module and then ID.
+func (c *Client) Check(ctx context.Context, requires map[string]string) ([]*esmodels.Vulnerability, error) {
+	modules, err := c.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(requires))
+	for p := range requires {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var vulns []*esmodels.Vulnerability
+	for _, p := range paths {
+		for _, iv := range modules[p] {
+			e, err := c.entry(ctx, iv)
+			if err != nil {
+				return nil, err
+			}
+			fixed, affected := e.affects(p, requires[p])
+			if !affected {
+				continue
+			}
+			vulns = append(vulns, &esmodels.Vulnerability{
+				ID:       e.ID,
+				Aliases:  e.Aliases,
+				Module:   p,
+				Version:  requires[p],
+				Fixed:    fixed,
+				Severity: e.severity(),
+				Summary:  e.Summary,
+			})
+		}
+	}
+	sort.SliceStable(vulns, func(i, j int) bool {
+		if vulns[i].Module != vulns[j].Module {
+			return vulns[i].Module < vulns[j].Module
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+	return vulns, nil
+}
+
+func (c *Client) index(ctx context.Context) (map[string][]indexVuln, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.modules != nil && time.Since(c.fetched) < indexTTL {
+		return c.modules, nil
+	}
+
+	var index []indexModule
+	err := c.get(ctx, "/index/modules.json", &index)
+	if err != nil {
+		return nil, err
+	}
+	c.modules = make(map[string][]indexVuln, len(index))
+	for _, m := range index {
+		c.modules[m.Path] = m.Vulns
+	}
+	c.fetched = time.Now()
+	return c.modules, nil
+}
+
+func (c *Client) entry(ctx context.Context, iv indexVuln) (*entry, error) {
+	c.mu.Lock()
+	e, ok := c.entries[iv.ID]
+	c.mu.Unlock()
+	if ok && e.Modified == iv.Modified {
+		return e, nil
+	}
+
+	e = &entry{}
+	err := c.get(ctx, "/ID/"+url.PathEscape(iv.ID)+".json", e)
+	if err != nil {
+		return nil, err
+	}
+	// The index and the entry are updated together, but if we happen to
+	// get them mid update we'd fetch the entry every time until the index
+	// expires.
+	e.Modified = iv.Modified
+
+	c.mu.Lock()
+	c.entries[iv.ID] = e
+	c.mu.Unlock()
+	return e, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not get %s from the vulnerability database: {{err}}", path), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not get %s from the vulnerability database: got a %d response", path, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not decode %s from the vulnerability database: {{err}}", path), err)
+	}
+	return nil
+}
+
+// affects returns true if the given version of the module is in one of the
+// entry's affected ranges, along with the version which fixed it, if there is
+// one.
+func (e *entry) affects(module, v string) (string, bool) {
+	have, err := version.NewVersion(v)
+	if err != nil {
+		return "", false
+	}
+
+	for _, a := range e.Affected {
+		if a.Package.Name != module {
+			continue
+		}
+		for _, r := range a.Ranges {
+			if r.Type != "SEMVER" {
+				continue
+			}
+
+			// Each introduced event starts an affected range and each fixed
+			// event ends one, so we're affected if the last event at or
+			// before our version was an introduction.
+			affected, fixedName := false, ""
+			var latest, fixed *version.Version
+			for _, ev := range r.Events {
+				name, introduced := ev.Fixed, false
+				if ev.Introduced != "" {
+					name, introduced = ev.Introduced, true
+				}
+				at, ok := eventVersion(name)
+				if !ok {
+					continue
+				}
+				if at.GreaterThan(have) {
+					if !introduced && (fixed == nil || at.LessThan(fixed)) {
+						fixed, fixedName = at, name
+					}
+					continue
+				}
+				if latest == nil || !at.LessThan(latest) {
+					latest = at
+					affected = introduced
+				}
+			}
+			if !affected {
+				continue
+			}
+			if fixed == nil {
+				return "", true
+			}
+			return "v" + strings.TrimPrefix(fixedName, "v"), true
+		}
+	}
+	return "", false
+}
+
+// OSV uses "0" for the very first version.
+func eventVersion(name string) (*version.Version, bool) {
+	if name == "0" {
+		name = "0.0.0-0"
+	}
+	v, err := version.NewVersion(name)
+	return v, err == nil
+}
+
+// The Go database doesn't include severities, but other OSV databases do,
+// either as a CVSS vector or as a word like "HIGH".
+func (e *entry) severity() string {
+	if e.DatabaseSpecific.Severity != "" {
+		return e.DatabaseSpecific.Severity
+	}
+	for _, s := range e.Severity {
+		if s.Score != "" {
+			return s.Score
+		}
+	}
+	return ""
+}
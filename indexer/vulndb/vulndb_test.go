@@ -0,0 +1,124 @@
+package vulndb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testIndex = `[
+	{"path": "example.com/lib", "vulns": [
+		{"id": "GO-2020-0002", "modified": "2021-01-01T00:00:00Z"},
+		{"id": "GO-2020-0001", "modified": "2021-01-01T00:00:00Z"}
+	]},
+	{"path": "example.com/other", "vulns": [{"id": "GO-2020-0003", "modified": "2021-01-01T00:00:00Z"}]}
+]`
+
+var testEntries = map[string]string{
+	"GO-2020-0001": `{
+		"id": "GO-2020-0001",
+		"summary": "Everything before 1.2.0 is broken",
+		"aliases": ["CVE-2020-1234"],
+		"affected": [{"package": {"name": "example.com/lib"}, "ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "1.2.0"}]}]}],
+		"database_specific": {"severity": "HIGH"}
+	}`,
+	"GO-2020-0002": `{
+		"id": "GO-2020-0002",
+		"affected": [{"package": {"name": "example.com/lib"}, "ranges": [{"type": "SEMVER", "events": [
+			{"introduced": "1.0.0"}, {"fixed": "1.0.5"}, {"introduced": "1.1.0"}, {"fixed": "1.1.3"}
+		]}]}]
+	}`,
+	"GO-2020-0003": `{
+		"id": "GO-2020-0003",
+		"affected": [{"package": {"name": "example.com/other"}, "ranges": [{"type": "SEMVER", "events": [{"introduced": "2.0.0"}]}]}]
+	}`,
+}
+
+func TestCheck(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/index/modules.json" {
+			w.Write([]byte(testIndex))
+			return
+		}
+		for id, e := range testEntries {
+			if r.URL.Path == "/ID/"+id+".json" {
+				w.Write([]byte(e))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL + "/")
+	assert.Nil(t, err)
+
+	vulns, err := c.Check(context.Background(), map[string]string{
+		"example.com/lib":   "v1.1.1",
+		"example.com/other": "v1.9.0",
+		"example.com/fine":  "v1.0.0",
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, vulns, 2) {
+		assert.Equal(t, "GO-2020-0001", vulns[0].ID)
+		assert.Equal(t, "v1.2.0", vulns[0].Fixed)
+		assert.Equal(t, "HIGH", vulns[0].Severity)
+		assert.Equal(t, []string{"CVE-2020-1234"}, vulns[0].Aliases)
+		assert.Equal(t, "GO-2020-0002", vulns[1].ID)
+		assert.Equal(t, "v1.1.3", vulns[1].Fixed)
+		assert.Equal(t, "v1.1.1", vulns[1].Version)
+	}
+
+	vulns, err = c.Check(context.Background(), map[string]string{
+		"example.com/lib":   "v1.0.7",
+		"example.com/other": "v2.1.0+incompatible",
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, vulns, 2) {
+		assert.Equal(t, "GO-2020-0001", vulns[0].ID)
+		assert.Equal(t, "GO-2020-0003", vulns[1].ID)
+		assert.Equal(t, "", vulns[1].Fixed, "not fixed yet")
+	}
+	assert.Equal(t, 4, requests, "the index and entries are cached")
+
+	_, err = New("vuln.go.dev")
+	assert.Error(t, err)
+}
+
+func TestRequirements(t *testing.T) {
+	goMod := `module example.com/app
+
+go 1.20
+
+require example.com/a v1.0.0 // indirect
+
+require (
+	example.com/b v1.2.3
+	"example.com/c" v0.0.0-20200101000000-abcdefabcdef
+	example.com/d v1.0.0
+	example.com/e v1.0.0
+)
+
+replace example.com/b => example.com/b-fork v1.2.4
+
+replace (
+	example.com/c => ../c
+	example.com/d v0.9.0 => example.com/d v0.9.1
+)
+`
+	assert.Equal(
+		t,
+		map[string]string{
+			"example.com/a":      "v1.0.0",
+			"example.com/b-fork": "v1.2.4",
+			"example.com/d":      "v1.0.0",
+			"example.com/e":      "v1.0.0",
+		},
+		Requirements([]byte(goMod)),
+	)
+}
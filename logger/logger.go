@@ -1,13 +1,22 @@
 package logger
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const maxPrefix = 24
 
 type NewParams struct {
 	IsProd bool
+	// One of "debug", "info", "warn", or "error". Defaults to "info" in
+	// production and "debug" otherwise.
+	Level string
+	// Either "json" or "console". Defaults to "json" in production and
+	// "console" otherwise.
+	Format string
 }
 
 type Logger struct {
@@ -15,14 +24,31 @@ type Logger struct {
 }
 
 func New(p NewParams) (*Logger, error) {
-	var l *zap.Logger
-	var err error
+	var c zap.Config
 	if p.IsProd {
-		l, err = zap.NewProduction()
+		c = zap.NewProductionConfig()
 	} else {
-		l, err = zap.NewDevelopment()
+		c = zap.NewDevelopmentConfig()
+	}
+
+	if p.Level != "" {
+		var level zapcore.Level
+		err := level.UnmarshalText([]byte(p.Level))
+		if err != nil {
+			return nil, fmt.Errorf("Unknown log level: %s", p.Level)
+		}
+		c.Level = zap.NewAtomicLevelAt(level)
 	}
 
+	switch p.Format {
+	case "":
+	case "json", "console":
+		c.Encoding = p.Format
+	default:
+		return nil, fmt.Errorf("Unknown log format: %s", p.Format)
+	}
+
+	l, err := c.Build()
 	if err != nil {
 		return nil, err
 	}
@@ -30,6 +56,12 @@ func New(p NewParams) (*Logger, error) {
 	return &Logger{l.Sugar()}, nil
 }
 
+// With returns a logger which adds the given key and value pairs as fields
+// to everything it logs, like the repository or ref being indexed.
+func (l *Logger) With(args ...interface{}) *Logger {
+	return &Logger{l.SugaredLogger.With(args...)}
+}
+
 func (l *Logger) Printf(format string, v ...interface{}) {
 	l.Infof(format, v...)
 }
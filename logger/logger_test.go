@@ -0,0 +1,24 @@
+package logger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNew(t *testing.T) {
+	l, err := New(NewParams{IsProd: true})
+	assert.NoError(t, err)
+	assert.False(t, l.Desugar().Core().Enabled(zapcore.DebugLevel), "production defaults to info")
+
+	l, err = New(NewParams{IsProd: true, Level: "debug", Format: "console"})
+	assert.NoError(t, err)
+	assert.True(t, l.Desugar().Core().Enabled(zapcore.DebugLevel))
+	assert.NotNil(t, l.With("repo", "github.com/example/thing"))
+
+	_, err = New(NewParams{Level: "loud"})
+	assert.Error(t, err)
+	_, err = New(NewParams{Format: "xml"})
+	assert.Error(t, err)
+}
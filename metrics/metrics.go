@@ -0,0 +1,76 @@
+// Package metrics holds the counters the indexer publishes through expvar
+// and in the Prometheus format, and serves them along with the pprof
+// handlers. A crawl can run for hours, so when it gets slow we want to be
+// able to look at it while it's running.
+package metrics
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+)
+
+var (
+	ReposProcessed = expvar.NewInt("repos_processed")
+	RefsProcessed  = expvar.NewInt("refs_processed")
+	// Packages we actually parsed, as opposed to ones we got from the
+	// package cache.
+	PackagesParsed = expvar.NewInt("packages_parsed")
+	// Documents Elasticsearch accepted in a _bulk request.
+	DocsWritten = expvar.NewInt("es_docs_written")
+	// Documents which couldn't be written, other than ones we're still
+	// retrying.
+	DocsFailed = expvar.NewInt("es_docs_failed")
+	// Panics recovered while indexing a repository.
+	Panics = expvar.NewInt("panics")
+	// Requests made to the GitHub API, which count against our quota.
+	GitHubRequests = expvar.NewInt("github_requests")
+
+	// The number of times we ran each git subcommand, and the total number
+	// of seconds they took.
+	GitCommands       = expvar.NewMap("git_commands")
+	GitCommandSeconds = expvar.NewMap("git_command_seconds")
+)
+
+// TimeGit records a git command which started at the given time. It's meant
+// to be deferred.
+func TimeGit(subcommand string, start time.Time) {
+	GitCommands.Add(subcommand, 1)
+	GitCommandSeconds.AddFloat(subcommand, time.Since(start).Seconds())
+}
+
+// Handler returns a handler for /metrics, /debug/vars, and /debug/pprof/.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", PrometheusHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serve listens on addr and serves Handler in the background. It returns an
+// error if it can't listen, but anything that goes wrong after that is just
+// logged, since it shouldn't stop the crawl.
+func Serve(l *logger.Logger, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	l.Infof("Serving metrics on http://%s/metrics and debug endpoints on http://%s/debug/", ln.Addr(), ln.Addr())
+	go func() {
+		err := http.Serve(ln, Handler())
+		if err != nil {
+			l.Errorf("Debug server stopped: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	TimeGit("fetch", time.Now().Add(-time.Second))
+	ReposProcessed.Add(1)
+
+	s := httptest.NewServer(Handler())
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var vars struct {
+		ReposProcessed    int64              `json:"repos_processed"`
+		GitCommands       map[string]int64   `json:"git_commands"`
+		GitCommandSeconds map[string]float64 `json:"git_command_seconds"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1), vars.ReposProcessed)
+	assert.Equal(t, int64(1), vars.GitCommands["fetch"])
+	assert.True(t, vars.GitCommandSeconds["fetch"] >= 1)
+
+	resp, err = http.Get(s.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	RepoFailures.Add("fetch", 1)
+	RepoFailures.Add("panic", 2)
+	PackagesPerRef.Observe(3)
+	PackagesPerRef.Observe(40)
+	GitHubQuotaRemaining.Set(4999)
+	TimeGit("clone", time.Now())
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE metagodoc_repository_failures_total counter",
+		`metagodoc_repository_failures_total{category="fetch"} 1`,
+		`metagodoc_repository_failures_total{category="panic"} 2`,
+		"# TYPE metagodoc_packages_per_ref histogram",
+		`metagodoc_packages_per_ref_bucket{le="1"} 0`,
+		`metagodoc_packages_per_ref_bucket{le="5"} 1`,
+		`metagodoc_packages_per_ref_bucket{le="50"} 2`,
+		`metagodoc_packages_per_ref_bucket{le="+Inf"} 2`,
+		"metagodoc_packages_per_ref_sum 43",
+		"metagodoc_packages_per_ref_count 2",
+		"metagodoc_github_quota_remaining 4999",
+		`metagodoc_git_commands_total{subcommand="clone"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
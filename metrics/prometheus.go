@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// These are served on /metrics in the Prometheus text format, so operators
+// can alert on how the crawl is going. We only need counters, gauges, and
+// histograms, which are simple enough to write out ourselves.
+
+var (
+	ReposIndexed = NewCounterVec("metagodoc_repositories_indexed_total", "Repositories indexed successfully.", "")
+	// The category is the stage the repository failed in, or "panic",
+	// "timeout", or "gone".
+	RepoFailures = NewCounterVec("metagodoc_repository_failures_total", "Repositories which could not be indexed, by category.", "category")
+	DeadLettered = NewCounterVec("metagodoc_repositories_dead_lettered_total", "Repositories set aside after failing too many times in a row.", "")
+	FetchSeconds = NewHistogram(
+		"metagodoc_fetch_duration_seconds",
+		"Time spent cloning or fetching a repository.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+	)
+	PackagesPerRef = NewHistogram(
+		"metagodoc_packages_per_ref",
+		"Packages found in each ref that was walked.",
+		[]float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	)
+	BulkSeconds = NewHistogram(
+		"metagodoc_es_bulk_duration_seconds",
+		"Time taken by each Elasticsearch bulk request.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	)
+	GitHubQuotaRemaining = NewGauge("metagodoc_github_quota_remaining", "GitHub API requests left in the current rate limit window.")
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	metrics []metric
+	mu      sync.Mutex
+}{}
+
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+// A CounterVec is a counter with one label. If the label name is empty then
+// there's just the one counter, and the label value passed to Add is
+// ignored.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(labelValue string, n float64) {
+	if c.label == "" {
+		labelValue = ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += n
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, v := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, v, formatFloat(c.values[v]))
+	}
+}
+
+type Gauge struct {
+	name  string
+	help  string
+	value float64
+	mu    sync.Mutex
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+}
+
+// A Histogram counts observations in buckets with the given upper bounds,
+// which must be sorted.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+	mu      sync.Mutex
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// The expvar counters are served as Prometheus counters too.
+var expvarCounters = []struct {
+	name string
+	help string
+	v    *expvar.Int
+}{
+	{"metagodoc_repos_processed_total", "Repositories checked for changes.", ReposProcessed},
+	{"metagodoc_refs_processed_total", "Refs walked.", RefsProcessed},
+	{"metagodoc_packages_parsed_total", "Packages parsed rather than taken from the package cache.", PackagesParsed},
+	{"metagodoc_es_docs_written_total", "Documents accepted by Elasticsearch.", DocsWritten},
+	{"metagodoc_es_docs_failed_total", "Documents which could not be written to Elasticsearch.", DocsFailed},
+	{"metagodoc_panics_total", "Panics recovered while indexing a repository.", Panics},
+	{"metagodoc_github_requests_total", "Requests made to the GitHub API.", GitHubRequests},
+}
+
+func writeExpvars(w io.Writer) {
+	for _, c := range expvarCounters {
+		writeHeader(w, c.name, c.help, "counter")
+		fmt.Fprintf(w, "%s %d\n", c.name, c.v.Value())
+	}
+
+	writeExpvarMap(w, "metagodoc_git_commands_total", "git commands run, by subcommand.", GitCommands)
+	writeExpvarMap(w, "metagodoc_git_command_seconds_total", "Time spent running git, by subcommand.", GitCommandSeconds)
+}
+
+func writeExpvarMap(w io.Writer, name, help string, m *expvar.Map) {
+	writeHeader(w, name, help, "counter")
+	values := make(map[string]string)
+	m.Do(func(kv expvar.KeyValue) {
+		values[kv.Key] = kv.Value.String()
+	})
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{subcommand=%q} %s\n", name, k, values[k])
+	}
+}
+
+// PrometheusHandler serves every metric in the Prometheus text format.
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registry.mu.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.mu.Unlock()
+
+		for _, m := range metrics {
+			m.write(w)
+		}
+		writeExpvars(w)
+	})
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.Replace(help, "\n", " ", -1), name, typ)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
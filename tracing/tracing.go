@@ -0,0 +1,393 @@
+// Package tracing records where the time goes while a repository is being
+// indexed, as OpenTelemetry traces. We don't vendor the OpenTelemetry SDK, so
+// spans are sent to a collector as OTLP over HTTP, encoded as JSON, which
+// any OpenTelemetry collector accepts.
+//
+// Until an Exporter is created, Start returns a nil span, and every method
+// on a nil span does nothing, so tracing costs next to nothing when it's not
+// turned on.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	DefaultBatchSize     = 512
+	DefaultFlushInterval = 5 * time.Second
+	// Spans which are finished while this many are waiting to be sent are
+	// dropped rather than slowing down the crawl.
+	maxQueuedSpans = 4096
+)
+
+type NewParams struct {
+	Logger *logger.Logger
+	// The collector's base URL, like "http://localhost:4318". Spans are sent
+	// to /v1/traces under it.
+	Endpoint string
+	// Defaults to "metagodoc-indexer".
+	ServiceName string
+	// Zero means DefaultBatchSize and DefaultFlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+	Client        *http.Client
+}
+
+// An Exporter sends finished spans to a collector in batches.
+type Exporter struct {
+	l             *logger.Logger
+	url           string
+	serviceName   string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+
+	spans   chan *Span
+	quit    chan struct{}
+	stopped chan struct{}
+	dropped int64
+}
+
+var current struct {
+	exporter *Exporter
+	mu       sync.RWMutex
+}
+
+// New starts an exporter, which every span started after this is sent to.
+// Close it to send whatever is left.
+func New(p NewParams) (*Exporter, error) {
+	if !strings.HasPrefix(p.Endpoint, "http://") && !strings.HasPrefix(p.Endpoint, "https://") {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %q, expected an http or https URL", p.Endpoint)
+	}
+	if p.ServiceName == "" {
+		p.ServiceName = "metagodoc-indexer"
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = DefaultBatchSize
+	}
+	if p.FlushInterval <= 0 {
+		p.FlushInterval = DefaultFlushInterval
+	}
+	if p.Client == nil {
+		p.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	e := &Exporter{
+		l:             p.Logger,
+		url:           strings.TrimSuffix(p.Endpoint, "/") + "/v1/traces",
+		serviceName:   p.ServiceName,
+		batchSize:     p.BatchSize,
+		flushInterval: p.FlushInterval,
+		client:        p.Client,
+		spans:         make(chan *Span, maxQueuedSpans),
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go e.run()
+
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	current.exporter = e
+	return e, nil
+}
+
+// Close stops the exporter after sending every span which has already
+// finished. Spans which finish after this are dropped.
+func (e *Exporter) Close() {
+	current.mu.Lock()
+	if current.exporter == e {
+		current.exporter = nil
+	}
+	current.mu.Unlock()
+
+	close(e.quit)
+	<-e.stopped
+}
+
+func (e *Exporter) add(s *Span) {
+	select {
+	case <-e.quit:
+	case e.spans <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case <-e.quit:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// send is best effort. Traces are nice to have, so a collector that's down
+// shouldn't affect the crawl.
+func (e *Exporter) send(batch []*Span) {
+	if dropped := atomic.SwapInt64(&e.dropped, 0); dropped > 0 {
+		e.l.Warnf("Dropped %d spans because the exporter couldn't keep up", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	err := e.post(batch)
+	if err != nil {
+		e.l.Warnf("Could not send %d spans: %s", len(batch), err)
+	}
+}
+
+func (e *Exporter) post(batch []*Span) error {
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return errwrap.Wrapf("Marshal spans: {{err}}", err)
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// A Span is one timed operation in a trace. Its methods are safe to call on
+// a nil span.
+type Span struct {
+	exporter *Exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []interface{}
+	err      error
+	once     sync.Once
+	mu       sync.Mutex
+}
+
+type spanKey struct{}
+
+// Start starts a span which is a child of the span in ctx, if there is one,
+// and returns a context carrying the new span. The attributes are key and
+// value pairs, just like the ones passed to logger.With.
+func Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	current.mu.RLock()
+	e := current.exporter
+	current.mu.RUnlock()
+	if e == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		exporter: e,
+		spanID:   newSpanID(),
+		name:     name,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span in ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return id
+}
+
+// SetAttributes adds key and value pairs to the span.
+func (s *Span) SetAttributes(attrs ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// SetError marks the span as failed if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span. Only the first call does anything.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.end = time.Now()
+		s.mu.Unlock()
+		s.exporter.add(s)
+	})
+}
+
+// These are the parts of the OTLP JSON encoding we use. IDs are hex strings
+// and times are nanoseconds since the epoch as strings, as the spec says.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusError      = 2
+)
+
+func (e *Exporter) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource:   otlpResource{Attributes: attributes([]interface{}{"service.name", e.serviceName})},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/autarch/metagodoc"}, Spans: spans}},
+			},
+		},
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attributes(s.attrs),
+	}
+	if s.parentID != ([8]byte{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+	}
+	return o
+}
+
+func attributes(kv []interface{}) []otlpAttribute {
+	var attrs []otlpAttribute
+	for i := 0; i+1 < len(kv); i += 2 {
+		var v map[string]interface{}
+		switch val := kv[i+1].(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		attrs = append(attrs, otlpAttribute{Key: fmt.Sprint(kv[i]), Value: v})
+	}
+	return attrs
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExporter(t *testing.T) {
+	var (
+		spans []otlpSpan
+		mu    sync.Mutex
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		var req otlpRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer s.Close()
+
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an exporter nothing is recorded.
+	ctx, span := Start(context.Background(), "ignored")
+	assert.Nil(t, span)
+	assert.Nil(t, FromContext(ctx))
+	span.SetError(errors.New("ignored"))
+	span.End()
+
+	_, err = New(NewParams{Logger: l, Endpoint: "localhost:4318"})
+	assert.Error(t, err)
+
+	e, err := New(NewParams{Logger: l, Endpoint: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := Start(context.Background(), "index repository", "repo", "github.com/foo/bar")
+	_, child := Start(ctx, "analyze ref", "ref", "master")
+	child.SetAttributes("packages", 3)
+	child.SetError(errors.New("no packages"))
+	child.End()
+	root.End()
+	root.End()
+	e.Close()
+
+	_, span = Start(context.Background(), "after close")
+	assert.Nil(t, span)
+
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	c, r := spans[0], spans[1]
+	assert.Equal(t, "analyze ref", c.Name)
+	assert.Equal(t, "index repository", r.Name)
+	assert.Equal(t, r.TraceID, c.TraceID)
+	assert.Equal(t, r.SpanID, c.ParentSpanID)
+	assert.Empty(t, r.ParentSpanID)
+	assert.Len(t, r.TraceID, 32)
+	assert.Len(t, r.SpanID, 16)
+
+	assert.Equal(t, otlpStatus{Code: statusError, Message: "no packages"}, c.Status)
+	assert.Equal(t, otlpStatus{}, r.Status)
+	assert.Equal(t, []otlpAttribute{
+		{Key: "ref", Value: map[string]interface{}{"stringValue": "master"}},
+		{Key: "packages", Value: map[string]interface{}{"intValue": "3"}},
+	}, c.Attributes)
+}